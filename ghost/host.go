@@ -6,6 +6,7 @@ import (
 	"crypto/ed25519"
 	"log"
 	"net"
+	"sync/atomic"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
@@ -32,6 +33,29 @@ type Host struct {
 	contracts   map[types.FileContractID]*hostContract
 	blockHeight types.BlockHeight
 	logErrs     bool
+	readFault   int32 // ReadFault, accessed atomically
+}
+
+// A ReadFault causes a Host to misbehave when serving Read RPCs.
+type ReadFault int32
+
+// ReadFault values.
+const (
+	// NoFault causes the host to serve Read RPCs correctly.
+	NoFault ReadFault = iota
+	// FaultBadData causes the host to send corrupted sector data, which will
+	// fail Merkle proof verification.
+	FaultBadData
+	// FaultShortData causes the host to send less sector data than requested.
+	FaultShortData
+	// FaultDisconnect causes the host to close the connection instead of
+	// sending sector data.
+	FaultDisconnect
+)
+
+// SetReadFault configures how the host misbehaves on subsequent Read RPCs.
+func (h *Host) SetReadFault(f ReadFault) {
+	atomic.StoreInt32(&h.readFault, int32(f))
 }
 
 func (h *Host) PublicKey() hostdb.HostPublicKey {
@@ -49,6 +73,17 @@ func (h *Host) Settings() hostdb.HostSettings {
 	}
 }
 
+// CorruptSector overwrites part of the sector with the given root, causing the
+// host to serve invalid data for it.
+func (h *Host) CorruptSector(root crypto.Hash) {
+	for _, c := range h.contracts {
+		if sector, ok := c.sectorData[root]; ok {
+			sector[0] ^= 0xFF
+			c.sectorData[root] = sector
+		}
+	}
+}
+
 func (h *Host) listen() error {
 	for {
 		conn, err := h.listener.Accept()
@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/bits"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -667,6 +668,17 @@ func (h *Host) rpcRead(s *session) error {
 			return err
 		}
 		data := sector[sec.Offset : sec.Offset+sec.Length]
+		switch ReadFault(atomic.LoadInt32(&h.readFault)) {
+		case FaultBadData:
+			if len(data) > 0 {
+				data = append([]byte(nil), data...)
+				data[0] ^= 0xFF
+			}
+		case FaultShortData:
+			data = data[:len(data)/2]
+		case FaultDisconnect:
+			return errors.New("simulated disconnect")
+		}
 
 		var proof []crypto.Hash
 		if req.MerkleProof {
@@ -2,8 +2,11 @@
 package merkle // import "lukechampine.com/us/merkle"
 
 import (
+	"bytes"
 	"io"
 	"math/bits"
+	"runtime"
+	"sync"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"lukechampine.com/us/merkle/blake2b"
@@ -24,14 +27,111 @@ const (
 // this assumption at compile time.
 var _ [0]struct{} = [renterhost.SectorSize & (renterhost.SectorSize - 1)]struct{}{}
 
+// zeroSectorRoot is the Merkle root of a sector containing only zeros. Since
+// every leaf (and thus every node at each level) is identical, it can be
+// computed with one hash per level of the tree.
+var zeroSectorRoot = func() crypto.Hash {
+	var leaf [SegmentSize]byte
+	root := blake2b.SumLeaf(&leaf)
+	for n := SegmentsPerSector; n > 1; n /= 2 {
+		root = blake2b.SumPair(root, root)
+	}
+	return root
+}()
+
+// zeroBlock is compared against sectors to detect whether they are all zeros.
+var zeroBlock [4096]byte
+
+// isZeroSector reports whether sector contains only zeros. It returns as soon
+// as a nonzero block is found, so for typical (nonzero) sectors it is far
+// cheaper than hashing.
+func isZeroSector(sector *[renterhost.SectorSize]byte) bool {
+	for i := 0; i < len(sector); i += len(zeroBlock) {
+		if !bytes.Equal(sector[i:][:len(zeroBlock)], zeroBlock[:]) {
+			return false
+		}
+	}
+	return true
+}
+
 // SectorRoot computes the Merkle root of a sector using SegmentSize bytes per
-// leaf.
+// leaf. The root of an all-zero sector is returned without hashing.
 func SectorRoot(sector *[renterhost.SectorSize]byte) crypto.Hash {
+	if isZeroSector(sector) {
+		return zeroSectorRoot
+	}
 	var s appendStack
 	s.appendLeaves(sector[:])
 	return s.root()
 }
 
+// maxSectorRootSubtrees is the maximum number of subtrees into which
+// SectorRootParallel divides a sector. Beyond this, the cost of spawning
+// goroutines dominates.
+const maxSectorRootSubtrees = 64
+
+// SectorRootParallel is like SectorRoot, but distributes the work across p
+// goroutines by computing the roots of equally-sized subtrees of the sector
+// in parallel. If p <= 0, runtime.NumCPU() is used; p is rounded down to a
+// power of two. SectorRootParallel is faster than SectorRoot only when
+// multiple CPUs are idle; when computing many roots at once, SectorRoots is
+// more efficient.
+func SectorRootParallel(sector *[renterhost.SectorSize]byte, p int) crypto.Hash {
+	if p <= 0 {
+		p = runtime.NumCPU()
+	}
+	if p > maxSectorRootSubtrees {
+		p = maxSectorRootSubtrees
+	}
+	p = 1 << (bits.Len(uint(p)) - 1)
+	if p == 1 || isZeroSector(sector) {
+		return SectorRoot(sector)
+	}
+	roots := make([]crypto.Hash, p)
+	subtreeSize := len(sector) / p
+	var wg sync.WaitGroup
+	wg.Add(p)
+	for i := range roots {
+		go func(i int) {
+			defer wg.Done()
+			var s appendStack
+			s.appendLeaves(sector[i*subtreeSize:][:subtreeSize])
+			roots[i] = s.root()
+		}(i)
+	}
+	wg.Wait()
+	return MetaRoot(roots)
+}
+
+// SectorRoots computes the Merkle roots of multiple sectors, distributing the
+// work across all available CPUs.
+func SectorRoots(sectors []*[renterhost.SectorSize]byte) []crypto.Hash {
+	roots := make([]crypto.Hash, len(sectors))
+	p := runtime.NumCPU()
+	if p > len(sectors) {
+		p = len(sectors)
+	}
+	var wg sync.WaitGroup
+	wg.Add(p)
+	for i := 0; i < p; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var s appendStack
+			for j := i; j < len(sectors); j += p {
+				if isZeroSector(sectors[j]) {
+					roots[j] = zeroSectorRoot
+					continue
+				}
+				s.reset()
+				s.appendLeaves(sectors[j][:])
+				roots[j] = s.root()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return roots
+}
+
 // MetaRoot calculates the root of a set of existing Merkle roots.
 func MetaRoot(roots []crypto.Hash) crypto.Hash {
 	// Stacks are only designed to store one sector's worth of leaves, so we'll
@@ -5,6 +5,7 @@ import (
 	"io"
 	"math/bits"
 	"reflect"
+	"strconv"
 	"testing"
 	"testing/iotest"
 
@@ -81,6 +82,8 @@ func TestSectorRoot(t *testing.T) {
 	var sector [renterhost.SectorSize]byte
 	if SectorRoot(&sector).String() != "50ed59cecd5ed3ca9e65cec0797202091dbba45272dafa3faa4e27064eedd52c" {
 		t.Error("wrong Merkle root for empty sector")
+	} else if SectorRoot(&sector) != refSectorRoot(&sector) {
+		t.Error("SectorRoot of empty sector does not match reference implementation")
 	}
 	sector[0] = 1
 	if SectorRoot(&sector).String() != "8c20a2c90a733a5139cc57e45755322e304451c3434b0c0a0aad87f2f89a44ab" {
@@ -110,14 +113,104 @@ func TestSectorRoot(t *testing.T) {
 }
 
 func BenchmarkSectorRoot(b *testing.B) {
-	b.ReportAllocs()
+	b.Run("zero", func(b *testing.B) {
+		b.ReportAllocs()
+		var sector [renterhost.SectorSize]byte
+		b.SetBytes(renterhost.SectorSize)
+		for i := 0; i < b.N; i++ {
+			_ = SectorRoot(&sector)
+		}
+	})
+	b.Run("random", func(b *testing.B) {
+		b.ReportAllocs()
+		var sector [renterhost.SectorSize]byte
+		frand.Read(sector[:])
+		b.SetBytes(renterhost.SectorSize)
+		for i := 0; i < b.N; i++ {
+			_ = SectorRoot(&sector)
+		}
+	})
+	b.Run("lastbyte", func(b *testing.B) {
+		// worst case for zero detection
+		b.ReportAllocs()
+		var sector [renterhost.SectorSize]byte
+		sector[len(sector)-1] = 1
+		b.SetBytes(renterhost.SectorSize)
+		for i := 0; i < b.N; i++ {
+			_ = SectorRoot(&sector)
+		}
+	})
+}
+
+func TestSectorRootParallel(t *testing.T) {
 	var sector [renterhost.SectorSize]byte
-	b.SetBytes(renterhost.SectorSize)
-	for i := 0; i < b.N; i++ {
-		_ = SectorRoot(&sector)
+	if SectorRootParallel(&sector, 4) != SectorRoot(&sector) {
+		t.Error("SectorRootParallel does not match SectorRoot for zero sector")
+	}
+	frand.Read(sector[:])
+	root := SectorRoot(&sector)
+	for _, p := range []int{-1, 0, 1, 2, 3, 4, 8, 64, 1000} {
+		if SectorRootParallel(&sector, p) != root {
+			t.Errorf("SectorRootParallel(%v) does not match SectorRoot", p)
+		}
+	}
+}
+
+func BenchmarkSectorRootParallel(b *testing.B) {
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	for _, p := range []int{1, 2, 4, 8, 16} {
+		b.Run(strconv.Itoa(p), func(b *testing.B) {
+			b.SetBytes(renterhost.SectorSize)
+			for i := 0; i < b.N; i++ {
+				_ = SectorRootParallel(&sector, p)
+			}
+		})
+	}
+}
+
+func TestSectorRoots(t *testing.T) {
+	sectors := make([]*[renterhost.SectorSize]byte, 13)
+	for i := range sectors {
+		sectors[i] = new([renterhost.SectorSize]byte)
+		frand.Read(sectors[i][:])
+	}
+	sectors[len(sectors)-1] = new([renterhost.SectorSize]byte) // all zeros
+	roots := SectorRoots(sectors)
+	for i := range sectors {
+		if roots[i] != SectorRoot(sectors[i]) {
+			t.Fatal("SectorRoots differs from SectorRoot at index", i)
+		}
+	}
+	if len(SectorRoots(nil)) != 0 {
+		t.Fatal("expected no roots for no sectors")
 	}
 }
 
+func BenchmarkSectorRoots(b *testing.B) {
+	sectors := make([]*[renterhost.SectorSize]byte, 32)
+	for i := range sectors {
+		sectors[i] = new([renterhost.SectorSize]byte)
+		frand.Read(sectors[i][:])
+	}
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(renterhost.SectorSize * int64(len(sectors)))
+		for i := 0; i < b.N; i++ {
+			for _, sector := range sectors {
+				_ = SectorRoot(sector)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(renterhost.SectorSize * int64(len(sectors)))
+		for i := 0; i < b.N; i++ {
+			_ = SectorRoots(sectors)
+		}
+	})
+}
+
 func TestMetaRoot(t *testing.T) {
 	// test some known roots
 	if MetaRoot(nil) != (crypto.Hash{}) {
@@ -3,6 +3,7 @@ package renter
 import (
 	"bytes"
 	"io"
+	"net"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/modules"
@@ -28,14 +29,16 @@ type ShardDownloader struct {
 	Downloader *proto.Session
 	Slices     []SectorSlice
 	Key        KeySeed
+	Deriver    KeyDeriver // if nil, XChaCha20Deriver is used
 	buf        bytes.Buffer
 }
 
 type cryptWriter struct {
-	w      io.Writer
-	slices []SectorSlice
-	key    KeySeed
-	off    int64
+	w       io.Writer
+	slices  []SectorSlice
+	key     KeySeed
+	deriver KeyDeriver
+	off     int64
 }
 
 func calcSections(slices []SectorSlice, offset, length int64) ([]renterhost.RPCReadRequestSection, error) {
@@ -106,7 +109,7 @@ func (cw *cryptWriter) Write(p []byte) (int, error) {
 			s.SegmentIndex += uint32(rem / merkle.SegmentSize)
 		}
 		bb := b.Next(int(s.NumSegments) * merkle.SegmentSize)
-		cw.key.XORKeyStream(bb, s.Nonce[:], uint64(s.SegmentIndex))
+		cw.key.XORKeyStreamWith(cw.deriver, bb, s.Nonce[:], uint64(s.SegmentIndex))
 	}
 	cw.off += int64(len(p))
 	return cw.w.Write(p)
@@ -119,7 +122,7 @@ func (d *ShardDownloader) CopySection(w io.Writer, offset, length int64) error {
 	if err != nil {
 		return err
 	}
-	cw := &cryptWriter{w, d.Slices, d.Key, offset}
+	cw := &cryptWriter{w, d.Slices, d.Key, d.Deriver, offset}
 	return d.Downloader.Read(cw, sections)
 }
 
@@ -146,7 +149,7 @@ func (d *ShardDownloader) DownloadAndDecrypt(chunkIndex int64) ([]byte, error) {
 	}
 	data := d.buf.Bytes()
 	// decrypt segments
-	d.Key.XORKeyStream(data, s.Nonce[:], uint64(s.SegmentIndex))
+	d.Key.XORKeyStreamWith(d.Deriver, data, s.Nonce[:], uint64(s.SegmentIndex))
 	return data, nil
 }
 
@@ -180,3 +183,17 @@ func NewShardDownloader(m *MetaFile, c Contract, hkr HostKeyResolver) (*ShardDow
 		Slices:     m.Shards[m.HostIndex(hostKey)],
 	}, nil
 }
+
+// NewShardDownloaderFromConn is like NewShardDownloader, but initiates the
+// download protocol on top of the provided conn instead of dialing the host.
+func NewShardDownloaderFromConn(m *MetaFile, c Contract, conn net.Conn) (*ShardDownloader, error) {
+	d, err := proto.NewSessionFromConn(conn, c.HostKey, c.ID, c.RenterKey, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v: could not initiate download protocol with host", c.HostKey.ShortKey())
+	}
+	return &ShardDownloader{
+		Downloader: d,
+		Key:        m.MasterKey,
+		Slices:     m.Shards[m.HostIndex(c.HostKey)],
+	}, nil
+}
@@ -53,7 +53,7 @@ func TestCopySection(t *testing.T) {
 			t.Fatal(err)
 		}
 		var buf bytes.Buffer
-		cw := &cryptWriter{&buf, slices, key, test.offset}
+		cw := &cryptWriter{&buf, slices, key, nil, test.offset}
 		for _, s := range sections {
 			// need to copy because cryptWriter modifies its argument
 			data := append([]byte(nil), sectors[s.MerkleRoot][s.Offset:][:s.Length]...)
@@ -94,18 +94,51 @@ func (s *KeySeed) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// A KeyDeriver derives the key used to encrypt a sector slice from a KeySeed
+// and the slice's 24-byte nonce. Since the same derivation must be used for
+// both encryption and decryption, a KeyDeriver must be deterministic.
+type KeyDeriver interface {
+	DeriveKey(seed KeySeed, nonce []byte) [32]byte
+}
+
+// XChaCha20Deriver is the default KeyDeriver. It derives keys using HChaCha20,
+// as specified by XChaCha20.
+type XChaCha20Deriver struct{}
+
+// DeriveKey implements KeyDeriver.
+func (XChaCha20Deriver) DeriveKey(seed KeySeed, nonce []byte) [32]byte {
+	var key [32]byte
+	var hNonce [16]byte
+	copy(hNonce[:], nonce[:16])
+	chacha.HChaCha20(&key, &hNonce, (*[32]byte)(&seed))
+	return key
+}
+
 // XORKeyStream xors msg with the keystream derived from s, using startIndex as
-// the starting offset within the stream. The nonce must be 24 bytes.
+// the starting offset within the stream. The nonce must be 24 bytes. It is
+// equivalent to XORKeyStreamWith(XChaCha20Deriver{}, ...).
 func (s *KeySeed) XORKeyStream(msg []byte, nonce []byte, startIndex uint64) {
+	s.XORKeyStreamWith(XChaCha20Deriver{}, msg, nonce, startIndex)
+}
+
+// XORKeyStreamWith is like XORKeyStream, but derives the subkey for each nonce
+// using kd. If kd is nil, XChaCha20Deriver is used. Data encrypted with one
+// KeyDeriver cannot be decrypted with another.
+func (s *KeySeed) XORKeyStreamWith(kd KeyDeriver, msg []byte, nonce []byte, startIndex uint64) {
 	if len(msg)%merkle.SegmentSize != 0 {
 		panic("message must be a multiple of segment size")
 	} else if len(nonce) != chacha.XNonceSize {
 		panic("nonce must be 24 bytes")
 	}
-	// NOTE: since we're using XChaCha20, the nonce and KeySeed are hashed
-	// together to produce a subkey; this is why s is referred to as a "seed"
-	// rather than a key in its own right.
-	c, err := chacha.NewCipher(nonce, s[:], 20)
+	if kd == nil {
+		kd = XChaCha20Deriver{}
+	}
+	// NOTE: the first 16 bytes of the nonce are consumed by the KeyDeriver,
+	// which hashes them together with the KeySeed to produce a subkey; this is
+	// why s is referred to as a "seed" rather than a key in its own right. With
+	// the default XChaCha20Deriver, this is equivalent to XChaCha20.
+	key := kd.DeriveKey(*s, nonce)
+	c, err := chacha.NewCipher(nonce[16:], key[:], 20)
 	if err != nil {
 		panic(err)
 	}
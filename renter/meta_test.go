@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/aead/chacha20/chacha"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
@@ -32,6 +33,53 @@ func TestEncryption(t *testing.T) {
 	}
 }
 
+type testKeyDeriver struct{ salt byte }
+
+func (kd testKeyDeriver) DeriveKey(seed KeySeed, nonce []byte) [32]byte {
+	seed[0] ^= kd.salt
+	return XChaCha20Deriver{}.DeriveKey(seed, nonce)
+}
+
+func TestKeyDeriver(t *testing.T) {
+	key := KeySeed(frand.Entropy256())
+	nonce := frand.Bytes(24)
+	plaintext := frand.Bytes(merkle.SegmentSize * 4)
+
+	// the default deriver should be equivalent to XChaCha20
+	ciphertext := append([]byte(nil), plaintext...)
+	key.XORKeyStream(ciphertext, nonce, 0)
+	exp := make([]byte, len(plaintext))
+	chacha.XORKeyStream(exp, plaintext, nonce, key[:], 20)
+	if !bytes.Equal(ciphertext, exp) {
+		t.Fatal("default deriver does not match XChaCha20")
+	}
+	nilDeriver := append([]byte(nil), plaintext...)
+	key.XORKeyStreamWith(nil, nilDeriver, nonce, 0)
+	if !bytes.Equal(nilDeriver, ciphertext) {
+		t.Fatal("nil deriver does not match default deriver")
+	}
+
+	// a custom deriver should produce a different keystream, and should be
+	// able to decrypt its own ciphertext, starting from any segment
+	kd := testKeyDeriver{salt: 1}
+	custom := append([]byte(nil), plaintext...)
+	key.XORKeyStreamWith(kd, custom, nonce, 0)
+	if bytes.Equal(custom, ciphertext) || bytes.Equal(custom, plaintext) {
+		t.Fatal("custom deriver was not used")
+	}
+	const start = 2
+	suffix := append([]byte(nil), custom[start*merkle.SegmentSize:]...)
+	key.XORKeyStreamWith(kd, suffix, nonce, start)
+	if !bytes.Equal(suffix, plaintext[start*merkle.SegmentSize:]) {
+		t.Fatal("custom deriver could not decrypt its own ciphertext")
+	}
+	// the default deriver should not
+	key.XORKeyStream(custom, nonce, 0)
+	if bytes.Equal(custom, plaintext) {
+		t.Fatal("default deriver decrypted custom ciphertext")
+	}
+}
+
 func BenchmarkEncryption(b *testing.B) {
 	var key KeySeed
 	data := make([]byte, renterhost.SectorSize)
@@ -2,6 +2,7 @@
 package proto // import "lukechampine.com/us/renter/proto"
 
 import (
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -60,6 +61,56 @@ type RPCStatsRecorder interface {
 	RecordRPCStats(stats RPCStats)
 }
 
+// ContractSpending summarizes the data transferred and funds spent in RPCs
+// involving a particular contract.
+type ContractSpending struct {
+	Host       hostdb.HostPublicKey
+	RPCs       int
+	Uploaded   uint64
+	Downloaded uint64
+	Cost       types.Currency
+}
+
+// A SpendingRecorder is an RPCStatsRecorder that tallies spending per contract.
+// Since a single SpendingRecorder may be shared by many Sessions (e.g. via
+// (*renterutil.HostSet).SetRPCStatsRecorder), it can produce a complete ledger
+// of a transfer spanning multiple hosts. It is safe for concurrent use.
+type SpendingRecorder struct {
+	spending map[types.FileContractID]ContractSpending
+	mu       sync.Mutex
+}
+
+// RecordRPCStats implements RPCStatsRecorder. RPCs made without a locked
+// contract are ignored, as they cannot incur costs.
+func (sr *SpendingRecorder) RecordRPCStats(stats RPCStats) {
+	if stats.Contract == (types.FileContractID{}) {
+		return
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.spending == nil {
+		sr.spending = make(map[types.FileContractID]ContractSpending)
+	}
+	cs := sr.spending[stats.Contract]
+	cs.Host = stats.Host
+	cs.RPCs++
+	cs.Uploaded += stats.Uploaded
+	cs.Downloaded += stats.Downloaded
+	cs.Cost = cs.Cost.Add(stats.Cost)
+	sr.spending[stats.Contract] = cs
+}
+
+// SpendingSummary returns the spending recorded for each contract.
+func (sr *SpendingRecorder) SpendingSummary() map[types.FileContractID]ContractSpending {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	m := make(map[types.FileContractID]ContractSpending, len(sr.spending))
+	for id, cs := range sr.spending {
+		m[id] = cs
+	}
+	return m
+}
+
 // A ContractRevision contains the most recent revision to a file contract and
 // its signatures.
 type ContractRevision struct {
@@ -2,15 +2,18 @@ package proto
 
 import (
 	"bufio"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/bits"
 	"net"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -55,8 +58,40 @@ var (
 
 	lockTimeout uint64 = DefaultLockTimeout
 	dialTimeout uint64 = DefaultDialTimeout
+	dialer      Dialer
 )
 
+// A Dialer establishes connections to hosts. It is satisfied by *net.Dialer
+// and by the SOCKS5 dialer in golang.org/x/net/proxy.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// A ContextDialer is a Dialer that can abort a dial when a Context is done.
+// If the Dialer passed to SetDialer is a ContextDialer, the Context-aware
+// Session constructors use DialContext rather than Dial.
+type ContextDialer interface {
+	Dialer
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// A SectorLengthError is returned by Read when the host sends a different
+// amount of sector data than was requested. This is usually caused by a faulty
+// host or connection; the caller may retry the request with another host.
+type SectorLengthError struct {
+	Expected uint64
+	Actual   uint64
+}
+
+// Error implements error.
+func (e *SectorLengthError) Error() string {
+	return fmt.Sprintf("host sent incomplete sector data (expected %v bytes, got %v)", e.Expected, e.Actual)
+}
+
+// Temporary reports whether the error is transient. It always returns true
+// for SectorLengthErrors, since another host may be able to supply the data.
+func (e *SectorLengthError) Temporary() bool { return true }
+
 // SetLockTimeout sets the timeout for lock requests to the given value.
 func SetLockTimeout(timeout uint64) {
 	lockTimeout = timeout
@@ -67,6 +102,15 @@ func SetDialTimeout(timeout uint64) {
 	dialTimeout = timeout
 }
 
+// SetDialer sets the Dialer used to connect to hosts, e.g. to route all host
+// traffic through a proxy. If d is nil, hosts are dialed directly via TCP. The
+// dial timeout is only enforced for direct connections; a custom Dialer is
+// responsible for its own timeouts. Likewise, a Context can only abort the dial
+// itself if d is a ContextDialer.
+func SetDialer(d Dialer) {
+	dialer = d
+}
+
 // wrapResponseErr formats RPC response errors nicely, wrapping them in either
 // readCtx or rejectCtx depending on whether we encountered an I/O error or the
 // host sent an explicit error message.
@@ -115,6 +159,10 @@ type Session struct {
 // HostKey returns the public key of the host.
 func (s *Session) HostKey() hostdb.HostPublicKey { return s.host.PublicKey }
 
+// HostSettings returns the most recent settings reported by the host. The
+// settings are updated each time the Settings RPC is called.
+func (s *Session) HostSettings() hostdb.HostSettings { return s.host.HostSettings }
+
 // Revision returns the most recent revision of the locked contract.
 func (s *Session) Revision() ContractRevision { return s.rev }
 
@@ -375,6 +423,37 @@ func (sw *segWriter) Write(p []byte) (int, error) {
 	return lenp, nil
 }
 
+// readBandwidth returns the number of bytes that a host charges for when
+// serving sections.
+func readBandwidth(sections []renterhost.RPCReadRequestSection) uint64 {
+	var bandwidth uint64
+	for _, sec := range sections {
+		// TODO: siad host uses worst-case size. This should be:
+		// proofHashes := merkle.ProofSize(merkle.SegmentsPerSector, int(sec.Offset), int(sec.Offset+sec.Length))
+		proofHashes := 2 * bits.Len64(merkle.SegmentsPerSector)
+		bandwidth += uint64(sec.Length) + uint64(proofHashes)*crypto.HashSize
+	}
+	if bandwidth < renterhost.MinMessageSize {
+		bandwidth = renterhost.MinMessageSize
+	}
+	return bandwidth
+}
+
+// ReadPrice returns the price that a host with the specified settings charges
+// for a Read RPC requesting sections. In addition to the base RPC price and
+// bandwidth, hosts charge SectorAccessPrice once for each distinct sector
+// accessed, so reading many small sections of different sectors can cost
+// considerably more than their total size would suggest.
+func ReadPrice(host hostdb.HostSettings, sections []renterhost.RPCReadRequestSection) types.Currency {
+	sectorAccesses := make(map[crypto.Hash]struct{})
+	for _, sec := range sections {
+		sectorAccesses[sec.MerkleRoot] = struct{}{}
+	}
+	sectorAccessPrice := host.SectorAccessPrice.Mul64(uint64(len(sectorAccesses)))
+	bandwidthPrice := host.DownloadBandwidthPrice.Mul64(readBandwidth(sections))
+	return host.BaseRPCPrice.Add(sectorAccessPrice).Add(bandwidthPrice)
+}
+
 // Read calls the Read RPC, writing the requested sections of sector data to w.
 // Merkle proofs are always requested.
 //
@@ -394,23 +473,8 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	}
 
 	// calculate price
-	sectorAccesses := make(map[crypto.Hash]struct{})
-	for _, sec := range sections {
-		sectorAccesses[sec.MerkleRoot] = struct{}{}
-	}
-	sectorAccessPrice := s.host.SectorAccessPrice.Mul64(uint64(len(sectorAccesses)))
-	var bandwidth uint64
-	for _, sec := range sections {
-		// TODO: siad host uses worst-case size. This should be:
-		// proofHashes := merkle.ProofSize(merkle.SegmentsPerSector, int(sec.Offset), int(sec.Offset+sec.Length))
-		proofHashes := 2 * bits.Len64(merkle.SegmentsPerSector)
-		bandwidth += uint64(sec.Length) + uint64(proofHashes)*crypto.HashSize
-	}
-	if bandwidth < renterhost.MinMessageSize {
-		bandwidth = renterhost.MinMessageSize
-	}
-	bandwidthPrice := s.host.DownloadBandwidthPrice.Mul64(bandwidth)
-	price := s.host.BaseRPCPrice.Add(sectorAccessPrice).Add(bandwidthPrice)
+	price := ReadPrice(s.host.HostSettings, sections)
+	bandwidth := readBandwidth(sections)
 	if !s.sufficientFunds(price) {
 		return ErrInsufficientFunds
 	}
@@ -471,16 +535,21 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 		// stream the sector data into w and the proof verifier
 		if _, err := io.ReadFull(msgReader, lenbuf); err != nil {
 			return errors.Wrap(err, "couldn't read data len")
-		} else if binary.LittleEndian.Uint64(lenbuf) != uint64(sec.Length) {
-			return errors.New("host sent wrong amount of sector data")
+		} else if n := binary.LittleEndian.Uint64(lenbuf); n != uint64(sec.Length) {
+			return &SectorLengthError{Expected: uint64(sec.Length), Actual: n}
 		}
 		proofStart := int(sec.Offset) / merkle.SegmentSize
 		proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
 		rpv := merkle.NewRangeProofVerifier(proofStart, proofEnd)
-		tee := io.TeeReader(io.LimitReader(msgReader, int64(sec.Length)), &segWriter{w: w})
+		lr := &io.LimitedReader{R: msgReader, N: int64(sec.Length)}
+		tee := io.TeeReader(lr, &segWriter{w: w})
 		// the proof verifier Reads one segment at a time, so bufio is crucial
 		// for performance here
-		if _, err := rpv.ReadFrom(bufio.NewReaderSize(tee, 1<<16)); err != nil {
+		_, err = rpv.ReadFrom(bufio.NewReaderSize(tee, 1<<16))
+		if lr.N != 0 && (err == nil || err == io.ErrUnexpectedEOF) {
+			// the stream ended cleanly, but before all the data was sent
+			return &SectorLengthError{Expected: uint64(sec.Length), Actual: uint64(sec.Length) - uint64(lr.N)}
+		} else if err != nil {
 			return errors.Wrap(err, "couldn't stream sector data")
 		}
 		// read the Merkle proof
@@ -527,6 +596,84 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	return nil
 }
 
+// sectorNotFoundErrs are the descriptions used by known host implementations
+// when rejecting a Read RPC for a sector they do not possess.
+var sectorNotFoundErrs = []string{
+	"could not find the desired sector", // siad
+	"no sector with Merkle root",        // ghost
+}
+
+func isSectorNotFound(err error) bool {
+	re, ok := errors.Cause(err).(*renterhost.RPCError)
+	if !ok {
+		return false
+	}
+	for _, desc := range sectorNotFoundErrs {
+		if strings.Contains(re.Description, desc) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSector reports whether the host is storing the sector with the specified
+// Merkle root. It calls the Read RPC for a single segment of the sector, so its
+// cost is that of the smallest possible download. If the host rejects the
+// request because it does not have the sector, HasSector returns false and a
+// nil error.
+//
+// Hosts typically terminate the session after rejecting an RPC, so after
+// HasSector returns false, the Session will likely need to be re-established.
+func (s *Session) HasSector(root crypto.Hash) (bool, error) {
+	err := s.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     merkle.SegmentSize,
+	}})
+	if isSectorNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sliceWriter is an io.Writer that fills a fixed-size slice.
+type sliceWriter struct {
+	buf []byte
+	n   int
+}
+
+func (sw *sliceWriter) Write(p []byte) (int, error) {
+	n := copy(sw.buf[sw.n:], p)
+	sw.n += n
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// SectorInto reads the sector with the specified Merkle root directly into
+// dst, which must be renterhost.SectorSize bytes long. As with Read, the
+// contents of dst are only valid if the returned error is nil.
+func (s *Session) SectorInto(root crypto.Hash, dst []byte) error {
+	if len(dst) != renterhost.SectorSize {
+		return errors.Errorf("destination buffer must be %v bytes, got %v", renterhost.SectorSize, len(dst))
+	}
+	sw := &sliceWriter{buf: dst}
+	err := s.Read(sw, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		return err
+	} else if sw.n != len(dst) {
+		return &SectorLengthError{Expected: uint64(len(dst)), Actual: uint64(sw.n)}
+	}
+	return nil
+}
+
 // Write implements the Write RPC, except for ActionUpdate. A Merkle proof is
 // always requested.
 func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
@@ -762,10 +909,36 @@ func (s *Session) Close() (err error) {
 // The host's settings will also be requested.
 func NewSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, id types.FileContractID, key ed25519.PrivateKey, currentHeight types.BlockHeight) (_ *Session, err error) {
 	defer wrapErrWithReplace(&err, "NewSession")
-	s, err := NewUnlockedSession(hostIP, hostKey, currentHeight)
+	return dialSession(context.Background(), hostIP, hostKey, currentHeight, func(s *Session) (*Session, error) {
+		return lockAndSync(s, id, key)
+	})
+}
+
+// NewSessionContext is like NewSession, but aborts the dial, the handshake, and
+// the locking of the contract if ctx is canceled or expires. The timeout set by
+// SetDialTimeout still applies.
+func NewSessionContext(ctx context.Context, hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, id types.FileContractID, key ed25519.PrivateKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErrWithReplace(&err, "NewSessionContext")
+	return dialSession(ctx, hostIP, hostKey, currentHeight, func(s *Session) (*Session, error) {
+		return lockAndSync(s, id, key)
+	})
+}
+
+// NewSessionFromConn is like NewSession, but initiates the session on top of
+// the provided conn instead of dialing the host. The conn should have a
+// deadline appropriate for the renter-host protocol handshake.
+func NewSessionFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, id types.FileContractID, key ed25519.PrivateKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErrWithReplace(&err, "NewSessionFromConn")
+	s, err := NewUnlockedSessionFromConn(conn, hostKey, currentHeight)
 	if err != nil {
 		return nil, err
 	}
+	return lockAndSync(s, id, key)
+}
+
+// lockAndSync locks the specified contract and requests the host's settings,
+// closing s if either fails.
+func lockAndSync(s *Session, id types.FileContractID, key ed25519.PrivateKey) (*Session, error) {
 	if err := s.Lock(id, key, time.Duration(lockTimeout)*time.Millisecond); err != nil {
 		if e := s.Close(); e != nil {
 			err = multierror.Append(err, e)
@@ -785,15 +958,68 @@ func NewSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, id type
 // host, without locking an associated contract or requesting the host's settings.
 func NewUnlockedSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Session, err error) {
 	defer wrapErrWithReplace(&err, "NewUnlockedSession")
-	conn, err := net.DialTimeout("tcp", string(hostIP), time.Duration(dialTimeout)*time.Millisecond)
+	return dialSession(context.Background(), hostIP, hostKey, currentHeight, nil)
+}
+
+// NewUnlockedSessionContext is like NewUnlockedSession, but aborts the dial and
+// the handshake if ctx is canceled or expires. The timeout set by
+// SetDialTimeout still applies.
+func NewUnlockedSessionContext(ctx context.Context, hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErrWithReplace(&err, "NewUnlockedSessionContext")
+	return dialSession(ctx, hostIP, hostKey, currentHeight, nil)
+}
+
+// dialHost connects to hostIP, using the Dialer set by SetDialer, if any.
+func dialHost(ctx context.Context, hostIP modules.NetAddress) (net.Conn, error) {
+	if cd, ok := dialer.(ContextDialer); ok {
+		return cd.DialContext(ctx, "tcp", string(hostIP))
+	} else if dialer != nil {
+		return dialer.Dial("tcp", string(hostIP))
+	}
+	d := &net.Dialer{Timeout: time.Duration(dialTimeout) * time.Millisecond}
+	return d.DialContext(ctx, "tcp", string(hostIP))
+}
+
+// dialSession dials hostIP and initiates a session with the host. If init is
+// non-nil, it is called on the new session before dialSession returns. If ctx
+// is done before then, the connection is closed and ctx.Err() is returned.
+func dialSession(ctx context.Context, hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight, init func(*Session) (*Session, error)) (_ *Session, err error) {
+	defer wrapErr(&err, "dialSession")
+	conn, err := dialHost(ctx, hostIP)
 	if err != nil {
 		return nil, err
 	}
-	err = conn.SetDeadline(time.Now().Add(time.Duration(dialTimeout) * time.Millisecond))
-	if err != nil {
+	deadline := time.Now().Add(time.Duration(dialTimeout) * time.Millisecond)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return NewUnlockedSessionFromConn(conn, hostKey, currentHeight)
+
+	// close the conn if ctx is done, unblocking any pending reads and writes
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+
+	s, err := NewUnlockedSessionFromConn(conn, hostKey, currentHeight)
+	if err == nil && init != nil {
+		s, err = init(s)
+	}
+	close(done)
+	if <-aborted {
+		return nil, ctx.Err()
+	}
+	return s, err
 }
 
 // NewUnlockedSessionFromConn initiates a new renter-host protocol session on
@@ -2,15 +2,22 @@ package proto
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"errors"
 	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/encoding"
+	"lukechampine.com/frand"
 	"lukechampine.com/us/ghost"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renterhost"
 )
 
@@ -140,6 +147,255 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestSpendingRecorder(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var sr SpendingRecorder
+	renter.SetRPCStatsRecorder(&sr)
+	sector := [renterhost.SectorSize]byte{0: 1}
+	sectorRoot, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: sectorRoot,
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary := sr.SpendingSummary()
+	cs, ok := summary[renter.Revision().ID()]
+	if len(summary) != 1 || !ok {
+		t.Fatal("expected spending for a single contract, got", summary)
+	} else if cs.Host != host.PublicKey() || cs.RPCs != 3 {
+		t.Fatal("bad spending:", cs)
+	} else if cs.Downloaded < 2*renterhost.SectorSize || cs.Uploaded < renterhost.SectorSize {
+		t.Fatal("bad bandwidth totals:", cs)
+	}
+}
+
+type countingDialer struct {
+	n int
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.n++
+	return net.Dial(network, addr)
+}
+
+func TestSessionDialer(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	id, key := renter.Revision().ID(), renter.key
+	if err := renter.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	var d countingDialer
+	SetDialer(&d)
+	defer SetDialer(nil)
+	s, err := NewSession(host.Settings().NetAddress, host.PublicKey(), id, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if d.n != 1 {
+		t.Fatal("custom Dialer was not used")
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// supply our own conn
+	conn, err := net.Dial("tcp", string(host.Settings().NetAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewSessionFromConn(conn, host.PublicKey(), id, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if s.Revision().ID() != id {
+		t.Fatal("wrong contract locked")
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionReadFaults(t *testing.T) {
+	tests := []struct {
+		fault ghost.ReadFault
+		check func(error) bool
+	}{
+		{ghost.FaultBadData, func(err error) bool { return errors.Is(err, ErrInvalidMerkleProof) }},
+		{ghost.FaultShortData, func(err error) bool {
+			var sle *SectorLengthError
+			return errors.As(err, &sle) && sle.Actual < sle.Expected
+		}},
+		{ghost.FaultDisconnect, func(err error) bool { return err != nil }},
+	}
+	for _, test := range tests {
+		renter, host := createTestingPair(t)
+		sector := [renterhost.SectorSize]byte{0: 1}
+		sectorRoot, err := renter.Append(&sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host.SetReadFault(test.fault)
+		err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: sectorRoot,
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}})
+		if !test.check(err) {
+			t.Errorf("fault %v: unexpected error %v", test.fault, err)
+		}
+		renter.Close()
+		host.Close()
+	}
+}
+
+var errInjected = errors.New("injected conn error")
+
+// failingConn returns errInjected once it has read failAfter bytes, if
+// failAfter is positive.
+type failingConn struct {
+	net.Conn
+	failAfter int
+}
+
+func (c *failingConn) Read(p []byte) (int, error) {
+	if c.failAfter <= 0 {
+		return c.Conn.Read(p)
+	} else if c.failAfter == 1 {
+		return 0, errInjected
+	} else if len(p) >= c.failAfter {
+		p = p[:c.failAfter-1]
+	}
+	n, err := c.Conn.Read(p)
+	c.failAfter -= n
+	return n, err
+}
+
+func TestSessionReadStreamError(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer host.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	sectorRoot, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key := renter.Revision().ID(), renter.key
+	if err := renter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", string(host.Settings().NetAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &failingConn{Conn: conn}
+	s, err := NewSessionFromConn(fc, host.PublicKey(), id, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// fail partway through the sector data; the conn error should be
+	// reported, not a SectorLengthError
+	fc.failAfter = renterhost.SectorSize / 2
+	err = s.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: sectorRoot,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	var sle *SectorLengthError
+	if errors.As(err, &sle) {
+		t.Fatalf("expected stream error, got %v", err)
+	} else if !errors.Is(err, errInjected) {
+		t.Fatalf("expected %v, got %v", errInjected, err)
+	}
+}
+
+func TestSessionHasSector(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	sector := [renterhost.SectorSize]byte{0: 1}
+	sectorRoot, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := renter.HasSector(sectorRoot); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected host to have sector")
+	}
+	if ok, err := renter.HasSector(crypto.Hash{1}); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected host not to have sector")
+	}
+
+	// other failures should still be reported
+	renter.Close()
+	if _, err := renter.HasSector(sectorRoot); err == nil {
+		t.Fatal("expected error from closed session")
+	}
+}
+
+func TestSessionSectorInto(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	sectorRoot, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, renterhost.SectorSize)
+	if err := renter.SectorInto(sectorRoot, dst); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(dst, sector[:]) {
+		t.Fatal("downloaded sector does not match uploaded sector")
+	}
+	if err := renter.SectorInto(sectorRoot, dst[:len(dst)-1]); err == nil {
+		t.Fatal("expected error for undersized buffer")
+	}
+}
+
+func TestReadPrice(t *testing.T) {
+	settings := hostdb.HostSettings{
+		BaseRPCPrice:           types.NewCurrency64(1),
+		SectorAccessPrice:      types.NewCurrency64(100),
+		DownloadBandwidthPrice: types.NewCurrency64(1000),
+	}
+	minBandwidth := types.NewCurrency64(1000 * renterhost.MinMessageSize)
+	sec := func(root byte) renterhost.RPCReadRequestSection {
+		return renterhost.RPCReadRequestSection{MerkleRoot: crypto.Hash{root}, Length: merkle.SegmentSize}
+	}
+	tests := []struct {
+		sections []renterhost.RPCReadRequestSection
+		exp      types.Currency
+	}{
+		{[]renterhost.RPCReadRequestSection{sec(1)}, types.NewCurrency64(101).Add(minBandwidth)},
+		// accessing the same sector twice incurs only one access charge
+		{[]renterhost.RPCReadRequestSection{sec(1), sec(1)}, types.NewCurrency64(101).Add(minBandwidth)},
+		{[]renterhost.RPCReadRequestSection{sec(1), sec(2)}, types.NewCurrency64(201).Add(minBandwidth)},
+	}
+	for _, test := range tests {
+		if price := ReadPrice(settings, test.sections); !price.Equals(test.exp) {
+			t.Errorf("expected %v, got %v", test.exp, price)
+		}
+	}
+}
+
 func TestRenew(t *testing.T) {
 	renter, host := createTestingPair(t)
 	defer renter.Close()
@@ -258,3 +514,60 @@ func BenchmarkRead(b *testing.B) {
 		}
 	}
 }
+
+func TestSessionContext(t *testing.T) {
+	// a listener that accepts connections but never completes the handshake
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	hostIP := modules.NetAddress(l.Addr().String())
+	hostKey := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewUnlockedSessionContext(ctx, hostIP, hostKey, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline error, got", err)
+	} else if time.Since(start) > 5*time.Second {
+		t.Fatal("handshake was not aborted promptly")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = NewSessionContext(ctx, hostIP, hostKey, types.FileContractID{}, nil, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation error, got", err)
+	}
+
+	// a working host should be unaffected
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	s, err := NewUnlockedSessionContext(context.Background(), host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Settings(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/pkg/errors"
 	"lukechampine.com/us/internal/reedsolomon"
 	"lukechampine.com/us/merkle"
 )
@@ -23,7 +24,9 @@ type ErasureCoder interface {
 	// zero.
 	Reconstruct(shards [][]byte) error
 	// Recover recalculates any missing data shards and writes them to w,
-	// skipping the first off bytes and stopping after n bytes.
+	// skipping the first off bytes and stopping after n bytes. If all of the
+	// data shards are present, they are joined directly, without decoding;
+	// downloaders should therefore prefer data shards to parity shards.
 	Recover(w io.Writer, shards [][]byte, off, n int) error
 }
 
@@ -77,20 +80,33 @@ func (rsc rsCode) Recover(w io.Writer, shards [][]byte, off, n int) error {
 	return rsc.enc.JoinMulti(w, shards, merkle.SegmentSize, off, n)
 }
 
-// NewRSCode returns an m-of-n ErasureCoder. It panics if m <= 0 or n < m.
+// NewRSCode returns an m-of-n ErasureCoder. It panics if m <= 0, n < m, or n
+// exceeds the maximum number of shards supported by the encoder (256).
 func NewRSCode(m, n int) ErasureCoder {
-	if m == n {
-		return simpleRedundancy(m)
+	rsc, err := NewRSCodeChecked(m, n)
+	if err != nil {
+		panic(err)
+	}
+	return rsc
+}
+
+// NewRSCodeChecked is like NewRSCode, but returns an error instead of
+// panicking if m and n are invalid.
+func NewRSCodeChecked(m, n int) (ErasureCoder, error) {
+	if m <= 0 || n < m {
+		return nil, errors.Errorf("invalid erasure code parameters (%v-of-%v): must have 0 < m <= n", m, n)
+	} else if m == n {
+		return simpleRedundancy(m), nil
 	}
 	rsc, err := reedsolomon.New(m, n-m)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrapf(err, "invalid erasure code parameters (%v-of-%v)", m, n)
 	}
 	return rsCode{
 		enc: rsc,
 		m:   m,
 		n:   n,
-	}
+	}, nil
 }
 
 // simpleRedundancy implements the ErasureCoder interface when no
@@ -35,6 +35,38 @@ func checkRecover(rsc ErasureCoder, shards [][]byte, data []byte) bool {
 	return bytes.Equal(buf.Bytes(), data)
 }
 
+func TestNewRSCodeChecked(t *testing.T) {
+	tests := []struct {
+		m, n  int
+		valid bool
+	}{
+		{1, 1, true},
+		{10, 10, true}, // no parity
+		{10, 40, true},
+		{1, 256, true},
+		{0, 0, false},
+		{0, 10, false},
+		{-1, 10, false},
+		{10, 9, false},
+		{1, 257, false},
+	}
+	for _, test := range tests {
+		_, err := NewRSCodeChecked(test.m, test.n)
+		if test.valid && err != nil {
+			t.Errorf("NewRSCodeChecked(%v, %v): unexpected error: %v", test.m, test.n, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("NewRSCodeChecked(%v, %v): expected error", test.m, test.n)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewRSCode(0, 10) to panic")
+		}
+	}()
+	NewRSCode(0, 10)
+}
+
 func TestReedSolomon(t *testing.T) {
 	// 3-of-10 code
 	rsc := NewRSCode(3, 10)
@@ -153,6 +185,26 @@ func BenchmarkReedSolomon(b *testing.B) {
 		}
 	}
 
+	// the healthy case: all of the data shards are present, so no decoding is
+	// required
+	benchRecoverData := func(m, n int) func(*testing.B) {
+		data, shards := makeShards(m, n)
+		rsc := NewRSCode(m, n)
+		rsc.Encode(data, shards)
+		for j := range shards[m:] {
+			shards[m+j] = shards[m+j][:0]
+		}
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := rsc.Recover(ioutil.Discard, shards, 0, len(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
 	benchReconstruct := func(m, n, r int) func(*testing.B) {
 		data, shards := makeShards(m, n)
 		rsc := NewRSCode(m, n)
@@ -179,6 +231,7 @@ func BenchmarkReedSolomon(b *testing.B) {
 	b.Run("recover-1-of-10-of-40", benchRecover(10, 40, 1))
 	b.Run("recover-10-of-10-of-40", benchRecover(10, 40, 10))
 	b.Run("recover-0-of-10-of-10", benchRecover(10, 10, 0))
+	b.Run("recover-data-10-of-40", benchRecoverData(10, 40))
 
 	b.Run("reconstruct-1-of-10-of-40", benchReconstruct(10, 40, 1))
 	b.Run("reconstruct-10-of-10-of-40", benchReconstruct(10, 40, 10))
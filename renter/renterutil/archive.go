@@ -0,0 +1,75 @@
+package renterutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+)
+
+// archivePageSize is the number of keys fetched from the MetaDB at a time by
+// GetArchive.
+const archivePageSize = 100
+
+// blobSize returns the total length of the chunks of b.
+func blobSize(db MetaDB, b DBBlob) (int64, error) {
+	var size int64
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return 0, err
+		}
+		size += int64(c.Len)
+	}
+	return size, nil
+}
+
+// GetArchive writes a tar archive to w containing the value of every key that
+// begins with prefix. Each entry is named by the remainder of its key after
+// prefix; a key equal to prefix is omitted. Values are downloaded one at a time
+// and streamed directly into the archive, so the archive is never held in
+// memory.
+func (kv PseudoKV) GetArchive(prefix []byte, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	after := prefix
+	for {
+		keys, next, err := kv.DB.BlobPage(after, archivePageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !bytes.HasPrefix(key, prefix) {
+				next = nil
+				break
+			}
+			b, err := kv.DB.Blob(key)
+			if err != nil {
+				return err
+			}
+			size, err := blobSize(kv.DB, b)
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     string(key[len(prefix):]),
+				Mode:     0644,
+				Size:     size,
+			})
+			if err != nil {
+				return err
+			}
+			bd := ParallelBlobDownloader{
+				D: kv.Downloader,
+				P: kv.P,
+			}
+			if err := bd.DownloadBlob(kv.DB, b, tw, 0, -1); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			break
+		}
+		after = next
+	}
+	return tw.Close()
+}
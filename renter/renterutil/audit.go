@@ -0,0 +1,151 @@
+package renterutil
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+)
+
+// AuditMetaDB wraps a MetaDB, writing a line to an audit log before each
+// mutating operation is delegated to the underlying MetaDB. Each line contains
+// a timestamp, the name of the operation, and its arguments. If the log cannot
+// be written, the operation is not performed.
+type AuditMetaDB struct {
+	MetaDB
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (db *AuditMetaDB) log(op string, format string, args ...interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := fmt.Fprintf(db.w, "%v %v "+format+"\n", append([]interface{}{time.Now().UTC().Format(time.RFC3339Nano), op}, args...)...)
+	if err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+	return nil
+}
+
+// AddBlob implements MetaDB.
+func (db *AuditMetaDB) AddBlob(b DBBlob) error {
+	if err := db.log("AddBlob", "key=%q chunks=%v", b.Key, b.Chunks); err != nil {
+		return err
+	}
+	return db.MetaDB.AddBlob(b)
+}
+
+// ReplaceBlob implements MetaDB.
+func (db *AuditMetaDB) ReplaceBlob(b DBBlob) error {
+	if err := db.log("ReplaceBlob", "key=%q chunks=%v", b.Key, b.Chunks); err != nil {
+		return err
+	}
+	return db.MetaDB.ReplaceBlob(b)
+}
+
+// ReplaceBlobIfUnchanged implements MetaDB.
+func (db *AuditMetaDB) ReplaceBlobIfUnchanged(b DBBlob, expectedModTime time.Time) error {
+	if err := db.log("ReplaceBlobIfUnchanged", "key=%q chunks=%v expectedModTime=%v", b.Key, b.Chunks, expectedModTime.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	return db.MetaDB.ReplaceBlobIfUnchanged(b, expectedModTime)
+}
+
+// DeleteBlob implements MetaDB.
+func (db *AuditMetaDB) DeleteBlob(key []byte) error {
+	if err := db.log("DeleteBlob", "key=%q", key); err != nil {
+		return err
+	}
+	return db.MetaDB.DeleteBlob(key)
+}
+
+// RenameBlob implements MetaDB.
+func (db *AuditMetaDB) RenameBlob(oldKey, newKey []byte) error {
+	if err := db.log("RenameBlob", "old=%q new=%q", oldKey, newKey); err != nil {
+		return err
+	}
+	return db.MetaDB.RenameBlob(oldKey, newKey)
+}
+
+// AddChunk implements MetaDB.
+func (db *AuditMetaDB) AddChunk(m, n int, length uint64) (DBChunk, error) {
+	if err := db.log("AddChunk", "m=%v n=%v len=%v", m, n, length); err != nil {
+		return DBChunk{}, err
+	}
+	return db.MetaDB.AddChunk(m, n, length)
+}
+
+// SetChunkShard implements MetaDB.
+func (db *AuditMetaDB) SetChunkShard(id uint64, i int, s uint64) error {
+	if err := db.log("SetChunkShard", "chunk=%v index=%v shard=%v", id, i, s); err != nil {
+		return err
+	}
+	return db.MetaDB.SetChunkShard(id, i, s)
+}
+
+// AddShard implements MetaDB.
+func (db *AuditMetaDB) AddShard(s DBShard) (uint64, error) {
+	if err := db.log("AddShard", "host=%v root=%v offset=%v", s.HostKey, s.SectorRoot, s.Offset); err != nil {
+		return 0, err
+	}
+	return db.MetaDB.AddShard(s)
+}
+
+// RemapHost implements MetaDB.
+func (db *AuditMetaDB) RemapHost(old, new hostdb.HostPublicKey) (int, error) {
+	if err := db.log("RemapHost", "old=%v new=%v", old, new); err != nil {
+		return 0, err
+	}
+	return db.MetaDB.RemapHost(old, new)
+}
+
+// AddMetadata implements MetaDB.
+func (db *AuditMetaDB) AddMetadata(key, val []byte) error {
+	if err := db.log("AddMetadata", "key=%q len=%v", key, len(val)); err != nil {
+		return err
+	}
+	return db.MetaDB.AddMetadata(key, val)
+}
+
+// IncrementMetadata implements MetaDB.
+func (db *AuditMetaDB) IncrementMetadata(key []byte, delta int64) (int64, error) {
+	if err := db.log("IncrementMetadata", "key=%q delta=%v", key, delta); err != nil {
+		return 0, err
+	}
+	return db.MetaDB.IncrementMetadata(key, delta)
+}
+
+// AddTag implements MetaDB.
+func (db *AuditMetaDB) AddTag(key []byte, tag string) error {
+	if err := db.log("AddTag", "key=%q tag=%q", key, tag); err != nil {
+		return err
+	}
+	return db.MetaDB.AddTag(key, tag)
+}
+
+// RemoveTag implements MetaDB.
+func (db *AuditMetaDB) RemoveTag(key []byte, tag string) error {
+	if err := db.log("RemoveTag", "key=%q tag=%q", key, tag); err != nil {
+		return err
+	}
+	return db.MetaDB.RemoveTag(key, tag)
+}
+
+// SetBlobNote implements MetaDB.
+func (db *AuditMetaDB) SetBlobNote(key []byte, note string) error {
+	if err := db.log("SetBlobNote", "key=%q len=%v", key, len(note)); err != nil {
+		return err
+	}
+	return db.MetaDB.SetBlobNote(key, note)
+}
+
+// NewAuditMetaDB returns an AuditMetaDB that wraps db and writes its audit log
+// to w.
+func NewAuditMetaDB(db MetaDB, w io.Writer) *AuditMetaDB {
+	return &AuditMetaDB{
+		MetaDB: db,
+		w:      w,
+	}
+}
@@ -0,0 +1,135 @@
+package renterutil
+
+import (
+	"bytes"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+)
+
+// A HostBenchmark summarizes the performance of a host, as measured by
+// BenchmarkHosts.
+type HostBenchmark struct {
+	Shards   int           // number of shards requested
+	Errors   int           // number of shards that could not be downloaded
+	Bytes    int64         // total bytes downloaded
+	Duration time.Duration // total time spent downloading
+
+	// Latency is the mean time taken to download a single segment of a shard,
+	// which approximates the round-trip time of an RPC.
+	Latency time.Duration
+}
+
+// Throughput returns the host's achieved throughput, in bytes per second.
+func (hb HostBenchmark) Throughput() float64 {
+	if hb.Duration == 0 {
+		return 0
+	}
+	return float64(hb.Bytes) / hb.Duration.Seconds()
+}
+
+// ErrorRate returns the fraction of shard downloads that failed.
+func (hb HostBenchmark) ErrorRate() float64 {
+	if hb.Shards == 0 {
+		return 0
+	}
+	return float64(hb.Errors) / float64(hb.Shards)
+}
+
+type benchShard struct {
+	shard DBShard
+	len   int64
+}
+
+// BenchmarkHosts downloads every shard of the blob associated with key and
+// reports the performance of each host that stores at least one of them.
+// Unlike a normal download, which stops once enough shards have been
+// retrieved, every shard is fetched, and each host is benchmarked separately
+// so that hosts do not compete for bandwidth. Downloaded shards are verified
+// but otherwise discarded.
+//
+// For each shard, a single segment is downloaded first to measure latency,
+// followed by the full shard to measure throughput.
+func BenchmarkHosts(db MetaDB, key []byte, hosts *HostSet) (map[hostdb.HostPublicKey]HostBenchmark, error) {
+	b, err := db.Blob(key)
+	if err != nil {
+		return nil, err
+	}
+	// group shards by host
+	shards := make(map[hostdb.HostPublicKey][]benchShard)
+	var order []hostdb.HostPublicKey
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return nil, err
+		}
+		_, shardLen := shardSection(c, 0, int64(c.Len))
+		for _, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := shards[s.HostKey]; !ok {
+				order = append(order, s.HostKey)
+			}
+			shards[s.HostKey] = append(shards[s.HostKey], benchShard{s, shardLen})
+		}
+	}
+
+	results := make(map[hostdb.HostPublicKey]HostBenchmark, len(shards))
+	for _, host := range order {
+		results[host] = benchmarkHost(hosts, b.Seed, host, shards[host])
+	}
+	return results, nil
+}
+
+func benchmarkHost(hosts *HostSet, key renter.KeySeed, host hostdb.HostPublicKey, shards []benchShard) HostBenchmark {
+	var hb HostBenchmark
+	var latency time.Duration
+	var probes int
+	var buf bytes.Buffer
+	for _, bs := range shards {
+		hb.Shards++
+		sess, err := hosts.acquire(host)
+		if err != nil {
+			hb.Errors++
+			continue
+		}
+		sd := &renter.ShardDownloader{
+			Downloader: sess,
+			Key:        key,
+			Slices: []renter.SectorSlice{{
+				MerkleRoot:   bs.shard.SectorRoot,
+				SegmentIndex: bs.shard.Offset,
+				NumSegments:  merkle.SegmentsPerSector - bs.shard.Offset, // inconsequential
+				Nonce:        bs.shard.Nonce,
+			}},
+		}
+		buf.Reset()
+		start := time.Now()
+		err = sd.CopySection(&buf, 0, merkle.SegmentSize)
+		if err == nil {
+			latency += time.Since(start)
+			probes++
+			buf.Reset()
+			start = time.Now()
+			err = sd.CopySection(&buf, 0, bs.len)
+			hb.Duration += time.Since(start)
+		}
+		hosts.release(host)
+		if err != nil {
+			hb.Errors++
+			continue
+		}
+		hb.Bytes += int64(buf.Len())
+	}
+	if probes > 0 {
+		hb.Latency = latency / time.Duration(probes)
+	}
+	return hb
+}
@@ -0,0 +1,219 @@
+package renterutil
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+// SectorCacheStats reports the effectiveness of a SectorCache.
+type SectorCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int64 // bytes currently cached
+}
+
+// HitRate returns the fraction of lookups that were served from the cache.
+func (s SectorCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type cachedSector struct {
+	root crypto.Hash
+	data []byte
+}
+
+// A SectorCache is an LRU cache of (encrypted) sectors, keyed by Merkle root.
+// It is safe for concurrent use.
+//
+// Sectors downloaded on a cache miss are verified against their Merkle root by
+// the Session (as is all data sourced from the network) before being cached.
+// Cache hits are then served without re-verification, since computing the root
+// of a sector is expensive and its integrity was established on first fetch.
+type SectorCache struct {
+	budget  int64
+	size    int64
+	lru     *list.List
+	entries map[crypto.Hash]*list.Element
+	hits    uint64
+	misses  uint64
+	mu      sync.Mutex
+}
+
+// Get returns the cached sector with the given Merkle root, if present.
+//
+// Get does not copy the sector: the returned slice is shared with the cache and
+// with every other caller of Get, so it must not be modified. Callers that need
+// to modify the sector (e.g. decrypting it in place) should use SectorCopy
+// instead.
+func (sc *SectorCache) Get(root crypto.Hash) ([]byte, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[root]
+	if !ok {
+		sc.misses++
+		return nil, false
+	}
+	sc.hits++
+	sc.lru.MoveToFront(e)
+	return e.Value.(*cachedSector).data, true
+}
+
+// SectorCopy is like Get, but returns a copy of the sector, which the caller
+// may freely modify or retain.
+func (sc *SectorCache) SectorCopy(root crypto.Hash) ([]byte, bool) {
+	data, ok := sc.Get(root)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), data...), true
+}
+
+// peek is like Get, but does not affect the cache's statistics. It is used
+// after a call to Get has already recorded a miss.
+func (sc *SectorCache) peek(root crypto.Hash) ([]byte, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[root]
+	if !ok {
+		return nil, false
+	}
+	sc.lru.MoveToFront(e)
+	return e.Value.(*cachedSector).data, true
+}
+
+// Put adds a sector to the cache, evicting the least-recently-used sectors
+// until the cache is within its budget.
+//
+// Put does not verify that root is the Merkle root of data, and the sector will
+// subsequently be served without verification. It is therefore unsafe to Put
+// data from an untrusted source; use (DBShard).Verify to check it first.
+func (sc *SectorCache) Put(root crypto.Hash, data []byte) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if int64(len(data)) > sc.budget {
+		return
+	} else if e, ok := sc.entries[root]; ok {
+		sc.lru.MoveToFront(e)
+		return
+	}
+	sc.entries[root] = sc.lru.PushFront(&cachedSector{root, data})
+	sc.size += int64(len(data))
+	for sc.size > sc.budget {
+		cs := sc.lru.Remove(sc.lru.Back()).(*cachedSector)
+		delete(sc.entries, cs.root)
+		sc.size -= int64(len(cs.data))
+	}
+}
+
+// Stats returns the cache's hit/miss counts and current size.
+func (sc *SectorCache) Stats() SectorCacheStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return SectorCacheStats{
+		Hits:   sc.hits,
+		Misses: sc.misses,
+		Size:   sc.size,
+	}
+}
+
+// sector returns the sector with the given Merkle root, downloading it from
+// sess (and storing it in the cache) if it is not already cached. Callers
+// should first try copyCachedShard, which records cache hits and misses.
+func (sc *SectorCache) sector(sess *proto.Session, root crypto.Hash) ([]byte, error) {
+	if data, ok := sc.peek(root); ok {
+		return data, nil
+	}
+	sector := make([]byte, renterhost.SectorSize)
+	if err := sess.SectorInto(root, sector); err != nil {
+		return nil, err
+	}
+	sc.Put(root, sector)
+	return sector, nil
+}
+
+// copyShard writes the decrypted section [offset, offset+length) of shard to
+// buf, using the cached sector if possible.
+func (sc *SectorCache) copyShard(buf *bytes.Buffer, sess *proto.Session, key renter.KeySeed, kd renter.KeyDeriver, shard DBShard, offset, length int64) error {
+	sector, err := sc.sector(sess, shard.SectorRoot)
+	if err != nil {
+		return err
+	}
+	decryptShard(buf, sector, key, kd, shard, offset, length)
+	return nil
+}
+
+// copyCachedShard is like copyShard, but only succeeds if the sector is already
+// cached. It allows callers to avoid acquiring a host Session on a hit.
+func (sc *SectorCache) copyCachedShard(buf *bytes.Buffer, key renter.KeySeed, kd renter.KeyDeriver, shard DBShard, offset, length int64) bool {
+	sector, ok := sc.Get(shard.SectorRoot)
+	if ok {
+		decryptShard(buf, sector, key, kd, shard, offset, length)
+	}
+	return ok
+}
+
+func decryptShard(buf *bytes.Buffer, sector []byte, key renter.KeySeed, kd renter.KeyDeriver, shard DBShard, offset, length int64) {
+	start := int64(shard.Offset)*merkle.SegmentSize + offset
+	if start+length > int64(len(sector)) {
+		length = int64(len(sector)) - start
+	}
+	data := append([]byte(nil), sector[start:start+length]...)
+	key.XORKeyStreamWith(kd, data, shard.Nonce[:], uint64(start/merkle.SegmentSize))
+	buf.Write(data)
+}
+
+// Contains reports whether the sector with the given Merkle root is cached. Unlike
+// Get, it does not affect the cache's statistics or eviction order.
+func (sc *SectorCache) Contains(root crypto.Hash) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, ok := sc.entries[root]
+	return ok
+}
+
+// BlobCached reports whether b can be downloaded entirely from the cache, i.e.
+// whether at least MinShards sectors of each of its chunks are cached.
+func (sc *SectorCache) BlobCached(db MetaDB, b DBBlob) (bool, error) {
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return false, err
+		}
+		var cached int
+		for _, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err != nil {
+				return false, err
+			} else if sc.Contains(s.SectorRoot) {
+				cached++
+			}
+		}
+		if cached < int(c.MinShards) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// NewSectorCache returns a SectorCache that holds at most budget bytes of
+// sector data.
+func NewSectorCache(budget int64) *SectorCache {
+	return &SectorCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[crypto.Hash]*list.Element),
+	}
+}
@@ -0,0 +1,118 @@
+package renterutil
+
+import (
+	"errors"
+	"fmt"
+
+	"lukechampine.com/us/renter"
+)
+
+// ErrNonceReuse is returned by CheckNonceReuse when two shards of a blob were
+// encrypted with the same nonce.
+var ErrNonceReuse = errors.New("nonce reused within blob")
+
+// VerifyChunkInvariants scans every chunk referenced by a blob in db and
+// returns the IDs of any chunks that can never be decoded, i.e. chunks with a
+// MinShards of 0 or a MinShards greater than their number of shards.
+func VerifyChunkInvariants(db MetaDB) ([]uint64, error) {
+	var bad []uint64
+	seen := make(map[uint64]struct{})
+	err := db.ForEachBlob(func(key []byte) error {
+		b, err := db.Blob(key)
+		if err != nil {
+			return err
+		}
+		for _, cid := range b.Chunks {
+			if _, ok := seen[cid]; ok {
+				continue
+			}
+			seen[cid] = struct{}{}
+			c, err := db.Chunk(cid)
+			if err != nil {
+				return err
+			}
+			if checkChunkParams(int(c.MinShards), len(c.Shards)) != nil {
+				bad = append(bad, cid)
+			}
+		}
+		return nil
+	})
+	return bad, err
+}
+
+// CheckNonceReuse scans the shards of the blob associated with key and returns
+// ErrNonceReuse if any two distinct shards share a nonce. Since every shard of
+// a blob is encrypted with the blob's seed, such reuse would compromise the
+// encryption of both shards.
+func CheckNonceReuse(db MetaDB, key []byte) error {
+	b, err := db.Blob(key)
+	if err != nil {
+		return err
+	}
+	nonces := make(map[[24]byte]uint64)
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return err
+		}
+		for _, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err != nil {
+				return err
+			}
+			if prev, ok := nonces[s.Nonce]; ok && prev != sid {
+				return fmt.Errorf("%w: shards %v and %v", ErrNonceReuse, prev, sid)
+			}
+			nonces[s.Nonce] = sid
+		}
+	}
+	return nil
+}
+
+// CheckBlobIntegrity checks the blob associated with key for inconsistencies
+// that would corrupt refcount accounting or prevent the blob from being
+// downloaded. It returns an error wrapping ErrDuplicateChunk if the blob
+// references the same chunk more than once, or an error wrapping
+// ErrKeyNotFound if the blob references a chunk or shard that does not exist.
+func CheckBlobIntegrity(db MetaDB, key []byte) error {
+	b, err := db.Blob(key)
+	if err != nil {
+		return err
+	} else if err := checkChunkIDs(b.Chunks); err != nil {
+		return err
+	}
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return fmt.Errorf("chunk %v: %w", cid, err)
+		}
+		for _, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			} else if _, err := db.Shard(sid); err != nil {
+				return fmt.Errorf("chunk %v: shard %v: %w", cid, sid, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSeeds returns, in sorted order, the keys of all blobs in db whose Seed
+// is the zero value. Such blobs were most likely stored by a bug that failed
+// to key them.
+func CheckSeeds(db MetaDB) ([][]byte, error) {
+	var keys [][]byte
+	err := db.ForEachBlob(func(key []byte) error {
+		b, err := db.Blob(key)
+		if err != nil {
+			return err
+		} else if b.Seed == (renter.KeySeed{}) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	return keys, err
+}
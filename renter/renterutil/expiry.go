@@ -0,0 +1,46 @@
+package renterutil
+
+import (
+	"errors"
+	"fmt"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/renter/proto"
+)
+
+// ErrContractExpired is returned when a contract is too close to its end
+// height for the host to accept further revisions.
+var ErrContractExpired = errors.New("contract is too close to expiration to be revised")
+
+// RevisionSubmissionBuffer is the number of blocks before a contract's end
+// height at which hosts begin refusing to revise it, ensuring that the final
+// revision can be confirmed before the proof window opens. It matches the
+// buffer used by siad hosts.
+const RevisionSubmissionBuffer types.BlockHeight = 144
+
+// A HeightSource reports the current block height. Since it may be consulted
+// once per chunk, implementations should be cheap; SiadClient satisfies
+// HeightSource, but a long-running process may prefer to cache its result.
+type HeightSource interface {
+	ChainHeight() (types.BlockHeight, error)
+}
+
+// expiryChecker returns a function that reports whether the contract locked by
+// a Session can still be revised at the current height, as reported by hs. If
+// hs is nil, the returned function always returns nil.
+func expiryChecker(hs HeightSource) (func(*proto.Session) error, error) {
+	if hs == nil {
+		return func(*proto.Session) error { return nil }, nil
+	}
+	height, err := hs.ChainHeight()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine current height: %w", err)
+	}
+	return func(sess *proto.Session) error {
+		end := sess.Revision().EndHeight()
+		if height+RevisionSubmissionBuffer >= end {
+			return fmt.Errorf("%w (ends at height %v, current height is %v)", ErrContractExpired, end, height)
+		}
+		return nil
+	}, nil
+}
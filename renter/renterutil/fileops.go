@@ -417,11 +417,16 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 		go func() {
 			for req := range reqChan {
 				hostKey := f.m.Hosts[req.shardIndex]
+				if !fs.acquireRead(hostKey, req.block) {
+					respChan <- &HostError{hostKey, errHostAcquired}
+					continue
+				}
 				s, err := fs.hosts.tryAcquire(hostKey)
 				if err == errHostAcquired && req.block {
 					s, err = fs.hosts.acquire(hostKey)
 				}
 				if err != nil {
+					fs.releaseRead(hostKey)
 					respChan <- &HostError{hostKey, err}
 					continue
 				}
@@ -429,9 +434,11 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 				err = (&renter.ShardDownloader{
 					Downloader: s,
 					Key:        f.m.MasterKey,
+					Deriver:    fs.deriver,
 					Slices:     f.m.Shards[req.shardIndex],
 				}).CopySection(buf, offset, length)
 				fs.hosts.release(hostKey)
+				fs.releaseRead(hostKey)
 				if err != nil {
 					respChan <- &HostError{hostKey, err}
 					continue
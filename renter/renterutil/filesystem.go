@@ -17,6 +17,7 @@ import (
 
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
 )
 
 // assume metafiles have this extension
@@ -49,9 +50,75 @@ type PseudoFS struct {
 	hosts          *HostSet
 	sectors        map[hostdb.HostPublicKey]*renter.SectorBuilder
 	lastCommitTime time.Time
+	readP          int
+	readSems       map[hostdb.HostPublicKey]chan struct{}
+	deriver        renter.KeyDeriver
 	mu             sync.RWMutex
 }
 
+// DefaultReadParallelism is the default maximum number of concurrent shard
+// requests made to each host when reading.
+const DefaultReadParallelism = 3
+
+// SetReadParallelism sets the maximum number of concurrent shard requests
+// made to any single host when reading. The limit is shared by all reads of
+// all files, so that hosts are not overwhelmed (and do not disconnect) when
+// e.g. ReadAtP splits a large buffer into many concurrent reads. If n <= 0,
+// DefaultReadParallelism is used.
+func (fs *PseudoFS) SetReadParallelism(n int) {
+	if n <= 0 {
+		n = DefaultReadParallelism
+	}
+	fs.mu.Lock()
+	fs.readP = n
+	fs.resetReadSems()
+	fs.mu.Unlock()
+}
+
+func (fs *PseudoFS) resetReadSems() {
+	fs.readSems = make(map[hostdb.HostPublicKey]chan struct{})
+	for hostKey := range fs.hosts.sessions {
+		fs.readSems[hostKey] = make(chan struct{}, fs.readP)
+	}
+}
+
+// acquireRead acquires one of hostKey's read slots, blocking until one is
+// available if block is true. It reports whether a slot was acquired.
+func (fs *PseudoFS) acquireRead(hostKey hostdb.HostPublicKey, block bool) bool {
+	sem, ok := fs.readSems[hostKey]
+	if !ok {
+		return true // not in the HostSet; acquiring the session will fail
+	} else if block {
+		sem <- struct{}{}
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (fs *PseudoFS) releaseRead(hostKey hostdb.HostPublicKey) {
+	if sem, ok := fs.readSems[hostKey]; ok {
+		<-sem
+	}
+}
+
+// SetKeyDeriver sets the KeyDeriver used to encrypt and decrypt file data. If
+// kd is nil, renter.XChaCha20Deriver is used. Since data encrypted with one
+// KeyDeriver cannot be decrypted with another, the same KeyDeriver must be
+// used every time a given file is accessed.
+func (fs *PseudoFS) SetKeyDeriver(kd renter.KeyDeriver) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deriver = kd
+	for _, sb := range fs.sectors {
+		sb.Deriver = kd
+	}
+}
+
 func (fs *PseudoFS) path(name string) string {
 	return filepath.Join(fs.root, name)
 }
@@ -423,6 +490,111 @@ func (fs *PseudoFS) Rename(oldname, newname string) error {
 	return os.Rename(oldpath, newpath)
 }
 
+// Upload creates the named file with the specified redundancy and fills it
+// with the contents of r. Data is read and uploaded incrementally, so r may be
+// arbitrarily large; the metafile is updated each time a sector's worth of
+// data is uploaded. If Upload is interrupted, the file will contain a prefix
+// of r, and the upload can be continued with Resume.
+func (fs *PseudoFS) Upload(name string, r io.Reader, minShards int) error {
+	pf, err := fs.Create(name, minShards)
+	if err != nil {
+		return err
+	}
+	return fs.uploadFrom(pf, r)
+}
+
+// Resume continues an interrupted Upload of rs to the named file. rs is
+// seeked to the current size of the file, and the remainder is appended.
+func (fs *PseudoFS) Resume(name string, rs io.ReadSeeker) error {
+	pf, err := fs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0, 0)
+	if err != nil {
+		return err
+	}
+	stat, err := pf.Stat()
+	if err != nil {
+		pf.Close()
+		return err
+	}
+	if _, err := rs.Seek(stat.Size(), io.SeekStart); err != nil {
+		pf.Close()
+		return err
+	}
+	return fs.uploadFrom(pf, rs)
+}
+
+func (fs *PseudoFS) uploadFrom(pf *PseudoFile, r io.Reader) error {
+	buf := make([]byte, renterhost.SectorSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := pf.Write(buf[:n]); werr != nil {
+				pf.Close()
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			pf.Close()
+			return errors.Wrap(err, "could not read upload data")
+		}
+	}
+	if err := pf.Sync(); err != nil {
+		pf.Close()
+		return err
+	}
+	return pf.Close()
+}
+
+// Download writes the contents of the named file to w. The file is downloaded
+// one chunk at a time, fetching shards from multiple hosts in parallel; each
+// shard is verified against its Merkle proof before being written to w.
+func (fs *PseudoFS) Download(name string, w io.Writer) error {
+	pf, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	stat, err := pf.Stat()
+	if err != nil {
+		return err
+	}
+	index := stat.Sys().(renter.MetaIndex)
+	buf := make([]byte, index.MaxChunkSize())
+	for off := int64(0); off < stat.Size(); off += int64(len(buf)) {
+		if rem := stat.Size() - off; rem < int64(len(buf)) {
+			buf = buf[:rem]
+		}
+		if _, err := pf.ReadAtP(buf, off); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate changes the size of the named file. It does NOT delete any data on
+// hosts: the sectors beyond the new size are merely no longer referenced by the
+// file, and continue to be stored (and paid for) until they are deleted by
+// (PseudoFS).GC. Likewise, the final sector is retained in full, even if only
+// part of it is still referenced.
+func (fs *PseudoFS) Truncate(name string, size int64) error {
+	pf, err := fs.OpenFile(name, os.O_RDWR, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err := pf.Truncate(size); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Sync(); err != nil {
+		pf.Close()
+		return err
+	}
+	return pf.Close()
+}
+
 // Stat returns the FileInfo structure describing file.
 func (fs *PseudoFS) Stat(name string) (os.FileInfo, error) {
 	fs.mu.RLock()
@@ -482,14 +654,17 @@ func NewFileSystem(root string, hosts *HostSet) *PseudoFS {
 	for hostKey := range hosts.sessions {
 		sectors[hostKey] = new(renter.SectorBuilder)
 	}
-	return &PseudoFS{
+	fs := &PseudoFS{
 		root:           root,
 		files:          make(map[int]*openMetaFile),
 		dirs:           make(map[int]*os.File),
 		hosts:          hosts,
 		sectors:        sectors,
 		lastCommitTime: time.Now(),
+		readP:          DefaultReadParallelism,
 	}
+	fs.resetReadSems()
+	return fs
 }
 
 // A PseudoFile presents a file-like interface for a metafile stored on Sia
@@ -550,6 +725,11 @@ func (pf PseudoFile) Close() error {
 	// f is only truly deleted if it has no pending writes; otherwise, it sticks
 	// around until the next flush
 	if len(f.pendingWrites) == 0 {
+		// a file that was never written to (e.g. a newly-created empty file)
+		// will not be committed by a flush, so commit it now
+		if err := pf.fs.commitChanges(f); err != nil {
+			return err
+		}
 		delete(pf.fs.files, pf.fd)
 	}
 	return nil
@@ -610,6 +790,9 @@ func (pf PseudoFile) ReadAt(p []byte, off int64) (int, error) {
 // in ideal circumstances, ReadAtP will be 2x faster than the equivalent ReadAt
 // call.
 //
+// The number of concurrent requests made to each host is limited by
+// fs.SetReadParallelism.
+//
 // ReadAtP returns the first non-nil error returned by a ReadAt call. The
 // contents of p are undefined if an error other than io.EOF is returned.
 func (pf PseudoFile) ReadAtP(p []byte, off int64) (int, error) {
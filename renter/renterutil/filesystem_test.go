@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -271,6 +272,38 @@ func TestFileSystemBasic(t *testing.T) {
 	} else if n != 500 {
 		t.Fatalf("expected to read 500 bytes, got %v", n)
 	}
+	// ReadAtP should behave the same regardless of parallelism
+	fs.SetReadParallelism(1)
+	full := make([]byte, len(data))
+	if n, err := pf.ReadAtP(full, 0); err != nil {
+		t.Fatal(err)
+	} else if n != len(data) || !bytes.Equal(full, data) {
+		t.Fatal("data from ReadAtP does not match actual data")
+	}
+	// the limit should be shared by all reads: if every host's read slots
+	// are taken, ReadAtP should block until one is freed
+	for _, sem := range fs.readSems {
+		sem <- struct{}{}
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pf.ReadAtP(full, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatal("ReadAtP did not respect read limit:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, sem := range fs.readSems {
+		<-sem
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(full, data) {
+		t.Fatal("data from ReadAtP does not match actual data")
+	}
+	fs.SetReadParallelism(0)
 
 	// remove file
 	if err := pf.Close(); err != nil {
@@ -686,6 +719,88 @@ func TestFileSystemDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 	expectStoredSectors(0)
+
+	// Truncate does not delete any sectors, but a subsequent GC should delete
+	// the sectors that are no longer referenced
+	truncName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err = fs.Create(truncName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(renterhost.SectorSize*2 + 1024)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(3)
+	if err := fs.Truncate(truncName, 1024); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(3)
+	if err := fs.GC(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(1)
+	var buf bytes.Buffer
+	if err := fs.Download(truncName, &buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data[:1024]) {
+		t.Fatal("contents do not match truncated data")
+	}
+}
+
+func TestFileSystemEmptyFile(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+
+	// create an empty metafile and immediately close it
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file should exist, and reads should return EOF immediately
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := pf.Stat(); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Fatal("expected empty file, got size", info.Size())
+	}
+	if n, err := pf.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("expected (0, EOF) when Reading empty file, got", n, err)
+	}
+	if n, err := pf.ReadAt(make([]byte, 1), 0); n != 0 || err != io.EOF {
+		t.Fatal("expected (0, EOF) when ReadAt-ing empty file, got", n, err)
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fs.Download(metaName, &buf); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() != 0 {
+		t.Fatal("expected empty download, got", buf.Len(), "bytes")
+	}
+
+	// removing the file and running a GC should succeed
+	if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	} else if err := fs.GC(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func BenchmarkFileSystemWrite(b *testing.B) {
@@ -780,3 +895,51 @@ func BenchmarkFileSystemReadAtP(b *testing.B) {
 		}
 	}
 }
+
+func TestFileSystemUploadDownload(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	data := frand.Bytes(renterhost.SectorSize*2 + 10)
+
+	// upload part of the data, as if interrupted
+	half := len(data) / 2
+	if err := fs.Upload(metaName, bytes.NewReader(data[:half]), 2); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := fs.Stat(metaName); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(half) {
+		t.Fatalf("expected size %v, got %v", half, stat.Size())
+	}
+
+	// resume the upload
+	if err := fs.Resume(metaName, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fs.Download(metaName, &buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("contents do not match data")
+	}
+
+	// truncate and download again
+	if err := fs.Truncate(metaName, 1000); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := fs.Download(metaName, &buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data[:1000]) {
+		t.Fatal("contents do not match truncated data")
+	}
+	if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	}
+}
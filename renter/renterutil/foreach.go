@@ -0,0 +1,93 @@
+package renterutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ForEachBlobParallel calls fn with the key of every blob in db, using up to p
+// concurrent workers. If p <= 0, keys are processed one at a time. The keys are
+// collected before fn is first called, so fn may freely access db.
+//
+// If any call to fn fails, no further keys are dispatched and the Context
+// passed to in-flight calls is canceled. Once all in-flight calls have
+// returned, ForEachBlobParallel returns the error associated with the earliest
+// key (in iteration order) that failed, ignoring errors caused by the
+// cancellation itself.
+func ForEachBlobParallel(ctx context.Context, db MetaDB, p int, fn func(ctx context.Context, key []byte) error) error {
+	keys, err := blobKeys(db)
+	if err != nil {
+		return err
+	}
+	return forEachKey(ctx, keys, p, func(ctx context.Context, _ int, key []byte) error {
+		return fn(ctx, key)
+	})
+}
+
+// blobKeys returns the key of every blob in db.
+func blobKeys(db MetaDB) ([][]byte, error) {
+	var keys [][]byte
+	err := db.ForEachBlob(func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	return keys, err
+}
+
+// forEachKey calls fn on each of keys, along with its index, using up to p
+// concurrent workers. See ForEachBlobParallel.
+func forEachKey(ctx context.Context, keys [][]byte, p int, fn func(ctx context.Context, i int, key []byte) error) error {
+	if p <= 0 {
+		p = 1
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(keys))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < p; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := fn(ctx, i, keys[i]); err != nil {
+					errs[i] = err
+					cancel()
+				}
+			}
+		}()
+	}
+	var dispatched int
+dispatch:
+	for i := range keys {
+		select {
+		case indices <- i:
+			dispatched++
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		} else if first == nil {
+			first = err
+		}
+		if parent.Err() != nil || !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	if first != nil {
+		return first
+	} else if dispatched < len(keys) {
+		return parent.Err()
+	}
+	return nil
+}
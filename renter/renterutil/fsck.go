@@ -0,0 +1,198 @@
+package renterutil
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// A FsckChunkRef identifies a chunk referenced by a blob.
+type FsckChunkRef struct {
+	Key   []byte
+	Chunk uint64
+}
+
+// A FsckShardRef identifies a shard referenced by slot Index of a chunk.
+type FsckShardRef struct {
+	Chunk uint64
+	Index int
+	Shard uint64
+}
+
+// A FsckReport describes the inconsistencies found by Fsck.
+type FsckReport struct {
+	Blobs  int // blobs checked
+	Chunks int // distinct chunks referenced by blobs
+	Shards int // distinct shards referenced by those chunks
+
+	CorruptBlobs    [][]byte       // blobs that could not be decoded
+	DuplicateChunks [][]byte       // blobs that reference a chunk more than once
+	MissingChunks   []FsckChunkRef // chunks referenced by a blob that do not exist
+	InvalidChunks   []uint64       // chunks that can never be decoded
+	MissingShards   []FsckShardRef // shards referenced by a chunk that do not exist
+	CorruptShards   []FsckShardRef // shards that could not be decoded
+	RefMismatches   []uint64       // live shards whose sectors are reported by UnreferencedSectors
+
+	// Orphans are harmless, and are reported for informational purposes
+	// only: chunks are orphaned whenever a blob is replaced or deleted, and
+	// shards are orphaned when an upload is interrupted.
+	OrphanChunks []uint64 // chunks not referenced by any blob
+	OrphanShards []uint64 // shards not referenced by any chunk
+
+	Repaired int // inconsistencies fixed by Fsck
+}
+
+// Consistent reports whether r contains no inconsistencies. Orphans are not
+// considered inconsistencies.
+func (r FsckReport) Consistent() bool {
+	return len(r.CorruptBlobs) == 0 &&
+		len(r.DuplicateChunks) == 0 &&
+		len(r.MissingChunks) == 0 &&
+		len(r.InvalidChunks) == 0 &&
+		len(r.MissingShards) == 0 &&
+		len(r.CorruptShards) == 0 &&
+		len(r.RefMismatches) == 0
+}
+
+// Fsck checks every cross-reference in db: that each blob can be decoded and
+// references each of its chunks once, that each of those chunks exists and
+// can be decoded, that each of their shards exists and can be decoded, and
+// that none of their sectors are reported by UnreferencedSectors (which would
+// cause them to be garbage-collected). It also reports orphaned chunks and
+// shards. Every inconsistency is reported; Fsck only returns an error if db
+// itself returns one.
+//
+// If repair is true, Fsck also fixes the inconsistencies that can be fixed
+// without losing data: chunk slots that reference missing or corrupt shards
+// are cleared, so that the shards are treated as not uploaded (and can be
+// restored by a ChunkUpdater). Other inconsistencies are only reported.
+//
+// Orphans are found by assuming that chunk and shard IDs are allocated
+// sequentially, as they are by the MetaDBs in this package. Consequently,
+// Fsck should be run on a full db rather than a namespace of it, since the
+// chunks and shards of other namespaces would be reported as orphans.
+func Fsck(db MetaDB, repair bool) (FsckReport, error) {
+	var r FsckReport
+	chunks := make(map[uint64]DBChunk)
+	var order []uint64 // for deterministic reports
+	err := db.ForEachBlob(func(key []byte) error {
+		r.Blobs++
+		b, err := db.Blob(key)
+		if errors.Is(err, ErrCorrupt) {
+			r.CorruptBlobs = append(r.CorruptBlobs, append([]byte(nil), key...))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if checkChunkIDs(b.Chunks) != nil {
+			r.DuplicateChunks = append(r.DuplicateChunks, append([]byte(nil), key...))
+		}
+		for _, cid := range b.Chunks {
+			if _, ok := chunks[cid]; ok {
+				continue
+			}
+			c, err := db.Chunk(cid)
+			if err == ErrKeyNotFound {
+				r.MissingChunks = append(r.MissingChunks, FsckChunkRef{append([]byte(nil), key...), cid})
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%q: chunk %v: %w", key, cid, err)
+			}
+			chunks[cid] = c
+			order = append(order, cid)
+			if checkChunkParams(int(c.MinShards), len(c.Shards)) != nil {
+				r.InvalidChunks = append(r.InvalidChunks, cid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return FsckReport{}, err
+	}
+	r.Chunks = len(chunks)
+
+	// check the shards of live chunks, recording their sectors
+	live := make(map[hostdb.HostPublicKey]map[crypto.Hash][]uint64)
+	checked := make(map[uint64]struct{})
+	for _, cid := range order {
+		c := chunks[cid]
+		for i, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err == ErrKeyNotFound || errors.Is(err, ErrCorrupt) {
+				ref := FsckShardRef{cid, i, sid}
+				if err == ErrKeyNotFound {
+					r.MissingShards = append(r.MissingShards, ref)
+				} else {
+					r.CorruptShards = append(r.CorruptShards, ref)
+				}
+				if repair {
+					if err := db.SetChunkShard(cid, i, 0); err != nil {
+						return FsckReport{}, err
+					}
+					r.Repaired++
+				}
+				continue
+			} else if err != nil {
+				return FsckReport{}, err
+			}
+			if _, ok := checked[sid]; ok {
+				continue
+			}
+			checked[sid] = struct{}{}
+			if live[s.HostKey] == nil {
+				live[s.HostKey] = make(map[crypto.Hash][]uint64)
+			}
+			live[s.HostKey][s.SectorRoot] = append(live[s.HostKey][s.SectorRoot], sid)
+		}
+	}
+	r.Shards = len(checked)
+
+	unref, err := db.UnreferencedSectors()
+	if err != nil {
+		return FsckReport{}, err
+	}
+	for host, roots := range unref {
+		for _, root := range roots {
+			r.RefMismatches = append(r.RefMismatches, live[host][root]...)
+			delete(live[host], root) // avoid reporting shards twice
+		}
+	}
+	sort.Slice(r.RefMismatches, func(i, j int) bool {
+		return r.RefMismatches[i] < r.RefMismatches[j]
+	})
+
+	// find orphans
+	referenced := make(map[uint64]struct{})
+	for id := uint64(1); ; id++ {
+		c, err := db.Chunk(id)
+		if err == ErrKeyNotFound {
+			break
+		} else if err != nil {
+			return FsckReport{}, fmt.Errorf("chunk %v: %w", id, err)
+		}
+		if _, ok := chunks[id]; !ok {
+			r.OrphanChunks = append(r.OrphanChunks, id)
+		}
+		for _, sid := range c.Shards {
+			referenced[sid] = struct{}{}
+		}
+	}
+	for id := uint64(1); ; id++ {
+		_, err := db.Shard(id)
+		if err == ErrKeyNotFound {
+			break
+		} else if err != nil && !errors.Is(err, ErrCorrupt) {
+			return FsckReport{}, err
+		}
+		if _, ok := referenced[id]; !ok {
+			r.OrphanShards = append(r.OrphanShards, id)
+		}
+	}
+	return r, nil
+}
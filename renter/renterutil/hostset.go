@@ -91,6 +91,11 @@ type lockedHost struct {
 	mu        tryLock
 }
 
+// hostIdleTimeout is how long a host may go unused before the HostSet checks
+// that its connection is still open. It is a variable so that tests can
+// shorten it.
+var hostIdleTimeout = 2 * time.Minute
+
 // A HostSet is a collection of renter-host protocol sessions.
 type HostSet struct {
 	sessions      map[hostdb.HostPublicKey]*lockedHost
@@ -98,6 +103,12 @@ type HostSet struct {
 	currentHeight types.BlockHeight
 	stats         proto.RPCStatsRecorder
 	lockTimeout   time.Duration
+	latency       time.Duration
+	readDeadline  time.Duration
+	writeDeadline time.Duration
+	settingsTTL   time.Duration
+	retry         RetryPolicy
+	log           Logger
 }
 
 // HasHost returns true if the specified host is in the set.
@@ -128,7 +139,7 @@ func (set *HostSet) acquire(host hostdb.HostPublicKey) (*proto.Session, error) {
 		return nil, errNoHost
 	}
 	ls.mu.Lock()
-	if err := ls.reconnect(); err != nil {
+	if err := set.connect(host, ls); err != nil {
 		ls.mu.Unlock()
 		return nil, err
 	}
@@ -143,13 +154,31 @@ func (set *HostSet) tryAcquire(host hostdb.HostPublicKey) (*proto.Session, error
 	if !ls.mu.TryLock() {
 		return nil, errHostAcquired
 	}
-	if err := ls.reconnect(); err != nil {
+	if err := set.connect(host, ls); err != nil {
 		ls.mu.Unlock()
 		return nil, err
 	}
 	return ls.s, nil
 }
 
+// connect ensures that lh has an open session, retrying according to the
+// set's RetryPolicy. lh must be locked.
+func (set *HostSet) connect(host hostdb.HostPublicKey, lh *lockedHost) error {
+	for attempt := 1; ; attempt++ {
+		err := lh.reconnect()
+		if err == nil {
+			return nil
+		}
+		retry, backoff := set.retry.ShouldRetry(attempt, err)
+		if !retry {
+			logf(set.log, "could not connect to %v: %v", host.ShortKey(), err)
+			return err
+		}
+		logf(set.log, "could not connect to %v (attempt %v), retrying in %v: %v", host.ShortKey(), attempt, backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
 func (set *HostSet) release(host hostdb.HostPublicKey) {
 	lh := set.sessions[host]
 	if lh.s.IsClosed() {
@@ -166,21 +195,78 @@ func (set *HostSet) SetRPCStatsRecorder(r proto.RPCStatsRecorder) { set.stats =
 // by the HostSet.
 func (set *HostSet) SetLockTimeout(timeout time.Duration) { set.lockTimeout = timeout }
 
+// SetLogger sets the Logger used to report connection failures. If l is nil,
+// nothing is logged.
+func (set *HostSet) SetLogger(l Logger) { set.log = l }
+
+// SetRetryPolicy sets the RetryPolicy used when connecting to hosts, on behalf
+// of both uploads and downloads. If p is nil, NoRetry is used, which is the
+// default.
+func (set *HostSet) SetRetryPolicy(p RetryPolicy) {
+	if p == nil {
+		p = NoRetry
+	}
+	set.retry = p
+}
+
+// SetDeadlines sets the deadlines used for all Sessions initiated by the
+// HostSet. read and write are the per-byte read and write deadlines, and
+// latency is the fixed deadline added to each RPC; see
+// (*proto.Session).SetReadDeadline, (*proto.Session).SetWriteDeadline, and
+// (*proto.Session).SetLatency. A value of 0 leaves the corresponding Session
+// default unchanged. Sessions that are already connected use the new deadlines
+// the next time they are acquired.
+func (set *HostSet) SetDeadlines(read, write, latency time.Duration) {
+	set.readDeadline = read
+	set.writeDeadline = write
+	set.latency = latency
+}
+
+// applyDeadlines sets the deadlines of s to those specified by SetDeadlines.
+func (set *HostSet) applyDeadlines(s *proto.Session) {
+	if set.readDeadline != 0 {
+		s.SetReadDeadline(set.readDeadline)
+	}
+	if set.writeDeadline != 0 {
+		s.SetWriteDeadline(set.writeDeadline)
+	}
+	if set.latency != 0 {
+		s.SetLatency(set.latency)
+	}
+}
+
+// SetSettingsTTL sets how long a host's settings are used before being
+// re-fetched. Once a host's settings are older than ttl, they are re-fetched
+// the next time the host is acquired. Since Sessions price RPCs using their
+// cached settings, a shorter TTL reduces the risk of RPCs being rejected by a
+// host whose prices have changed, at the cost of additional roundtrips. The
+// TTL is a client-side heuristic: hosts do not report how long their settings
+// remain valid.
+//
+// Regardless of ttl, settings are also re-fetched (as a "ping") when a host is
+// acquired after being idle for two minutes, to check that the connection is
+// still open. If ttl is 0 (the default), this is the only time they are
+// re-fetched.
+func (set *HostSet) SetSettingsTTL(ttl time.Duration) { set.settingsTTL = ttl }
+
 // AddHost adds a host to the set for later use.
 func (set *HostSet) AddHost(c renter.Contract) {
 	lh := new(lockedHost)
 	// lazy connection function
 	var lastSeen time.Time
+	var fetched time.Time // when the host's settings were last fetched
 	lh.reconnect = func() error {
 		if lh.s != nil && !lh.s.IsClosed() {
-			// if it hasn't been long since the last reconnect, assume the
-			// connection is still open
-			if time.Since(lastSeen) < 2*time.Minute {
+			set.applyDeadlines(lh.s)
+			// if it hasn't been long since the last reconnect, and the
+			// settings are still fresh, assume the connection is still open
+			stale := set.settingsTTL > 0 && time.Since(fetched) >= set.settingsTTL
+			if time.Since(lastSeen) < hostIdleTimeout && !stale {
 				lastSeen = time.Now()
 				return nil
 			}
 			// otherwise, the connection *might* still be open; test by sending
-			// a "ping" RPC
+			// a "ping" RPC, which also refreshes the settings
 			//
 			// NOTE: this is somewhat inefficient; it means we might incur an
 			// extra roundtrip when we don't need to. Better would be for the
@@ -189,6 +275,7 @@ func (set *HostSet) AddHost(c renter.Contract) {
 			// has actually disconnected. But that feels too burdensome.
 			if _, err := lh.s.Settings(); err == nil {
 				lastSeen = time.Now()
+				fetched = lastSeen
 				return nil
 			}
 			// connection timed out, or some other error occurred; close our
@@ -205,6 +292,7 @@ func (set *HostSet) AddHost(c renter.Contract) {
 		if err != nil {
 			return err
 		}
+		set.applyDeadlines(lh.s)
 		if err := lh.s.Lock(c.ID, c.RenterKey, set.lockTimeout); err != nil {
 			lh.s.Close()
 			return err
@@ -214,6 +302,7 @@ func (set *HostSet) AddHost(c renter.Contract) {
 		}
 		lh.s.SetRPCStatsRecorder(set.stats)
 		lastSeen = time.Now()
+		fetched = lastSeen
 		return nil
 	}
 	set.sessions[c.HostKey] = lh
@@ -227,5 +316,6 @@ func NewHostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) *Ho
 		currentHeight: currentHeight,
 		sessions:      make(map[hostdb.HostPublicKey]*lockedHost),
 		lockTimeout:   10 * time.Second,
+		retry:         NoRetry,
 	}
 }
@@ -0,0 +1,158 @@
+package renterutil
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidRange = errors.New("invalid range")
+
+// parseRange parses the value of a Range header for a resource of the given
+// size, returning the offset and length of the requested range. Only a single
+// byte range is supported; requests for multiple ranges are rejected.
+func parseRange(s string, size int64) (off, n int64, err error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, errInvalidRange
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(s, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, errors.New("multiple ranges are not supported")
+	}
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return 0, 0, errInvalidRange
+	}
+	startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if startStr == "" {
+		// suffix range: the final n bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, errInvalidRange
+		} else if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errInvalidRange
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		} else if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// ServeHTTP implements http.Handler, serving the value associated with the
+// key named by the request path (without its leading slash). GET and HEAD
+// requests are supported.
+//
+// Single-range requests are honored, so interrupted downloads can be resumed;
+// only the chunks overlapping the requested range are downloaded. Requests for
+// multiple ranges, or for ranges that cannot be satisfied, are rejected with
+// 416. If the request carries an If-Range date that does not match the
+// value's modification time, the entire value is served instead.
+//
+// If the request has an archive=tar query parameter, the path is instead
+// treated as a prefix, and a tar archive of every value under it is streamed
+// as an attachment; see GetArchive.
+func (kv PseudoKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if format, ok := req.URL.Query()["archive"]; ok {
+		if len(format) != 1 || format[0] != "tar" {
+			http.Error(w, "unsupported archive format", http.StatusBadRequest)
+			return
+		}
+		kv.serveArchive(w, req)
+		return
+	}
+	key := []byte(strings.TrimPrefix(req.URL.Path, "/"))
+	b, err := kv.DB.Blob(key)
+	if err == ErrKeyNotFound || err == ErrInvalidKey {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size, err := blobSize(kv.DB, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	var lastModified string
+	if !b.ModTime.IsZero() {
+		lastModified = b.ModTime.UTC().Format(http.TimeFormat)
+		w.Header().Set("Last-Modified", lastModified)
+	}
+
+	off, n, status := int64(0), size, http.StatusOK
+	if rh := req.Header.Get("Range"); rh != "" && size > 0 {
+		if ir := req.Header.Get("If-Range"); ir == "" || (lastModified != "" && sameHTTPTime(ir, b.ModTime)) {
+			off, n, err = parseRange(rh, size)
+			if err != nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size))
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead || n == 0 {
+		return
+	}
+	// once the header has been written, there's no way to report an error
+	// (e.g. a client disconnect) other than terminating the response
+	if err := kv.GetRange(key, w, off, n); err != nil {
+		logf(kv.Log, "%q: could not serve range [%v, %v): %v", key, off, off+n, err)
+	}
+}
+
+// serveArchive serves a tar archive of the values whose keys begin with the
+// request path (without its leading slash).
+func (kv PseudoKV) serveArchive(w http.ResponseWriter, req *http.Request) {
+	prefix := strings.TrimPrefix(req.URL.Path, "/")
+	name := path.Base(strings.TrimSuffix(prefix, "/"))
+	if name == "." || name == "/" {
+		name = "archive"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".tar"}))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+	// as in ServeHTTP, errors can only be reported by terminating the response
+	if err := kv.GetArchive([]byte(prefix), w); err != nil {
+		logf(kv.Log, "%q: could not serve archive: %v", prefix, err)
+	}
+}
+
+// sameHTTPTime reports whether the HTTP date s matches t, at the one-second
+// resolution of HTTP dates.
+func sameHTTPTime(s string, t time.Time) bool {
+	ht, err := http.ParseTime(s)
+	return err == nil && ht.Equal(t.UTC().Truncate(time.Second))
+}
@@ -0,0 +1,147 @@
+package renterutil
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// ForeignMetadata is the JSON representation of blob metadata exported by other
+// renter tools. Its shape is:
+//
+//    {
+//      "blobs": [{
+//        "key": "foo",
+//        "seed": "<hex-encoded 32-byte seed>",
+//        "chunks": [{
+//          "minShards": 2,
+//          "len": 8192,
+//          "shards": [{
+//            "hostKey": "ed25519:<hex>",
+//            "sectorRoot": "<hex-encoded 32-byte root>",
+//            "offset": 0,
+//            "nonce": "<hex-encoded 24-byte nonce>"
+//          }]
+//        }]
+//      }]
+//    }
+type ForeignMetadata struct {
+	Blobs []ForeignBlob `json:"blobs"`
+}
+
+// A ForeignBlob is the JSON representation of a DBBlob.
+type ForeignBlob struct {
+	Key    string         `json:"key"`
+	Seed   renter.KeySeed `json:"seed"`
+	Chunks []ForeignChunk `json:"chunks"`
+}
+
+// A ForeignChunk is the JSON representation of a DBChunk.
+type ForeignChunk struct {
+	MinShards uint8          `json:"minShards"`
+	Len       uint64         `json:"len"`
+	Shards    []ForeignShard `json:"shards"`
+}
+
+// A ForeignShard is the JSON representation of a DBShard. Its fields are left
+// as strings so that a ShardMapper can handle any format differences.
+type ForeignShard struct {
+	HostKey    string `json:"hostKey"`
+	SectorRoot string `json:"sectorRoot"`
+	Offset     uint32 `json:"offset"`
+	Nonce      string `json:"nonce"`
+}
+
+// A ShardMapper translates a ForeignShard into a DBShard.
+type ShardMapper func(ForeignShard) (DBShard, error)
+
+// DefaultShardMapper is a ShardMapper for foreign shards whose fields are hex-
+// encoded. Host keys lacking a specifier are assumed to be Ed25519 keys.
+func DefaultShardMapper(fs ForeignShard) (DBShard, error) {
+	s := DBShard{
+		HostKey: hostdb.HostPublicKey(fs.HostKey),
+		Offset:  fs.Offset,
+	}
+	if !strings.Contains(fs.HostKey, ":") {
+		s.HostKey = hostdb.HostPublicKey("ed25519:" + fs.HostKey)
+	}
+	if len(s.HostKey.Ed25519()) != 32 {
+		return DBShard{}, fmt.Errorf("invalid host key %q", fs.HostKey)
+	}
+	if err := s.SectorRoot.LoadString(fs.SectorRoot); err != nil {
+		return DBShard{}, fmt.Errorf("invalid sector root %q: %w", fs.SectorRoot, err)
+	}
+	if len(fs.Nonce) != hex.EncodedLen(len(s.Nonce)) {
+		return DBShard{}, fmt.Errorf("invalid nonce %q: wrong length", fs.Nonce)
+	} else if _, err := hex.Decode(s.Nonce[:], []byte(fs.Nonce)); err != nil {
+		return DBShard{}, fmt.Errorf("invalid nonce %q: %w", fs.Nonce, err)
+	}
+	return s, nil
+}
+
+// ImportForeignMetadata reads ForeignMetadata from r and adds its blobs,
+// chunks, and shards to db. If mapping is nil, DefaultShardMapper is used.
+// Existing blobs with the same key are replaced, releasing their chunks.
+//
+// Each blob is validated, and all of its shards are mapped, before anything is
+// added to db, so invalid metadata does not leave behind partially-imported
+// blobs. However, blobs preceding an invalid blob are still imported, and if
+// db itself returns an error partway through a blob, the chunks and shards
+// already added for that blob are orphaned; use Fsck to find them.
+func ImportForeignMetadata(db MetaDB, r io.Reader, mapping ShardMapper) error {
+	if mapping == nil {
+		mapping = DefaultShardMapper
+	}
+	var fm ForeignMetadata
+	if err := json.NewDecoder(r).Decode(&fm); err != nil {
+		return fmt.Errorf("couldn't decode metadata: %w", err)
+	}
+	for _, fb := range fm.Blobs {
+		if fb.Key == "" {
+			return errors.New("blob has empty key")
+		}
+		b := DBBlob{
+			Key:  []byte(fb.Key),
+			Seed: fb.Seed,
+		}
+		shards := make([][]DBShard, len(fb.Chunks))
+		for i, fc := range fb.Chunks {
+			if fc.MinShards == 0 || int(fc.MinShards) > len(fc.Shards) {
+				return fmt.Errorf("blob %q: invalid chunk redundancy (%v-of-%v)", fb.Key, fc.MinShards, len(fc.Shards))
+			}
+			shards[i] = make([]DBShard, len(fc.Shards))
+			for j, fs := range fc.Shards {
+				s, err := mapping(fs)
+				if err != nil {
+					return fmt.Errorf("blob %q: %w", fb.Key, err)
+				}
+				shards[i][j] = s
+			}
+		}
+		for ci, fc := range fb.Chunks {
+			c, err := db.AddChunk(int(fc.MinShards), len(fc.Shards), fc.Len)
+			if err != nil {
+				return err
+			}
+			for i, s := range shards[ci] {
+				sid, err := db.AddShard(s)
+				if err != nil {
+					return err
+				} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+					return err
+				}
+			}
+			b.Chunks = append(b.Chunks, c.ID)
+		}
+		if err := db.ReplaceBlob(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package renterutil
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+)
+
+func TestImportForeignMetadata(t *testing.T) {
+	hostKey := hex.EncodeToString(frand.Bytes(32))
+	root := crypto.Hash(frand.Entropy256())
+	nonce := frand.Entropy192()
+	js := fmt.Sprintf(`{"blobs": [{
+		"key": "foo",
+		"seed": "%x",
+		"chunks": [{
+			"minShards": 1,
+			"len": 100,
+			"shards": [{"hostKey": %q, "sectorRoot": %q, "offset": 0, "nonce": "%x"}]
+		}]
+	}]}`, frand.Bytes(32), hostKey, root, nonce[:])
+
+	db := NewEphemeralMetaDB()
+	if err := ImportForeignMetadata(db, strings.NewReader(js), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(b.Chunks) != 1 {
+		t.Fatal("expected 1 chunk, got", len(b.Chunks))
+	}
+	c, err := db.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if c.Len != 100 || c.MinShards != 1 || len(c.Shards) != 1 {
+		t.Fatal("chunk mismatch:", c)
+	}
+	s, err := db.Shard(c.Shards[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if s.HostKey.Key() != hostKey || s.SectorRoot != root || s.Nonce != nonce {
+		t.Fatal("shard mismatch:", s)
+	}
+
+	// invalid redundancy should be rejected
+	bad := strings.Replace(js, `"minShards": 1`, `"minShards": 2`, 1)
+	if err := ImportForeignMetadata(db, strings.NewReader(bad), nil); err == nil {
+		t.Fatal("expected invalid redundancy to be rejected")
+	}
+
+	// oversized nonces should be rejected without adding anything to db
+	bad = strings.Replace(js, fmt.Sprintf("%x", nonce[:]), fmt.Sprintf("%x", frand.Bytes(32)), 1)
+	if err := ImportForeignMetadata(db, strings.NewReader(bad), nil); err == nil {
+		t.Fatal("expected oversized nonce to be rejected")
+	} else if _, err := db.Chunk(c.ID + 1); err != ErrKeyNotFound {
+		t.Fatal("invalid blob was partially imported")
+	}
+
+	// re-importing should replace the blob, releasing its old shards
+	if err := ImportForeignMetadata(db, strings.NewReader(js), nil); err != nil {
+		t.Fatal(err)
+	}
+	if unref, err := db.UnreferencedSectors(); err != nil {
+		t.Fatal(err)
+	} else if roots := unref[s.HostKey]; len(roots) != 1 || roots[0] != root {
+		t.Fatal("old shard was not released:", unref)
+	}
+}
@@ -0,0 +1,157 @@
+package renterutil
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// An InventoryRecord summarizes a single blob, as exported by ExportInventory.
+type InventoryRecord struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	Chunks  int       `json:"chunks"`
+	Shards  int       `json:"shards"`
+	Hosts   int       `json:"hosts"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// inventoryRecord computes the InventoryRecord of b. Shards that have not been
+// uploaded are not counted.
+func inventoryRecord(db MetaDB, b DBBlob) (InventoryRecord, error) {
+	r := InventoryRecord{
+		Key:     string(b.Key),
+		Chunks:  len(b.Chunks),
+		ModTime: b.ModTime,
+	}
+	hosts := make(map[hostdb.HostPublicKey]struct{})
+	for _, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return InventoryRecord{}, err
+		}
+		r.Size += int64(c.Len)
+		for _, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err != nil {
+				return InventoryRecord{}, err
+			}
+			r.Shards++
+			hosts[s.HostKey] = struct{}{}
+		}
+	}
+	r.Hosts = len(hosts)
+	return r, nil
+}
+
+// ExportInventory writes a summary of every blob in db to w, one record per
+// line, in key order. format must be "jsonl" (one JSON-encoded InventoryRecord
+// per line) or "csv" (with a header row). Records are written as they are
+// computed, so memory usage does not grow with the size of db.
+func ExportInventory(db MetaDB, w io.Writer, format string) error {
+	var write func(InventoryRecord) error
+	var flush func() error
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		write = func(r InventoryRecord) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "size", "chunks", "shards", "hosts", "modTime"}); err != nil {
+			return err
+		}
+		write = func(r InventoryRecord) error {
+			var modTime string
+			if !r.ModTime.IsZero() {
+				modTime = r.ModTime.UTC().Format(time.RFC3339Nano)
+			}
+			return cw.Write([]string{
+				r.Key,
+				strconv.FormatInt(r.Size, 10),
+				strconv.Itoa(r.Chunks),
+				strconv.Itoa(r.Shards),
+				strconv.Itoa(r.Hosts),
+				modTime,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("unknown inventory format %q", format)
+	}
+
+	err := db.ForEachBlob(func(key []byte) error {
+		b, err := db.Blob(key)
+		if err != nil {
+			return err
+		}
+		r, err := inventoryRecord(db, b)
+		if err != nil {
+			return fmt.Errorf("%q: %w", key, err)
+		}
+		return write(r)
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// StorageByHost returns the number of distinct sectors stored on each host by
+// the blobs in db. Since hosts charge for storage by the sector, multiplying
+// by renterhost.SectorSize yields the amount of storage being paid for.
+// Sectors that are not referenced by any blob are not counted.
+func StorageByHost(db MetaDB) (map[hostdb.HostPublicKey]int, error) {
+	sectors := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	seen := make(map[uint64]struct{})
+	err := db.ForEachBlob(func(key []byte) error {
+		b, err := db.Blob(key)
+		if err != nil {
+			return err
+		}
+		for _, cid := range b.Chunks {
+			if _, ok := seen[cid]; ok {
+				continue
+			}
+			seen[cid] = struct{}{}
+			c, err := db.Chunk(cid)
+			if err != nil {
+				return fmt.Errorf("%q: %w", key, err)
+			}
+			shards, err := db.Shards(c.Shards)
+			if err != nil {
+				return fmt.Errorf("%q: %w", key, err)
+			}
+			for i, s := range shards {
+				if c.Shards[i] == 0 {
+					continue
+				}
+				if sectors[s.HostKey] == nil {
+					sectors[s.HostKey] = make(map[crypto.Hash]struct{})
+				}
+				sectors[s.HostKey][s.SectorRoot] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[hostdb.HostPublicKey]int, len(sectors))
+	for host, roots := range sectors {
+		counts[host] = len(roots)
+	}
+	return counts, nil
+}
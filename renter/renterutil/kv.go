@@ -3,6 +3,7 @@ package renterutil
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 
 	"lukechampine.com/frand"
@@ -19,14 +20,19 @@ type PseudoKV struct {
 	Uploader   ChunkUploader
 	Downloader ChunkDownloader
 	Deleter    SectorDeleter
+	Watcher    *UploadWatcher // optional; enables GetLive
+	Log        Logger         // optional; if nil, nothing is logged
 }
 
 // Put uploads r to hosts and associates it with the specified key. Any existing
 // data associated with the key will be overwritten.
 func (kv PseudoKV) Put(ctx context.Context, key []byte, r io.Reader) error {
+	if kv.Watcher != nil {
+		defer kv.Watcher.begin(key)()
+	}
 	b := DBBlob{Key: key}
 	frand.Read(b.Seed[:])
-	if err := kv.DB.AddBlob(b); err != nil {
+	if err := kv.DB.ReplaceBlob(b); err != nil {
 		return err
 	}
 	bu := ParallelBlobUploader{
@@ -38,6 +44,26 @@ func (kv PseudoKV) Put(ctx context.Context, key []byte, r io.Reader) error {
 	return bu.UploadBlob(ctx, kv.DB, b, r)
 }
 
+// PutWithResult uploads r to hosts and associates it with the specified key,
+// like Put. It also reports the redundancy achieved for each chunk and any
+// hosts that failed during the upload, allowing the caller to decide whether to
+// repair the value immediately. The result is populated even if an error
+// occurs.
+func (kv PseudoKV) PutWithResult(ctx context.Context, key []byte, r io.Reader) (UploadResult, error) {
+	var ur uploadRecorder
+	err := kv.Put(withUploadRecorder(ctx, &ur), key, r)
+	res := UploadResult{FailedHosts: ur.errs}
+	if b, dbErr := kv.DB.Blob(key); dbErr == nil {
+		res.Chunks, dbErr = BlobRedundancy(kv.DB, b)
+		if err == nil {
+			err = dbErr
+		}
+	} else if err == nil {
+		err = dbErr
+	}
+	return res, err
+}
+
 // PutBytes uploads val to hosts and associates it with the specified key.
 func (kv PseudoKV) PutBytes(ctx context.Context, key []byte, val []byte) error {
 	return kv.Put(ctx, key, bytes.NewReader(val))
@@ -45,6 +71,9 @@ func (kv PseudoKV) PutBytes(ctx context.Context, key []byte, val []byte) error {
 
 // Resume resumes uploading the value associated with key.
 func (kv PseudoKV) Resume(ctx context.Context, key []byte, rs io.ReadSeeker) error {
+	if kv.Watcher != nil {
+		defer kv.Watcher.begin(key)()
+	}
 	b, err := kv.DB.Blob(key)
 	if err != nil {
 		return err
@@ -63,6 +92,7 @@ func (kv PseudoKV) Resume(ctx context.Context, key []byte, rs io.ReadSeeker) err
 
 			if ssid == 0 {
 				// TODO: only attempt repair if erasure params match
+				logf(kv.Log, "%q: repairing partially-uploaded chunk %v", key, c.ID)
 				if _, err := rs.Seek(int64(offset), io.SeekStart); err != nil {
 					return err
 				} else if err := kv.repairChunk(ctx, b, c, rs); err != nil {
@@ -137,6 +167,49 @@ func (kv *PseudoKV) Migrate(ctx context.Context, key []byte, hosts *HostSet) err
 	})
 }
 
+// Truncate shrinks the value associated with key to size bytes. Chunks that
+// lie entirely beyond size are dropped, releasing their shards so that they can
+// be deleted by GC. If size does not fall on a chunk boundary, the final chunk
+// is replaced with a new, shorter chunk.
+func (kv PseudoKV) Truncate(ctx context.Context, key []byte, size int64) error {
+	b, err := kv.DB.Blob(key)
+	if err != nil {
+		return err
+	}
+	var off int64
+	var chunks []uint64
+	var newChunk uint64 // the shorter final chunk, if any
+	for _, cid := range b.Chunks {
+		c, err := kv.DB.Chunk(cid)
+		if err != nil {
+			return err
+		}
+		if off+int64(c.Len) <= size {
+			chunks = append(chunks, cid)
+		} else if off < size {
+			// re-upload the part of the chunk that precedes size
+			nc, err := kv.truncateChunk(ctx, b, c, size-off)
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, nc.ID)
+			newChunk = nc.ID
+		}
+		off += int64(c.Len)
+	}
+	if size > off {
+		return errors.New("cannot extend value with Truncate")
+	}
+	b.Chunks = chunks
+	if err := kv.DB.ReplaceBlob(b); err != nil {
+		if newChunk != 0 {
+			_ = discardChunks(kv.DB, []uint64{newChunk})
+		}
+		return err
+	}
+	return nil
+}
+
 // Delete deletes the value associated with key.
 //
 // The actual data stored on hosts is not deleted. To delete host data, use
@@ -148,11 +221,31 @@ func (kv PseudoKV) Delete(key []byte) error {
 // GC deletes from hosts all sectors that are not currently associated with any
 // value.
 func (kv PseudoKV) GC(ctx context.Context) error {
+	_, err := kv.CollectGarbage(ctx, false)
+	return err
+}
+
+// CollectGarbage is like GC, but also returns the number of unreferenced
+// sectors on each host. If dryRun is true, the sectors are counted, but not
+// deleted.
+func (kv PseudoKV) CollectGarbage(ctx context.Context, dryRun bool) (map[hostdb.HostPublicKey]int, error) {
 	sectors, err := kv.DB.UnreferencedSectors()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return kv.Deleter.DeleteSectors(ctx, kv.DB, sectors)
+	freed := make(map[hostdb.HostPublicKey]int, len(sectors))
+	for hostKey, roots := range sectors {
+		freed[hostKey] = len(roots)
+		logf(kv.Log, "GC: %v has %v unreferenced sectors", hostKey.ShortKey(), len(roots))
+	}
+	if dryRun {
+		return freed, nil
+	}
+	if err := kv.Deleter.DeleteSectors(ctx, kv.DB, sectors); err != nil {
+		logf(kv.Log, "GC: could not delete sectors: %v", err)
+		return freed, err
+	}
+	return freed, nil
 }
 
 // Close implements io.Closer.
@@ -176,3 +269,30 @@ func (kv PseudoKV) repairChunk(ctx context.Context, b DBBlob, c DBChunk, r io.Re
 	}
 	return nil
 }
+
+func (kv PseudoKV) truncateChunk(ctx context.Context, b DBBlob, c DBChunk, n int64) (DBChunk, error) {
+	shards, err := kv.Downloader.DownloadChunk(kv.DB, c, b.Seed, 0, n)
+	if err != nil {
+		return DBChunk{}, err
+	}
+	var buf bytes.Buffer
+	err = renter.NewRSCode(int(c.MinShards), len(c.Shards)).Recover(&buf, shards, 0, int(n))
+	releaseShards(shards)
+	if err != nil {
+		return DBChunk{}, err
+	}
+	nc, err := kv.DB.AddChunk(int(c.MinShards), len(c.Shards), uint64(n))
+	if err != nil {
+		return DBChunk{}, err
+	}
+	shards = make([][]byte, len(c.Shards))
+	for i := range shards {
+		shards[i] = make([]byte, renterhost.SectorSize)
+	}
+	renter.NewRSCode(int(c.MinShards), len(c.Shards)).Encode(buf.Bytes(), shards)
+	if err := kv.Uploader.UploadChunk(ctx, kv.DB, nc, b.Seed, shards); err != nil {
+		_ = discardChunks(kv.DB, []uint64{nc.ID})
+		return DBChunk{}, err
+	}
+	return nc, nil
+}
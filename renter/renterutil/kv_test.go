@@ -1,19 +1,37 @@
 package renterutil
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"testing/iotest"
+	"time"
 
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/ghost"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
@@ -82,6 +100,22 @@ func TestKVPutGet(t *testing.T) {
 	if string(data) != "bar" {
 		t.Fatalf("bad data: %q", data)
 	}
+	// shards should record the contract used to upload them
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := kv.DB.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sid := range c.Shards {
+		if s, err := kv.DB.Shard(sid); err != nil {
+			t.Fatal(err)
+		} else if s.ContractID == (types.FileContractID{}) {
+			t.Fatal("shard is missing ContractID")
+		}
+	}
 
 	// large value, using streaming API
 	bigdata := frand.Bytes(renterhost.SectorSize * 4)
@@ -265,6 +299,175 @@ func TestKVResumeHost(t *testing.T) {
 	}
 }
 
+func TestKVPutWithResult(t *testing.T) {
+	hosts := make([]*ghost.Host, 3)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	for i := range hosts {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hosts[i] = h
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	kv := PseudoKV{
+		DB:         NewEphemeralMetaDB(),
+		M:          2,
+		N:          3,
+		P:          1,
+		Uploader:   MinimumChunkUploader{Hosts: hs},
+		Downloader: SerialChunkDownloader{Hosts: hs},
+	}
+
+	// a MinimumChunkUploader stores only MinShards shards
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 4)
+	res, err := kv.PutWithResult(ctx, []byte("foo"), bytes.NewReader(bigdata))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res.Chunks) != 2 || !res.Degraded() || len(res.FailedHosts) != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	for _, cr := range res.Chunks {
+		if cr.Requested != 3 || cr.Achieved != 2 {
+			t.Fatalf("expected 2 of 3 shards, got %v of %v", cr.Achieved, cr.Requested)
+		}
+	}
+
+	// with one host offline, a ParallelChunkUploader should report the host
+	hosts[0].Close()
+	if s, err := hs.acquire(hosts[0].PublicKey()); err == nil {
+		s.Close()
+		hs.release(hosts[0].PublicKey())
+	}
+	kv.Uploader = ParallelChunkUploader{Hosts: hs}
+	res, err = kv.PutWithResult(ctx, []byte("bar"), bytes.NewReader(bigdata))
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	} else if len(res.FailedHosts) == 0 || res.FailedHosts[0].HostKey != hosts[0].PublicKey() {
+		t.Fatalf("expected failure of %v, got %v", hosts[0].PublicKey().ShortKey(), res.FailedHosts)
+	} else if len(res.Chunks) != 1 || res.Chunks[0].Achieved != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Len() int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Len()
+}
+
+func TestKVBlobsBelowTarget(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	ctx := context.Background()
+	for _, key := range []string{"foo", "bar"} {
+		if err := kv.PutBytes(ctx, []byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bar only needs to keep 2 live shards
+	if err := SetRedundancyTarget(kv.DB, []byte("bar"), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	online := make(map[hostdb.HostPublicKey]bool)
+	for hostKey := range hs.sessions {
+		online[hostKey] = true
+	}
+	check := func(exp ...string) {
+		t.Helper()
+		keys, err := kv.BlobsBelowTarget(online)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(keys))
+		for i := range keys {
+			got[i] = string(keys[i])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+	}
+	check()
+	for hostKey := range online {
+		online[hostKey] = false
+		check("foo")
+		break
+	}
+	for hostKey := range online {
+		if online[hostKey] {
+			delete(online, hostKey) // absent hosts are offline
+			break
+		}
+	}
+	check("bar", "foo")
+}
+
+func TestKVGetLive(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	kv.Watcher = NewUploadWatcher()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	chunkSize := renterhost.SectorSize * 2
+	bigdata := frand.Bytes(chunkSize * 3)
+	pr, pw := io.Pipe()
+	putErr := make(chan error, 1)
+	go func() { putErr <- kv.Put(ctx, []byte("foo"), pr) }()
+
+	// write the first chunk and start reading
+	if _, err := pw.Write(bigdata[:chunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	for !kv.Watcher.Uploading([]byte("foo")) {
+		time.Sleep(time.Millisecond)
+	}
+	var buf lockedBuffer
+	getErr := make(chan error, 1)
+	go func() { getErr <- kv.GetLive(ctx, []byte("foo"), &buf) }()
+
+	// the first chunk should be readable before the upload completes
+	for buf.Len() < chunkSize {
+		select {
+		case err := <-getErr:
+			t.Fatal("GetLive returned early:", err)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for first chunk")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if _, err := pw.Write(bigdata[chunkSize:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if err := <-putErr; err != nil {
+		t.Fatal(err)
+	} else if err := <-getErr; err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.buf.Bytes(), bigdata) {
+		t.Fatal("bad data")
+	}
+	if kv.Watcher.Uploading([]byte("foo")) {
+		t.Fatal("upload should be finished")
+	}
+}
+
 func TestKVUpdate(t *testing.T) {
 	kv, cleanup := createTestingKV(t, 2, 3)
 	defer cleanup()
@@ -343,7 +546,7 @@ func TestKVMigrate(t *testing.T) {
 	}
 }
 
-func TestKVGC(t *testing.T) {
+func TestReshardBlob(t *testing.T) {
 	kv, cleanup := createTestingKV(t, 2, 3)
 	defer cleanup()
 
@@ -354,143 +557,472 @@ func TestKVGC(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := kv.Delete([]byte("foo")); err != nil {
+	// demote to 1-of-2
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	if err := ReshardBlob(ctx, kv.DB, []byte("foo"), 1, 2, hs); err != nil {
 		t.Fatal(err)
 	}
-	if err := kv.GC(ctx); err != nil {
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
 		t.Fatal(err)
 	}
+	for _, cid := range b.Chunks {
+		c, err := kv.DB.Chunk(cid)
+		if err != nil {
+			t.Fatal(err)
+		} else if c.MinShards != 1 || len(c.Shards) != 2 {
+			t.Fatalf("chunk %v was not resharded: %v-of-%v", cid, c.MinShards, len(c.Shards))
+		}
+	}
+	data, err := kv.GetBytes([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
+	}
 
-	if _, err := kv.GetBytes([]byte("foo")); err != ErrKeyNotFound {
-		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	// the old shards should be unreferenced
+	if _, ok := kv.DB.(*EphemeralMetaDB); ok {
+		sectors, err := kv.DB.UnreferencedSectors()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sectors) == 0 {
+			t.Fatal("expected old sectors to be unreferenced")
+		}
 	}
-}
 
-func TestKVPutGetParallel(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
+	// resharding again with the same parameters should be a no-op
+	if err := ReshardBlob(ctx, kv.DB, []byte("foo"), 1, 2, hs); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(b2.Chunks, b.Chunks) {
+		t.Fatal("chunks should not have changed")
 	}
+}
+
+func TestReshardBlobUploadFailure(t *testing.T) {
 	kv, cleanup := createTestingKV(t, 2, 3)
 	defer cleanup()
-	hs := kv.Uploader.(ParallelChunkUploader).Hosts
-	kv.Uploader = ParallelChunkUploader{Hosts: hs}
-	kv.Downloader = ParallelChunkDownloader{Hosts: hs}
 
-	var kvs [5]struct {
-		smallKey []byte
-		smallVal []byte
-		largeKey []byte
-		largeVal []byte
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 2)
+	if err := kv.PutBytes(ctx, []byte("foo"), bigdata); err != nil {
+		t.Fatal(err)
 	}
-	for i := range kvs {
-		kvs[i].smallKey = []byte("small" + strconv.Itoa(i))
-		kvs[i].smallVal = []byte("value" + strconv.Itoa(i))
-		kvs[i].largeKey = []byte("large" + strconv.Itoa(i))
-		kvs[i].largeVal = frand.Bytes(renterhost.SectorSize * 4)
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	// spawn multiple goroutines uploading in parallel
-	ctx := context.Background()
-	errCh := make(chan error)
-	for i := range kvs {
-		go func(i int) {
-			errCh <- func() error {
-				err := kv.PutBytes(ctx, kvs[i].smallKey, kvs[i].smallVal)
-				if err != nil {
-					return err
-				}
-				return kv.Put(ctx, kvs[i].largeKey, bytes.NewReader(kvs[i].largeVal))
-			}()
-		}(i)
+	oldChunks := append([]uint64(nil), b.Chunks...)
+
+	// add a host that cannot be reached, so that uploading to all four hosts
+	// fails after the other three shards have been uploaded
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	h, c := createHostWithContract(t)
+	hs.hkr.(testHKR)[h.PublicKey()] = h.Settings().NetAddress
+	hs.AddHost(c)
+	h.Close()
+	if err := ReshardBlob(ctx, kv.DB, []byte("foo"), 1, 4, hs); err == nil {
+		t.Fatal("expected upload to fail")
 	}
-	for range kvs {
-		if err := <-errCh; err != nil {
-			t.Fatal(err)
-		}
+
+	// the blob should be unchanged, and the uploaded shards should be
+	// released
+	if b, err := kv.DB.Blob([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(b.Chunks, oldChunks) {
+		t.Fatal("blob should not have changed")
 	}
-	// spawn multiple goroutines downloading in parallel
-	// TODO: make one host fail
-	for i := range kvs {
-		go func(i int) {
-			errCh <- func() error {
-				data, err := kv.GetBytes(kvs[i].smallKey)
-				if err != nil {
-					return err
-				} else if !bytes.Equal(data, kvs[i].smallVal) {
-					return fmt.Errorf("bad data: %q", data)
-				}
-				var buf bytes.Buffer
-				err = kv.Get([]byte(kvs[i].largeKey), &buf)
-				if err != nil {
-					return err
-				} else if !bytes.Equal(buf.Bytes(), kvs[i].largeVal) {
-					return fmt.Errorf("bad data")
-				}
-				// range request
-				buf.Reset()
-				off, n := int64(renterhost.SectorSize+10*(i+1)), int64(497*(i+1))
-				err = kv.GetRange(kvs[i].largeKey, &buf, off, n)
-				if err != nil {
-					return err
-				} else if !bytes.Equal(buf.Bytes(), kvs[i].largeVal[off:][:n]) {
-					return fmt.Errorf("bad range data")
-				}
-				return nil
-			}()
-		}(i)
+	if sectors, err := kv.DB.UnreferencedSectors(); err != nil {
+		t.Fatal(err)
+	} else if len(sectors) == 0 {
+		t.Fatal("expected uploaded sectors to be unreferenced")
 	}
-	for range kvs {
-		if err := <-errCh; err != nil {
-			t.Fatal(err)
-		}
+	if data, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
 	}
 }
 
-func TestKVMinimumAvailability(t *testing.T) {
-	kv, cleanup := createTestingKV(t, 1, 3)
+func TestKVEmpty(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
 	defer cleanup()
-	hs := kv.Uploader.(ParallelChunkUploader).Hosts
-	kv.Uploader = MinimumChunkUploader{Hosts: hs}
 
 	ctx := context.Background()
-	bigdata := frand.Bytes(renterhost.SectorSize * 4)
-	err := kv.Put(ctx, []byte("foo"), bytes.NewReader(bigdata))
+	if err := kv.PutBytes(ctx, []byte("empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("empty"))
 	if err != nil {
 		t.Fatal(err)
+	} else if len(b.Chunks) != 0 {
+		t.Fatal("expected empty blob to have no chunks, got", len(b.Chunks))
 	}
-
-	// only one shard should have been uploaded
-	var totalUploaded uint64
-	for _, ls := range hs.sessions {
-		if ls.s != nil {
-			totalUploaded += ls.s.Revision().Revision.NewFileSize
-		}
+	data, err := kv.GetBytes([]byte("empty"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 0 {
+		t.Fatal("expected empty value, got", len(data), "bytes")
 	}
-	if totalUploaded != uint64(len(bigdata)) {
-		t.Fatal("expected 1x redundancy, got", float64(totalUploaded)/float64(len(bigdata)))
+	var buf bytes.Buffer
+	if err := kv.GetRange([]byte("empty"), &buf, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() != 0 {
+		t.Fatal("expected empty range")
 	}
 
-	// should be able to download
-	data, err := kv.GetBytes([]byte("foo"))
+	// deleting an empty blob should not leave anything behind for GC
+	if err := kv.Delete([]byte("empty")); err != nil {
+		t.Fatal(err)
+	} else if _, err := kv.DB.Blob([]byte("empty")); err != ErrKeyNotFound {
+		t.Fatal("expected ErrKeyNotFound, got", err)
+	}
+	freed, err := kv.CollectGarbage(ctx, false)
 	if err != nil {
 		t.Fatal(err)
-	} else if !bytes.Equal(data, bigdata) {
-		t.Fatal("bad data")
+	} else if len(freed) != 0 {
+		t.Fatal("expected no sectors to be freed, got", freed)
 	}
+}
 
-	// resume to full redundancy
-	kv.Uploader = ParallelChunkUploader{Hosts: hs}
-	err = kv.Resume(ctx, []byte("foo"), bytes.NewReader(bigdata))
+func TestBenchmarkHosts(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 4)
+	if err := kv.PutBytes(ctx, []byte("foo"), bigdata); err != nil {
+		t.Fatal(err)
+	}
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	results, err := BenchmarkHosts(kv.DB, []byte("foo"), hs)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(results) != 3 {
+		t.Fatal("expected results for 3 hosts, got", len(results))
+	}
+	for host, hb := range results {
+		if hb.Shards != 2 || hb.Errors != 0 {
+			t.Errorf("%v: expected 2 successful shards, got %v (%v errors)", host.ShortKey(), hb.Shards, hb.Errors)
+		} else if hb.Bytes != 2*renterhost.SectorSize {
+			t.Errorf("%v: expected %v bytes, got %v", host.ShortKey(), 2*renterhost.SectorSize, hb.Bytes)
+		} else if hb.Throughput() <= 0 || hb.Latency <= 0 {
+			t.Errorf("%v: expected non-zero throughput and latency", host.ShortKey())
+		} else if hb.ErrorRate() != 0 {
+			t.Errorf("%v: expected zero error rate, got %v", host.ShortKey(), hb.ErrorRate())
+		}
 	}
 
-	data, err = kv.GetBytes([]byte("foo"))
+	// a host that is not in the set should report only errors
+	for hostKey := range hs.sessions {
+		s, _ := hs.acquire(hostKey)
+		s.Close()
+		hs.release(hostKey)
+		delete(hs.sessions, hostKey)
+		break
+	}
+	results, err = BenchmarkHosts(kv.DB, []byte("foo"), hs)
 	if err != nil {
 		t.Fatal(err)
-	} else if !bytes.Equal(data, bigdata) {
-		t.Fatal("bad data")
 	}
-}
+	var failed int
+	for _, hb := range results {
+		if hb.ErrorRate() == 1 {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatal("expected exactly one failing host, got", failed)
+	}
+}
+
+func TestKVGC(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 4)
+	err := kv.PutBytes(ctx, []byte("foo"), bigdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kv.Delete([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.DB.(*EphemeralMetaDB); ok {
+		freed, err := kv.CollectGarbage(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int
+		for _, n := range freed {
+			total += n
+		}
+		if len(freed) != 3 || total != 6 {
+			t.Fatalf("expected 6 sectors on 3 hosts, got %v", freed)
+		}
+	}
+	if err := kv.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.GetBytes([]byte("foo")); err != ErrKeyNotFound {
+		t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestKVTruncate(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 5)
+	if err := kv.PutBytes(ctx, []byte("foo"), bigdata); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Truncate(ctx, []byte("foo"), int64(len(bigdata)+1)); err == nil {
+		t.Fatal("expected error when extending value")
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastChunk := b.Chunks[len(b.Chunks)-1]
+	for _, size := range []int{renterhost.SectorSize*3 + 100, renterhost.SectorSize * 2, 0} {
+		if err := kv.Truncate(ctx, []byte("foo"), int64(size)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := kv.GetBytes([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, bigdata[:size]) {
+			t.Fatalf("bad data after truncating to %v bytes", size)
+		}
+	}
+	if sectors, err := kv.DB.UnreferencedSectors(); err != nil {
+		t.Fatal(err)
+	} else if len(sectors) == 0 {
+		t.Fatal("truncated sectors should be unreferenced")
+	}
+	// dropped chunks should be released, not cleared
+	if c, err := kv.DB.Chunk(lastChunk); err != nil {
+		t.Fatal(err)
+	} else if c.Shards[0] == 0 {
+		t.Fatal("dropped chunk should not be cleared")
+	}
+}
+
+func TestBlobPacker(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	bp := &BlobPacker{KV: kv}
+	vals := map[string][]byte{
+		"small1": frand.Bytes(100),
+		"small2": frand.Bytes(renterhost.SectorSize),
+		"small3": frand.Bytes(renterhost.SectorSize / 2),
+		"big":    frand.Bytes(renterhost.SectorSize * 3),
+	}
+	for _, key := range []string{"small1", "small2", "big", "small3"} {
+		if err := bp.Add(ctx, []byte(key), vals[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bp.GetBytes([]byte("small1")); err != ErrKeyNotFound {
+		t.Fatalf("expected %v before flush, got %v", ErrKeyNotFound, err)
+	} else if err := bp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range vals {
+		data, err := bp.GetBytes([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, val) {
+			t.Fatalf("%v: data mismatch", key)
+		}
+	}
+	// the small values should have been packed into a single chunk
+	var blobs int
+	kv.DB.ForEachBlob(func([]byte) error { blobs++; return nil })
+	if blobs != 2 {
+		t.Fatal("expected 2 blobs (one pack, one big), got", blobs)
+	}
+}
+
+func TestKVHostGroups(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 1, 4)
+	defer cleanup()
+	kv.N = 3
+
+	// place two hosts in the same group
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	groups := make(map[hostdb.HostPublicKey]string)
+	for hostKey := range hs.sessions {
+		groups[hostKey] = strconv.Itoa(len(groups) % 3)
+	}
+	kv.Uploader = ParallelChunkUploader{
+		Hosts:     hs,
+		HostGroup: func(h hostdb.HostPublicKey) string { return groups[h] },
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		key := []byte(strconv.Itoa(i))
+		if err := kv.PutBytes(ctx, key, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := kv.DB.Blob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := kv.DB.Chunk(b.Chunks[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for _, sid := range c.Shards {
+			s, err := kv.DB.Shard(sid)
+			if err != nil {
+				t.Fatal(err)
+			} else if seen[groups[s.HostKey]] {
+				t.Fatal("multiple shards stored in group", groups[s.HostKey])
+			}
+			seen[groups[s.HostKey]] = true
+		}
+	}
+}
+
+func TestKVPutGetParallel(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	kv.Uploader = ParallelChunkUploader{Hosts: hs}
+	kv.Downloader = ParallelChunkDownloader{Hosts: hs}
+
+	var kvs [5]struct {
+		smallKey []byte
+		smallVal []byte
+		largeKey []byte
+		largeVal []byte
+	}
+	for i := range kvs {
+		kvs[i].smallKey = []byte("small" + strconv.Itoa(i))
+		kvs[i].smallVal = []byte("value" + strconv.Itoa(i))
+		kvs[i].largeKey = []byte("large" + strconv.Itoa(i))
+		kvs[i].largeVal = frand.Bytes(renterhost.SectorSize * 4)
+	}
+	// spawn multiple goroutines uploading in parallel
+	ctx := context.Background()
+	errCh := make(chan error)
+	for i := range kvs {
+		go func(i int) {
+			errCh <- func() error {
+				err := kv.PutBytes(ctx, kvs[i].smallKey, kvs[i].smallVal)
+				if err != nil {
+					return err
+				}
+				return kv.Put(ctx, kvs[i].largeKey, bytes.NewReader(kvs[i].largeVal))
+			}()
+		}(i)
+	}
+	for range kvs {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// spawn multiple goroutines downloading in parallel
+	// TODO: make one host fail
+	for i := range kvs {
+		go func(i int) {
+			errCh <- func() error {
+				data, err := kv.GetBytes(kvs[i].smallKey)
+				if err != nil {
+					return err
+				} else if !bytes.Equal(data, kvs[i].smallVal) {
+					return fmt.Errorf("bad data: %q", data)
+				}
+				var buf bytes.Buffer
+				err = kv.Get([]byte(kvs[i].largeKey), &buf)
+				if err != nil {
+					return err
+				} else if !bytes.Equal(buf.Bytes(), kvs[i].largeVal) {
+					return fmt.Errorf("bad data")
+				}
+				// range request
+				buf.Reset()
+				off, n := int64(renterhost.SectorSize+10*(i+1)), int64(497*(i+1))
+				err = kv.GetRange(kvs[i].largeKey, &buf, off, n)
+				if err != nil {
+					return err
+				} else if !bytes.Equal(buf.Bytes(), kvs[i].largeVal[off:][:n]) {
+					return fmt.Errorf("bad range data")
+				}
+				return nil
+			}()
+		}(i)
+	}
+	for range kvs {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKVMinimumAvailability(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 1, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	kv.Uploader = MinimumChunkUploader{Hosts: hs}
+
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 4)
+	err := kv.Put(ctx, []byte("foo"), bytes.NewReader(bigdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only one shard should have been uploaded
+	var totalUploaded uint64
+	for _, ls := range hs.sessions {
+		if ls.s != nil {
+			totalUploaded += ls.s.Revision().Revision.NewFileSize
+		}
+	}
+	if totalUploaded != uint64(len(bigdata)) {
+		t.Fatal("expected 1x redundancy, got", float64(totalUploaded)/float64(len(bigdata)))
+	}
+
+	// should be able to download
+	data, err := kv.GetBytes([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
+	}
+
+	// resume to full redundancy
+	kv.Uploader = ParallelChunkUploader{Hosts: hs}
+	err = kv.Resume(ctx, []byte("foo"), bytes.NewReader(bigdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = kv.GetBytes([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
+	}
+}
 
 func TestKVBuffering(t *testing.T) {
 	t.Skip("TODO: store multiple values in one sector")
@@ -638,3 +1170,1508 @@ func BenchmarkKVGetParallel(b *testing.B) {
 		}
 	}
 }
+
+func TestKVSectorCache(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	cache := NewSectorCache(10 * renterhost.SectorSize)
+	kv.Downloader = ParallelChunkDownloader{
+		Hosts: kv.Downloader.(ParallelChunkDownloader).Hosts,
+		Cache: cache,
+	}
+
+	ctx := context.Background()
+	bigdata := frand.Bytes(renterhost.SectorSize * 3)
+	if err := kv.PutBytes(ctx, []byte("foo"), bigdata); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		off, n := int64(1000+i*8000), int64(9000)
+		if err := kv.GetRange([]byte("foo"), &buf, off, n); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), bigdata[off:][:n]) {
+			t.Fatal("bad data")
+		}
+	}
+	if stats := cache.Stats(); stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatal("expected both hits and misses, got", stats)
+	} else if stats.Size > 10*renterhost.SectorSize {
+		t.Fatal("cache exceeded budget:", stats.Size)
+	}
+
+	// once cached, the blob should be downloadable without contacting any hosts
+	if _, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if cached, err := cache.BlobCached(kv.DB, b); err != nil {
+		t.Fatal(err)
+	} else if !cached {
+		t.Fatal("expected blob to be cached")
+	}
+	kv.Downloader = ParallelChunkDownloader{
+		Hosts: NewHostSet(make(testHKR), 0),
+		Cache: cache,
+	}
+	if data, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
+	}
+}
+
+func TestSectorCacheCopy(t *testing.T) {
+	cache := NewSectorCache(renterhost.SectorSize)
+	var root crypto.Hash
+	frand.Read(root[:])
+	sector := frand.Bytes(renterhost.SectorSize)
+	cache.Put(root, append([]byte(nil), sector...))
+
+	// Get returns shared memory; SectorCopy does not
+	a, _ := cache.Get(root)
+	b, _ := cache.Get(root)
+	if &a[0] != &b[0] {
+		t.Fatal("expected Get to return shared memory")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, ok := cache.SectorCopy(root)
+			if !ok {
+				t.Error("sector not cached")
+				return
+			}
+			for j := range c {
+				c[j] ^= byte(i + 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if data, _ := cache.Get(root); !bytes.Equal(data, sector) {
+		t.Fatal("modifying a copy altered the cached sector")
+	} else if _, ok := cache.SectorCopy(crypto.Hash{}); ok {
+		t.Fatal("expected miss for uncached sector")
+	}
+}
+
+func TestVerifySeed(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	ctx := context.Background()
+	if err := kv.PutBytes(ctx, []byte("foo"), frand.Bytes(1000)); err != nil {
+		t.Fatal(err)
+	} else if err := VerifySeed(kv.DB, []byte("foo"), hs); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace seed
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frand.Read(b.Seed[:])
+	if err := kv.DB.AddBlob(b); err != nil {
+		t.Fatal(err)
+	} else if err := VerifySeed(kv.DB, []byte("foo"), hs); err != ErrIncorrectSeed {
+		t.Fatalf("expected %v, got %v", ErrIncorrectSeed, err)
+	}
+}
+
+func TestKVReadRepair(t *testing.T) {
+	hosts := make(map[hostdb.HostPublicKey]*ghost.Host)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	for i := 0; i < 4; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hosts[h.PublicKey()] = h
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	kv := PseudoKV{
+		DB:         NewEphemeralMetaDB(),
+		M:          2,
+		N:          3,
+		P:          1,
+		Uploader:   ParallelChunkUploader{Hosts: hs},
+		Downloader: ParallelChunkDownloader{Hosts: hs, ReadRepair: true},
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	data := frand.Bytes(4096)
+	if err := kv.PutBytes(ctx, []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := kv.DB.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := kv.DB.Shard(c.Shards[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts[bad.HostKey].CorruptSector(bad.SectorRoot)
+
+	// the corrupt shard is only detected if it is chosen for download, and is
+	// repaired in the background, so download repeatedly until it is repaired
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if got, err := kv.GetBytes([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("bad data")
+		}
+		if c, err = kv.DB.Chunk(c.ID); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := kv.DB.Shard(c.Shards[0]); err != nil {
+			t.Fatal(err)
+		} else if s.HostKey != bad.HostKey {
+			break
+		}
+	}
+	s, err := kv.DB.Shard(c.Shards[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if s.HostKey == bad.HostKey {
+		t.Fatal("corrupt shard was not repaired")
+	}
+	for _, sid := range c.Shards[1:] {
+		if other, err := kv.DB.Shard(sid); err != nil {
+			t.Fatal(err)
+		} else if other.HostKey == s.HostKey {
+			t.Fatal("repaired shard was stored on a host that already has a shard")
+		}
+	}
+
+	// every pair of shards should now be sufficient to recover the chunk
+	for i := range c.Shards {
+		shards, err := ParallelChunkDownloader{Hosts: hs}.downloadFullChunk(kv.DB, DBChunk{
+			ID:        c.ID,
+			Shards:    []uint64{c.Shards[i], c.Shards[(i+1)%3], 0},
+			MinShards: 2,
+			Len:       c.Len,
+		}, b.Seed)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(shards) != 3 {
+			t.Fatal("wrong number of shards")
+		}
+	}
+}
+
+func TestRepairShardsPlacement(t *testing.T) {
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	for i := 0; i < 3; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	db := NewEphemeralMetaDB()
+	kv := PseudoKV{
+		DB:         db,
+		M:          2,
+		N:          3,
+		P:          1,
+		Uploader:   ParallelChunkUploader{Hosts: hs},
+		Downloader: ParallelChunkDownloader{Hosts: hs},
+	}
+	defer kv.Close()
+	if err := kv.PutBytes(context.Background(), []byte("foo"), frand.Bytes(4096)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := db.Shards(c.Shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add two replacement hosts, one of which shares a group with a
+	// surviving shard
+	var same, other hostdb.HostPublicKey
+	for i := 0; i < 2; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+		if i == 0 {
+			same = h.PublicKey()
+		} else {
+			other = h.PublicKey()
+		}
+	}
+	group := func(h hostdb.HostPublicKey) string {
+		if h == same {
+			return string(shards[1].HostKey)
+		}
+		return string(h)
+	}
+	nonce := [24]byte{1, 2, 3}
+	pcd := ParallelChunkDownloader{
+		Hosts:     hs,
+		HostGroup: group,
+		Nonces:    func() [24]byte { return nonce },
+	}
+	orig := c.Shards[0]
+	for i := 0; i < 10; i++ {
+		// restore the original shard, so that the same hosts are excluded
+		if err := db.SetChunkShard(c.ID, 0, orig); err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Chunk(c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pcd.repairShards(db, c, b.Seed, []int{0}); err != nil {
+			t.Fatal(err)
+		}
+		if c, err = db.Chunk(c.ID); err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.Shard(c.Shards[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if s.HostKey != other {
+			t.Fatal("repaired shard was not placed in an unused group")
+		} else if s.Nonce != nonce {
+			t.Fatal("repaired shard was not encrypted with the configured NonceFunc")
+		}
+	}
+}
+
+func TestHostQuarantine(t *testing.T) {
+	var host1, host2 hostdb.HostPublicKey = "host1", "host2"
+	q := NewHostQuarantine(2, 50*time.Millisecond)
+
+	q.RecordFailure(host1)
+	if q.Quarantined(host1) {
+		t.Fatal("host should not be quarantined after a single failure")
+	}
+	q.RecordSuccess(host1)
+	q.RecordFailure(host1)
+	if q.Quarantined(host1) {
+		t.Fatal("success should reset consecutive failures")
+	}
+	q.RecordFailure(host1)
+	if !q.Quarantined(host1) {
+		t.Fatal("host should be quarantined after consecutive failures")
+	} else if q.Quarantined(host2) {
+		t.Fatal("unrelated host should not be quarantined")
+	}
+	if m := q.Quarantine(); len(m) != 1 || m[host1].IsZero() {
+		t.Fatal("wrong quarantine state:", m)
+	}
+
+	// after the backoff, the host should be re-admitted on probation
+	time.Sleep(60 * time.Millisecond)
+	if q.Quarantined(host1) {
+		t.Fatal("host should be re-admitted after backoff")
+	} else if len(q.Quarantine()) != 0 {
+		t.Fatal("quarantine should be empty")
+	}
+	q.RecordFailure(host1)
+	if !q.Quarantined(host1) {
+		t.Fatal("failed probe should quarantine host again")
+	}
+	time.Sleep(60 * time.Millisecond)
+	q.RecordSuccess(host1)
+	q.RecordFailure(host1)
+	if q.Quarantined(host1) {
+		t.Fatal("successful probe should clear host's record")
+	}
+}
+
+func TestKVQuarantine(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	err := kv.PutBytes(context.Background(), []byte("foo"), []byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// quarantine every host; since no other hosts are available, they should
+	// still be used
+	q := NewHostQuarantine(1, time.Hour)
+	for hostKey := range hs.sessions {
+		q.RecordFailure(hostKey)
+	}
+	kv.Downloader = ParallelChunkDownloader{Hosts: hs, Quarantine: q}
+	if data, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "bar" {
+		t.Fatalf("bad data: %q", data)
+	}
+	// the successful downloads should have re-admitted at least MinShards hosts
+	if len(q.Quarantine()) > 1 {
+		t.Fatal("hosts were not re-admitted after successful download")
+	}
+}
+
+type readCounter struct {
+	reads map[hostdb.HostPublicKey]int
+	mu    sync.Mutex
+}
+
+func (rc *readCounter) RecordRPCStats(stats proto.RPCStats) {
+	if stats.RPC == renterhost.RPCReadID {
+		rc.mu.Lock()
+		rc.reads[stats.Host]++
+		rc.mu.Unlock()
+	}
+}
+
+func TestKVDownloadMargin(t *testing.T) {
+	hosts := make(map[hostdb.HostPublicKey]*ghost.Host)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	rc := &readCounter{reads: make(map[hostdb.HostPublicKey]int)}
+	hs.SetRPCStatsRecorder(rc)
+	for i := 0; i < 4; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hosts[h.PublicKey()] = h
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	kv := PseudoKV{
+		DB:         NewEphemeralMetaDB(),
+		M:          2,
+		N:          4,
+		P:          1,
+		Uploader:   ParallelChunkUploader{Hosts: hs},
+		Downloader: ParallelChunkDownloader{Hosts: hs, Margin: 2},
+	}
+	defer kv.Close()
+
+	ctx := context.Background()
+	data := frand.Bytes(4096)
+	if err := kv.PutBytes(ctx, []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := kv.DB.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := kv.DB.Shard(c.Shards[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts[bad.HostKey].CorruptSector(bad.SectorRoot)
+
+	// with a margin of 2, every host should be contacted on each download,
+	// and the corrupt shard should never cause the download to fail
+	const downloads = 10
+	for i := 0; i < downloads; i++ {
+		if got, err := kv.GetBytes([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("bad data")
+		}
+	}
+	if len(rc.reads) != 4 {
+		t.Fatalf("expected reads from 4 hosts, got %v", len(rc.reads))
+	}
+	for _, n := range rc.reads {
+		if n != downloads {
+			t.Fatalf("expected %v reads per host, got %v", downloads, n)
+		}
+	}
+}
+
+func TestKVShardFunc(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	type note struct {
+		chunkID    uint64
+		shardIndex int
+		shardID    uint64
+	}
+	var notes []note
+	ctx, stop := WithShardFunc(context.Background(), func(chunkID uint64, shardIndex int, shardID uint64) {
+		notes = append(notes, note{chunkID, shardIndex, shardID})
+	})
+	data := frand.Bytes(renterhost.SectorSize * 3)
+	err := kv.PutBytes(ctx, []byte("foo"), data)
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every shard should have been reported exactly once
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[note]bool)
+	for _, cid := range b.Chunks {
+		c, err := kv.DB.Chunk(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, sid := range c.Shards {
+			want[note{cid, i, sid}] = true
+		}
+	}
+	if len(notes) != len(want) {
+		t.Fatalf("expected %v notifications, got %v", len(want), len(notes))
+	}
+	for _, n := range notes {
+		if !want[n] {
+			t.Fatal("unexpected notification:", n)
+		}
+		delete(want, n)
+	}
+}
+
+func TestParallelChunkUploaderPinned(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 1, 4)
+	defer cleanup()
+	kv.N = 2
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	var hosts []hostdb.HostPublicKey
+	for h := range hs.sessions {
+		hosts = append(hosts, h)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		pinned := hosts[i%len(hosts)]
+		kv.Uploader = ParallelChunkUploader{Hosts: hs, Pinned: map[int]hostdb.HostPublicKey{1: pinned}}
+		key := []byte(strconv.Itoa(i))
+		data := frand.Bytes(100)
+		if err := kv.PutBytes(ctx, key, data); err != nil {
+			t.Fatal(err)
+		} else if got, err := kv.GetBytes(key); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("bad data")
+		}
+		b, err := kv.DB.Blob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := kv.DB.Chunk(b.Chunks[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s0, err := kv.DB.Shard(c.Shards[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s1, err := kv.DB.Shard(c.Shards[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s1.HostKey != pinned {
+			t.Fatalf("shard was placed on %v, expected %v", s1.HostKey.ShortKey(), pinned.ShortKey())
+		} else if s0.HostKey == pinned {
+			t.Fatal("unpinned shard was placed on pinned host")
+		}
+	}
+
+	// invalid pins should be rejected
+	for _, pins := range []map[int]hostdb.HostPublicKey{
+		{2: hosts[0]},
+		{0: hosts[0], 1: hosts[0]},
+		{0: hostdb.HostKeyFromPublicKey(frand.Bytes(32))},
+	} {
+		kv.Uploader = ParallelChunkUploader{Hosts: hs, Pinned: pins}
+		if err := kv.PutBytes(ctx, []byte("bad"), frand.Bytes(100)); err == nil {
+			t.Errorf("expected error for pins %v", pins)
+		}
+	}
+}
+
+func TestParallelChunkDownloaderPrefersData(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 4)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	if err := kv.PutBytes(context.Background(), []byte("foo"), frand.Bytes(1000)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := kv.DB.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// when every host is healthy, only the data shards should be downloaded
+	for i := 0; i < 10; i++ {
+		shards, err := ParallelChunkDownloader{Hosts: hs}.DownloadChunk(kv.DB, c, b.Seed, 0, int64(c.Len))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, shard := range shards {
+			if isData := j < int(c.MinShards); isData != (len(shard) != 0) {
+				t.Fatalf("shard %v: expected data shards only, got %v bytes", j, len(shard))
+			}
+		}
+	}
+}
+
+func TestDownloadAndReconstruct(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	data := frand.Bytes(1000)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := kv.DB.Chunk(b.Chunks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DownloadAndReconstruct(ParallelChunkDownloader{Hosts: hs}, kv.DB, c, b.Seed)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("reconstructed chunk does not match")
+	}
+
+	// with too few hosts, the error should identify the failures
+	_, err = DownloadAndReconstruct(SerialChunkDownloader{Hosts: NewHostSet(make(testHKR), 0)}, kv.DB, c, b.Seed)
+	var hes HostErrorSet
+	if !errors.As(err, &hes) || len(hes) == 0 {
+		t.Fatal("expected HostErrorSet, got", err)
+	}
+}
+
+func TestShardSection(t *testing.T) {
+	c := DBChunk{MinShards: 2, Len: 1000}
+	minChunkSize := int64(merkle.SegmentSize * 2)
+	tests := []struct {
+		off, n         int64
+		offset, length int64
+	}{
+		{0, 0, 0, 0},
+		{0, 1, 0, merkle.SegmentSize},
+		{0, minChunkSize - 1, 0, merkle.SegmentSize},
+		{0, minChunkSize, 0, merkle.SegmentSize},
+		{0, minChunkSize + 1, 0, 2 * merkle.SegmentSize},
+		{minChunkSize - 1, 1, 0, merkle.SegmentSize},
+		{minChunkSize - 1, 2, 0, 2 * merkle.SegmentSize},
+		{minChunkSize, 1, merkle.SegmentSize, merkle.SegmentSize},
+		{minChunkSize + 1, 1000 - minChunkSize - 1, merkle.SegmentSize, 7 * merkle.SegmentSize},
+	}
+	for _, test := range tests {
+		offset, length := shardSection(c, test.off, test.n)
+		if offset != test.offset || length != test.length {
+			t.Errorf("shardSection(%v, %v): expected (%v, %v), got (%v, %v)", test.off, test.n, test.offset, test.length, offset, length)
+		}
+	}
+
+	readLenTests := []struct {
+		off, n, exp int64
+	}{
+		{0, -1, 1000},
+		{0, 1000, 1000},
+		{0, 1001, 1000},
+		{10, -1, 990},
+		{10, 1000, 990},
+		{10, 990, 990},
+		{10, 5, 5},
+		{999, -1, 1},
+		{1000, -1, 0},
+	}
+	for _, test := range readLenTests {
+		if n := chunkReadLen(c, test.off, test.n); n != test.exp {
+			t.Errorf("chunkReadLen(%v, %v): expected %v, got %v", test.off, test.n, test.exp, n)
+		}
+	}
+}
+
+func TestKVPartialChunks(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	chunkSize := renterhost.SectorSize * kv.M
+	minChunkSize := merkle.SegmentSize * kv.M
+	sizes := []int{
+		1,
+		minChunkSize - 1,
+		minChunkSize,
+		minChunkSize + 1,
+		chunkSize - 1,
+		chunkSize,
+		chunkSize + 1,
+		chunkSize + minChunkSize + 1,
+	}
+	for _, size := range sizes {
+		data := frand.Bytes(size)
+		if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+			t.Fatal(err)
+		}
+		b, err := kv.DB.Blob([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		downloaders := []BlobDownloader{
+			SerialBlobDownloader{D: SerialChunkDownloader{Hosts: hs}},
+			SerialBlobDownloader{D: SerialChunkDownloader{Hosts: hs}, Window: renterhost.SectorSize/2 + 1},
+			ParallelBlobDownloader{D: ParallelChunkDownloader{Hosts: hs}, P: 2},
+		}
+		ranges := []struct{ off, n int64 }{
+			{0, -1},
+			{0, int64(size)},
+			{0, int64(size) + 1},
+			{int64(size) - 1, -1},
+			{int64(size) / 2, -1},
+			{int64(size) / 2, int64(size)},
+		}
+		for _, bd := range downloaders {
+			for _, r := range ranges {
+				var buf bytes.Buffer
+				if err := bd.DownloadBlob(kv.DB, b, &buf, r.off, r.n); err != nil {
+					t.Fatal(err)
+				}
+				if exp := data[r.off:]; !bytes.Equal(buf.Bytes(), exp) {
+					t.Errorf("%T: size %v, range (%v, %v): expected %v bytes, got %v", bd, size, r.off, r.n, len(exp), buf.Len())
+				}
+			}
+		}
+
+		// the final chunk should reconstruct to exactly its recorded length
+		c, err := kv.DB.Chunk(b.Chunks[len(b.Chunks)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DownloadAndReconstruct(ParallelChunkDownloader{Hosts: hs}, kv.DB, c, b.Seed)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data[size-int(c.Len):]) {
+			t.Errorf("size %v: final chunk does not match", size)
+		}
+	}
+}
+
+type windowRecorder struct {
+	ChunkDownloader
+	reqs [][2]int64
+}
+
+func (wr *windowRecorder) DownloadChunk(db MetaDB, c DBChunk, key renter.KeySeed, off, n int64) ([][]byte, error) {
+	wr.reqs = append(wr.reqs, [2]int64{off, n})
+	return wr.ChunkDownloader.DownloadChunk(db, c, key, off, n)
+}
+
+func TestSerialBlobDownloaderWindow(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	data := frand.Bytes(renterhost.SectorSize * 3)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.DB.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// windows should be rounded up to a segment boundary
+	const window = 1 << 18
+	minChunkSize := int64(merkle.SegmentSize * kv.M)
+	rounded := ((window + minChunkSize - 1) / minChunkSize) * minChunkSize
+	off := minChunkSize/2 + 1
+	wr := &windowRecorder{ChunkDownloader: ParallelChunkDownloader{Hosts: hs}}
+	bd := SerialBlobDownloader{D: wr, Window: window}
+	var buf bytes.Buffer
+	if err := bd.DownloadBlob(kv.DB, b, &buf, off, -1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data[off:]) {
+		t.Fatal("bad data")
+	}
+	if len(wr.reqs) < len(data)/int(rounded) {
+		t.Fatalf("expected at least %v requests, got %v", len(data)/int(rounded), len(wr.reqs))
+	}
+	for i, r := range wr.reqs {
+		if r[1] > rounded {
+			t.Fatalf("request %v exceeds window: %v > %v", i, r[1], rounded)
+		} else if i < len(wr.reqs)-1 && (r[0]+r[1])%minChunkSize != 0 {
+			t.Fatalf("request %v does not end on a segment boundary", i)
+		}
+	}
+}
+
+func TestBlobManifest(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	data := frand.Bytes(renterhost.SectorSize*2 + 100)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := BlobManifest(kv.DB, []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(m.Chunks) != 2 {
+		t.Fatal("expected 2 chunks, got", len(m.Chunks))
+	}
+
+	// the manifest should survive serialization
+	js, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m2 Manifest
+	if err := json.Unmarshal(js, &m2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m, m2) {
+		t.Fatal("manifest did not round-trip")
+	}
+
+	// download without the db
+	var buf bytes.Buffer
+	if err := DownloadFromManifest(m2, hs, &buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	if _, err := BlobManifest(kv.DB, []byte("bar")); err != ErrKeyNotFound {
+		t.Fatal("expected ErrKeyNotFound, got", err)
+	}
+}
+
+type recordingUpdater struct {
+	order []uint64
+	mu    sync.Mutex
+}
+
+func (ru *recordingUpdater) UpdateChunk(ctx context.Context, db MetaDB, b DBBlob, c DBChunk) (uint64, error) {
+	ru.mu.Lock()
+	ru.order = append(ru.order, c.ID)
+	ru.mu.Unlock()
+	// replace the chunk with a fully-stored copy
+	nc, err := db.AddChunk(int(c.MinShards), len(c.Shards), c.Len)
+	if err != nil {
+		return 0, err
+	}
+	for i := range c.Shards {
+		sid, err := db.AddShard(DBShard{SectorRoot: frand.Entropy256()})
+		if err != nil {
+			return 0, err
+		} else if err := db.SetChunkShard(nc.ID, i, sid); err != nil {
+			return 0, err
+		}
+	}
+	return nc.ID, nil
+}
+
+func TestRepairQueue(t *testing.T) {
+	db := NewEphemeralMetaDB()
+	// create chunks with 1, 0, and 2 spare shards
+	var cids []uint64
+	for _, stored := range []int{3, 2, 4} {
+		c, err := db.AddChunk(2, 4, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < stored; i++ {
+			sid, err := db.AddShard(DBShard{SectorRoot: frand.Entropy256()})
+			if err != nil {
+				t.Fatal(err)
+			} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cids = append(cids, c.ID)
+	}
+	if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: append([]uint64(nil), cids...)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ru := new(recordingUpdater)
+	q := NewRepairQueue(db, ru, 1, 0)
+	for _, cid := range append(cids, cids...) {
+		if err := q.Enqueue([]byte("foo"), cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := q.Status(); s.Queued != 3 {
+		t.Fatal("expected duplicates to be ignored, got", s)
+	} else if !q.Queued(cids[0]) {
+		t.Fatal("chunk should be queued")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- q.Run(ctx) }()
+	for q.Status().Repaired < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+
+	// chunks should be repaired in order of fewest spare shards
+	if exp := []uint64{cids[1], cids[0], cids[2]}; !reflect.DeepEqual(ru.order, exp) {
+		t.Fatalf("expected repair order %v, got %v", exp, ru.order)
+	}
+	if s := q.Status(); s != (RepairStatus{Repaired: 3}) {
+		t.Fatal("unexpected status:", s)
+	} else if q.Queued(cids[0]) {
+		t.Fatal("chunk should no longer be queued")
+	}
+
+	// the blob should reference the replacement chunks
+	b, err := db.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cid := range b.Chunks {
+		if cid == cids[i] {
+			t.Fatal("blob still references original chunk", cid)
+		}
+	}
+
+	// failed repairs should be counted
+	q = NewRepairQueue(db, ru, 1, 0)
+	if err := q.Enqueue([]byte("bar"), b.Chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- q.Run(ctx) }()
+	for q.Status().Failed < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+type replacingUpdater struct {
+	recordingUpdater
+	chunks []uint64
+	nc     uint64
+}
+
+func (ru *replacingUpdater) UpdateChunk(ctx context.Context, db MetaDB, b DBBlob, c DBChunk) (uint64, error) {
+	id, err := ru.recordingUpdater.UpdateChunk(ctx, db, b, c)
+	if err != nil {
+		return 0, err
+	}
+	ru.nc = id
+	// simulate a concurrent Put that drops the chunk being repaired
+	b.Chunks = ru.chunks
+	return id, db.ReplaceBlob(b)
+}
+
+func TestRepairQueueReplacedBlob(t *testing.T) {
+	db := NewEphemeralMetaDB()
+	var cids []uint64
+	for i := 0; i < 2; i++ {
+		c, err := db.AddChunk(1, 2, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, err := db.AddShard(DBShard{SectorRoot: frand.Entropy256()})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(c.ID, 0, sid); err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, c.ID)
+	}
+	if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{cids[0]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ru := &replacingUpdater{chunks: []uint64{cids[1]}}
+	q := NewRepairQueue(db, ru, 1, 0)
+	if err := q.Enqueue([]byte("foo"), cids[0]); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- q.Run(ctx) }()
+	for s := q.Status(); s.Repaired+s.Failed < 1; s = q.Status() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// the concurrent write should be preserved, and the repaired chunk
+	// released
+	b, err := db.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(b.Chunks, []uint64{cids[1]}) {
+		t.Fatal("concurrent write was lost:", b.Chunks)
+	}
+	c, err := db.Chunk(ru.nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sid := range c.Shards {
+		if sid != 0 {
+			t.Fatalf("repaired chunk still references shard %v in slot %v", sid, i)
+		}
+	}
+}
+
+func TestKVServeHTTP(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	data := frand.Bytes(renterhost.SectorSize*2 + 100)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+
+	get := func(key string, header map[string]string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/"+key, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("foo", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatal("bad full response:", resp.Status, len(body))
+	} else if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatal("Accept-Ranges not advertised")
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+
+	// resume from the middle of the second chunk
+	off := len(data) - 1000
+	resp, body = get("foo", map[string]string{"Range": fmt.Sprintf("bytes=%d-", off)})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[off:]) {
+		t.Fatal("bad resume response:", resp.Status, len(body))
+	} else if exp := fmt.Sprintf("bytes %d-%d/%d", off, len(data)-1, len(data)); resp.Header.Get("Content-Range") != exp {
+		t.Fatal("bad Content-Range:", resp.Header.Get("Content-Range"))
+	}
+
+	// bounded and suffix ranges
+	resp, body = get("foo", map[string]string{"Range": "bytes=10-19", "If-Range": lastModified})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[10:20]) {
+		t.Fatal("bad bounded range response:", resp.Status, len(body))
+	}
+	resp, body = get("foo", map[string]string{"Range": "bytes=-50"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[len(data)-50:]) {
+		t.Fatal("bad suffix range response:", resp.Status, len(body))
+	}
+
+	// multiple or unsatisfiable ranges should be rejected
+	for _, r := range []string{"bytes=0-9,20-29", fmt.Sprintf("bytes=%d-", len(data)), "bytes=9-0", "items=0-9"} {
+		resp, _ = get("foo", map[string]string{"Range": r})
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%q: expected 416, got %v", r, resp.Status)
+		} else if exp := fmt.Sprintf("bytes */%d", len(data)); resp.Header.Get("Content-Range") != exp {
+			t.Errorf("%q: bad Content-Range: %v", r, resp.Header.Get("Content-Range"))
+		}
+	}
+
+	// a stale If-Range should yield the full value
+	resp, body = get("foo", map[string]string{"Range": "bytes=10-19", "If-Range": "Mon, 02 Jan 2006 15:04:05 GMT"})
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatal("bad response to stale If-Range:", resp.Status, len(body))
+	}
+
+	if resp, _ = get("bar", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("expected 404, got", resp.Status)
+	}
+}
+
+func TestKVGetArchive(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	files := map[string][]byte{
+		"dir/a":     []byte("foo"),
+		"dir/b/c":   frand.Bytes(renterhost.SectorSize*2 + 10),
+		"dir/empty": nil,
+	}
+	for name, data := range files {
+		if err := kv.PutBytes(ctx, []byte(name), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"dir", "dis", "other"} {
+		if err := kv.PutBytes(ctx, []byte(key), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkArchive := func(r io.Reader) {
+		t.Helper()
+		tr := tar.NewReader(r)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(data, files["dir/"+hdr.Name]) {
+				t.Fatalf("wrong contents for %q", hdr.Name)
+			}
+		}
+		if fmt.Sprint(names) != "[a b/c empty]" {
+			t.Fatal("wrong archive entries:", names)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := kv.GetArchive([]byte("dir/"), &buf); err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(&buf)
+
+	// the archive should also be served over HTTP
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/dir/?archive=tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("bad archive response:", resp.Status)
+	} else if ct := resp.Header.Get("Content-Type"); ct != "application/x-tar" {
+		t.Fatal("bad Content-Type:", ct)
+	} else if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename=dir.tar` {
+		t.Fatal("bad Content-Disposition:", cd)
+	}
+	checkArchive(resp.Body)
+
+	resp, err = http.Get(srv.URL + "/dir/?archive=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400 for unsupported format, got", resp.Status)
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	err := errors.New("error")
+	if retry, _ := NoRetry.ShouldRetry(1, err); retry {
+		t.Fatal("NoRetry should not retry")
+	}
+	for attempt := 1; attempt <= 4; attempt++ {
+		retry, backoff := FixedRetry(3).ShouldRetry(attempt, err)
+		if retry != (attempt <= 3) || backoff != 0 {
+			t.Fatalf("FixedRetry(3), attempt %v: got %v, %v", attempt, retry, backoff)
+		}
+	}
+	eb := ExponentialBackoff{Retries: 4, Base: time.Second, Max: 5 * time.Second}
+	for attempt, exp := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if retry, backoff := eb.ShouldRetry(attempt+1, err); !retry || backoff != exp {
+			t.Fatalf("ExponentialBackoff, attempt %v: expected %v, got %v, %v", attempt+1, exp, retry, backoff)
+		}
+	}
+	if retry, _ := eb.ShouldRetry(5, err); retry {
+		t.Fatal("ExponentialBackoff should stop after Retries attempts")
+	}
+}
+
+// flakyHKR fails to resolve host keys until it has been called fails times.
+type flakyHKR struct {
+	testHKR
+	fails int
+}
+
+func (hkr *flakyHKR) ResolveHostKey(pubkey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	if hkr.fails > 0 {
+		hkr.fails--
+		return "", errors.New("temporary failure")
+	}
+	return hkr.testHKR.ResolveHostKey(pubkey)
+}
+
+func TestHostSetRetryPolicy(t *testing.T) {
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hkr := &flakyHKR{testHKR: testHKR{h.PublicKey(): h.Settings().NetAddress}}
+	hs := NewHostSet(hkr, 0)
+	hs.AddHost(c)
+	defer hs.Close()
+
+	// by default, failures are not retried
+	hkr.fails = 2
+	if _, err := hs.acquire(h.PublicKey()); err == nil {
+		t.Fatal("expected error without retries")
+	}
+
+	hkr.fails = 2
+	hs.SetRetryPolicy(FixedRetry(2))
+	if _, err := hs.acquire(h.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	hs.release(h.PublicKey())
+}
+
+type settingsCounter struct {
+	n  int
+	mu sync.Mutex
+}
+
+func (sc *settingsCounter) RecordRPCStats(stats proto.RPCStats) {
+	if stats.RPC == renterhost.RPCSettingsID {
+		sc.mu.Lock()
+		sc.n++
+		sc.mu.Unlock()
+	}
+}
+
+func TestHostSetSettingsTTL(t *testing.T) {
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hs := NewHostSet(testHKR{h.PublicKey(): h.Settings().NetAddress}, 0)
+	hs.AddHost(c)
+	defer hs.Close()
+	sc := new(settingsCounter)
+	hs.SetRPCStatsRecorder(sc)
+
+	acquire := func() {
+		t.Helper()
+		if _, err := hs.acquire(h.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		hs.release(h.PublicKey())
+	}
+
+	// by default, a recently-seen host should not be pinged
+	for i := 0; i < 3; i++ {
+		acquire()
+	}
+	if sc.n != 0 {
+		t.Fatalf("expected no Settings RPCs, got %v", sc.n)
+	}
+
+	// once the settings expire, they should be re-fetched on each acquire
+	hs.SetSettingsTTL(time.Nanosecond)
+	for i := 0; i < 3; i++ {
+		acquire()
+	}
+	if sc.n != 3 {
+		t.Fatalf("expected 3 Settings RPCs, got %v", sc.n)
+	}
+
+	// while they are fresh, they should not be re-fetched
+	hs.SetSettingsTTL(time.Hour)
+	sc.n = 0
+	for i := 0; i < 3; i++ {
+		acquire()
+	}
+	if sc.n != 0 {
+		t.Fatalf("expected no Settings RPCs, got %v", sc.n)
+	}
+
+	// an idle host should be pinged even if its settings are fresh
+	defer func(d time.Duration) { hostIdleTimeout = d }(hostIdleTimeout)
+	hostIdleTimeout = time.Nanosecond
+	sc.n = 0
+	for i := 0; i < 3; i++ {
+		acquire()
+	}
+	if sc.n != 3 {
+		t.Fatalf("expected 3 Settings RPCs, got %v", sc.n)
+	}
+}
+
+func TestHostSetDeadlines(t *testing.T) {
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hs := NewHostSet(testHKR{h.PublicKey(): h.Settings().NetAddress}, 0)
+	hs.AddHost(c)
+	defer hs.Close()
+
+	// connect with the default deadlines
+	if _, err := hs.acquire(h.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	hs.release(h.PublicKey())
+
+	// new deadlines should apply to the existing session; a deadline in the
+	// past causes every RPC to time out
+	hs.SetDeadlines(0, 0, -time.Hour)
+	s, err := hs.acquire(h.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.release(h.PublicKey())
+	var ne net.Error
+	if _, err := s.Settings(); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	}
+}
+
+type saltedDeriver struct{ salt byte }
+
+func (kd saltedDeriver) DeriveKey(seed renter.KeySeed, nonce []byte) [32]byte {
+	seed[0] ^= kd.salt
+	return renter.XChaCha20Deriver{}.DeriveKey(seed, nonce)
+}
+
+func TestKVKeyDeriver(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 2, 3)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	kd := saltedDeriver{salt: 1}
+	kv.Uploader = ParallelChunkUploader{Hosts: hs, Deriver: kd}
+	kv.Downloader = ParallelChunkDownloader{Hosts: hs, Deriver: kd}
+
+	data := frand.Bytes(merkle.SegmentSize * 20)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("bad data")
+	}
+	// read from a nonzero segment index
+	var buf bytes.Buffer
+	off, n := int64(merkle.SegmentSize*3+5), int64(merkle.SegmentSize*4)
+	if err := kv.GetRange([]byte("foo"), &buf, off, n); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), data[off:][:n]) {
+		t.Fatal("bad data")
+	}
+
+	// the default deriver should not be able to decrypt the data
+	kv.Downloader = ParallelChunkDownloader{Hosts: hs}
+	if got, err := kv.GetBytes([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(got, data) {
+		t.Fatal("default deriver decrypted custom data")
+	}
+}
+
+func TestKVDeterministicPlacement(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 1, 5)
+	defer cleanup()
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+
+	var key renter.KeySeed
+	frand.Read(key[:])
+	shards := [][]byte{frand.Bytes(128), frand.Bytes(128)}
+	upload := func() []hostdb.HostPublicKey {
+		// use the same nonces for each upload, so that the sector roots match
+		var ctr byte
+		pcu := ParallelChunkUploader{
+			Hosts:                  hs,
+			Nonces:                 func() (n [24]byte) { ctr++; n[0] = ctr; return },
+			DeterministicPlacement: true,
+		}
+		c, err := kv.DB.AddChunk(1, len(shards), 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pcu.UploadChunk(context.Background(), kv.DB, c, key, shards); err != nil {
+			t.Fatal(err)
+		}
+		c, err = kv.DB.Chunk(c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := make([]hostdb.HostPublicKey, len(c.Shards))
+		for i, sid := range c.Shards {
+			s, err := kv.DB.Shard(sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts[i] = s.HostKey
+		}
+		return hosts
+	}
+
+	first := upload()
+	for i := 0; i < 3; i++ {
+		if hosts := upload(); !reflect.DeepEqual(hosts, first) {
+			t.Fatalf("placement changed: %v vs %v", hosts, first)
+		}
+	}
+	if first[0] == first[1] {
+		t.Fatal("shards placed on the same host")
+	}
+}
+
+// testLogger records logged messages.
+type testLogger struct {
+	msgs []string
+	mu   sync.Mutex
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+type stubHeight types.BlockHeight
+
+func (h *stubHeight) ChainHeight() (types.BlockHeight, error) { return types.BlockHeight(*h), nil }
+
+func TestContractExpiry(t *testing.T) {
+	// form contracts that end at height 1000
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	for i := 0; i < 3; i++ {
+		h, err := ghost.New(":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		sh := hostdb.ScannedHost{HostSettings: h.Settings(), PublicKey: h.PublicKey()}
+		rev, _, err := proto.FormContract(stubWallet{}, stubTpool{}, key, sh, types.ZeroCurrency, 0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(renter.Contract{HostKey: rev.HostKey(), ID: rev.ID(), RenterKey: key})
+	}
+	height := new(stubHeight)
+	kv := PseudoKV{
+		DB:         NewEphemeralMetaDB(),
+		M:          2,
+		N:          3,
+		P:          1,
+		Uploader:   ParallelChunkUploader{Hosts: hs},
+		Downloader: ParallelChunkDownloader{Hosts: hs, Height: height},
+	}
+	defer kv.Close()
+
+	data := frand.Bytes(1000)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), data); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []ChunkDownloader{
+		ParallelChunkDownloader{Hosts: hs, Height: height},
+		SerialChunkDownloader{Hosts: hs, Height: height},
+	} {
+		kv.Downloader = d
+		*height = 0
+		if got, err := kv.GetBytes([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("bad data")
+		}
+		// within RevisionSubmissionBuffer of the end height, the download
+		// should fail up front
+		*height = stubHeight(1000 - RevisionSubmissionBuffer)
+		if _, err := kv.GetBytes([]byte("foo")); !errors.Is(err, ErrContractExpired) {
+			t.Fatalf("%T: expected ErrContractExpired, got %v", d, err)
+		}
+	}
+}
+
+func TestKVLogger(t *testing.T) {
+	kv, cleanup := createTestingKV(t, 1, 3)
+	defer cleanup()
+	kv.N = 2
+	hs := kv.Uploader.(ParallelChunkUploader).Hosts
+	var l testLogger
+	hs.SetLogger(&l)
+	kv.Uploader = ParallelChunkUploader{Hosts: hs, Log: &l}
+	kv.Downloader = ParallelChunkDownloader{Hosts: hs, Log: &l}
+	kv.Log = &l
+
+	// make one host unreachable
+	var dead hostdb.HostPublicKey
+	for hostKey := range hs.sessions {
+		dead = hostKey
+		break
+	}
+	hs.hkr.(testHKR)[dead] = "127.0.0.1:1"
+
+	// hosts are chosen randomly, so upload until the dead host is chosen
+	ctx := context.Background()
+	for i := 0; i < 50 && !l.contains("could not upload shard"); i++ {
+		if err := kv.PutBytes(ctx, []byte(strconv.Itoa(i)), []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !l.contains("could not connect to " + dead.ShortKey()) {
+		t.Error("connection failure was not logged:", l.msgs)
+	}
+	if !l.contains("could not upload shard") {
+		t.Error("upload failure was not logged:", l.msgs)
+	}
+	if _, err := kv.CollectGarbage(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a nil Logger should be silent
+	n := len(l.msgs)
+	kv.Uploader = ParallelChunkUploader{Hosts: hs}
+	hs.SetLogger(nil)
+	if err := kv.PutBytes(ctx, []byte("bar"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	} else if len(l.msgs) != n {
+		t.Error("expected no messages to be logged")
+	}
+}
@@ -0,0 +1,134 @@
+package renterutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// livePollInterval is how often GetLive checks whether the next chunk of a
+// blob has been uploaded.
+const livePollInterval = 50 * time.Millisecond
+
+type liveUpload struct {
+	done chan struct{}
+}
+
+// An UploadWatcher tracks the blobs that a PseudoKV is currently uploading,
+// allowing them to be read with GetLive while the upload is in progress. It is
+// safe for concurrent use.
+type UploadWatcher struct {
+	uploads map[string]*liveUpload
+	mu      sync.Mutex
+}
+
+// begin marks key as being uploaded. The returned function must be called when
+// the upload finishes.
+func (uw *UploadWatcher) begin(key []byte) (end func()) {
+	lu := &liveUpload{done: make(chan struct{})}
+	uw.mu.Lock()
+	uw.uploads[string(key)] = lu
+	uw.mu.Unlock()
+	return func() {
+		uw.mu.Lock()
+		if uw.uploads[string(key)] == lu {
+			delete(uw.uploads, string(key))
+		}
+		uw.mu.Unlock()
+		close(lu.done)
+	}
+}
+
+// done returns a channel that is closed when the upload of key finishes. If key
+// is not being uploaded, the returned channel is already closed.
+func (uw *UploadWatcher) done(key []byte) <-chan struct{} {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	if lu, ok := uw.uploads[string(key)]; ok {
+		return lu.done
+	}
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// Uploading reports whether key is currently being uploaded.
+func (uw *UploadWatcher) Uploading(key []byte) bool {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	_, ok := uw.uploads[string(key)]
+	return ok
+}
+
+// NewUploadWatcher returns an empty UploadWatcher.
+func NewUploadWatcher() *UploadWatcher {
+	return &UploadWatcher{
+		uploads: make(map[string]*liveUpload),
+	}
+}
+
+// chunkReady reports whether enough shards of c have been uploaded for it to be
+// downloaded.
+func chunkReady(c DBChunk) bool {
+	var n int
+	for _, sid := range c.Shards {
+		if sid != 0 {
+			n++
+		}
+	}
+	return n >= int(c.MinShards)
+}
+
+// GetLive downloads the value associated with key and writes it to w, like Get.
+// However, if the value is still being uploaded (as reported by kv.Watcher),
+// GetLive downloads each chunk as soon as it is available, blocking until the
+// next chunk is ready or the upload finishes. To bound the time spent waiting
+// on a stalled upload, use a Context with a timeout.
+//
+// If kv.Watcher is nil, GetLive is equivalent to Get.
+func (kv PseudoKV) GetLive(ctx context.Context, key []byte, w io.Writer) error {
+	if kv.Watcher == nil {
+		return kv.Get(key, w)
+	}
+	done := kv.Watcher.done(key)
+	ticker := time.NewTicker(livePollInterval)
+	defer ticker.Stop()
+	bd := SerialBlobDownloader{D: kv.Downloader}
+	for i := 0; ; {
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		b, err := kv.DB.Blob(key)
+		if err != nil && (err != ErrKeyNotFound || finished) {
+			return err
+		}
+		for ; i < len(b.Chunks); i++ {
+			c, err := kv.DB.Chunk(b.Chunks[i])
+			if err != nil {
+				return err
+			} else if !chunkReady(c) && !finished {
+				break
+			}
+			next := DBBlob{Key: b.Key, Chunks: b.Chunks[i : i+1], Seed: b.Seed}
+			if err := bd.DownloadBlob(kv.DB, next, w, 0, -1); err != nil {
+				return err
+			}
+		}
+		if finished {
+			// the upload finished before we fetched the blob, so every
+			// chunk has been downloaded (or attempted)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		case <-ticker.C:
+		}
+	}
+}
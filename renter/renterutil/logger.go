@@ -0,0 +1,15 @@
+package renterutil
+
+// A Logger receives diagnostic messages from long-running operations, such as
+// host failures during uploads and downloads. It is satisfied by *log.Logger.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf logs a message with l, if l is non-nil.
+func logf(l Logger, format string, v ...interface{}) {
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
@@ -0,0 +1,111 @@
+package renterutil
+
+import (
+	"io"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// A Manifest contains everything needed to retrieve a blob from its hosts,
+// without access to the MetaDB that stores it. Since it includes the blob's
+// Seed, anyone holding a Manifest can decrypt the blob; it should be shared
+// with the same care as the data itself.
+type Manifest struct {
+	Seed   renter.KeySeed  `json:"seed"`
+	Chunks []ManifestChunk `json:"chunks"`
+}
+
+// A ManifestChunk is the Manifest representation of a DBChunk.
+type ManifestChunk struct {
+	MinShards uint8           `json:"minShards"`
+	Len       uint64          `json:"len"`
+	Shards    []ManifestShard `json:"shards"`
+}
+
+// A ManifestShard is the Manifest representation of a DBShard. Shards that
+// have not been uploaded are represented by the zero value.
+type ManifestShard struct {
+	HostKey    hostdb.HostPublicKey `json:"hostKey"`
+	SectorRoot crypto.Hash          `json:"sectorRoot"`
+	Offset     uint32               `json:"offset"`
+	Nonce      [24]byte             `json:"nonce"`
+}
+
+// BlobManifest returns a Manifest for the blob stored under key.
+func BlobManifest(db MetaDB, key []byte) (Manifest, error) {
+	b, err := db.Blob(key)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m := Manifest{
+		Seed:   b.Seed,
+		Chunks: make([]ManifestChunk, len(b.Chunks)),
+	}
+	for i, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return Manifest{}, err
+		}
+		mc := ManifestChunk{
+			MinShards: c.MinShards,
+			Len:       c.Len,
+			Shards:    make([]ManifestShard, len(c.Shards)),
+		}
+		for j, sid := range c.Shards {
+			if sid == 0 {
+				continue
+			}
+			s, err := db.Shard(sid)
+			if err != nil {
+				return Manifest{}, err
+			}
+			mc.Shards[j] = ManifestShard{
+				HostKey:    s.HostKey,
+				SectorRoot: s.SectorRoot,
+				Offset:     s.Offset,
+				Nonce:      s.Nonce,
+			}
+		}
+		m.Chunks[i] = mc
+	}
+	return m, nil
+}
+
+// DownloadFromManifest downloads the blob described by m from hosts, writing
+// it to w.
+func DownloadFromManifest(m Manifest, hosts *HostSet, w io.Writer) error {
+	// load the manifest into a throwaway db so that the usual downloaders can
+	// be used
+	db := NewEphemeralMetaDB()
+	b := DBBlob{
+		Key:  []byte("manifest"),
+		Seed: m.Seed,
+	}
+	for _, mc := range m.Chunks {
+		c, err := db.AddChunk(int(mc.MinShards), len(mc.Shards), mc.Len)
+		if err != nil {
+			return err
+		}
+		for i, ms := range mc.Shards {
+			if ms.HostKey == "" {
+				continue
+			}
+			sid, err := db.AddShard(DBShard{
+				HostKey:    ms.HostKey,
+				SectorRoot: ms.SectorRoot,
+				Offset:     ms.Offset,
+				Nonce:      ms.Nonce,
+			})
+			if err != nil {
+				return err
+			} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+				return err
+			}
+		}
+		b.Chunks = append(b.Chunks, c.ID)
+	}
+	bd := SerialBlobDownloader{D: ParallelChunkDownloader{Hosts: hosts}}
+	return bd.DownloadBlob(db, b, w, 0, -1)
+}
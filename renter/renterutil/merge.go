@@ -0,0 +1,179 @@
+package renterutil
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// A ConflictPolicy determines how MergeMetaDB handles a blob whose key is
+// already present in the destination.
+type ConflictPolicy int
+
+// ConflictPolicy values.
+const (
+	// ConflictSkip leaves the existing blob untouched and does not copy the
+	// new one.
+	ConflictSkip ConflictPolicy = iota
+	// ConflictOverwrite replaces the existing blob with the new one.
+	ConflictOverwrite
+	// ConflictRename copies the new blob under a fresh key, formed by
+	// appending ".1", ".2", etc. to the original key.
+	ConflictRename
+)
+
+// MergeMetaDB copies every blob in src, along with its chunks and shards, into
+// dst, returning the number of blobs copied. Collisions between keys in src and
+// dst are resolved according to onConflict.
+//
+// Since chunk and shard IDs are local to a MetaDB, each copied chunk and shard
+// is assigned a new ID in dst, and the blobs and chunks that reference them
+// are rewritten accordingly. A shard shared by multiple chunks in src is
+// copied only once, so it remains shared in dst. Likewise, shards already
+// present in dst (that is, shards with the same host, sector root, and offset)
+// are reused rather than copied. Chunks, however, are copied once per blob that
+// references them, since shard references are counted per chunk and a chunk
+// shared by multiple blobs would be released when any of them is deleted.
+// Metadata, tags, and notes are not copied.
+//
+// Existing shards are found by assuming that shard IDs are allocated
+// sequentially, as they are by the MetaDBs in this package.
+//
+// If MergeMetaDB returns an error, dst may contain some of the blobs in src.
+func MergeMetaDB(dst, src MetaDB, onConflict ConflictPolicy) (merged int, err error) {
+	keys, err := blobKeys(src)
+	if err != nil {
+		return 0, err
+	}
+	type shardLoc struct {
+		host   hostdb.HostPublicKey
+		root   crypto.Hash
+		offset uint32
+	}
+	existing := make(map[shardLoc]uint64)
+	for id := uint64(1); ; id++ {
+		s, err := dst.Shard(id)
+		if err == ErrKeyNotFound {
+			break
+		} else if errors.Is(err, ErrCorrupt) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		loc := shardLoc{s.HostKey, s.SectorRoot, s.Offset}
+		if _, ok := existing[loc]; !ok {
+			existing[loc] = id
+		}
+	}
+
+	shards := make(map[uint64]uint64) // src ID -> dst ID
+	copyShard := func(sid uint64) (uint64, error) {
+		if sid == 0 {
+			return 0, nil
+		} else if id, ok := shards[sid]; ok {
+			return id, nil
+		}
+		s, err := src.Shard(sid)
+		if err != nil {
+			return 0, err
+		}
+		loc := shardLoc{s.HostKey, s.SectorRoot, s.Offset}
+		id, ok := existing[loc]
+		if !ok {
+			if id, err = dst.AddShard(s); err != nil {
+				return 0, err
+			}
+			existing[loc] = id
+		}
+		shards[sid] = id
+		return id, nil
+	}
+	copyChunk := func(cid uint64) (uint64, error) {
+		c, err := src.Chunk(cid)
+		if err != nil {
+			return 0, err
+		}
+		nc, err := dst.AddChunk(int(c.MinShards), len(c.Shards), c.Len)
+		if err != nil {
+			return 0, err
+		}
+		for i, sid := range c.Shards {
+			id, err := copyShard(sid)
+			if err != nil {
+				return 0, err
+			} else if id == 0 {
+				continue
+			} else if err := dst.SetChunkShard(nc.ID, i, id); err != nil {
+				return 0, err
+			}
+		}
+		return nc.ID, nil
+	}
+
+	for _, key := range keys {
+		b, err := src.Blob(key)
+		if err != nil {
+			return merged, err
+		}
+		exists, err := hasBlob(dst, b.Key)
+		if err != nil {
+			return merged, err
+		}
+		if exists {
+			switch onConflict {
+			case ConflictSkip:
+				continue
+			case ConflictOverwrite:
+			case ConflictRename:
+				if b.Key, err = freeKey(dst, b.Key); err != nil {
+					return merged, err
+				}
+				exists = false
+			default:
+				return merged, fmt.Errorf("unknown conflict policy %v", onConflict)
+			}
+		}
+		ids := make([]uint64, len(b.Chunks))
+		for i, cid := range b.Chunks {
+			if ids[i], err = copyChunk(cid); err != nil {
+				return merged, fmt.Errorf("blob %q: %w", key, err)
+			}
+		}
+		b.Chunks = ids
+		if exists {
+			err = dst.ReplaceBlob(b)
+		} else {
+			err = dst.AddBlob(b)
+		}
+		if err != nil {
+			return merged, fmt.Errorf("blob %q: %w", key, err)
+		}
+		merged++
+	}
+	return merged, nil
+}
+
+// hasBlob reports whether db contains a blob with the specified key.
+func hasBlob(db MetaDB, key []byte) (bool, error) {
+	_, err := db.Blob(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// freeKey returns the first key of the form key.1, key.2, etc. not present in
+// db.
+func freeKey(db MetaDB, key []byte) ([]byte, error) {
+	for i := 1; ; i++ {
+		k := append(append([]byte(nil), key...), "."+strconv.Itoa(i)...)
+		if exists, err := hasBlob(db, k); err != nil {
+			return nil, err
+		} else if !exists {
+			return k, nil
+		}
+	}
+}
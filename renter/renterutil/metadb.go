@@ -1,27 +1,213 @@
 package renterutil
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
 	"sort"
 	"sync"
 	"time"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/bolt"
 	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
 )
 
 // ErrKeyNotFound is returned when a key is not found in a MetaDB.
 var ErrKeyNotFound = errors.New("key not found")
 
-// A DBBlob is the concatenation of one or more chunks.
+var errShardIndexOutOfRange = errors.New("shard index out of range")
+
+var errInvalidPageLimit = errors.New("page limit must be positive")
+
+// ErrCorrupt is returned when a record stored in a MetaDB fails its integrity
+// check.
+var ErrCorrupt = errors.New("record is corrupt")
+
+// ErrInvalidKey is returned when a blob key is empty or too long.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrInvalidTag is returned by AddTag when a tag is empty.
+var ErrInvalidTag = errors.New("invalid tag")
+
+// ErrDuplicateChunk is returned when a blob references the same chunk more
+// than once.
+var ErrDuplicateChunk = errors.New("chunk referenced more than once within blob")
+
+// ErrConflict is returned by ReplaceBlobIfUnchanged when the stored blob has
+// been modified.
+var ErrConflict = errors.New("blob was modified concurrently")
+
+// ErrClosed is returned when an operation is attempted on a closed MetaDB.
+var ErrClosed = errors.New("MetaDB is closed")
+
+// ErrZeroSeed is returned when a blob's Seed is the zero value.
+var ErrZeroSeed = errors.New("blob has zero seed")
+
+// DefaultMaxKeyLen is the default maximum length of a blob key.
+const DefaultMaxKeyLen = 4096
+
+// DefaultMaxBlobChunks is the default maximum number of chunks in a blob stored
+// by a BoltMetaDB. Even with the smallest possible chunks, this is enough for
+// blobs of several terabytes, while bounding the memory allocated when decoding
+// a corrupt blob record to 128 MiB.
+const DefaultMaxBlobChunks = 1 << 24
+
+// checkKey returns an error if key is empty or longer than maxLen.
+func checkKey(key []byte, maxLen int) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: key is empty", ErrInvalidKey)
+	} else if len(key) > maxLen {
+		return fmt.Errorf("%w: key length (%v) exceeds maximum (%v)", ErrInvalidKey, len(key), maxLen)
+	}
+	return nil
+}
+
+// checkTag returns an error if tag is empty.
+func checkTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("%w: tag is empty", ErrInvalidTag)
+	}
+	return nil
+}
+
+// checkChunkIDs returns an error if chunks contains any ID more than once.
+func checkChunkIDs(chunks []uint64) error {
+	seen := make(map[uint64]struct{}, len(chunks))
+	for _, cid := range chunks {
+		if _, ok := seen[cid]; ok {
+			return fmt.Errorf("%w: chunk %v", ErrDuplicateChunk, cid)
+		}
+		seen[cid] = struct{}{}
+	}
+	return nil
+}
+
+// checkChunkParams returns an error if an m-of-n chunk could never be decoded.
+func checkChunkParams(m, n int) error {
+	if m <= 0 || m > n || m > math.MaxUint8 {
+		return fmt.Errorf("invalid chunk redundancy (%v-of-%v)", m, n)
+	}
+	return nil
+}
+
+// discardChunks clears every slot of the chunks in cids, releasing their
+// shards so that they can be garbage-collected. It must only be called on
+// chunks that are not referenced by any blob, such as those created by an
+// operation that failed before storing its blob.
+func discardChunks(db MetaDB, cids []uint64) error {
+	for _, cid := range cids {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return err
+		}
+		for i := range c.Shards {
+			if err := db.SetChunkShard(cid, i, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkChunkShards returns an error if a chunk of the given length could not
+// be built from m-of-len(ss) shards.
+func checkChunkShards(m int, length uint64, ss []*DBShard) error {
+	if err := checkChunkParams(m, len(ss)); err != nil {
+		return err
+	} else if length > uint64(m)*renterhost.SectorSize {
+		return fmt.Errorf("chunk length (%v) exceeds capacity of %v shards", length, m)
+	}
+	for i, s := range ss {
+		if s == nil {
+			return fmt.Errorf("shard %v is nil", i)
+		}
+	}
+	return nil
+}
+
+// A DBBlob is the concatenation of zero or more chunks. A DBBlob with no
+// chunks represents an empty value.
 type DBBlob struct {
 	Key    []byte
 	Chunks []uint64
 	Seed   renter.KeySeed
+
+	// RedundancyTarget is the minimum number of shards of each chunk that
+	// should be stored on live hosts; see PseudoKV.BlobsBelowTarget. If zero,
+	// the target for each chunk is the number of shards it was uploaded
+	// with.
+	RedundancyTarget uint8
+
+	// ModTime is the time at which the blob was last added, replaced, or
+	// renamed. It is maintained by the MetaDB; any value supplied to AddBlob
+	// is ignored. Blobs stored before ModTime was recorded have a zero
+	// ModTime.
+	ModTime time.Time
+}
+
+// releasedChunks returns the chunks in old that are not in new, counting
+// multiplicity; these are the chunks released when old is replaced by new.
+func releasedChunks(old, new []uint64) []uint64 {
+	kept := make(map[uint64]int, len(new))
+	for _, cid := range new {
+		kept[cid]++
+	}
+	var released []uint64
+	for _, cid := range old {
+		if kept[cid] > 0 {
+			kept[cid]--
+		} else {
+			released = append(released, cid)
+		}
+	}
+	return released
+}
+
+// chunkTarget returns the redundancy target of c within b.
+func (b DBBlob) chunkTarget(c DBChunk) int {
+	if b.RedundancyTarget == 0 {
+		return len(c.Shards)
+	}
+	return int(b.RedundancyTarget)
+}
+
+// chunkRange returns the chunks in ids that overlap the byte range [start,
+// end), along with the offset of start within the first returned chunk.
+func chunkRange(ids []uint64, chunk func(id uint64) (DBChunk, error), start, end int64) ([]DBChunk, int64, error) {
+	if start < 0 || end < start {
+		return nil, 0, fmt.Errorf("invalid range [%v, %v)", start, end)
+	} else if start == end {
+		return nil, 0, nil
+	}
+	var chunks []DBChunk
+	var skip, off int64
+	for _, id := range ids {
+		if off >= end {
+			break
+		}
+		c, err := chunk(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if off+int64(c.Len) > start {
+			if chunks == nil {
+				skip = start - off
+			}
+			chunks = append(chunks, c)
+		}
+		off += int64(c.Len)
+	}
+	return chunks, skip, nil
 }
 
 // A DBChunk is a set of erasure-encoded shards.
@@ -33,20 +219,75 @@ type DBChunk struct {
 }
 
 // A DBShard is a piece of data stored on a Sia host.
+//
+// A shard need not occupy an entire sector: multiple shards may be packed into
+// the same sector, in which case they share a SectorRoot. Offset is the index
+// of the shard's first segment within the sector (not a byte offset), and is
+// also the segment index used to derive the shard's keystream. Shards that
+// occupy their own sector have an Offset of 0.
 type DBShard struct {
 	HostKey    hostdb.HostPublicKey
 	SectorRoot crypto.Hash
 	Offset     uint32
 	Nonce      [24]byte
+	ContractID types.FileContractID // of the contract used to upload the shard; may be empty
 	// NOTE: Length is not stored, as it can be derived from the DBChunk.Len
 }
 
-// A MetaDB stores the metadata of blobs stored on Sia hosts.
+// Verify checks that sector is the sector referenced by s, i.e. that its
+// Merkle root matches s.SectorRoot. If s is packed alongside other shards, the
+// entire sector is verified; use VerifySection to verify only the segments
+// belonging to s.
+func (s DBShard) Verify(sector *[renterhost.SectorSize]byte) error {
+	if root := merkle.SectorRoot(sector); root != s.SectorRoot {
+		return fmt.Errorf("sector has Merkle root %v, expected %v", root, s.SectorRoot)
+	}
+	return nil
+}
+
+// VerifySection checks that segments are the (encrypted) segments of the
+// sector referenced by s beginning at s.Offset, using a Merkle range proof
+// for the range [s.Offset, s.Offset+len(segments)/merkle.SegmentSize).
+func (s DBShard) VerifySection(segments []byte, proof []crypto.Hash) error {
+	if len(segments) == 0 || len(segments)%merkle.SegmentSize != 0 {
+		return fmt.Errorf("section length (%v) must be a non-zero multiple of the segment size", len(segments))
+	}
+	start := int(s.Offset)
+	end := start + len(segments)/merkle.SegmentSize
+	if end > merkle.SegmentsPerSector {
+		return fmt.Errorf("section [%v, %v) extends beyond end of sector", start, end)
+	} else if !merkle.VerifyProof(proof, segments, start, end, s.SectorRoot) {
+		return fmt.Errorf("invalid Merkle proof for segments [%v, %v) of sector %v", start, end, s.SectorRoot)
+	}
+	return nil
+}
+
+// A MetaDB stores the metadata of blobs stored on Sia hosts. Each method is
+// atomic; if the same blob is stored concurrently, the last write wins.
 type MetaDB interface {
 	AddBlob(b DBBlob) error
+	// ReplaceBlob atomically replaces the blob associated with b.Key (if any)
+	// with b, preserving its tags. Unlike AddBlob, it releases the old blob's
+	// chunks, so that shards it no longer references can be garbage-collected.
+	ReplaceBlob(b DBBlob) error
+	// ReplaceBlobIfUnchanged is like ReplaceBlob, but returns ErrConflict
+	// (without modifying the db) if the ModTime of the stored blob is not
+	// expectedModTime. A zero expectedModTime matches a missing blob. This
+	// allows callers to implement safe read-modify-write cycles.
+	ReplaceBlobIfUnchanged(b DBBlob, expectedModTime time.Time) error
 	Blob(key []byte) (DBBlob, error)
 	DeleteBlob(key []byte) error
+	RenameBlob(oldKey, newKey []byte) error
 	ForEachBlob(func(key []byte) error) error
+	// BlobPage returns up to limit keys, in sorted order, that follow after.
+	// If more keys remain, next is the cursor for the following page;
+	// otherwise, next is nil. limit must be positive.
+	BlobPage(after []byte, limit int) (keys [][]byte, next []byte, err error)
+	// BlobChunkRange returns the chunks of the blob associated with key that
+	// overlap the byte range [start, end), along with the offset of start
+	// within the first returned chunk. The range is clamped to the length of
+	// the blob.
+	BlobChunkRange(key []byte, start, end int64) ([]DBChunk, int64, error)
 
 	AddChunk(m, n int, length uint64) (DBChunk, error)
 	Chunk(id uint64) (DBChunk, error)
@@ -54,15 +295,97 @@ type MetaDB interface {
 
 	AddShard(s DBShard) (uint64, error)
 	Shard(id uint64) (DBShard, error)
+	// Shards returns the shards with the specified IDs, in the same order. An
+	// ID of 0 (denoting a shard that has not been uploaded) yields the zero
+	// DBShard.
+	Shards(ids []uint64) ([]DBShard, error)
+	// RemapHost changes the HostKey of every shard stored on old to new,
+	// returning the number of shards changed.
+	RemapHost(old, new hostdb.HostPublicKey) (int, error)
 
 	UnreferencedSectors() (map[hostdb.HostPublicKey][]crypto.Hash, error)
+	// BlobsReferencingHost returns, in sorted order, the key of every blob
+	// with at least one shard stored on host.
+	BlobsReferencingHost(host hostdb.HostPublicKey) ([][]byte, error)
+	// BlobsModifiedSince returns, in sorted order, the key of every blob whose
+	// ModTime is after t.
+	BlobsModifiedSince(t time.Time) ([][]byte, error)
 
 	AddMetadata(key, val []byte) error
 	Metadata(key []byte) ([]byte, error)
+	// ForEachMetadata calls fn on each metadata key and value, in sorted
+	// order. The key and value must not be retained after fn returns.
+	ForEachMetadata(fn func(key, val []byte) error) error
+	// IncrementMetadata atomically adds delta to the counter stored as the
+	// metadata associated with key, returning the new value. A missing
+	// counter is treated as zero.
+	IncrementMetadata(key []byte, delta int64) (int64, error)
+
+	// AddTag tags the blob stored under key. The tag must not be empty.
+	AddTag(key []byte, tag string) error
+	RemoveTag(key []byte, tag string) error
+	BlobsByTag(tag string) ([][]byte, error)
+
+	// SetBlobNote sets the free-text note associated with the blob stored
+	// under key; an empty note removes it. Notes are stored separately from
+	// metadata, and are moved by RenameBlob and removed by DeleteBlob.
+	SetBlobNote(key []byte, note string) error
+	// BlobNote returns the note associated with the blob stored under key, or
+	// the empty string if it has none.
+	BlobNote(key []byte) (string, error)
 
 	Close() error
 }
 
+// incrementCounter adds delta to the little-endian int64 counter encoded in v,
+// returning the new encoding and value. An empty v is treated as zero.
+func incrementCounter(v []byte, delta int64) ([]byte, int64, error) {
+	var n int64
+	if len(v) == 8 {
+		n = int64(binary.LittleEndian.Uint64(v))
+	} else if len(v) != 0 {
+		return nil, 0, fmt.Errorf("metadata value is not a counter (%v bytes)", len(v))
+	}
+	n += delta
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	return buf, n, nil
+}
+
+// SetMetaJSON stores the JSON encoding of v as the metadata associated with
+// key.
+func SetMetaJSON(db MetaDB, key string, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.AddMetadata([]byte(key), js)
+}
+
+// SetRedundancyTarget sets the RedundancyTarget of the blob associated with
+// key. A target of zero restores the default.
+func SetRedundancyTarget(db MetaDB, key []byte, target int) error {
+	if target < 0 || target > math.MaxUint8 {
+		return fmt.Errorf("invalid redundancy target (%v)", target)
+	}
+	b, err := db.Blob(key)
+	if err != nil {
+		return err
+	}
+	b.RedundancyTarget = uint8(target)
+	return db.AddBlob(b)
+}
+
+// GetMetaJSON decodes the JSON metadata associated with key into v. It returns
+// ErrKeyNotFound if no such metadata exists.
+func GetMetaJSON(db MetaDB, key string, v interface{}) error {
+	js, err := db.Metadata([]byte(key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, v)
+}
+
 // EphemeralMetaDB implements MetaDB in memory.
 type EphemeralMetaDB struct {
 	shards []DBShard
@@ -70,6 +393,12 @@ type EphemeralMetaDB struct {
 	blobs  map[string]DBBlob
 	refs   map[uint64]int
 	meta   map[string]string
+	tags   map[string]map[string]struct{}
+	notes  map[string]string
+	maxKey int
+	strict bool
+	noZero bool
+	closed bool
 	mu     sync.Mutex
 }
 
@@ -77,6 +406,9 @@ type EphemeralMetaDB struct {
 func (db *EphemeralMetaDB) AddShard(s DBShard) (uint64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
 	db.shards = append(db.shards, s)
 	return uint64(len(db.shards)), nil
 }
@@ -85,13 +417,61 @@ func (db *EphemeralMetaDB) AddShard(s DBShard) (uint64, error) {
 func (db *EphemeralMetaDB) Shard(id uint64) (DBShard, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return DBShard{}, ErrClosed
+	}
+	if id == 0 || id > uint64(len(db.shards)) {
+		return DBShard{}, ErrKeyNotFound
+	}
 	return db.shards[id-1], nil
 }
 
+// Shards implements MetaDB.
+func (db *EphemeralMetaDB) Shards(ids []uint64) ([]DBShard, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	shards := make([]DBShard, len(ids))
+	for i, id := range ids {
+		if id == 0 {
+			continue
+		} else if id > uint64(len(db.shards)) {
+			return nil, ErrKeyNotFound
+		}
+		shards[i] = db.shards[id-1]
+	}
+	return shards, nil
+}
+
+// RemapHost implements MetaDB.
+func (db *EphemeralMetaDB) RemapHost(old, new hostdb.HostPublicKey) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	var n int
+	for i := range db.shards {
+		if db.shards[i].HostKey == old {
+			db.shards[i].HostKey = new
+			n++
+		}
+	}
+	return n, nil
+}
+
 // AddChunk implements MetaDB.
 func (db *EphemeralMetaDB) AddChunk(m, n int, length uint64) (DBChunk, error) {
+	if err := checkChunkParams(m, n); err != nil {
+		return DBChunk{}, err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return DBChunk{}, ErrClosed
+	}
 	c := DBChunk{
 		ID:        uint64(len(db.chunks)) + 1,
 		Shards:    make([]uint64, n),
@@ -99,6 +479,7 @@ func (db *EphemeralMetaDB) AddChunk(m, n int, length uint64) (DBChunk, error) {
 		Len:       length,
 	}
 	db.chunks = append(db.chunks, c)
+	c.Shards = append([]uint64(nil), c.Shards...)
 	return c, nil
 }
 
@@ -106,6 +487,14 @@ func (db *EphemeralMetaDB) AddChunk(m, n int, length uint64) (DBChunk, error) {
 func (db *EphemeralMetaDB) SetChunkShard(id uint64, i int, s uint64) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if id == 0 || id > uint64(len(db.chunks)) {
+		return ErrKeyNotFound
+	} else if i < 0 || i >= len(db.chunks[id-1].Shards) {
+		return errShardIndexOutOfRange
+	}
 	db.refs[db.chunks[id-1].Shards[i]]--
 	db.chunks[id-1].Shards[i] = s
 	db.refs[s]++
@@ -113,6 +502,9 @@ func (db *EphemeralMetaDB) SetChunkShard(id uint64, i int, s uint64) error {
 }
 
 func (db *EphemeralMetaDB) AddChunkAndShards(m int, length uint64, ss []*DBShard) (c DBChunk, err error) {
+	if err := checkChunkShards(m, length, ss); err != nil {
+		return DBChunk{}, err
+	}
 	shards := make([]uint64, len(ss))
 	for i, s := range ss {
 		id, err := db.AddShard(*s)
@@ -123,6 +515,9 @@ func (db *EphemeralMetaDB) AddChunkAndShards(m int, length uint64, ss []*DBShard
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return DBChunk{}, ErrClosed
+	}
 	c = DBChunk{
 		ID:        uint64(len(db.chunks)) + 1,
 		Shards:    shards,
@@ -130,23 +525,92 @@ func (db *EphemeralMetaDB) AddChunkAndShards(m int, length uint64, ss []*DBShard
 		Len:       length,
 	}
 	db.chunks = append(db.chunks, c)
+	for _, sid := range shards {
+		db.refs[sid]++
+	}
 	return c, nil
 }
 
 // Chunk implements MetaDB.
 func (db *EphemeralMetaDB) Chunk(id uint64) (DBChunk, error) {
-	if id == 0 {
-		panic("GetChunk: unset id")
-	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.chunks[id-1], nil
+	if db.closed {
+		return DBChunk{}, ErrClosed
+	}
+	if id == 0 || id > uint64(len(db.chunks)) {
+		return DBChunk{}, ErrKeyNotFound
+	}
+	c := db.chunks[id-1]
+	c.Shards = append([]uint64(nil), c.Shards...)
+	return c, nil
 }
 
 // AddBlob implements MetaDB.
 func (db *EphemeralMetaDB) AddBlob(b DBBlob) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	} else if db.noZero && b.Seed == (renter.KeySeed{}) {
+		return fmt.Errorf("%q: %w", b.Key, ErrZeroSeed)
+	} else if db.strict {
+		if err := checkChunkIDs(b.Chunks); err != nil {
+			return err
+		}
+	}
+	b.ModTime = time.Now()
+	db.blobs[string(b.Key)] = b
+	return nil
+}
+
+// ReplaceBlob implements MetaDB.
+func (db *EphemeralMetaDB) ReplaceBlob(b DBBlob) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.replaceBlob(b)
+}
+
+// ReplaceBlobIfUnchanged implements MetaDB.
+func (db *EphemeralMetaDB) ReplaceBlobIfUnchanged(b DBBlob, expectedModTime time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.blobs[string(b.Key)].ModTime.Equal(expectedModTime) {
+		return fmt.Errorf("%q: %w", b.Key, ErrConflict)
+	}
+	return db.replaceBlob(b)
+}
+
+// replaceBlob implements ReplaceBlob. The caller must hold db.mu.
+func (db *EphemeralMetaDB) replaceBlob(b DBBlob) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	} else if db.noZero && b.Seed == (renter.KeySeed{}) {
+		return fmt.Errorf("%q: %w", b.Key, ErrZeroSeed)
+	} else if db.strict {
+		if err := checkChunkIDs(b.Chunks); err != nil {
+			return err
+		}
+	}
+	if old, ok := db.blobs[string(b.Key)]; ok {
+		for _, cid := range releasedChunks(old.Chunks, b.Chunks) {
+			if cid != 0 && cid <= uint64(len(db.chunks)) {
+				for _, sid := range db.chunks[cid-1].Shards {
+					db.refs[sid]--
+				}
+			}
+		}
+	}
+	b.ModTime = time.Now()
 	db.blobs[string(b.Key)] = b
 	return nil
 }
@@ -155,6 +619,9 @@ func (db *EphemeralMetaDB) AddBlob(b DBBlob) error {
 func (db *EphemeralMetaDB) Blob(key []byte) (DBBlob, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return DBBlob{}, ErrClosed
+	}
 	b, ok := db.blobs[string(key)]
 	if !ok {
 		return DBBlob{}, ErrKeyNotFound
@@ -166,26 +633,80 @@ func (db *EphemeralMetaDB) Blob(key []byte) (DBBlob, error) {
 func (db *EphemeralMetaDB) DeleteBlob(key []byte) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	b, ok := db.blobs[string(key)]
+	if db.closed {
+		return ErrClosed
+	}
+	db.deleteBlob(string(key))
+	for _, keys := range db.tags {
+		delete(keys, string(key))
+	}
+	return nil
+}
+
+func (db *EphemeralMetaDB) deleteBlob(key string) {
+	delete(db.notes, key)
+	b, ok := db.blobs[key]
 	if !ok {
-		return nil
+		return
 	}
 	for _, cid := range b.Chunks {
+		if cid == 0 || cid > uint64(len(db.chunks)) {
+			continue
+		}
 		for _, sid := range db.chunks[cid-1].Shards {
 			db.refs[sid]--
 		}
 	}
-	delete(db.blobs, string(key))
+	delete(db.blobs, key)
+}
+
+// RenameBlob implements MetaDB.
+func (db *EphemeralMetaDB) RenameBlob(oldKey, newKey []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := checkKey(newKey, db.maxKey); err != nil {
+		return err
+	}
+	b, ok := db.blobs[string(oldKey)]
+	if !ok {
+		return ErrKeyNotFound
+	} else if string(oldKey) == string(newKey) {
+		return nil
+	}
+	db.deleteBlob(string(newKey))
+	delete(db.blobs, string(oldKey))
+	b.Key = newKey
+	b.ModTime = time.Now()
+	db.blobs[string(newKey)] = b
+	if note, ok := db.notes[string(oldKey)]; ok {
+		delete(db.notes, string(oldKey))
+		db.notes[string(newKey)] = note
+	}
+	for _, keys := range db.tags {
+		delete(keys, string(newKey))
+		if _, ok := keys[string(oldKey)]; ok {
+			delete(keys, string(oldKey))
+			keys[string(newKey)] = struct{}{}
+		}
+	}
 	return nil
 }
 
 // ForEachBlob implements MetaDB.
 func (db *EphemeralMetaDB) ForEachBlob(fn func(key []byte) error) error {
 	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
 	var keys []string
 	for key := range db.blobs {
 		keys = append(keys, key)
 	}
+	// fn may call other methods of db, so release the lock before calling it
 	db.mu.Unlock()
 	sort.Strings(keys)
 	for _, key := range keys {
@@ -196,14 +717,63 @@ func (db *EphemeralMetaDB) ForEachBlob(fn func(key []byte) error) error {
 	return nil
 }
 
+// BlobPage implements MetaDB.
+func (db *EphemeralMetaDB) BlobPage(after []byte, limit int) (keys [][]byte, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errInvalidPageLimit
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
+	var sorted []string
+	for key := range db.blobs {
+		if key > string(after) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if len(keys) == limit {
+			next = keys[len(keys)-1]
+			break
+		}
+		keys = append(keys, []byte(key))
+	}
+	return keys, next, nil
+}
+
+// BlobChunkRange implements MetaDB.
+func (db *EphemeralMetaDB) BlobChunkRange(key []byte, start, end int64) ([]DBChunk, int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+	b, ok := db.blobs[string(key)]
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	return chunkRange(b.Chunks, func(id uint64) (DBChunk, error) {
+		if id == 0 || id > uint64(len(db.chunks)) {
+			return DBChunk{}, ErrKeyNotFound
+		}
+		return db.chunks[id-1], nil
+	}, start, end)
+}
+
 // UnreferencedSectors returns all sectors that are not referenced by any blob
 // in the db.
 func (db *EphemeralMetaDB) UnreferencedSectors() (map[hostdb.HostPublicKey][]crypto.Hash, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
 	m := make(map[hostdb.HostPublicKey][]crypto.Hash)
 	for sid, n := range db.refs {
-		if n == 0 {
+		if n == 0 && sid != 0 && sid <= uint64(len(db.shards)) {
 			s := db.shards[sid-1]
 			m[s.HostKey] = append(m[s.HostKey], s.SectorRoot)
 		}
@@ -211,10 +781,69 @@ func (db *EphemeralMetaDB) UnreferencedSectors() (map[hostdb.HostPublicKey][]cry
 	return m, nil
 }
 
+// BlobsReferencingHost implements MetaDB.
+func (db *EphemeralMetaDB) BlobsReferencingHost(host hostdb.HostPublicKey) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var sorted []string
+	for key, b := range db.blobs {
+		if db.blobReferencesHost(b, host) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	keys := make([][]byte, len(sorted))
+	for i := range keys {
+		keys[i] = []byte(sorted[i])
+	}
+	return keys, nil
+}
+
+// BlobsModifiedSince implements MetaDB.
+func (db *EphemeralMetaDB) BlobsModifiedSince(t time.Time) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var sorted []string
+	for key, b := range db.blobs {
+		if b.ModTime.After(t) {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	keys := make([][]byte, len(sorted))
+	for i := range keys {
+		keys[i] = []byte(sorted[i])
+	}
+	return keys, nil
+}
+
+func (db *EphemeralMetaDB) blobReferencesHost(b DBBlob, host hostdb.HostPublicKey) bool {
+	for _, cid := range b.Chunks {
+		if cid == 0 || cid > uint64(len(db.chunks)) {
+			continue
+		}
+		for _, sid := range db.chunks[cid-1].Shards {
+			if sid != 0 && sid <= uint64(len(db.shards)) && db.shards[sid-1].HostKey == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // AddMetadata implements MetaDB.
 func (db *EphemeralMetaDB) AddMetadata(key, val []byte) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
 	db.meta[string(key)] = string(val)
 	return nil
 }
@@ -223,6 +852,9 @@ func (db *EphemeralMetaDB) AddMetadata(key, val []byte) error {
 func (db *EphemeralMetaDB) Metadata(key []byte) ([]byte, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
 	md, ok := db.meta[string(key)]
 	if !ok {
 		return nil, ErrKeyNotFound
@@ -230,36 +862,459 @@ func (db *EphemeralMetaDB) Metadata(key []byte) ([]byte, error) {
 	return []byte(md), nil
 }
 
-// Close implements MetaDB.
-func (db *EphemeralMetaDB) Close() error {
-	return nil
+// IncrementMetadata implements MetaDB.
+func (db *EphemeralMetaDB) IncrementMetadata(key []byte, delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	v, n, err := incrementCounter([]byte(db.meta[string(key)]), delta)
+	if err != nil {
+		return 0, err
+	}
+	db.meta[string(key)] = string(v)
+	return n, nil
 }
 
-// NewEphemeralMetaDB initializes an EphemeralMetaDB.
-func NewEphemeralMetaDB() *EphemeralMetaDB {
-	db := &EphemeralMetaDB{
-		refs:  make(map[uint64]int),
-		blobs: make(map[string]DBBlob),
-		meta:  make(map[string]string),
+// ForEachMetadata implements MetaDB.
+func (db *EphemeralMetaDB) ForEachMetadata(fn func(key, val []byte) error) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
 	}
-	return db
+	keys := make([]string, 0, len(db.meta))
+	for key := range db.meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	vals := make([]string, len(keys))
+	for i, key := range keys {
+		vals[i] = db.meta[key]
+	}
+	// fn may call other methods of db, so release the lock before calling it
+	db.mu.Unlock()
+	for i := range keys {
+		if err := fn([]byte(keys[i]), []byte(vals[i])); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// BoltMetaDB implements MetaDB with a Bolt database.
-type BoltMetaDB struct {
-	bdb *bolt.DB
+// AddTag implements MetaDB.
+func (db *EphemeralMetaDB) AddTag(key []byte, tag string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := checkTag(tag); err != nil {
+		return err
+	}
+	if _, ok := db.blobs[string(key)]; !ok {
+		return ErrKeyNotFound
+	}
+	if db.tags[tag] == nil {
+		db.tags[tag] = make(map[string]struct{})
+	}
+	db.tags[tag][string(key)] = struct{}{}
+	return nil
 }
 
-var (
-	bucketBlobs  = []byte("blobs")
+// RemoveTag implements MetaDB.
+func (db *EphemeralMetaDB) RemoveTag(key []byte, tag string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	delete(db.tags[tag], string(key))
+	if len(db.tags[tag]) == 0 {
+		delete(db.tags, tag)
+	}
+	return nil
+}
+
+// BlobsByTag implements MetaDB.
+func (db *EphemeralMetaDB) BlobsByTag(tag string) ([][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var sorted []string
+	for key := range db.tags[tag] {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	keys := make([][]byte, len(sorted))
+	for i := range keys {
+		keys[i] = []byte(sorted[i])
+	}
+	return keys, nil
+}
+
+// SetBlobNote implements MetaDB.
+func (db *EphemeralMetaDB) SetBlobNote(key []byte, note string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if _, ok := db.blobs[string(key)]; !ok {
+		return ErrKeyNotFound
+	}
+	if note == "" {
+		delete(db.notes, string(key))
+	} else {
+		db.notes[string(key)] = note
+	}
+	return nil
+}
+
+// BlobNote implements MetaDB.
+func (db *EphemeralMetaDB) BlobNote(key []byte) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return "", ErrClosed
+	}
+	if _, ok := db.blobs[string(key)]; !ok {
+		return "", ErrKeyNotFound
+	}
+	return db.notes[string(key)], nil
+}
+
+// Close implements MetaDB. Subsequent operations return ErrClosed.
+func (db *EphemeralMetaDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	return nil
+}
+
+// NewEphemeralMetaDB initializes an EphemeralMetaDB.
+func NewEphemeralMetaDB() *EphemeralMetaDB {
+	db := &EphemeralMetaDB{
+		refs:   make(map[uint64]int),
+		blobs:  make(map[string]DBBlob),
+		meta:   make(map[string]string),
+		tags:   make(map[string]map[string]struct{}),
+		notes:  make(map[string]string),
+		maxKey: DefaultMaxKeyLen,
+	}
+	return db
+}
+
+// SetMaxKeyLen sets the maximum length of the keys accepted by AddBlob and
+// RenameBlob. If n <= 0, DefaultMaxKeyLen is used. Existing keys are not
+// affected.
+func (db *EphemeralMetaDB) SetMaxKeyLen(n int) {
+	if n <= 0 {
+		n = DefaultMaxKeyLen
+	}
+	db.mu.Lock()
+	db.maxKey = n
+	db.mu.Unlock()
+}
+
+// SetStrictChunks controls whether AddBlob and ReplaceBlob reject blobs that
+// reference the same chunk more than once, returning ErrDuplicateChunk. Such
+// blobs are never created by this package, but would corrupt refcount
+// accounting if introduced by a bug. Existing blobs are not affected; use
+// CheckBlobIntegrity to detect them.
+func (db *EphemeralMetaDB) SetStrictChunks(strict bool) {
+	db.mu.Lock()
+	db.strict = strict
+	db.mu.Unlock()
+}
+
+// SetRejectZeroSeeds controls whether AddBlob and ReplaceBlob reject blobs
+// whose Seed is the zero value, returning ErrZeroSeed. A zero Seed usually
+// indicates that a blob was never keyed. Existing blobs are not affected; use
+// CheckSeeds to detect them.
+func (db *EphemeralMetaDB) SetRejectZeroSeeds(reject bool) {
+	db.mu.Lock()
+	db.noZero = reject
+	db.mu.Unlock()
+}
+
+// BoltMetaDB implements MetaDB with a Bolt database.
+type BoltMetaDB struct {
+	bdb       *bolt.DB
+	maxKey    int
+	strict    bool
+	noZero    bool
+	checksums bool
+	maxChunks int
+	batch     bool
+
+	// closed is set by Close; active tracks the transactions that began
+	// before it was set, which Close waits for
+	closed bool
+	active sync.WaitGroup
+	mu     sync.Mutex
+}
+
+var (
+	bucketBlobs  = []byte("blobs")
 	bucketChunks = []byte("chunks")
 	bucketShards = []byte("shards")
 	bucketMeta   = []byte("meta")
+	bucketTags   = []byte("tags")
+	bucketNotes  = []byte("notes")
+
+	// reverse indices, used by BlobsReferencingHost
+	bucketHostShards  = []byte("hostShards")
+	bucketShardChunks = []byte("shardChunks")
+	bucketChunkBlobs  = []byte("chunkBlobs")
+
+	// time index, used by BlobsModifiedSince
+	bucketBlobModTimes = []byte("blobModTimes")
+
+	// shard reference counts, used by UnreferencedSectors
+	bucketShardRefs = []byte("shardRefs")
+
+	// schema version
+	bucketSchema = []byte("schema")
+	keyVersion   = []byte("version")
 )
 
+// schemaShardChecksums is the schema version at which shard records are
+// prefixed with a checksum. Dbs created before the schema was versioned have
+// version 0.
+const schemaShardChecksums = 1
+
+// The reverse indices map each host to its shards, each shard to the chunks
+// that contain it, and each chunk to the blobs that contain it. Each index
+// key is the concatenation of two identifiers, so that all of the entries for
+// the first identifier can be found with a prefix scan. Entries in
+// bucketShardChunks hold the number of times the shard appears in the chunk.
+//
+// The time index maps each blob's ModTime to its key. Index keys are the
+// big-endian ModTime (in nanoseconds), followed by the blob key, so that the
+// blobs modified after a given time can be found with a single seek. Blobs
+// with a zero ModTime are not indexed.
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, id)
+	return key
+}
+
+// hostPrefix returns the bucketHostShards prefix for host. The host key is
+// length-prefixed, so that no host's prefix is a prefix of another's.
+func hostPrefix(host hostdb.HostPublicKey) []byte {
+	prefix := make([]byte, binary.MaxVarintLen64+len(host))
+	n := binary.PutUvarint(prefix, uint64(len(host)))
+	return append(prefix[:n], host...)
+}
+
+// modTimeKey returns the bucketBlobModTimes prefix for t.
+func modTimeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func indexKey(prefix []byte, suffix []byte) []byte {
+	return append(append([]byte(nil), prefix...), suffix...)
+}
+
+// forEachIndexed calls fn with the suffix of each key in b that begins with
+// prefix.
+func forEachIndexed(b *bolt.Bucket, prefix []byte, fn func(suffix, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k[len(prefix):], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexShardChunk adds delta to the number of times shard sid appears in
+// chunk cid.
+func indexShardChunk(tx *bolt.Tx, sid, cid uint64, delta int) error {
+	if sid == 0 {
+		return nil
+	}
+	b := tx.Bucket(bucketShardChunks)
+	key := indexKey(idKey(sid), idKey(cid))
+	var n uint64
+	if v := b.Get(key); len(v) == 8 {
+		n = binary.LittleEndian.Uint64(v)
+	}
+	if delta < 0 && n < uint64(-delta) {
+		n = 0
+	} else {
+		n += uint64(delta)
+	}
+	if n == 0 {
+		return b.Delete(key)
+	}
+	return b.Put(key, idKey(n))
+}
+
+// indexBlob adds (or, if add is false, removes) the chunks of the blob stored
+// under key to bucketChunkBlobs, and its ModTime to bucketBlobModTimes.
+func indexBlob(tx *bolt.Tx, key []byte, blobBytes []byte, add bool, maxChunks int) error {
+	if len(blobBytes) == 0 {
+		return nil
+	}
+	var blob DBBlob
+	if err := decodeBlob(blobBytes, &blob, maxChunks); err != nil {
+		return err
+	}
+	b := tx.Bucket(bucketChunkBlobs)
+	for _, cid := range blob.Chunks {
+		var err error
+		if add {
+			err = b.Put(indexKey(idKey(cid), key), []byte{})
+		} else {
+			err = b.Delete(indexKey(idKey(cid), key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if blob.ModTime.IsZero() {
+		return nil
+	}
+	mb := tx.Bucket(bucketBlobModTimes)
+	if add {
+		return mb.Put(indexKey(modTimeKey(blob.ModTime), key), []byte{})
+	}
+	return mb.Delete(indexKey(modTimeKey(blob.ModTime), key))
+}
+
+// Each entry in bucketShardRefs holds the number of chunk slots that refer to
+// a shard, less the number of times a blob has released a chunk containing
+// it. A shard whose count has fallen to zero is garbage; shards that have
+// never been assigned to a chunk have no entry.
+
+// adjustRef adds delta to the reference count of shard sid.
+func adjustRef(tx *bolt.Tx, sid uint64, delta int64) error {
+	if sid == 0 {
+		return nil
+	}
+	b := tx.Bucket(bucketShardRefs)
+	key := idKey(sid)
+	var n int64
+	if v := b.Get(key); len(v) == 8 {
+		n = int64(binary.LittleEndian.Uint64(v))
+	}
+	return b.Put(key, idKey(uint64(n+delta)))
+}
+
+// releaseChunks decrements the reference count of each shard of the chunks
+// in cids. Missing chunks are ignored.
+func releaseChunks(tx *bolt.Tx, cids []uint64) error {
+	for _, cid := range cids {
+		chunkBytes := tx.Bucket(bucketChunks).Get(idKey(cid))
+		if chunkBytes == nil {
+			continue
+		}
+		var c DBChunk
+		if err := encoding.Unmarshal(chunkBytes, &c); err != nil {
+			return err
+		}
+		for _, sid := range c.Shards {
+			if err := adjustRef(tx, sid, -1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storedBlobChunks returns the chunks of the blob stored under key, if any.
+func storedBlobChunks(tx *bolt.Tx, key []byte, maxChunks int) ([]uint64, error) {
+	blobBytes := tx.Bucket(bucketBlobs).Get(key)
+	if len(blobBytes) == 0 {
+		return nil, nil
+	}
+	var b DBBlob
+	err := decodeBlob(blobBytes, &b, maxChunks)
+	return b.Chunks, err
+}
+
+// rebuildRefs populates bucketShardRefs from the contents of db. It is called
+// when opening a db that predates reference counting. Since the history of
+// released chunks is not available, each shard is counted once per slot in
+// the chunks of live blobs; shards that only appear in other chunks are
+// considered garbage.
+func rebuildRefs(tx *bolt.Tx, maxChunks int) error {
+	live := make(map[uint64]bool)
+	err := tx.Bucket(bucketBlobs).ForEach(func(_, v []byte) error {
+		var b DBBlob
+		if err := decodeBlob(v, &b, maxChunks); err != nil {
+			return err
+		}
+		for _, cid := range b.Chunks {
+			live[cid] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketChunks).ForEach(func(_, v []byte) error {
+		var c DBChunk
+		if err := encoding.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		for _, sid := range c.Shards {
+			var delta int64
+			if live[c.ID] {
+				delta = 1
+			}
+			if err := adjustRef(tx, sid, delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rebuildIndices populates the reverse indices from the contents of db. It is
+// called when opening a db that predates them.
+func rebuildIndices(tx *bolt.Tx, checksums bool, maxChunks int) error {
+	err := tx.Bucket(bucketShards).ForEach(func(k, v []byte) error {
+		var s DBShard
+		if err := decodeShard(v, checksums, &s); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketHostShards).Put(indexKey(hostPrefix(s.HostKey), k), []byte{})
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketChunks).ForEach(func(k, v []byte) error {
+		var c DBChunk
+		if err := encoding.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		for _, sid := range c.Shards {
+			if err := indexShardChunk(tx, sid, c.ID, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketBlobs).ForEach(func(k, v []byte) error {
+		return indexBlob(tx, k, v, true, maxChunks)
+	})
+}
+
 // AddShard implements MetaDB.
 func (db *BoltMetaDB) AddShard(s DBShard) (id uint64, err error) {
-	err = db.bdb.Update(func(tx *bolt.Tx) error {
+	err = db.update(func(tx *bolt.Tx) error {
 		id, err = db.addShard(tx, s)
 		return err
 	})
@@ -271,28 +1326,165 @@ func (db *BoltMetaDB) addShard(tx *bolt.Tx, s DBShard) (id uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	key := make([]byte, 8)
-	binary.LittleEndian.PutUint64(key, id)
-	err = tx.Bucket(bucketShards).Put(key, encoding.Marshal(s))
+	key := idKey(id)
+	err = tx.Bucket(bucketShards).Put(key, encodeShard(s, db.checksums))
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Bucket(bucketHostShards).Put(indexKey(hostPrefix(s.HostKey), key), []byte{})
 	if err != nil {
 		return 0, err
 	}
 	return id, nil
 }
 
+// encodeShard encodes s for storage in a BoltMetaDB. If checksums is true, the
+// encoding is prefixed with its CRC-32 checksum.
+func encodeShard(s DBShard, checksums bool) []byte {
+	b := encoding.Marshal(s)
+	if !checksums {
+		return b
+	}
+	buf := make([]byte, 4, 4+len(b))
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(b))
+	return append(buf, b...)
+}
+
+// decodeShard decodes a DBShard stored by a BoltMetaDB. If checksums is true,
+// the checksum prefix is verified, and ErrCorrupt is returned if it does not
+// match. Shards stored before the ContractID field was added are decoded with
+// an empty ContractID.
+func decodeShard(b []byte, checksums bool, s *DBShard) error {
+	if checksums {
+		if len(b) < 4 || binary.LittleEndian.Uint32(b) != crc32.ChecksumIEEE(b[4:]) {
+			return ErrCorrupt
+		}
+		b = b[4:]
+	}
+	if err := encoding.Unmarshal(b, s); err == nil {
+		return nil
+	}
+	*s = DBShard{}
+	return encoding.UnmarshalAll(b, &s.HostKey, &s.SectorRoot, &s.Offset, &s.Nonce)
+}
+
+// encodeBlob encodes b, excluding its Key, for storage in a BoltMetaDB.
+func encodeBlob(b DBBlob) []byte {
+	var modTime uint64
+	if !b.ModTime.IsZero() {
+		modTime = uint64(b.ModTime.UnixNano())
+	}
+	return encoding.MarshalAll(b.Chunks, b.Seed, b.RedundancyTarget, modTime)
+}
+
+// decodeBlob decodes a DBBlob stored by a BoltMetaDB, excluding its Key. Blobs
+// stored before the RedundancyTarget or ModTime fields were added are decoded
+// with a zero RedundancyTarget or ModTime. If the encoding claims more than
+// maxChunks chunks, decodeBlob returns ErrCorrupt without decoding them.
+func decodeBlob(blobBytes []byte, b *DBBlob, maxChunks int) error {
+	if len(blobBytes) < 8 {
+		return fmt.Errorf("%w: blob record is truncated", ErrCorrupt)
+	} else if n := binary.LittleEndian.Uint64(blobBytes); n > uint64(maxChunks) {
+		return fmt.Errorf("%w: blob has %v chunks (max %v)", ErrCorrupt, n, maxChunks)
+	}
+	var modTime uint64
+	if err := encoding.UnmarshalAll(blobBytes, &b.Chunks, &b.Seed, &b.RedundancyTarget, &modTime); err == nil {
+		b.ModTime = time.Time{}
+		if modTime != 0 {
+			b.ModTime = time.Unix(0, int64(modTime))
+		}
+		return nil
+	}
+	b.Chunks, b.Seed, b.RedundancyTarget, b.ModTime = nil, renter.KeySeed{}, 0, time.Time{}
+	if err := encoding.UnmarshalAll(blobBytes, &b.Chunks, &b.Seed, &b.RedundancyTarget); err == nil {
+		return nil
+	}
+	b.Chunks, b.Seed, b.RedundancyTarget = nil, renter.KeySeed{}, 0
+	return encoding.UnmarshalAll(blobBytes, &b.Chunks, &b.Seed)
+}
+
 // Shard implements MetaDB.
 func (db *BoltMetaDB) Shard(id uint64) (s DBShard, err error) {
 	key := make([]byte, 8)
 	binary.LittleEndian.PutUint64(key, id)
-	err = db.bdb.View(func(tx *bolt.Tx) error {
-		return encoding.Unmarshal(tx.Bucket(bucketShards).Get(key), &s)
+	err = db.view(func(tx *bolt.Tx) error {
+		shardBytes := tx.Bucket(bucketShards).Get(key)
+		if shardBytes == nil {
+			return ErrKeyNotFound
+		} else if err := decodeShard(shardBytes, db.checksums, &s); err != nil {
+			return fmt.Errorf("shard %v: %w", id, err)
+		}
+		return nil
+	})
+	return
+}
+
+// Shards implements MetaDB.
+func (db *BoltMetaDB) Shards(ids []uint64) (shards []DBShard, err error) {
+	shards = make([]DBShard, len(ids))
+	err = db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketShards)
+		for i, id := range ids {
+			if id == 0 {
+				continue
+			}
+			shardBytes := b.Get(idKey(id))
+			if shardBytes == nil {
+				return ErrKeyNotFound
+			} else if err := decodeShard(shardBytes, db.checksums, &shards[i]); err != nil {
+				return fmt.Errorf("shard %v: %w", id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// RemapHost implements MetaDB.
+func (db *BoltMetaDB) RemapHost(old, new hostdb.HostPublicKey) (n int, err error) {
+	err = db.update(func(tx *bolt.Tx) error {
+		// collect the shards first, since modifying a bucket during iteration
+		// may invalidate its cursor
+		b := tx.Bucket(bucketShards)
+		hs := tx.Bucket(bucketHostShards)
+		updated := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			var s DBShard
+			if err := decodeShard(v, db.checksums, &s); err != nil {
+				return err
+			} else if s.HostKey == old {
+				s.HostKey = new
+				updated[string(k)] = encodeShard(s, db.checksums)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updated {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			} else if err := hs.Delete(indexKey(hostPrefix(old), []byte(k))); err != nil {
+				return err
+			} else if err := hs.Put(indexKey(hostPrefix(new), []byte(k)), []byte{}); err != nil {
+				return err
+			}
+		}
+		n = len(updated)
+		return nil
 	})
 	return
 }
 
 // AddChunk implements MetaDB.
 func (db *BoltMetaDB) AddChunk(m, n int, length uint64) (c DBChunk, err error) {
-	err = db.bdb.Update(func(tx *bolt.Tx) error {
+	if err := checkChunkParams(m, n); err != nil {
+		return DBChunk{}, err
+	}
+	err = db.update(func(tx *bolt.Tx) error {
 		c, err = db.addChunk(tx, m, length, make([]uint64, n))
 		return err
 	})
@@ -316,16 +1508,38 @@ func (db *BoltMetaDB) addChunk(tx *bolt.Tx, m int, length uint64, shards []uint6
 	if err != nil {
 		return DBChunk{}, err
 	}
+	for _, sid := range shards {
+		if err := indexShardChunk(tx, sid, id, 1); err != nil {
+			return DBChunk{}, err
+		} else if err := adjustRef(tx, sid, 1); err != nil {
+			return DBChunk{}, err
+		}
+	}
 	return c, nil
 }
 
 // SetChunkShard implements MetaDB.
 func (db *BoltMetaDB) SetChunkShard(id uint64, i int, s uint64) error {
-	return db.bdb.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		key := make([]byte, 8)
 		binary.LittleEndian.PutUint64(key, id)
+		chunkBytes := tx.Bucket(bucketChunks).Get(key)
+		if chunkBytes == nil {
+			return ErrKeyNotFound
+		}
 		var c DBChunk
-		if err := encoding.Unmarshal(tx.Bucket(bucketChunks).Get(key), &c); err != nil {
+		if err := encoding.Unmarshal(chunkBytes, &c); err != nil {
+			return err
+		} else if i < 0 || i >= len(c.Shards) {
+			return errShardIndexOutOfRange
+		}
+		if err := indexShardChunk(tx, c.Shards[i], id, -1); err != nil {
+			return err
+		} else if err := indexShardChunk(tx, s, id, 1); err != nil {
+			return err
+		} else if err := adjustRef(tx, c.Shards[i], -1); err != nil {
+			return err
+		} else if err := adjustRef(tx, s, 1); err != nil {
 			return err
 		}
 		c.Shards[i] = s
@@ -334,12 +1548,15 @@ func (db *BoltMetaDB) SetChunkShard(id uint64, i int, s uint64) error {
 }
 
 func (db *BoltMetaDB) AddChunkAndShards(m int, length uint64, ss []*DBShard) (c DBChunk, err error) {
-	err = db.bdb.Update(func(tx *bolt.Tx) error {
+	if err := checkChunkShards(m, length, ss); err != nil {
+		return DBChunk{}, err
+	}
+	err = db.update(func(tx *bolt.Tx) error {
 		shards := make([]uint64, len(ss))
 		for i, s := range ss {
 			id, err := db.addShard(tx, *s)
 			if err != nil {
-				return nil
+				return err
 			}
 			shards[i] = id
 		}
@@ -353,76 +1570,554 @@ func (db *BoltMetaDB) AddChunkAndShards(m int, length uint64, ss []*DBShard) (c
 func (db *BoltMetaDB) Chunk(id uint64) (c DBChunk, err error) {
 	key := make([]byte, 8)
 	binary.LittleEndian.PutUint64(key, id)
-	err = db.bdb.View(func(tx *bolt.Tx) error {
-		return encoding.Unmarshal(tx.Bucket(bucketChunks).Get(key), &c)
+	err = db.view(func(tx *bolt.Tx) error {
+		chunkBytes := tx.Bucket(bucketChunks).Get(key)
+		if chunkBytes == nil {
+			return ErrKeyNotFound
+		}
+		return encoding.Unmarshal(chunkBytes, &c)
 	})
 	return
 }
 
 // AddBlob implements MetaDB.
 func (db *BoltMetaDB) AddBlob(b DBBlob) error {
-	return db.bdb.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(bucketBlobs).Put(b.Key, encoding.MarshalAll(b.Chunks, b.Seed))
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	return db.addBlob(b, false, nil)
+}
+
+// ReplaceBlob implements MetaDB.
+func (db *BoltMetaDB) ReplaceBlob(b DBBlob) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	return db.addBlob(b, true, nil)
+}
+
+// ReplaceBlobIfUnchanged implements MetaDB.
+func (db *BoltMetaDB) ReplaceBlobIfUnchanged(b DBBlob, expectedModTime time.Time) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	return db.addBlob(b, true, &expectedModTime)
+}
+
+// addBlob stores b. If replace is true, the chunks of the existing blob (if
+// any) that b no longer references are released. If expectedModTime is
+// non-nil, ErrConflict is returned unless it matches the ModTime of the
+// existing blob.
+func (db *BoltMetaDB) addBlob(b DBBlob, replace bool, expectedModTime *time.Time) error {
+	if db.noZero && b.Seed == (renter.KeySeed{}) {
+		return fmt.Errorf("%q: %w", b.Key, ErrZeroSeed)
+	}
+	if len(b.Chunks) > db.maxChunks {
+		return fmt.Errorf("%q: blob has %v chunks (max %v)", b.Key, len(b.Chunks), db.maxChunks)
+	}
+	if db.strict {
+		if err := checkChunkIDs(b.Chunks); err != nil {
+			return err
+		}
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(bucketBlobs)
+		if expectedModTime != nil {
+			var old DBBlob
+			if v := blobs.Get(b.Key); len(v) > 0 {
+				if err := decodeBlob(v, &old, db.maxChunks); err != nil {
+					return err
+				}
+			}
+			if !old.ModTime.Equal(*expectedModTime) {
+				return fmt.Errorf("%q: %w", b.Key, ErrConflict)
+			}
+		}
+		if replace {
+			old, err := storedBlobChunks(tx, b.Key, db.maxChunks)
+			if err != nil {
+				return err
+			} else if err := releaseChunks(tx, releasedChunks(old, b.Chunks)); err != nil {
+				return err
+			}
+		}
+		b.ModTime = time.Now()
+		blobBytes := encodeBlob(b)
+		if err := indexBlob(tx, b.Key, blobs.Get(b.Key), false, db.maxChunks); err != nil {
+			return err
+		} else if err := indexBlob(tx, b.Key, blobBytes, true, db.maxChunks); err != nil {
+			return err
+		}
+		return blobs.Put(b.Key, blobBytes)
 	})
 }
 
 // Blob implements MetaDB.
 func (db *BoltMetaDB) Blob(key []byte) (b DBBlob, err error) {
-	err = db.bdb.View(func(tx *bolt.Tx) error {
+	err = db.view(func(tx *bolt.Tx) error {
 		blobBytes := tx.Bucket(bucketBlobs).Get(key)
 		if len(blobBytes) == 0 {
 			return ErrKeyNotFound
 		}
-		return encoding.UnmarshalAll(blobBytes, &b.Chunks, &b.Seed)
+		return decodeBlob(blobBytes, &b, db.maxChunks)
 	})
+	if err != nil {
+		return DBBlob{}, err
+	}
 	b.Key = key
 	return
 }
 
 // DeleteBlob implements MetaDB.
 func (db *BoltMetaDB) DeleteBlob(key []byte) error {
-	return db.bdb.Update(func(tx *bolt.Tx) error {
-		// TODO: refcounts
-		return tx.Bucket(bucketBlobs).Delete(key)
+	return db.update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(bucketBlobs)
+		if old, err := storedBlobChunks(tx, key, db.maxChunks); err != nil {
+			return err
+		} else if err := releaseChunks(tx, old); err != nil {
+			return err
+		} else if err := indexBlob(tx, key, blobs.Get(key), false, db.maxChunks); err != nil {
+			return err
+		} else if err := blobs.Delete(key); err != nil {
+			return err
+		} else if err := tx.Bucket(bucketNotes).Delete(key); err != nil {
+			return err
+		}
+		return db.removeAllTags(tx, key)
+	})
+}
+
+// removeAllTags removes key from every tag bucket.
+func (db *BoltMetaDB) removeAllTags(tx *bolt.Tx, key []byte) error {
+	return tx.Bucket(bucketTags).ForEach(func(tag, _ []byte) error {
+		return tx.Bucket(bucketTags).Bucket(tag).Delete(key)
+	})
+}
+
+// RenameBlob implements MetaDB.
+func (db *BoltMetaDB) RenameBlob(oldKey, newKey []byte) error {
+	if err := checkKey(newKey, db.maxKey); err != nil {
+		return err
+	}
+	return db.renameBlob(oldKey, newKey)
+}
+
+func (db *BoltMetaDB) renameBlob(oldKey, newKey []byte) error {
+	return db.update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(bucketBlobs)
+		blobBytes := blobs.Get(oldKey)
+		if len(blobBytes) == 0 {
+			return ErrKeyNotFound
+		} else if bytes.Equal(oldKey, newKey) {
+			return nil
+		}
+		var b DBBlob
+		if err := decodeBlob(blobBytes, &b, db.maxChunks); err != nil {
+			return err
+		}
+		b.ModTime = time.Now()
+		newBytes := encodeBlob(b)
+		if old, err := storedBlobChunks(tx, newKey, db.maxChunks); err != nil {
+			return err
+		} else if err := releaseChunks(tx, old); err != nil {
+			return err
+		} else if err := indexBlob(tx, newKey, blobs.Get(newKey), false, db.maxChunks); err != nil {
+			return err
+		} else if err := indexBlob(tx, oldKey, blobBytes, false, db.maxChunks); err != nil {
+			return err
+		} else if err := indexBlob(tx, newKey, newBytes, true, db.maxChunks); err != nil {
+			return err
+		}
+		if err := blobs.Put(newKey, newBytes); err != nil {
+			return err
+		} else if err := blobs.Delete(oldKey); err != nil {
+			return err
+		}
+		// move note
+		notes := tx.Bucket(bucketNotes)
+		note := notes.Get(oldKey)
+		if note == nil {
+			if err := notes.Delete(newKey); err != nil {
+				return err
+			}
+		} else if err := notes.Put(newKey, append([]byte(nil), note...)); err != nil {
+			return err
+		} else if err := notes.Delete(oldKey); err != nil {
+			return err
+		}
+		// move tags
+		return tx.Bucket(bucketTags).ForEach(func(tag, _ []byte) error {
+			b := tx.Bucket(bucketTags).Bucket(tag)
+			if err := b.Delete(newKey); err != nil {
+				return err
+			} else if b.Get(oldKey) == nil {
+				return nil
+			} else if err := b.Delete(oldKey); err != nil {
+				return err
+			}
+			return b.Put(newKey, []byte{})
+		})
 	})
 }
 
 // ForEachBlob implements MetaDB.
 func (db *BoltMetaDB) ForEachBlob(fn func(key []byte) error) error {
-	return db.bdb.View(func(tx *bolt.Tx) error {
+	return db.view(func(tx *bolt.Tx) error {
 		return tx.Bucket(bucketBlobs).ForEach(func(k, _ []byte) error {
 			return fn(k)
 		})
 	})
 }
 
+// BlobPage implements MetaDB.
+func (db *BoltMetaDB) BlobPage(after []byte, limit int) (keys [][]byte, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errInvalidPageLimit
+	}
+	err = db.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketBlobs).Cursor()
+		k, _ := c.Seek(after)
+		if k != nil && after != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+		for ; k != nil; k, _ = c.Next() {
+			if len(keys) == limit {
+				next = keys[len(keys)-1]
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	return
+}
+
+// BlobChunkRange implements MetaDB.
+func (db *BoltMetaDB) BlobChunkRange(key []byte, start, end int64) (chunks []DBChunk, skip int64, err error) {
+	err = db.view(func(tx *bolt.Tx) error {
+		blobBytes := tx.Bucket(bucketBlobs).Get(key)
+		if len(blobBytes) == 0 {
+			return ErrKeyNotFound
+		}
+		var b DBBlob
+		if err := decodeBlob(blobBytes, &b, db.maxChunks); err != nil {
+			return err
+		}
+		chunkBucket := tx.Bucket(bucketChunks)
+		chunks, skip, err = chunkRange(b.Chunks, func(id uint64) (c DBChunk, err error) {
+			chunkBytes := chunkBucket.Get(idKey(id))
+			if chunkBytes == nil {
+				return DBChunk{}, ErrKeyNotFound
+			}
+			err = encoding.Unmarshal(chunkBytes, &c)
+			return
+		}, start, end)
+		return err
+	})
+	return
+}
+
 // UnreferencedSectors returns all sectors that are not referenced by any blob
 // in the db.
-func (db *BoltMetaDB) UnreferencedSectors() (map[hostdb.HostPublicKey][]crypto.Hash, error) {
-	return nil, nil // TODO
+func (db *BoltMetaDB) UnreferencedSectors() (m map[hostdb.HostPublicKey][]crypto.Hash, err error) {
+	m = make(map[hostdb.HostPublicKey][]crypto.Hash)
+	err = db.view(func(tx *bolt.Tx) error {
+		shards := tx.Bucket(bucketShards)
+		return tx.Bucket(bucketShardRefs).ForEach(func(k, v []byte) error {
+			if binary.LittleEndian.Uint64(v) != 0 {
+				return nil
+			}
+			shardBytes := shards.Get(k)
+			if shardBytes == nil {
+				return nil
+			}
+			var s DBShard
+			if err := decodeShard(shardBytes, db.checksums, &s); err != nil {
+				return err
+			}
+			m[s.HostKey] = append(m[s.HostKey], s.SectorRoot)
+			return nil
+		})
+	})
+	return
+}
+
+// BlobsReferencingHost implements MetaDB.
+func (db *BoltMetaDB) BlobsReferencingHost(host hostdb.HostPublicKey) (keys [][]byte, err error) {
+	err = db.view(func(tx *bolt.Tx) error {
+		keys, err = blobsReferencingHost(tx, host)
+		return err
+	})
+	return
+}
+
+// BlobsModifiedSince implements MetaDB.
+func (db *BoltMetaDB) BlobsModifiedSince(t time.Time) (keys [][]byte, err error) {
+	err = db.view(func(tx *bolt.Tx) error {
+		keys, err = blobsModifiedSince(tx, t)
+		return err
+	})
+	return
+}
+
+// blobsModifiedSince scans the time index for blobs modified after t.
+func blobsModifiedSince(tx *bolt.Tx, t time.Time) ([][]byte, error) {
+	var keys [][]byte
+	c := tx.Bucket(bucketBlobModTimes).Cursor()
+	k, _ := c.First()
+	if t.After(time.Unix(0, 0)) {
+		k, _ = c.Seek(modTimeKey(t.Add(time.Nanosecond)))
+	}
+	for ; k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k[8:]...))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys, nil
+}
+
+// blobsReferencingHost walks the reverse indices from host to its shards, to
+// the chunks containing them, to the blobs containing those chunks.
+func blobsReferencingHost(tx *bolt.Tx, host hostdb.HostPublicKey) ([][]byte, error) {
+	seen := make(map[string]struct{})
+	err := forEachIndexed(tx.Bucket(bucketHostShards), hostPrefix(host), func(sid, _ []byte) error {
+		return forEachIndexed(tx.Bucket(bucketShardChunks), sid, func(cid, _ []byte) error {
+			return forEachIndexed(tx.Bucket(bucketChunkBlobs), cid, func(key, _ []byte) error {
+				seen[string(key)] = struct{}{}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, 0, len(seen))
+	for key := range seen {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	keys := make([][]byte, len(sorted))
+	for i := range keys {
+		keys[i] = []byte(sorted[i])
+	}
+	return keys, nil
 }
 
 // AddMetadata implements MetaDB.
 func (db *BoltMetaDB) AddMetadata(key, val []byte) error {
-	return db.bdb.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		return tx.Bucket(bucketMeta).Put(key, val)
 	})
 }
 
 // Metadata implements MetaDB.
 func (db *BoltMetaDB) Metadata(key []byte) (val []byte, err error) {
-	err = db.bdb.View(func(tx *bolt.Tx) error {
-		val = append(val, tx.Bucket(bucketMeta).Get(key)...)
+	err = db.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketMeta).Get(key)
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		val = append([]byte{}, v...)
 		return nil
 	})
-	if err == nil && val == nil {
-		err = ErrKeyNotFound
+	return
+}
+
+// IncrementMetadata implements MetaDB.
+func (db *BoltMetaDB) IncrementMetadata(key []byte, delta int64) (n int64, err error) {
+	err = db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		var v []byte
+		v, n, err = incrementCounter(b.Get(key), delta)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	return
+}
+
+// ForEachMetadata implements MetaDB.
+func (db *BoltMetaDB) ForEachMetadata(fn func(key, val []byte) error) error {
+	return db.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).ForEach(fn)
+	})
+}
+
+// AddTag implements MetaDB.
+func (db *BoltMetaDB) AddTag(key []byte, tag string) error {
+	if err := checkTag(tag); err != nil {
+		return err
 	}
+	return db.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketBlobs).Get(key) == nil {
+			return ErrKeyNotFound
+		}
+		b, err := tx.Bucket(bucketTags).CreateBucketIfNotExists([]byte(tag))
+		if err != nil {
+			return err
+		}
+		return b.Put(key, []byte{})
+	})
+}
+
+// RemoveTag implements MetaDB.
+func (db *BoltMetaDB) RemoveTag(key []byte, tag string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTags).Bucket([]byte(tag))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(key)
+	})
+}
+
+// BlobsByTag implements MetaDB.
+func (db *BoltMetaDB) BlobsByTag(tag string) (keys [][]byte, err error) {
+	err = db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTags).Bucket([]byte(tag))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		})
+	})
+	return
+}
+
+// SetBlobNote implements MetaDB.
+func (db *BoltMetaDB) SetBlobNote(key []byte, note string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketBlobs).Get(key) == nil {
+			return ErrKeyNotFound
+		} else if note == "" {
+			return tx.Bucket(bucketNotes).Delete(key)
+		}
+		return tx.Bucket(bucketNotes).Put(key, []byte(note))
+	})
+}
+
+// BlobNote implements MetaDB.
+func (db *BoltMetaDB) BlobNote(key []byte) (note string, err error) {
+	err = db.view(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketBlobs).Get(key) == nil {
+			return ErrKeyNotFound
+		}
+		note = string(tx.Bucket(bucketNotes).Get(key))
+		return nil
+	})
 	return
 }
 
-// Close implements MetaDB.
+// SetMaxKeyLen sets the maximum length of the keys accepted by AddBlob and
+// RenameBlob. If n <= 0, DefaultMaxKeyLen is used. Existing keys are not
+// affected. SetMaxKeyLen must not be called concurrently with other methods.
+func (db *BoltMetaDB) SetMaxKeyLen(n int) {
+	if n <= 0 {
+		n = DefaultMaxKeyLen
+	}
+	db.maxKey = n
+}
+
+// SetStrictChunks controls whether AddBlob and ReplaceBlob reject blobs that
+// reference the same chunk more than once, returning ErrDuplicateChunk. Such
+// blobs are never created by this package, but would corrupt refcount
+// accounting if introduced by a bug. Existing blobs are not affected; use
+// CheckBlobIntegrity to detect them. SetStrictChunks must not be called
+// concurrently with other methods.
+func (db *BoltMetaDB) SetStrictChunks(strict bool) {
+	db.strict = strict
+}
+
+// SetRejectZeroSeeds controls whether AddBlob and ReplaceBlob reject blobs
+// whose Seed is the zero value, returning ErrZeroSeed. A zero Seed usually
+// indicates that a blob was never keyed. Existing blobs are not affected; use
+// CheckSeeds to detect them. SetRejectZeroSeeds must not be called
+// concurrently with other methods.
+func (db *BoltMetaDB) SetRejectZeroSeeds(reject bool) {
+	db.noZero = reject
+}
+
+// SetMaxBlobChunks sets the maximum number of chunks in a blob. AddBlob and
+// ReplaceBlob reject blobs with more chunks, and stored blobs claiming more
+// chunks are treated as corrupt, causing ErrCorrupt to be returned. If n <= 0,
+// DefaultMaxBlobChunks is used. SetMaxBlobChunks must not be called
+// concurrently with other methods.
+func (db *BoltMetaDB) SetMaxBlobChunks(n int) {
+	if n <= 0 {
+		n = DefaultMaxBlobChunks
+	}
+	db.maxChunks = n
+}
+
+// SetWriteBatching controls whether mutating methods use Bolt's Batch instead
+// of Update. Batching coalesces concurrent writes into a single transaction,
+// greatly increasing throughput when many goroutines write at once (e.g.
+// during a parallel upload), at the cost of up to maxDelay additional latency
+// per write. A batch is committed when it contains maxSize writes or maxDelay
+// has elapsed, whichever comes first. If maxSize <= 0, batching is disabled,
+// which is the default. SetWriteBatching must not be called concurrently with
+// other methods.
+func (db *BoltMetaDB) SetWriteBatching(maxDelay time.Duration, maxSize int) {
+	db.batch = maxSize > 0
+	if db.batch {
+		db.bdb.MaxBatchDelay = maxDelay
+		db.bdb.MaxBatchSize = maxSize
+	}
+}
+
+// begin registers the start of a transaction, returning ErrClosed if db has
+// been closed.
+func (db *BoltMetaDB) begin() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.active.Add(1)
+	return nil
+}
+
+// view is a wrapper around bolt.DB.View that returns ErrClosed if db has been
+// closed.
+func (db *BoltMetaDB) view(fn func(*bolt.Tx) error) error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.active.Done()
+	return db.bdb.View(fn)
+}
+
+// update is a wrapper around bolt.DB.Update (or bolt.DB.Batch, if batching is
+// enabled) that returns ErrClosed if db has been closed. Since a batched fn may
+// be called more than once, fn must only assign to variables outside the
+// transaction, never accumulate into them.
+func (db *BoltMetaDB) update(fn func(*bolt.Tx) error) error {
+	if err := db.begin(); err != nil {
+		return err
+	}
+	defer db.active.Done()
+	if db.batch {
+		return db.bdb.Batch(fn)
+	}
+	return db.bdb.Update(fn)
+}
+
+// Close implements MetaDB. Operations that have already begun are allowed to
+// finish before the underlying database is closed; subsequent operations
+// return ErrClosed. Closing a closed db has no effect.
 func (db *BoltMetaDB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
+	db.active.Wait()
 	return db.bdb.Close()
 }
 
@@ -435,20 +2130,53 @@ func NewBoltMetaDB(path string) (*BoltMetaDB, error) {
 		return nil, err
 	}
 	db := &BoltMetaDB{
-		bdb: bdb,
+		bdb:       bdb,
+		maxKey:    DefaultMaxKeyLen,
+		maxChunks: DefaultMaxBlobChunks,
 	}
 	// initialize
 	err = bdb.Update(func(tx *bolt.Tx) error {
+		// blobs with a zero ModTime are not indexed by time, so an empty time
+		// index is always consistent with a db that predates it
+		needIndex := tx.Bucket(bucketChunkBlobs) == nil
+		needRefs := tx.Bucket(bucketShardRefs) == nil
+		fresh := tx.Bucket(bucketBlobs) == nil
 		for _, bucket := range [][]byte{
 			bucketBlobs,
 			bucketChunks,
 			bucketShards,
 			bucketMeta,
+			bucketTags,
+			bucketNotes,
+			bucketHostShards,
+			bucketShardChunks,
+			bucketChunkBlobs,
+			bucketBlobModTimes,
+			bucketShardRefs,
+			bucketSchema,
 		} {
 			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
 				return err
 			}
 		}
+		// new dbs use the current schema; existing dbs keep their version
+		schema := tx.Bucket(bucketSchema)
+		if fresh {
+			if err := schema.Put(keyVersion, idKey(schemaShardChecksums)); err != nil {
+				return err
+			}
+		}
+		if v := schema.Get(keyVersion); len(v) == 8 {
+			db.checksums = binary.LittleEndian.Uint64(v) >= schemaShardChecksums
+		}
+		if needIndex {
+			if err := rebuildIndices(tx, db.checksums, db.maxChunks); err != nil {
+				return err
+			}
+		}
+		if needRefs {
+			return rebuildRefs(tx, db.maxChunks)
+		}
 		return nil
 	})
 	if err != nil {
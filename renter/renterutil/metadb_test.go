@@ -0,0 +1,2314 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/bolt"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+// forEachMetaDB runs fn against each MetaDB implementation.
+func forEachMetaDB(t *testing.T, fn func(*testing.T, MetaDB)) {
+	t.Helper()
+	t.Run("Ephemeral", func(t *testing.T) {
+		fn(t, NewEphemeralMetaDB())
+	})
+	t.Run("Bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "metadb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		fn(t, db)
+	})
+}
+
+func TestMetaDBMissingIDs(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		for _, id := range []uint64{0, 1, 1000} {
+			if _, err := db.Shard(id); err != ErrKeyNotFound {
+				t.Errorf("Shard(%v): expected %v, got %v", id, ErrKeyNotFound, err)
+			}
+			if _, err := db.Chunk(id); err != ErrKeyNotFound {
+				t.Errorf("Chunk(%v): expected %v, got %v", id, ErrKeyNotFound, err)
+			}
+			if err := db.SetChunkShard(id, 0, 1); err != ErrKeyNotFound {
+				t.Errorf("SetChunkShard(%v): expected %v, got %v", id, ErrKeyNotFound, err)
+			}
+		}
+		if _, err := db.Blob([]byte("foo")); err != ErrKeyNotFound {
+			t.Errorf("Blob: expected %v, got %v", ErrKeyNotFound, err)
+		}
+
+		c, err := db.AddChunk(1, 2, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Chunk(c.ID); err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range []int{-1, 2} {
+			if err := db.SetChunkShard(c.ID, i, 1); err != errShardIndexOutOfRange {
+				t.Errorf("SetChunkShard(%v, %v): expected %v, got %v", c.ID, i, errShardIndexOutOfRange, err)
+			}
+		}
+	})
+}
+
+func TestMetaDBBlobPage(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		for _, key := range []string{"d", "a", "c", "e", "b"} {
+			if err := db.AddBlob(DBBlob{Key: []byte(key)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var pages []string
+		var after []byte
+		for {
+			keys, next, err := db.BlobPage(after, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page string
+			for _, k := range keys {
+				page += string(k)
+			}
+			pages = append(pages, page)
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		if fmt.Sprint(pages) != "[ab cd e]" {
+			t.Fatal("wrong pages:", pages)
+		}
+
+		// non-positive limits should be rejected
+		for _, limit := range []int{0, -1} {
+			if _, _, err := db.BlobPage(nil, limit); err == nil {
+				t.Errorf("expected BlobPage to reject limit %v", limit)
+			}
+		}
+	})
+}
+
+func TestMetaDBForEachMetadata(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		for _, k := range []string{"foo", "bar", "baz"} {
+			if err := db.AddMetadata([]byte(k), []byte(k+"-val")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var pairs []string
+		err := db.ForEachMetadata(func(key, val []byte) error {
+			pairs = append(pairs, string(key)+"="+string(val))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if fmt.Sprint(pairs) != "[bar=bar-val baz=baz-val foo=foo-val]" {
+			t.Fatal("wrong metadata:", pairs)
+		}
+
+		// errors should halt iteration
+		errStop := errors.New("stop")
+		var n int
+		err = db.ForEachMetadata(func(key, val []byte) error {
+			n++
+			return errStop
+		})
+		if err != errStop || n != 1 {
+			t.Fatal("expected iteration to stop after first error, got", n, err)
+		}
+	})
+}
+
+func TestMetaDBIncrementMetadata(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		key := []byte("counter")
+		if n, err := db.IncrementMetadata(key, 3); err != nil {
+			t.Fatal(err)
+		} else if n != 3 {
+			t.Fatal("expected 3, got", n)
+		} else if n, err := db.IncrementMetadata(key, -5); err != nil {
+			t.Fatal(err)
+		} else if n != -2 {
+			t.Fatal("expected -2, got", n)
+		}
+
+		// concurrent increments should not be lost
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if _, err := db.IncrementMetadata(key, 1); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n, err := db.IncrementMetadata(key, 0); err != nil {
+			t.Fatal(err)
+		} else if n != 98 {
+			t.Fatal("expected 98, got", n)
+		}
+
+		// non-counter values should be rejected
+		if err := db.AddMetadata([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if _, err := db.IncrementMetadata([]byte("foo"), 1); err == nil {
+			t.Fatal("expected error when incrementing non-counter")
+		} else if v, err := db.Metadata([]byte("foo")); err != nil || string(v) != "bar" {
+			t.Fatal("non-counter value was modified:", v, err)
+		}
+	})
+}
+
+func TestMetaDBClose(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		if err := db.AddBlob(DBBlob{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+
+		// close the db while an operation is in progress
+		inside := make(chan struct{})
+		release := make(chan struct{})
+		iterErr := make(chan error, 1)
+		go func() {
+			iterErr <- db.ForEachBlob(func(key []byte) error {
+				close(inside)
+				<-release
+				// operations begun after Close should fail, not deadlock
+				if _, err := db.Blob(key); !errors.Is(err, ErrClosed) {
+					return fmt.Errorf("expected ErrClosed, got %v", err)
+				}
+				return nil
+			})
+		}()
+		<-inside
+		closeErr := make(chan error, 1)
+		go func() { closeErr <- db.Close() }()
+
+		// Close should not return until the operation finishes
+		if _, ok := db.(*BoltMetaDB); ok {
+			select {
+			case <-closeErr:
+				t.Fatal("Close returned during active operation")
+			case <-time.After(50 * time.Millisecond):
+			}
+		} else if err := <-closeErr; err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := db.Blob([]byte("foo")); errors.Is(err, ErrClosed) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		if err := <-iterErr; err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.(*BoltMetaDB); ok {
+			if err := <-closeErr; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := db.AddBlob(DBBlob{Key: []byte("bar")}); !errors.Is(err, ErrClosed) {
+			t.Fatal("expected ErrClosed, got", err)
+		} else if err := db.AddMetadata([]byte("bar"), nil); !errors.Is(err, ErrClosed) {
+			t.Fatal("expected ErrClosed, got", err)
+		} else if err := db.Close(); err != nil {
+			t.Fatal("second Close failed:", err)
+		}
+	})
+}
+
+func TestMetaDBShards(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		var exp []DBShard
+		var ids []uint64
+		for i := 0; i < 5; i++ {
+			s := DBShard{HostKey: hostdb.HostKeyFromPublicKey(frand.Bytes(32)), Offset: uint32(i)}
+			id, err := db.AddShard(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp = append(exp, s)
+			ids = append(ids, id)
+		}
+		// request out of order, with a missing shard
+		req := []uint64{ids[3], 0, ids[0], ids[4]}
+		shards, err := db.Shards(req)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(shards) != len(req) {
+			t.Fatal("wrong number of shards:", len(shards))
+		}
+		for i, s := range []DBShard{exp[3], {}, exp[0], exp[4]} {
+			if shards[i] != s {
+				t.Errorf("shard %v: expected %v, got %v", i, s, shards[i])
+			}
+		}
+		if _, err := db.Shards([]uint64{ids[0], ids[4] + 100}); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatal("expected ErrKeyNotFound, got", err)
+		}
+	})
+}
+
+func TestMetaDBTags(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		if err := db.AddTag([]byte("foo"), "backup"); err != ErrKeyNotFound {
+			t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+		for _, key := range []string{"foo", "bar", "baz"} {
+			if err := db.AddBlob(DBBlob{Key: []byte(key)}); err != nil {
+				t.Fatal(err)
+			} else if err := db.AddTag([]byte(key), "backup"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.AddTag([]byte("foo"), "media"); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddTag([]byte("foo"), ""); !errors.Is(err, ErrInvalidTag) {
+			t.Fatal("expected ErrInvalidTag for empty tag, got", err)
+		}
+		byTag := func(tag string) string {
+			t.Helper()
+			keys, err := db.BlobsByTag(tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fmt.Sprintf("%s", keys)
+		}
+		if s := byTag("backup"); s != "[bar baz foo]" {
+			t.Fatal("wrong backup blobs:", s)
+		} else if s := byTag("media"); s != "[foo]" {
+			t.Fatal("wrong media blobs:", s)
+		}
+
+		// tags should survive a rename
+		if err := db.RenameBlob([]byte("foo"), []byte("qux")); err != nil {
+			t.Fatal(err)
+		} else if s := byTag("media"); s != "[qux]" {
+			t.Fatal("wrong media blobs after rename:", s)
+		} else if _, err := db.Blob([]byte("foo")); err != ErrKeyNotFound {
+			t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+
+		if err := db.RemoveTag([]byte("bar"), "backup"); err != nil {
+			t.Fatal(err)
+		} else if err := db.DeleteBlob([]byte("baz")); err != nil {
+			t.Fatal(err)
+		} else if s := byTag("backup"); s != "[qux]" {
+			t.Fatal("wrong backup blobs after removal:", s)
+		}
+	})
+}
+
+func TestMetaDBChunkInvariants(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		for _, mn := range [][2]int{{0, 1}, {3, 2}, {256, 300}} {
+			if _, err := db.AddChunk(mn[0], mn[1], 100); err == nil {
+				t.Errorf("AddChunk(%v, %v): expected error", mn[0], mn[1])
+			}
+		}
+		c, err := db.AddChunk(1, 2, 100)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+			t.Fatal(err)
+		}
+		if bad, err := VerifyChunkInvariants(db); err != nil {
+			t.Fatal(err)
+		} else if len(bad) != 0 {
+			t.Fatal("expected no violations, got", bad)
+		}
+
+		// corrupt the chunk directly
+		if edb, ok := db.(*EphemeralMetaDB); ok {
+			edb.chunks[c.ID-1].MinShards = 3
+			if bad, err := VerifyChunkInvariants(db); err != nil {
+				t.Fatal(err)
+			} else if len(bad) != 1 || bad[0] != c.ID {
+				t.Fatal("expected violation in chunk", c.ID, "got", bad)
+			}
+		}
+	})
+}
+
+func TestMetaDBAddChunkAndShards(t *testing.T) {
+	type chunkAndShardsAdder interface {
+		AddChunkAndShards(m int, length uint64, ss []*DBShard) (DBChunk, error)
+	}
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		cdb := db.(chunkAndShardsAdder)
+		shards := func(n int) []*DBShard {
+			ss := make([]*DBShard, n)
+			for i := range ss {
+				ss[i] = &DBShard{HostKey: hostdb.HostPublicKey(fmt.Sprintf("ed25519:%02x", i))}
+			}
+			return ss
+		}
+		tests := []struct {
+			m      int
+			length uint64
+			ss     []*DBShard
+		}{
+			{0, 100, shards(2)},
+			{3, 100, shards(2)},
+			{1, 100, nil},
+			{2, 2*renterhost.SectorSize + 1, shards(3)},
+			{1, 100, []*DBShard{nil}},
+		}
+		for _, test := range tests {
+			if _, err := cdb.AddChunkAndShards(test.m, test.length, test.ss); err == nil {
+				t.Errorf("AddChunkAndShards(%v, %v, %v shards): expected error", test.m, test.length, len(test.ss))
+			}
+		}
+		c, err := cdb.AddChunkAndShards(2, 2*renterhost.SectorSize, shards(3))
+		if err != nil {
+			t.Fatal(err)
+		} else if c.MinShards != 2 || len(c.Shards) != 3 {
+			t.Fatal("wrong chunk params:", c.MinShards, len(c.Shards))
+		}
+		for _, sid := range c.Shards {
+			if _, err := db.Shard(sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// errors from adding a shard should be propagated, and no chunk should
+		// be created
+		if bdb, ok := db.(*BoltMetaDB); ok {
+			ss := shards(2)
+			ss[1].HostKey = hostdb.HostPublicKey(strings.Repeat("a", bolt.MaxKeySize))
+			if _, err := bdb.AddChunkAndShards(1, 100, ss); err == nil {
+				t.Fatal("expected error from oversized host key")
+			}
+			if _, err := db.Chunk(c.ID + 1); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatal("expected no chunk to be created, got", err)
+			}
+		}
+	})
+}
+
+func TestCheckNonceReuse(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		nonces := CounterNonces()
+		c, err := db.AddChunk(1, 2, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range c.Shards {
+			sid, err := db.AddShard(DBShard{Nonce: nonces()})
+			if err != nil {
+				t.Fatal(err)
+			} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+			t.Fatal(err)
+		} else if err := CheckNonceReuse(db, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// add a chunk whose shard reuses a nonce
+		c, err = db.Chunk(c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.Shard(c.Shards[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := db.AddChunk(1, 1, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, err := db.AddShard(DBShard{Nonce: s.Nonce, Offset: 1})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(c2.ID, 0, sid); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID, c2.ID}}); err != nil {
+			t.Fatal(err)
+		} else if err := CheckNonceReuse(db, []byte("foo")); !errors.Is(err, ErrNonceReuse) {
+			t.Fatalf("expected %v, got %v", ErrNonceReuse, err)
+		}
+	})
+}
+
+func TestDuplicateChunks(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		c, err := db.AddChunk(1, 1, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid, err := db.AddShard(DBShard{})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(c.ID, 0, sid); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+			t.Fatal(err)
+		} else if err := CheckBlobIntegrity(db, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// by default, duplicate chunks are accepted, but detected by
+		// CheckBlobIntegrity
+		dup := DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID, c.ID}}
+		if err := db.AddBlob(dup); err != nil {
+			t.Fatal(err)
+		} else if err := CheckBlobIntegrity(db, []byte("foo")); !errors.Is(err, ErrDuplicateChunk) {
+			t.Fatalf("expected %v, got %v", ErrDuplicateChunk, err)
+		}
+
+		// in strict mode, they are rejected
+		db.(interface{ SetStrictChunks(bool) }).SetStrictChunks(true)
+		if err := db.AddBlob(dup); !errors.Is(err, ErrDuplicateChunk) {
+			t.Fatalf("AddBlob: expected %v, got %v", ErrDuplicateChunk, err)
+		} else if err := db.ReplaceBlob(dup); !errors.Is(err, ErrDuplicateChunk) {
+			t.Fatalf("ReplaceBlob: expected %v, got %v", ErrDuplicateChunk, err)
+		}
+
+		// missing chunks should also be detected
+		if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: []uint64{c.ID + 1000}}); err != nil {
+			t.Fatal(err)
+		} else if err := CheckBlobIntegrity(db, []byte("bar")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+	})
+}
+
+func TestZeroSeeds(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		keyed := DBBlob{Key: []byte("keyed")}
+		keyed.Seed[0] = 1
+		if err := db.AddBlob(keyed); err != nil {
+			t.Fatal(err)
+		}
+
+		// by default, zero seeds are accepted, but detected by CheckSeeds
+		for _, key := range []string{"foo", "bar"} {
+			if err := db.AddBlob(DBBlob{Key: []byte(key)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if keys, err := CheckSeeds(db); err != nil {
+			t.Fatal(err)
+		} else if len(keys) != 2 || string(keys[0]) != "bar" || string(keys[1]) != "foo" {
+			t.Fatal("expected zero-seed blobs to be detected, got", keys)
+		}
+
+		// when rejection is enabled, they are rejected
+		db.(interface{ SetRejectZeroSeeds(bool) }).SetRejectZeroSeeds(true)
+		if err := db.AddBlob(DBBlob{Key: []byte("baz")}); !errors.Is(err, ErrZeroSeed) {
+			t.Fatalf("AddBlob: expected %v, got %v", ErrZeroSeed, err)
+		} else if err := db.ReplaceBlob(DBBlob{Key: []byte("foo")}); !errors.Is(err, ErrZeroSeed) {
+			t.Fatalf("ReplaceBlob: expected %v, got %v", ErrZeroSeed, err)
+		} else if err := db.AddBlob(keyed); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExportInventory(t *testing.T) {
+	hosts := []hostdb.HostPublicKey{
+		hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+		hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+	}
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		// "foo" has two chunks, with three shards stored on two hosts; "bar"
+		// is empty
+		var cids []uint64
+		for i, n := range []int{2, 1} {
+			c, err := db.AddChunk(1, 2, uint64(100*(i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < n; j++ {
+				sid, err := db.AddShard(DBShard{HostKey: hosts[j]})
+				if err != nil {
+					t.Fatal(err)
+				} else if err := db.SetChunkShard(c.ID, j, sid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cids = append(cids, c.ID)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: cids}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := ExportInventory(db, &buf, "jsonl"); err != nil {
+			t.Fatal(err)
+		}
+		dec := json.NewDecoder(&buf)
+		var recs []InventoryRecord
+		for dec.More() {
+			var r InventoryRecord
+			if err := dec.Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, r)
+		}
+		if len(recs) != 2 {
+			t.Fatal("expected 2 records, got", len(recs))
+		} else if r := recs[0]; r.Key != "bar" || r.Size != 0 || r.Chunks != 0 || r.Shards != 0 || r.Hosts != 0 {
+			t.Fatal("bad record for bar:", r)
+		} else if r := recs[1]; r.Key != "foo" || r.Size != 300 || r.Chunks != 2 || r.Shards != 3 || r.Hosts != 2 || r.ModTime.IsZero() {
+			t.Fatal("bad record for foo:", r)
+		}
+
+		buf.Reset()
+		if err := ExportInventory(db, &buf, "csv"); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(rows) != 3 || rows[0][0] != "key" {
+			t.Fatal("bad CSV:", rows)
+		} else if exp := []string{"foo", "300", "2", "3", "2"}; !reflect.DeepEqual(rows[2][:5], exp) {
+			t.Fatal("bad CSV row for foo:", rows[2])
+		}
+
+		if err := ExportInventory(db, &buf, "xml"); err == nil {
+			t.Fatal("expected error for unknown format")
+		}
+	})
+}
+
+func TestStorageByHost(t *testing.T) {
+	hosts := []hostdb.HostPublicKey{
+		hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+		hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+	}
+	roots := []crypto.Hash{frand.Entropy256(), frand.Entropy256()}
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		// hosts[0] stores two shards in roots[0] (packed) and one in
+		// roots[1]; hosts[1] stores one shard in roots[0]. One chunk is shared
+		// by both blobs, and an unreferenced chunk stores a shard on hosts[1].
+		addChunk := func(shards ...DBShard) uint64 {
+			c, err := db.AddChunk(1, len(shards), 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range shards {
+				sid, err := db.AddShard(s)
+				if err != nil {
+					t.Fatal(err)
+				} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return c.ID
+		}
+		c1 := addChunk(DBShard{HostKey: hosts[0], SectorRoot: roots[0]}, DBShard{HostKey: hosts[1], SectorRoot: roots[0]})
+		c2 := addChunk(DBShard{HostKey: hosts[0], SectorRoot: roots[0], Offset: 1})
+		c3 := addChunk(DBShard{HostKey: hosts[0], SectorRoot: roots[1]})
+		addChunk(DBShard{HostKey: hosts[1], SectorRoot: roots[1]})
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c1, c2}}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: []uint64{c1, c3}}); err != nil {
+			t.Fatal(err)
+		}
+
+		storage, err := StorageByHost(db)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(storage) != 2 || storage[hosts[0]] != 2 || storage[hosts[1]] != 1 {
+			t.Fatal("wrong storage:", storage)
+		}
+	})
+}
+
+func TestMetaJSON(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		type config struct {
+			MinShards  int
+			LastRepair string
+		}
+		var c config
+		if err := GetMetaJSON(db, "config", &c); err != ErrKeyNotFound {
+			t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+		exp := config{MinShards: 2, LastRepair: "yesterday"}
+		if err := SetMetaJSON(db, "config", exp); err != nil {
+			t.Fatal(err)
+		} else if err := GetMetaJSON(db, "config", &c); err != nil {
+			t.Fatal(err)
+		} else if c != exp {
+			t.Fatal("mismatch:", c)
+		}
+	})
+}
+
+func TestDBShardVerify(t *testing.T) {
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	s := DBShard{SectorRoot: merkle.SectorRoot(&sector)}
+	if err := s.Verify(&sector); err != nil {
+		t.Fatal(err)
+	}
+	sector[0] ^= 1
+	if err := s.Verify(&sector); err == nil {
+		t.Fatal("expected error for modified sector")
+	}
+}
+
+func TestDBShardPacked(t *testing.T) {
+	// pack two shards into one sector
+	var key renter.KeySeed
+	frand.Read(key[:])
+	datas := [][]byte{frand.Bytes(merkle.SegmentSize * 3), frand.Bytes(merkle.SegmentSize * 2)}
+	var sb renter.SectorBuilder
+	for _, data := range datas {
+		sb.Append(data, key, renter.RandomNonce())
+	}
+	sector := sb.Finish()
+	root := merkle.SectorRoot(sector)
+	var shards []DBShard
+	for _, ss := range sb.Slices() {
+		shards = append(shards, DBShard{SectorRoot: root, Offset: ss.SegmentIndex, Nonce: ss.Nonce})
+	}
+	if shards[1].Offset != 3 {
+		t.Fatal("expected second shard to begin at segment 3, got", shards[1].Offset)
+	}
+
+	// each shard should verify only its own segments
+	for i, s := range shards {
+		start := int(s.Offset)
+		end := start + len(datas[i])/merkle.SegmentSize
+		segments := sector[start*merkle.SegmentSize : end*merkle.SegmentSize]
+		proof := merkle.BuildProof(sector, start, end, nil)
+		if err := s.VerifySection(segments, proof); err != nil {
+			t.Error(err)
+		}
+		other := shards[1-i]
+		if err := other.VerifySection(segments, proof); err == nil {
+			t.Error("expected shard", 1-i, "to reject segments of shard", i)
+		}
+		if err := s.Verify(sector); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := shards[0].VerifySection(nil, nil); err == nil {
+		t.Error("expected error for empty section")
+	}
+
+	// reads should honor the offset, both for the whole shard and for
+	// (segment-aligned) sub-ranges
+	sc := NewSectorCache(renterhost.SectorSize)
+	sc.Put(root, sector[:])
+	for i, s := range shards {
+		var buf bytes.Buffer
+		if !sc.copyCachedShard(&buf, key, nil, s, 0, int64(len(datas[i]))) {
+			t.Fatal("sector should be cached")
+		} else if !bytes.Equal(buf.Bytes(), datas[i]) {
+			t.Fatalf("shard %v decrypted incorrectly", i)
+		}
+		buf.Reset()
+		sc.copyCachedShard(&buf, key, nil, s, merkle.SegmentSize, merkle.SegmentSize)
+		if !bytes.Equal(buf.Bytes(), datas[i][merkle.SegmentSize:][:merkle.SegmentSize]) {
+			t.Fatalf("section of shard %v decrypted incorrectly", i)
+		}
+	}
+}
+
+func TestAuditMetaDB(t *testing.T) {
+	var buf bytes.Buffer
+	db := NewAuditMetaDB(NewEphemeralMetaDB(), &buf)
+	c, err := db.AddChunk(1, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := db.AddShard(DBShard{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.SetChunkShard(c.ID, 0, sid); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+		t.Fatal(err)
+	} else if err := db.DeleteBlob([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	// reads should not be logged
+	if _, err := db.Blob([]byte("foo")); err != ErrKeyNotFound {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		ops = append(ops, strings.Fields(line)[1])
+	}
+	if fmt.Sprint(ops) != "[AddChunk AddShard SetChunkShard AddBlob DeleteBlob]" {
+		t.Fatal("wrong audit log:", buf.String())
+	}
+}
+
+func TestMetaDBRemapHost(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		oldKey := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+		newKey := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+		otherKey := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+		var ids []uint64
+		for _, hk := range []hostdb.HostPublicKey{oldKey, otherKey, oldKey} {
+			id, err := db.AddShard(DBShard{HostKey: hk})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if n, err := db.RemapHost(oldKey, newKey); err != nil {
+			t.Fatal(err)
+		} else if n != 2 {
+			t.Fatal("expected 2 shards to be remapped, got", n)
+		}
+		for i, exp := range []hostdb.HostPublicKey{newKey, otherKey, newKey} {
+			if s, err := db.Shard(ids[i]); err != nil {
+				t.Fatal(err)
+			} else if s.HostKey != exp {
+				t.Errorf("shard %v: expected host %v, got %v", ids[i], exp, s.HostKey)
+			}
+		}
+		if n, err := db.RemapHost(oldKey, newKey); err != nil {
+			t.Fatal(err)
+		} else if n != 0 {
+			t.Fatal("expected no shards to be remapped, got", n)
+		}
+	})
+}
+
+func TestMetaDBReplaceBlob(t *testing.T) {
+	hostA := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	hostB := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		// one chunk on A, one on B
+		var cids []uint64
+		for _, h := range []hostdb.HostPublicKey{hostA, hostB} {
+			sid, err := db.AddShard(DBShard{HostKey: h, SectorRoot: frand.Entropy256()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := db.AddChunk(1, 1, 10)
+			if err != nil {
+				t.Fatal(err)
+			} else if err := db.SetChunkShard(c.ID, 0, sid); err != nil {
+				t.Fatal(err)
+			}
+			cids = append(cids, c.ID)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: cids}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddTag([]byte("foo"), "bar"); err != nil {
+			t.Fatal(err)
+		}
+
+		// replace with a blob that only keeps the chunk on B
+		if err := db.ReplaceBlob(DBBlob{Key: []byte("foo"), Chunks: cids[1:]}); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := db.Blob([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(b.Chunks, cids[1:]) {
+			t.Fatal("blob was not replaced:", b.Chunks)
+		}
+		if keys, err := db.BlobsByTag("bar"); err != nil {
+			t.Fatal(err)
+		} else if len(keys) != 1 || string(keys[0]) != "foo" {
+			t.Fatal("tag was not preserved:", keys)
+		}
+		if keys, err := db.BlobsReferencingHost(hostA); err != nil {
+			t.Fatal(err)
+		} else if len(keys) != 0 {
+			t.Fatal("expected no blobs to reference A, got", keys)
+		}
+		sectors, err := db.UnreferencedSectors()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sectors) != 1 || len(sectors[hostA]) != 1 {
+			t.Fatal("expected only A's sector to be unreferenced, got", sectors)
+		}
+	})
+}
+
+func TestMetaDBReplaceBlobIfUnchanged(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		key := []byte("foo")
+		if err := db.ReplaceBlobIfUnchanged(DBBlob{Key: key, Chunks: []uint64{1}}, time.Now()); !errors.Is(err, ErrConflict) {
+			t.Fatal("expected ErrConflict for missing blob, got", err)
+		} else if err := db.ReplaceBlobIfUnchanged(DBBlob{Key: key, Chunks: []uint64{1}}, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := db.Blob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale := b.ModTime
+		b.Chunks = []uint64{2}
+		if err := db.ReplaceBlobIfUnchanged(b, stale); err != nil {
+			t.Fatal(err)
+		}
+		b.Chunks = []uint64{3}
+		if err := db.ReplaceBlobIfUnchanged(b, stale); !errors.Is(err, ErrConflict) {
+			t.Fatal("expected ErrConflict, got", err)
+		} else if err := db.ReplaceBlobIfUnchanged(b, time.Time{}); !errors.Is(err, ErrConflict) {
+			t.Fatal("expected ErrConflict, got", err)
+		} else if b, err := db.Blob(key); err != nil {
+			t.Fatal(err)
+		} else if len(b.Chunks) != 1 || b.Chunks[0] != 2 {
+			t.Fatal("blob was modified despite conflict:", b.Chunks)
+		}
+
+		// concurrent read-modify-write cycles should not lose updates
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					for {
+						b, err := db.Blob(key)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						b.Chunks = append(append([]uint64(nil), b.Chunks...), uint64(100+i*10+j))
+						if err := db.ReplaceBlobIfUnchanged(b, b.ModTime); err == nil {
+							break
+						} else if !errors.Is(err, ErrConflict) {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if b, err := db.Blob(key); err != nil {
+			t.Fatal(err)
+		} else if len(b.Chunks) != 21 {
+			t.Fatal("expected 21 chunks, got", len(b.Chunks))
+		}
+	})
+}
+
+func TestMetaDBSetChunkShardRefs(t *testing.T) {
+	host := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		var sids []uint64
+		for i := 0; i < 2; i++ {
+			sid, err := db.AddShard(DBShard{HostKey: host, SectorRoot: frand.Entropy256()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sids = append(sids, sid)
+		}
+		c, err := db.AddChunk(1, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(c.ID, 0, sids[0]); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// replacing the shard should release the old one, but not the new one
+		if err := db.SetChunkShard(c.ID, 0, sids[1]); err != nil {
+			t.Fatal(err)
+		}
+		old, _ := db.Shard(sids[0])
+		sectors, err := db.UnreferencedSectors()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sectors[host]) != 1 || sectors[host][0] != old.SectorRoot {
+			t.Fatal("expected only the replaced sector to be unreferenced, got", sectors)
+		}
+
+		// deleting the blob should release the new shard too
+		if err := db.DeleteBlob([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		sectors, err = db.UnreferencedSectors()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sectors[host]) != 2 {
+			t.Fatal("expected both sectors to be unreferenced, got", sectors)
+		}
+	})
+}
+
+func TestMetaDBBlobNote(t *testing.T) {
+	test := func(t *testing.T, db MetaDB) {
+		if err := db.SetBlobNote([]byte("foo"), "note"); err != ErrKeyNotFound {
+			t.Fatal("expected ErrKeyNotFound, got", err)
+		}
+		for _, key := range []string{"foo", "bar"} {
+			if err := db.AddBlob(DBBlob{Key: []byte(key)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if note, err := db.BlobNote([]byte("foo")); err != nil || note != "" {
+			t.Fatalf("expected empty note, got %q (%v)", note, err)
+		}
+		if err := db.SetBlobNote([]byte("foo"), "my note"); err != nil {
+			t.Fatal(err)
+		} else if err := db.SetBlobNote([]byte("bar"), "other note"); err != nil {
+			t.Fatal(err)
+		}
+
+		// notes should not be visible as metadata, and metadata should not
+		// affect notes
+		if err := db.AddMetadata([]byte("foo\x00note"), []byte("meta")); err != nil {
+			t.Fatal(err)
+		} else if note, err := db.BlobNote([]byte("foo")); err != nil || note != "my note" {
+			t.Fatalf("expected note to be unaffected by metadata, got %q (%v)", note, err)
+		}
+		var metaKeys []string
+		if err := db.ForEachMetadata(func(key, _ []byte) error {
+			metaKeys = append(metaKeys, string(key))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if len(metaKeys) != 1 || metaKeys[0] != "foo\x00note" {
+			t.Fatalf("expected only user metadata, got %q", metaKeys)
+		}
+
+		// renaming should move the note, overwriting the destination's note
+		if err := db.RenameBlob([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if note, err := db.BlobNote([]byte("bar")); err != nil || note != "my note" {
+			t.Fatalf("expected note to be moved, got %q (%v)", note, err)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if note, err := db.BlobNote([]byte("foo")); err != nil || note != "" {
+			t.Fatalf("expected note to be moved, got %q (%v)", note, err)
+		}
+
+		// deleting should remove the note, but not the metadata
+		if err := db.DeleteBlob([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if val, err := db.Metadata([]byte("foo\x00note")); err != nil || string(val) != "meta" {
+			t.Fatalf("expected metadata to be preserved, got %q (%v)", val, err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		} else if note, err := db.BlobNote([]byte("bar")); err != nil || note != "" {
+			t.Fatalf("expected note to be deleted, got %q (%v)", note, err)
+		}
+	}
+	forEachMetaDB(t, test)
+	t.Run("Namespaced", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "metadb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		bdb, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bdb.Close()
+		test(t, NewNamespacedMetaDB(bdb, []byte("ns")))
+	})
+}
+
+func TestForEachBlobParallel(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		for i := 0; i < 20; i++ {
+			if err := db.AddBlob(DBBlob{Key: []byte(fmt.Sprintf("%02d", i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx := context.Background()
+
+		// all keys should be visited, with bounded concurrency
+		var mu sync.Mutex
+		var active, maxActive int
+		visited := make(map[string]bool)
+		err := ForEachBlobParallel(ctx, db, 4, func(_ context.Context, key []byte) error {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			visited[string(key)] = true
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(visited) != 20 {
+			t.Fatal("expected 20 keys to be visited, got", len(visited))
+		} else if maxActive > 4 {
+			t.Fatal("expected at most 4 concurrent calls, got", maxActive)
+		}
+
+		// the error of the earliest failing key should be returned, even if a
+		// later key fails first
+		err = ForEachBlobParallel(ctx, db, 4, func(ctx context.Context, key []byte) error {
+			switch string(key) {
+			case "01":
+				time.Sleep(10 * time.Millisecond)
+				return errors.New("01 failed")
+			case "02":
+				return errors.New("02 failed")
+			case "03":
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "01 failed" {
+			t.Fatal("expected error from key 01, got", err)
+		}
+
+		// cancellation of the parent Context should be reported
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err = ForEachBlobParallel(cctx, db, 4, func(ctx context.Context, key []byte) error {
+			return ctx.Err()
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+	})
+}
+
+func TestMetaDBBlobChunkRange(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		// chunks of length 10, 20, and 30
+		var cids []uint64
+		for _, n := range []uint64{10, 20, 30} {
+			c, err := db.AddChunk(1, 1, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cids = append(cids, c.ID)
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: cids}); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			start, end int64
+			chunks     []uint64
+			skip       int64
+		}{
+			{0, 60, cids, 0},
+			{0, 10, cids[:1], 0},
+			{5, 15, cids[:2], 5},
+			{10, 30, cids[1:2], 0},
+			{29, 31, cids[1:], 19},
+			{45, 1000, cids[2:], 15},
+			{20, 20, nil, 0},
+			{60, 70, nil, 0},
+		}
+		for _, test := range tests {
+			chunks, skip, err := db.BlobChunkRange([]byte("foo"), test.start, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uint64
+			for _, c := range chunks {
+				got = append(got, c.ID)
+			}
+			if !reflect.DeepEqual(got, test.chunks) || skip != test.skip {
+				t.Errorf("[%v, %v): expected %v+%v, got %v+%v", test.start, test.end, test.chunks, test.skip, got, skip)
+			}
+		}
+
+		if _, _, err := db.BlobChunkRange([]byte("foo"), 10, 5); err == nil {
+			t.Error("expected error for invalid range")
+		}
+		if _, _, err := db.BlobChunkRange([]byte("bar"), 0, 10); err != ErrKeyNotFound {
+			t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+	})
+}
+
+func TestMetaDBBlobsReferencingHost(t *testing.T) {
+	hostA := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	hostB := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	hostC := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	check := func(t *testing.T, db MetaDB, host hostdb.HostPublicKey, exp ...string) {
+		t.Helper()
+		keys, err := db.BlobsReferencingHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(keys))
+		for i := range keys {
+			got[i] = string(keys[i])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Errorf("expected %v, got %v", exp, got)
+		}
+	}
+
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		// foo has shards on A and B; bar shares foo's first chunk and has
+		// another chunk stored only on B
+		var sids []uint64
+		for _, h := range []hostdb.HostPublicKey{hostA, hostB, hostB, hostB} {
+			sid, err := db.AddShard(DBShard{HostKey: h})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sids = append(sids, sid)
+		}
+		var cids []uint64
+		for i := 0; i < 2; i++ {
+			c, err := db.AddChunk(1, 2, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cids = append(cids, c.ID)
+		}
+		for _, cs := range []struct {
+			cid uint64
+			i   int
+			sid uint64
+		}{
+			{cids[0], 0, sids[0]},
+			{cids[0], 1, sids[1]},
+			{cids[1], 0, sids[2]},
+			{cids[1], 1, sids[3]},
+		} {
+			if err := db.SetChunkShard(cs.cid, cs.i, cs.sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: cids[:1]}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: cids}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostA, "bar", "foo")
+		check(t, db, hostB, "bar", "foo")
+		check(t, db, hostC)
+
+		// replacing foo's shard on A should remove foo and bar from A
+		sid, err := db.AddShard(DBShard{HostKey: hostC})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(cids[0], 0, sid); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostA)
+		check(t, db, hostC, "bar", "foo")
+
+		// renaming, overwriting, and deleting blobs should update the index
+		if err := db.RenameBlob([]byte("bar"), []byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostB, "baz", "foo")
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: cids[1:]}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostC, "baz")
+		if err := db.DeleteBlob([]byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostB, "foo")
+		check(t, db, hostC)
+
+		// remapping a host should move its blobs
+		if _, err := db.RemapHost(hostB, hostA); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, hostA, "foo")
+		check(t, db, hostB)
+	})
+
+	// the index should be rebuilt when opening a db that lacks it
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "meta.db")
+	db, err := NewBoltMetaDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := db.AddShard(DBShard{HostKey: hostA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.AddChunk(1, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.SetChunkShard(c.ID, 0, sid); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketHostShards, bucketShardChunks, bucketChunkBlobs} {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewBoltMetaDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db, hostA, "foo")
+}
+
+func TestMetaDBBlobsModifiedSince(t *testing.T) {
+	check := func(t *testing.T, db MetaDB, since time.Time, exp ...string) {
+		t.Helper()
+		keys, err := db.BlobsModifiedSince(since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(keys))
+		for i := range keys {
+			got[i] = string(keys[i])
+		}
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Errorf("expected %v, got %v", exp, got)
+		}
+	}
+	// ensure that successive calls to time.Now are distinct
+	tick := func() time.Time {
+		time.Sleep(time.Millisecond)
+		t := time.Now()
+		time.Sleep(time.Millisecond)
+		return t
+	}
+
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		start := tick()
+		if err := db.AddBlob(DBBlob{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, time.Time{}, "bar", "foo")
+		check(t, db, start, "bar", "foo")
+		if b, err := db.Blob([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if !b.ModTime.After(start) {
+			t.Fatal("ModTime was not set:", b.ModTime)
+		}
+
+		// supplied ModTimes should be ignored
+		mid := tick()
+		check(t, db, mid)
+		if err := db.AddBlob(DBBlob{Key: []byte("baz"), ModTime: start}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, mid, "baz")
+
+		// replacing, renaming, and deleting blobs should update the index
+		mid = tick()
+		if err := db.ReplaceBlob(DBBlob{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if err := db.RenameBlob([]byte("bar"), []byte("qux")); err != nil {
+			t.Fatal(err)
+		} else if err := db.DeleteBlob([]byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, start, "foo", "qux")
+		check(t, db, mid, "foo", "qux")
+		check(t, db, tick())
+	})
+
+	// blobs stored before ModTime was added should decode with a zero ModTime
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exp := DBBlob{Key: []byte("foo"), Chunks: []uint64{1, 2}, RedundancyTarget: 3}
+	frand.Read(exp.Seed[:])
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBlobs).Put(exp.Key, encoding.MarshalAll(exp.Chunks, exp.Seed, exp.RedundancyTarget))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.Blob(exp.Key); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(b) != fmt.Sprint(exp) {
+		t.Fatal("legacy blob decoded incorrectly:", b)
+	}
+	check(t, db, time.Time{})
+}
+
+func TestMetaDBRedundancyTarget(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		if err := db.AddBlob(DBBlob{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if err := SetRedundancyTarget(db, []byte("foo"), 7); err != nil {
+			t.Fatal(err)
+		} else if b, err := db.Blob([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if b.RedundancyTarget != 7 {
+			t.Fatal("expected target of 7, got", b.RedundancyTarget)
+		}
+		if err := SetRedundancyTarget(db, []byte("foo"), 256); err == nil {
+			t.Fatal("expected error for out-of-range target")
+		} else if err := SetRedundancyTarget(db, []byte("bar"), 1); err != ErrKeyNotFound {
+			t.Fatal("expected ErrKeyNotFound, got", err)
+		}
+	})
+
+	// blobs stored before RedundancyTarget was added should still decode
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exp := DBBlob{Key: []byte("foo"), Chunks: []uint64{1, 2}}
+	frand.Read(exp.Seed[:])
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBlobs).Put(exp.Key, encoding.MarshalAll(exp.Chunks, exp.Seed))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.Blob(exp.Key); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(b) != fmt.Sprint(exp) {
+		t.Fatal("legacy blob decoded incorrectly:", b)
+	}
+}
+
+func TestBoltMetaDBLegacyShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// downgrade the db to the schema used before shard checksums were added
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSchema).Delete(keyVersion)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// store a shard in the format used before ContractID was added
+	exp := DBShard{
+		HostKey: hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+		Offset:  7,
+	}
+	frand.Read(exp.SectorRoot[:])
+	frand.Read(exp.Nonce[:])
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		key := make([]byte, 8)
+		binary.LittleEndian.PutUint64(key, 1)
+		return tx.Bucket(bucketShards).Put(key, encoding.MarshalAll(exp.HostKey, exp.SectorRoot, exp.Offset, exp.Nonce))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.Shard(1); err != nil {
+		t.Fatal(err)
+	} else if s != exp {
+		t.Fatal("legacy shard decoded incorrectly:", s)
+	}
+
+	// new shards should round-trip their ContractID
+	exp.ContractID[0] = 1
+	if id, err := db.AddShard(exp); err != nil {
+		t.Fatal(err)
+	} else if s, err := db.Shard(id); err != nil {
+		t.Fatal(err)
+	} else if s != exp {
+		t.Fatal("shard decoded incorrectly:", s)
+	}
+}
+
+func TestBoltMetaDBAddChunkAndShardsRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	countKeys := func() (n [3]int) {
+		db.bdb.View(func(tx *bolt.Tx) error {
+			for i, bucket := range [][]byte{bucketShards, bucketHostShards, bucketChunks} {
+				n[i] = tx.Bucket(bucket).Stats().KeyN
+			}
+			return nil
+		})
+		return
+	}
+	before := countKeys()
+
+	// the final shard's host key is too large to be indexed, so addShard fails
+	// after the preceding shards have been written
+	ss := make([]*DBShard, 3)
+	for i := range ss {
+		ss[i] = &DBShard{HostKey: hostdb.HostKeyFromPublicKey(frand.Bytes(32))}
+	}
+	ss[2].HostKey = hostdb.HostPublicKey(strings.Repeat("a", bolt.MaxKeySize))
+	if _, err := db.AddChunkAndShards(2, 100, ss); err == nil {
+		t.Fatal("expected error")
+	}
+	if after := countKeys(); after != before {
+		t.Fatalf("partial chunk persisted: had %v keys, now %v", before, after)
+	}
+
+	// the IDs consumed by the failed call should be reused
+	ss[2].HostKey = hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	c, err := db.AddChunkAndShards(2, 100, ss)
+	if err != nil {
+		t.Fatal(err)
+	} else if c.ID != 1 || c.Shards[0] != 1 {
+		t.Fatal("IDs were not reused:", c.ID, c.Shards)
+	}
+}
+
+func TestBoltMetaDBMaxBlobChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	b := DBBlob{Key: []byte("foo"), Chunks: []uint64{1, 2, 3}}
+	if err := db.AddBlob(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// lowering the limit should reject new blobs, and cause existing blobs to
+	// be treated as corrupt
+	db.SetMaxBlobChunks(2)
+	if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: []uint64{1, 2, 3}}); err == nil {
+		t.Fatal("expected AddBlob to reject blob with too many chunks")
+	} else if _, err := db.Blob(b.Key); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt, got", err)
+	}
+	db.SetMaxBlobChunks(0)
+	if _, err := db.Blob(b.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	// a huge length prefix should be rejected without allocating
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		bb := tx.Bucket(bucketBlobs)
+		v := append([]byte(nil), bb.Get(b.Key)...)
+		binary.LittleEndian.PutUint64(v, 1<<60)
+		return bb.Put(b.Key, v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Blob(b.Key); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt, got", err)
+	} else if _, _, err := db.BlobChunkRange(b.Key, 0, 1); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt, got", err)
+	}
+}
+
+func TestBoltMetaDBWriteBatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetWriteBatching(time.Millisecond, 10)
+
+	// add shards concurrently; each should be assigned a distinct ID
+	const n = 50
+	ids := make([]uint64, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = db.AddShard(DBShard{HostKey: "foo", Offset: uint32(i)})
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[uint64]struct{})
+	for i, id := range ids {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		} else if _, ok := seen[id]; ok {
+			t.Fatal("duplicate shard ID", id)
+		}
+		seen[id] = struct{}{}
+		if s, err := db.Shard(id); err != nil {
+			t.Fatal(err)
+		} else if s.Offset != uint32(i) {
+			t.Fatal("wrong shard stored under ID", id)
+		}
+	}
+
+	// errors should be returned to the failing caller only
+	if err := db.SetChunkShard(12345, 0, ids[0]); err != ErrKeyNotFound {
+		t.Fatal("expected ErrKeyNotFound, got", err)
+	}
+
+	// disabling batching should not affect stored data
+	db.SetWriteBatching(0, 0)
+	if _, err := db.AddShard(DBShard{HostKey: "foo"}); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Shard(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltMetaDBShardChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := DBShard{HostKey: hostdb.HostKeyFromPublicKey(frand.Bytes(32))}
+	frand.Read(exp.SectorRoot[:])
+	id, err := db.AddShard(exp)
+	if err != nil {
+		t.Fatal(err)
+	} else if s, err := db.Shard(id); err != nil {
+		t.Fatal(err)
+	} else if s != exp {
+		t.Fatal("shard decoded incorrectly:", s)
+	}
+
+	// flip a bit in the stored SectorRoot
+	err = db.bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketShards)
+		v := append([]byte(nil), b.Get(idKey(id))...)
+		v[len(v)-60] ^= 1
+		return b.Put(idKey(id), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Shard(id); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("expected ErrCorrupt, got", err)
+	}
+
+	// the schema version should persist across reopening
+	db.Close()
+	db, err = NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.checksums {
+		t.Fatal("expected checksums to be enabled")
+	}
+}
+
+// assertMetaDBEquivalent applies the same pseudorandom sequence of operations
+// to a and b, failing if any operation produces different results.
+func assertMetaDBEquivalent(t *testing.T, a, b MetaDB, seed int64, ops int) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("bb"), []byte("c")}
+	tags := []string{"x", "y", ""}
+	hosts := []hostdb.HostPublicKey{
+		hostdb.HostKeyFromPublicKey(make([]byte, 32)),
+		hostdb.HostKeyFromPublicKey(bytes.Repeat([]byte{1}, 32)),
+	}
+	randKey := func() []byte { return keys[rng.Intn(len(keys))] }
+	randID := func() uint64 { return uint64(rng.Intn(8)) } // includes invalid IDs
+	var seedBytes []byte
+
+	check := func(op string, ra, rb interface{}) {
+		t.Helper()
+		if sa, sb := fmt.Sprintf("%v", ra), fmt.Sprintf("%v", rb); sa != sb {
+			t.Fatalf("%v (seed %v): results differ:\n%v\n%v", op, seed, sa, sb)
+		}
+	}
+	for i := 0; i < ops; i++ {
+		switch rng.Intn(14) {
+		case 0:
+			var blob DBBlob
+			blob.Key = randKey()
+			for j := rng.Intn(3); j > 0; j-- {
+				blob.Chunks = append(blob.Chunks, randID())
+			}
+			seedBytes = append(seedBytes[:0], byte(rng.Intn(256)))
+			copy(blob.Seed[:], seedBytes)
+			check("AddBlob", a.AddBlob(blob), b.AddBlob(blob))
+		case 1:
+			key := randKey()
+			ba, erra := a.Blob(key)
+			bb, errb := b.Blob(key)
+			check("Blob", []interface{}{ba.Key, ba.Chunks, ba.Seed, erra}, []interface{}{bb.Key, bb.Chunks, bb.Seed, errb})
+		case 2:
+			key := randKey()
+			check("DeleteBlob", a.DeleteBlob(key), b.DeleteBlob(key))
+		case 3:
+			oldKey, newKey := randKey(), randKey()
+			check("RenameBlob", a.RenameBlob(oldKey, newKey), b.RenameBlob(oldKey, newKey))
+		case 4:
+			var ka, kb []string
+			erra := a.ForEachBlob(func(k []byte) error { ka = append(ka, string(k)); return nil })
+			errb := b.ForEachBlob(func(k []byte) error { kb = append(kb, string(k)); return nil })
+			check("ForEachBlob", []interface{}{ka, erra}, []interface{}{kb, errb})
+		case 5:
+			after, limit := randKey(), 1+rng.Intn(3)
+			if rng.Intn(2) == 0 {
+				after = nil
+			}
+			ka, na, erra := a.BlobPage(after, limit)
+			kb, nb, errb := b.BlobPage(after, limit)
+			check("BlobPage", []interface{}{ka, na, erra}, []interface{}{kb, nb, errb})
+		case 6:
+			m, n := rng.Intn(3), rng.Intn(4)
+			length := uint64(rng.Intn(1000))
+			ca, erra := a.AddChunk(m, n, length)
+			cb, errb := b.AddChunk(m, n, length)
+			check("AddChunk", []interface{}{ca, erra}, []interface{}{cb, errb})
+		case 7:
+			id := randID()
+			ca, erra := a.Chunk(id)
+			cb, errb := b.Chunk(id)
+			check("Chunk", []interface{}{ca, erra}, []interface{}{cb, errb})
+		case 8:
+			id, index, sid := randID(), rng.Intn(4)-1, randID()
+			check("SetChunkShard", a.SetChunkShard(id, index, sid), b.SetChunkShard(id, index, sid))
+		case 9:
+			s := DBShard{HostKey: hosts[rng.Intn(len(hosts))], Offset: uint32(rng.Intn(10))}
+			s.SectorRoot[0] = byte(rng.Intn(256))
+			ida, erra := a.AddShard(s)
+			idb, errb := b.AddShard(s)
+			check("AddShard", []interface{}{ida, erra}, []interface{}{idb, errb})
+		case 10:
+			id := randID()
+			sa, erra := a.Shard(id)
+			sb, errb := b.Shard(id)
+			check("Shard", []interface{}{sa, erra}, []interface{}{sb, errb})
+		case 11:
+			key, tag := randKey(), tags[rng.Intn(len(tags))]
+			if rng.Intn(2) == 0 {
+				check("AddTag", a.AddTag(key, tag), b.AddTag(key, tag))
+			} else {
+				check("RemoveTag", a.RemoveTag(key, tag), b.RemoveTag(key, tag))
+			}
+			ka, erra := a.BlobsByTag(tag)
+			kb, errb := b.BlobsByTag(tag)
+			check("BlobsByTag", []interface{}{ka, erra}, []interface{}{kb, errb})
+		case 12:
+			key := randKey()
+			if rng.Intn(2) == 0 {
+				val := bytes.Repeat([]byte{1}, rng.Intn(3))
+				check("AddMetadata", a.AddMetadata(key, val), b.AddMetadata(key, val))
+			}
+			va, erra := a.Metadata(key)
+			vb, errb := b.Metadata(key)
+			check("Metadata", []interface{}{va, erra}, []interface{}{vb, errb})
+		case 13:
+			host := hosts[rng.Intn(len(hosts))]
+			if rng.Intn(4) == 0 {
+				other := hosts[rng.Intn(len(hosts))]
+				na, erra := a.RemapHost(host, other)
+				nb, errb := b.RemapHost(host, other)
+				check("RemapHost", []interface{}{na, erra}, []interface{}{nb, errb})
+			}
+			ka, erra := a.BlobsReferencingHost(host)
+			kb, errb := b.BlobsReferencingHost(host)
+			check("BlobsReferencingHost", []interface{}{ka, erra}, []interface{}{kb, errb})
+		}
+	}
+
+	ua, erra := a.UnreferencedSectors()
+	ub, errb := b.UnreferencedSectors()
+	check("UnreferencedSectors error", erra, errb)
+	for _, m := range []map[hostdb.HostPublicKey][]crypto.Hash{ua, ub} {
+		for _, roots := range m {
+			sort.Slice(roots, func(i, j int) bool { return bytes.Compare(roots[i][:], roots[j][:]) < 0 })
+		}
+	}
+	check("UnreferencedSectors", ua, ub)
+}
+
+func TestMetaDBEquivalence(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		dir, err := ioutil.TempDir("", "metadb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		bdb, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertMetaDBEquivalent(t, NewEphemeralMetaDB(), bdb, seed, 500)
+		bdb.Close()
+	}
+}
+
+func TestNamespacedMetaDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bdb, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+
+	// "a" must not be confused with a prefix of "ab"
+	dbA := NewNamespacedMetaDB(bdb, []byte("a"))
+	dbAB := NewNamespacedMetaDB(bdb, []byte("ab"))
+	for _, db := range []MetaDB{dbA, dbAB, bdb} {
+		if err := db.AddBlob(DBBlob{Key: []byte("bfoo")}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddTag([]byte("bfoo"), "tag"); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddMetadata([]byte("bfoo"), []byte("meta")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dbA.AddBlob(DBBlob{Key: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	dbA.ForEachBlob(func(k []byte) error { keys = append(keys, string(k)); return nil })
+	if fmt.Sprint(keys) != "[bar bfoo]" {
+		t.Fatal("wrong keys in namespace:", keys)
+	}
+	if page, next, err := dbA.BlobPage(nil, 1); err != nil {
+		t.Fatal(err)
+	} else if len(page) != 1 || string(page[0]) != "bar" || string(next) != "bar" {
+		t.Fatalf("wrong page: %q %q", page, next)
+	} else if page, next, err := dbA.BlobPage(next, 10); err != nil {
+		t.Fatal(err)
+	} else if len(page) != 1 || string(page[0]) != "bfoo" || next != nil {
+		t.Fatalf("wrong page: %q %q", page, next)
+	}
+	if tagged, err := dbAB.BlobsByTag("tag"); err != nil {
+		t.Fatal(err)
+	} else if len(tagged) != 1 || string(tagged[0]) != "bfoo" {
+		t.Fatalf("wrong tagged keys: %q", tagged)
+	}
+	var metaKeys []string
+	dbAB.ForEachMetadata(func(k, v []byte) error { metaKeys = append(metaKeys, string(k)+"="+string(v)); return nil })
+	if fmt.Sprint(metaKeys) != "[bfoo=meta]" {
+		t.Fatal("wrong metadata in namespace:", metaKeys)
+	}
+	if modified, err := dbAB.BlobsModifiedSince(time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if len(modified) != 1 || string(modified[0]) != "bfoo" {
+		t.Fatalf("wrong modified keys: %q", modified)
+	}
+
+	// deleting in one namespace should not affect the others
+	if err := dbA.DeleteBlob([]byte("bfoo")); err != nil {
+		t.Fatal(err)
+	} else if _, err := dbA.Blob([]byte("bfoo")); err != ErrKeyNotFound {
+		t.Fatal("expected ErrKeyNotFound, got", err)
+	}
+	for _, db := range []MetaDB{dbAB, bdb} {
+		if b, err := db.Blob([]byte("bfoo")); err != nil {
+			t.Fatal(err)
+		} else if string(b.Key) != "bfoo" {
+			t.Fatalf("wrong key: %q", b.Key)
+		}
+	}
+	if err := dbA.RenameBlob([]byte("bar"), []byte("baz")); err != nil {
+		t.Fatal(err)
+	} else if _, err := bdb.Blob([]byte("baz")); err != ErrKeyNotFound {
+		t.Fatal("rename escaped namespace")
+	}
+
+	// closing a namespace should not close the underlying db
+	if err := dbA.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := dbAB.Blob([]byte("bfoo")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespacedMetaDBEquivalence(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		dir, err := ioutil.TempDir("", "metadb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		bdb, err := NewBoltMetaDB(filepath.Join(dir, "meta.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// populate another namespace, which should be invisible
+		other := NewNamespacedMetaDB(bdb, []byte("other"))
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprint("blob", i))
+			other.AddBlob(DBBlob{Key: key})
+			other.AddTag(key, "tag0")
+			other.AddMetadata(key, key)
+		}
+		assertMetaDBEquivalent(t, NewEphemeralMetaDB(), NewNamespacedMetaDB(bdb, []byte("ns")), seed, 500)
+		bdb.Close()
+	}
+}
+
+func TestMetaDBKeyValidation(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		db.(interface{ SetMaxKeyLen(int) }).SetMaxKeyLen(4)
+		if err := db.AddBlob(DBBlob{Key: nil}); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey for empty key, got", err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("abcde")}); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey for long key, got", err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("abcd")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RenameBlob([]byte("abcd"), []byte("")); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey for empty key, got", err)
+		} else if err := db.RenameBlob([]byte("abcd"), []byte("abcde")); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey for long key, got", err)
+		} else if _, err := db.Blob([]byte("abcd")); err != nil {
+			t.Fatal("failed rename should not remove blob:", err)
+		}
+
+		// the limit applies to the key within a namespace, not the prefixed key
+		if bdb, ok := db.(*BoltMetaDB); ok {
+			ns := NewNamespacedMetaDB(bdb, []byte("ns"))
+			if err := ns.AddBlob(DBBlob{Key: []byte("abcd")}); err != nil {
+				t.Fatal(err)
+			} else if err := ns.AddBlob(DBBlob{}); !errors.Is(err, ErrInvalidKey) {
+				t.Fatal("expected ErrInvalidKey for empty key, got", err)
+			}
+		}
+	})
+}
+
+func TestMergeMetaDB(t *testing.T) {
+	hostA := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	hostB := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	hostC := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+
+	// resolve returns a representation of a blob that is independent of its
+	// chunk and shard IDs
+	resolve := func(t *testing.T, db MetaDB, key string) string {
+		t.Helper()
+		b, err := db.Blob([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := fmt.Sprint(b.Seed, b.RedundancyTarget)
+		for _, cid := range b.Chunks {
+			c, err := db.Chunk(cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s += fmt.Sprint(" ", c.MinShards, c.Len)
+			for _, sid := range c.Shards {
+				var sh DBShard
+				if sid != 0 {
+					if sh, err = db.Shard(sid); err != nil {
+						t.Fatal(err)
+					}
+				}
+				s += fmt.Sprint(" ", sh)
+			}
+		}
+		return s
+	}
+	addChunk := func(t *testing.T, db MetaDB, hosts ...hostdb.HostPublicKey) uint64 {
+		t.Helper()
+		c, err := db.AddChunk(1, len(hosts), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, h := range hosts {
+			if h == "" {
+				continue // leave shard missing
+			}
+			s := DBShard{HostKey: h}
+			frand.Read(s.SectorRoot[:])
+			sid, err := db.AddShard(s)
+			if err != nil {
+				t.Fatal(err)
+			} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c.ID
+	}
+
+	// foo and bar share a chunk; baz has a missing shard
+	src := NewEphemeralMetaDB()
+	c1 := addChunk(t, src, hostA, hostB)
+	c2 := addChunk(t, src, hostA, "")
+	for _, b := range []DBBlob{
+		{Key: []byte("foo"), Chunks: []uint64{c1, c2}},
+		{Key: []byte("bar"), Chunks: []uint64{c1}},
+		{Key: []byte("baz"), Chunks: []uint64{c2}, RedundancyTarget: 1},
+	} {
+		frand.Read(b.Seed[:])
+		if err := src.AddBlob(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		policy ConflictPolicy
+		merged int
+		keys   map[string]string // dst key -> src key
+	}{
+		{"Skip", ConflictSkip, 2, map[string]string{"bar": "bar", "baz": "baz"}},
+		{"Overwrite", ConflictOverwrite, 3, map[string]string{"foo": "foo", "bar": "bar", "baz": "baz"}},
+		{"Rename", ConflictRename, 3, map[string]string{"foo.1": "foo", "bar": "bar", "baz": "baz"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forEachMetaDB(t, func(t *testing.T, dst MetaDB) {
+				// dst has its own foo, so its IDs will not line up with src's
+				if err := dst.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{addChunk(t, dst, hostC)}}); err != nil {
+					t.Fatal(err)
+				}
+				oldFoo := resolve(t, dst, "foo")
+
+				merged, err := MergeMetaDB(dst, src, test.policy)
+				if err != nil {
+					t.Fatal(err)
+				} else if merged != test.merged {
+					t.Fatalf("expected %v blobs to be merged, got %v", test.merged, merged)
+				}
+				for dstKey, srcKey := range test.keys {
+					if got, exp := resolve(t, dst, dstKey), resolve(t, src, srcKey); got != exp {
+						t.Errorf("%v: expected %v, got %v", dstKey, exp, got)
+					}
+				}
+				if _, ok := test.keys["foo"]; !ok {
+					if resolve(t, dst, "foo") != oldFoo {
+						t.Error("existing blob was modified")
+					}
+				}
+
+				// chunks shared in src should be copied for each blob, but
+				// their shards should remain shared
+				bar, err := dst.Blob([]byte("bar"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				barChunk, err := dst.Chunk(bar.Chunks[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				for dstKey, srcKey := range test.keys {
+					if srcKey != "foo" {
+						continue
+					}
+					foo, err := dst.Blob([]byte(dstKey))
+					if err != nil {
+						t.Fatal(err)
+					} else if foo.Chunks[0] == bar.Chunks[0] {
+						t.Error("shared chunk was not copied")
+					} else if fooChunk, err := dst.Chunk(foo.Chunks[0]); err != nil {
+						t.Fatal(err)
+					} else if fmt.Sprint(fooChunk.Shards) != fmt.Sprint(barChunk.Shards) {
+						t.Error("shared shards were copied twice")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestMergeMetaDBDelete(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, dst MetaDB) {
+		// a and b share a chunk in src
+		src := NewEphemeralMetaDB()
+		c, err := src.AddChunk(1, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := DBShard{HostKey: hostdb.HostKeyFromPublicKey(frand.Bytes(32))}
+		frand.Read(s.SectorRoot[:])
+		if sid, err := src.AddShard(s); err != nil {
+			t.Fatal(err)
+		} else if err := src.SetChunkShard(c.ID, 0, sid); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := src.AddBlob(DBBlob{Key: []byte(key), Chunks: []uint64{c.ID}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := MergeMetaDB(dst, src, ConflictSkip); err != nil {
+			t.Fatal(err)
+		}
+
+		// deleting a must not release the shard still used by b
+		if err := dst.DeleteBlob([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if unref, err := dst.UnreferencedSectors(); err != nil {
+			t.Fatal(err)
+		} else if len(unref[s.HostKey]) != 0 {
+			t.Fatal("sector still referenced by b was reported as unreferenced")
+		}
+		if err := dst.DeleteBlob([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if unref, err := dst.UnreferencedSectors(); err != nil {
+			t.Fatal(err)
+		} else if len(unref[s.HostKey]) != 1 || unref[s.HostKey][0] != s.SectorRoot {
+			t.Fatal("unreferenced sector was not reported:", unref)
+		}
+	})
+}
+
+func TestMergeMetaDBExistingShards(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, dst MetaDB) {
+		countShards := func(db MetaDB) (n int) {
+			for id := uint64(1); ; id++ {
+				if _, err := db.Shard(id); err == ErrKeyNotFound {
+					return
+				}
+				n++
+			}
+		}
+		host := hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+		shared := DBShard{HostKey: host, Offset: 3}
+		frand.Read(shared.SectorRoot[:])
+		other := DBShard{HostKey: host}
+		frand.Read(other.SectorRoot[:])
+
+		// dst already stores shared
+		dstID, err := dst.AddShard(shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src := NewEphemeralMetaDB()
+		c, err := src.AddChunk(1, 2, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range []DBShard{other, shared} {
+			if sid, err := src.AddShard(s); err != nil {
+				t.Fatal(err)
+			} else if err := src.SetChunkShard(c.ID, i, sid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c.ID}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := MergeMetaDB(dst, src, ConflictSkip); err != nil {
+			t.Fatal(err)
+		}
+		// only other should have been added
+		if n := countShards(dst); n != 2 {
+			t.Fatalf("expected 2 shards in dst, got %v", n)
+		}
+		b, err := dst.Blob([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc, err := dst.Chunk(b.Chunks[0])
+		if err != nil {
+			t.Fatal(err)
+		} else if dc.Shards[1] != dstID {
+			t.Fatal("existing shard was not reused")
+		} else if s, err := dst.Shard(dc.Shards[0]); err != nil {
+			t.Fatal(err)
+		} else if s != other {
+			t.Fatal("new shard was not copied")
+		}
+	})
+}
+
+func TestFsck(t *testing.T) {
+	forEachMetaDB(t, func(t *testing.T, db MetaDB) {
+		addChunk := func(sids ...uint64) uint64 {
+			t.Helper()
+			c, err := db.AddChunk(1, len(sids), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, sid := range sids {
+				if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return c.ID
+		}
+		addShard := func() uint64 {
+			t.Helper()
+			id, err := db.AddShard(DBShard{
+				HostKey:    hostdb.HostKeyFromPublicKey(frand.Bytes(32)),
+				SectorRoot: frand.Entropy256(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+
+		// a healthy db, with an orphaned shard
+		c1 := addChunk(addShard(), addShard())
+		orphan := addShard()
+		if err := db.AddBlob(DBBlob{Key: []byte("foo"), Chunks: []uint64{c1}}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := Fsck(db, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if !r.Consistent() {
+			t.Fatalf("expected consistent report, got %+v", r)
+		} else if r.Blobs != 1 || r.Chunks != 1 || r.Shards != 2 {
+			t.Fatalf("wrong counts: %+v", r)
+		} else if !reflect.DeepEqual(r.OrphanShards, []uint64{orphan}) || len(r.OrphanChunks) != 0 {
+			t.Fatalf("wrong orphans: %+v", r)
+		}
+
+		// introduce some inconsistencies
+		live := addShard()
+		c2 := addChunk(live, 1000)
+		c3 := addChunk(addShard())
+		if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: []uint64{c2, c2, 2000}}); err != nil {
+			t.Fatal(err)
+		} else if err := db.AddBlob(DBBlob{Key: []byte("baz"), Chunks: []uint64{c1}}); err != nil {
+			t.Fatal(err)
+		} else if err := db.DeleteBlob([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		r, err = Fsck(db, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.Consistent() {
+			t.Fatal("expected inconsistent report")
+		}
+		if !reflect.DeepEqual(r.DuplicateChunks, [][]byte{[]byte("bar")}) {
+			t.Error("wrong duplicate chunks:", r.DuplicateChunks)
+		}
+		if !reflect.DeepEqual(r.MissingChunks, []FsckChunkRef{{[]byte("bar"), 2000}}) {
+			t.Error("wrong missing chunks:", r.MissingChunks)
+		}
+		if !reflect.DeepEqual(r.MissingShards, []FsckShardRef{{c2, 1, 1000}}) {
+			t.Error("wrong missing shards:", r.MissingShards)
+		}
+		// deleting foo released the shards of c1, which is still used by baz
+		if c, err := db.Chunk(c1); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(r.RefMismatches, c.Shards) {
+			t.Error("wrong ref mismatches:", r.RefMismatches)
+		}
+		if !reflect.DeepEqual(r.OrphanChunks, []uint64{c3}) {
+			t.Error("wrong orphan chunks:", r.OrphanChunks)
+		}
+		if r.Repaired != 0 {
+			t.Error("Fsck should not repair unless requested")
+		}
+
+		// repair should clear the slot referencing the missing shard
+		if r, err = Fsck(db, true); err != nil {
+			t.Fatal(err)
+		} else if r.Repaired != 1 {
+			t.Fatal("expected 1 repair, got", r.Repaired)
+		}
+		if c, err := db.Chunk(c2); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(c.Shards, []uint64{live, 0}) {
+			t.Fatal("slot was not cleared:", c.Shards)
+		}
+		if r, err = Fsck(db, false); err != nil {
+			t.Fatal(err)
+		} else if len(r.MissingShards) != 0 {
+			t.Fatal("missing shard was not repaired:", r.MissingShards)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package renterutil
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -208,3 +209,72 @@ func NewMigrator(hosts *HostSet) *Migrator {
 		shards: shards,
 	}
 }
+
+// ErrUnrecoverable is returned by MigrateHost when one or more chunks do not
+// have enough surviving shards to be reconstructed.
+var ErrUnrecoverable = errors.New("chunk has too few surviving shards")
+
+// MigrateHost moves every shard stored on the dead host to other hosts in
+// hosts. Each affected chunk is reconstructed from its surviving shards, and
+// the shards that were stored on dead are re-uploaded to hosts that do not
+// already store a shard of the chunk. It returns the number of shards
+// migrated.
+//
+// Chunks with fewer than MinShards surviving shards are skipped; if any are
+// encountered, the returned error wraps ErrUnrecoverable and lists their IDs.
+// Since each chunk is updated as soon as its shards have been migrated, a
+// MigrateHost that is interrupted can be resumed by calling it again.
+func MigrateHost(db MetaDB, dead hostdb.HostPublicKey, hosts *HostSet) (migrated int, err error) {
+	keys, err := db.BlobsReferencingHost(dead)
+	if err != nil {
+		return 0, err
+	}
+	pcd := ParallelChunkDownloader{Hosts: hosts}
+	seen := make(map[uint64]struct{})
+	var unrecoverable []uint64
+	for _, key := range keys {
+		b, err := db.Blob(key)
+		if err != nil {
+			return migrated, err
+		}
+		for _, cid := range b.Chunks {
+			if _, ok := seen[cid]; ok {
+				continue
+			}
+			seen[cid] = struct{}{}
+			c, err := db.Chunk(cid)
+			if err != nil {
+				return migrated, err
+			}
+			shards, err := db.Shards(c.Shards)
+			if err != nil {
+				return migrated, err
+			}
+			var lost []int
+			var surviving int
+			for i, s := range shards {
+				if c.Shards[i] == 0 {
+					continue
+				} else if s.HostKey == dead {
+					lost = append(lost, i)
+				} else {
+					surviving++
+				}
+			}
+			if len(lost) == 0 {
+				continue
+			} else if surviving < int(c.MinShards) {
+				unrecoverable = append(unrecoverable, cid)
+				continue
+			}
+			if err := pcd.repairShards(db, c, b.Seed, lost); err != nil {
+				return migrated, fmt.Errorf("%q: could not migrate chunk %v: %w", key, cid, err)
+			}
+			migrated += len(lost)
+		}
+	}
+	if len(unrecoverable) > 0 {
+		return migrated, fmt.Errorf("%w: chunks %v", ErrUnrecoverable, unrecoverable)
+	}
+	return migrated, nil
+}
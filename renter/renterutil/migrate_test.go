@@ -2,14 +2,19 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"lukechampine.com/frand"
+	"lukechampine.com/us/ghost"
+	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
 )
 
 func TestMigrate(t *testing.T) {
@@ -127,3 +132,92 @@ func TestMigrate(t *testing.T) {
 		}
 	}
 }
+
+func TestMigrateHost(t *testing.T) {
+	hosts := make([]*ghost.Host, 3)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	for i := range hosts {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hosts[i] = h
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	db := NewEphemeralMetaDB()
+	kv := PseudoKV{
+		DB: db,
+		M:  2,
+		N:  3,
+		P:  2,
+
+		Uploader:   ParallelChunkUploader{Hosts: hs},
+		Downloader: ParallelChunkDownloader{Hosts: hs},
+	}
+	bigdata := frand.Bytes(renterhost.SectorSize * 4)
+	if err := kv.PutBytes(context.Background(), []byte("foo"), bigdata); err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.Blob([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace host 1 with a new host
+	dead := hosts[1].PublicKey()
+	hosts[1].Close()
+	delete(hs.sessions, dead)
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hkr[h.PublicKey()] = h.Settings().NetAddress
+	hs.AddHost(c)
+
+	migrated, err := MigrateHost(db, dead, hs)
+	if err != nil {
+		t.Fatal(err)
+	} else if migrated != len(b.Chunks) {
+		t.Fatalf("expected %v shards to be migrated, got %v", len(b.Chunks), migrated)
+	}
+	if keys, err := db.BlobsReferencingHost(dead); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Fatal("blob still references dead host")
+	}
+	// the data should be recoverable from the surviving and new hosts alone
+	hosts[0].Close()
+	delete(hs.sessions, hosts[0].PublicKey())
+	data, err := kv.GetBytes([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, bigdata) {
+		t.Fatal("bad data")
+	}
+
+	// migrating again should be a no-op
+	if migrated, err := MigrateHost(db, dead, hs); err != nil {
+		t.Fatal(err)
+	} else if migrated != 0 {
+		t.Fatalf("expected no shards to be migrated, got %v", migrated)
+	}
+
+	// chunks without enough surviving shards should be reported
+	c2, err := db.AddChunk(2, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, hostKey := range []hostdb.HostPublicKey{dead, h.PublicKey()} {
+		if sid, err := db.AddShard(DBShard{HostKey: hostKey}); err != nil {
+			t.Fatal(err)
+		} else if err := db.SetChunkShard(c2.ID, i, sid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddBlob(DBBlob{Key: []byte("bar"), Chunks: []uint64{c2.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := MigrateHost(db, dead, hs); !errors.Is(err, ErrUnrecoverable) {
+		t.Fatal("expected ErrUnrecoverable, got", err)
+	} else if migrated != 0 {
+		t.Fatalf("expected no shards to be migrated, got %v", migrated)
+	}
+}
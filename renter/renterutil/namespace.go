@@ -0,0 +1,237 @@
+package renterutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"gitlab.com/NebulousLabs/bolt"
+	"lukechampine.com/us/hostdb"
+)
+
+// A namespacedMetaDB is a BoltMetaDB whose blob, tag, and metadata keys are
+// confined to a namespace.
+type namespacedMetaDB struct {
+	*BoltMetaDB
+	prefix []byte
+}
+
+func (db *namespacedMetaDB) key(key []byte) []byte {
+	return append(append([]byte(nil), db.prefix...), key...)
+}
+
+func (db *namespacedMetaDB) strip(key []byte) []byte {
+	return append([]byte(nil), key[len(db.prefix):]...)
+}
+
+// AddBlob implements MetaDB.
+func (db *namespacedMetaDB) AddBlob(b DBBlob) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	b.Key = db.key(b.Key)
+	return db.addBlob(b, false, nil)
+}
+
+// ReplaceBlob implements MetaDB.
+func (db *namespacedMetaDB) ReplaceBlob(b DBBlob) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	b.Key = db.key(b.Key)
+	return db.addBlob(b, true, nil)
+}
+
+// ReplaceBlobIfUnchanged implements MetaDB.
+func (db *namespacedMetaDB) ReplaceBlobIfUnchanged(b DBBlob, expectedModTime time.Time) error {
+	if err := checkKey(b.Key, db.maxKey); err != nil {
+		return err
+	}
+	b.Key = db.key(b.Key)
+	return db.addBlob(b, true, &expectedModTime)
+}
+
+// Blob implements MetaDB.
+func (db *namespacedMetaDB) Blob(key []byte) (DBBlob, error) {
+	b, err := db.BoltMetaDB.Blob(db.key(key))
+	if err != nil {
+		return DBBlob{}, err
+	}
+	b.Key = key
+	return b, nil
+}
+
+// DeleteBlob implements MetaDB.
+func (db *namespacedMetaDB) DeleteBlob(key []byte) error {
+	return db.BoltMetaDB.DeleteBlob(db.key(key))
+}
+
+// RenameBlob implements MetaDB.
+func (db *namespacedMetaDB) RenameBlob(oldKey, newKey []byte) error {
+	if err := checkKey(newKey, db.maxKey); err != nil {
+		return err
+	}
+	return db.renameBlob(db.key(oldKey), db.key(newKey))
+}
+
+// ForEachBlob implements MetaDB.
+func (db *namespacedMetaDB) ForEachBlob(fn func(key []byte) error) error {
+	return db.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketBlobs).Cursor()
+		for k, _ := c.Seek(db.prefix); k != nil && bytes.HasPrefix(k, db.prefix); k, _ = c.Next() {
+			if err := fn(k[len(db.prefix):]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BlobPage implements MetaDB.
+func (db *namespacedMetaDB) BlobPage(after []byte, limit int) (keys [][]byte, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errInvalidPageLimit
+	}
+	err = db.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketBlobs).Cursor()
+		k, _ := c.Seek(db.key(after))
+		if k != nil && after != nil && bytes.Equal(k, db.key(after)) {
+			k, _ = c.Next()
+		}
+		for ; k != nil && bytes.HasPrefix(k, db.prefix); k, _ = c.Next() {
+			if len(keys) == limit {
+				next = keys[len(keys)-1]
+				break
+			}
+			keys = append(keys, db.strip(k))
+		}
+		return nil
+	})
+	return
+}
+
+// BlobChunkRange implements MetaDB.
+func (db *namespacedMetaDB) BlobChunkRange(key []byte, start, end int64) ([]DBChunk, int64, error) {
+	return db.BoltMetaDB.BlobChunkRange(db.key(key), start, end)
+}
+
+// BlobsReferencingHost implements MetaDB.
+func (db *namespacedMetaDB) BlobsReferencingHost(host hostdb.HostPublicKey) ([][]byte, error) {
+	all, err := db.BoltMetaDB.BlobsReferencingHost(host)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, k := range all {
+		if bytes.HasPrefix(k, db.prefix) {
+			keys = append(keys, db.strip(k))
+		}
+	}
+	return keys, nil
+}
+
+// BlobsModifiedSince implements MetaDB.
+func (db *namespacedMetaDB) BlobsModifiedSince(t time.Time) ([][]byte, error) {
+	all, err := db.BoltMetaDB.BlobsModifiedSince(t)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, k := range all {
+		if bytes.HasPrefix(k, db.prefix) {
+			keys = append(keys, db.strip(k))
+		}
+	}
+	return keys, nil
+}
+
+// AddMetadata implements MetaDB.
+func (db *namespacedMetaDB) AddMetadata(key, val []byte) error {
+	return db.BoltMetaDB.AddMetadata(db.key(key), val)
+}
+
+// Metadata implements MetaDB.
+func (db *namespacedMetaDB) Metadata(key []byte) ([]byte, error) {
+	return db.BoltMetaDB.Metadata(db.key(key))
+}
+
+// IncrementMetadata implements MetaDB.
+func (db *namespacedMetaDB) IncrementMetadata(key []byte, delta int64) (int64, error) {
+	return db.BoltMetaDB.IncrementMetadata(db.key(key), delta)
+}
+
+// ForEachMetadata implements MetaDB.
+func (db *namespacedMetaDB) ForEachMetadata(fn func(key, val []byte) error) error {
+	return db.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketMeta).Cursor()
+		for k, v := c.Seek(db.prefix); k != nil && bytes.HasPrefix(k, db.prefix); k, v = c.Next() {
+			if err := fn(k[len(db.prefix):], v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddTag implements MetaDB.
+func (db *namespacedMetaDB) AddTag(key []byte, tag string) error {
+	return db.BoltMetaDB.AddTag(db.key(key), tag)
+}
+
+// RemoveTag implements MetaDB.
+func (db *namespacedMetaDB) RemoveTag(key []byte, tag string) error {
+	return db.BoltMetaDB.RemoveTag(db.key(key), tag)
+}
+
+// BlobsByTag implements MetaDB.
+func (db *namespacedMetaDB) BlobsByTag(tag string) ([][]byte, error) {
+	all, err := db.BoltMetaDB.BlobsByTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, k := range all {
+		if bytes.HasPrefix(k, db.prefix) {
+			keys = append(keys, db.strip(k))
+		}
+	}
+	return keys, nil
+}
+
+// SetBlobNote implements MetaDB.
+func (db *namespacedMetaDB) SetBlobNote(key []byte, note string) error {
+	return db.BoltMetaDB.SetBlobNote(db.key(key), note)
+}
+
+// BlobNote implements MetaDB.
+func (db *namespacedMetaDB) BlobNote(key []byte) (string, error) {
+	return db.BoltMetaDB.BlobNote(db.key(key))
+}
+
+// Close implements MetaDB. It does not close the underlying BoltMetaDB, which
+// may be shared with other namespaces.
+func (db *namespacedMetaDB) Close() error {
+	return nil
+}
+
+// NewNamespacedMetaDB returns a MetaDB that stores its blobs, tags, and
+// metadata within db under the namespace ns. Keys in one namespace never
+// collide with keys in another, and iteration only visits keys within the
+// namespace.
+//
+// Chunks and shards are not namespaced: they are identified by IDs that are
+// unique across the entire db, so they can be shared safely. For the same
+// reason, UnreferencedSectors considers every namespace in db, since a sector
+// is only garbage if no namespace references it.
+//
+// Closing the returned MetaDB does not close db.
+func NewNamespacedMetaDB(db *BoltMetaDB, ns []byte) MetaDB {
+	// length-prefix the namespace, so that no namespace is a prefix of another
+	prefix := make([]byte, binary.MaxVarintLen64+len(ns))
+	n := binary.PutUvarint(prefix, uint64(len(ns)))
+	prefix = append(prefix[:n], ns...)
+	return &namespacedMetaDB{
+		BoltMetaDB: db,
+		prefix:     prefix,
+	}
+}
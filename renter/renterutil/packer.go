@@ -0,0 +1,111 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+// packKeyPrefix is prepended to the keys of blobs created by a BlobPacker.
+const packKeyPrefix = "_pack/"
+
+// packedMetaPrefix is prepended to a key to form the metadata key that stores
+// its packedRange.
+const packedMetaPrefix = "packed/"
+
+// A packedRange identifies a value stored within a shared pack blob.
+type packedRange struct {
+	Pack   []byte
+	Offset int64
+	Length int64
+}
+
+type packEntry struct {
+	key    []byte
+	offset int64
+	length int64
+}
+
+// A BlobPacker coalesces small values into shared blobs, amortizing the
+// per-chunk overhead of storing each value separately. Each pack occupies at
+// most one chunk; values too large to share a chunk are stored normally.
+//
+// Values are buffered until the pack is full or Flush is called. Until then,
+// they cannot be retrieved with Get.
+type BlobPacker struct {
+	KV      PseudoKV
+	buf     bytes.Buffer
+	entries []packEntry
+}
+
+func (bp *BlobPacker) chunkSize() int {
+	return renterhost.SectorSize * bp.KV.M
+}
+
+// Add adds the value val, associated with key, to the current pack. If val does
+// not fit in the current pack, the pack is flushed first. If val is larger than
+// a chunk, it is uploaded as a regular blob.
+func (bp *BlobPacker) Add(ctx context.Context, key []byte, val []byte) error {
+	if len(val) >= bp.chunkSize() {
+		return bp.KV.PutBytes(ctx, key, val)
+	} else if bp.buf.Len()+len(val) > bp.chunkSize() {
+		if err := bp.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	bp.entries = append(bp.entries, packEntry{
+		key:    append([]byte(nil), key...),
+		offset: int64(bp.buf.Len()),
+		length: int64(len(val)),
+	})
+	bp.buf.Write(val)
+	return nil
+}
+
+// Flush uploads the current pack, if any, and records the location of each
+// value within it.
+func (bp *BlobPacker) Flush(ctx context.Context) error {
+	if len(bp.entries) == 0 {
+		return nil
+	}
+	packKey := []byte(packKeyPrefix + hex.EncodeToString(frand.Bytes(16)))
+	if err := bp.KV.PutBytes(ctx, packKey, bp.buf.Bytes()); err != nil {
+		return err
+	}
+	for _, e := range bp.entries {
+		pr := packedRange{
+			Pack:   packKey,
+			Offset: e.offset,
+			Length: e.length,
+		}
+		if err := SetMetaJSON(bp.KV.DB, packedMetaPrefix+string(e.key), pr); err != nil {
+			return err
+		}
+	}
+	bp.buf.Reset()
+	bp.entries = bp.entries[:0]
+	return nil
+}
+
+// Get downloads the value associated with key and writes it to w. If the value
+// was not packed, it is downloaded normally.
+func (bp *BlobPacker) Get(key []byte, w io.Writer) error {
+	var pr packedRange
+	if err := GetMetaJSON(bp.KV.DB, packedMetaPrefix+string(key), &pr); err == ErrKeyNotFound {
+		return bp.KV.Get(key, w)
+	} else if err != nil {
+		return err
+	}
+	return bp.KV.GetRange(pr.Pack, w, pr.Offset, pr.Length)
+}
+
+// GetBytes downloads the value associated with key and returns it as a []byte.
+func (bp *BlobPacker) GetBytes(key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bp.Get(key, &buf)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,36 @@
+package renterutil
+
+import (
+	"sync"
+
+	"lukechampine.com/us/renterhost"
+)
+
+// shardPool recycles the sector-sized buffers into which shards are
+// downloaded. Without it, every chunk downloaded allocates a fresh buffer for
+// each of its shards, which quickly adds up when downloading large blobs.
+var shardPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 0, renterhost.SectorSize) },
+}
+
+// allocShard returns an empty buffer with capacity for a shard of n bytes. Only
+// buffers for large shards are drawn from shardPool; small ones are cheap
+// enough to allocate directly.
+func allocShard(n int64) []byte {
+	if n <= renterhost.SectorSize/2 || n > renterhost.SectorSize {
+		return make([]byte, 0, n)
+	}
+	return shardPool.Get().([]byte)[:0]
+}
+
+// releaseShards returns the sector-sized buffers of shards to shardPool. Since
+// ChunkDownloaders may not retain the shards they return, this is safe even if
+// the buffers did not come from allocShard. The caller must not use shards
+// afterward.
+func releaseShards(shards [][]byte) {
+	for _, s := range shards {
+		if cap(s) == renterhost.SectorSize {
+			shardPool.Put(s[:0])
+		}
+	}
+}
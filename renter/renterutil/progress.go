@@ -0,0 +1,48 @@
+package renterutil
+
+import "context"
+
+// shardNotifyBuffer is the number of shard notifications that may be queued
+// before uploads block waiting for the ShardFunc to catch up.
+const shardNotifyBuffer = 64
+
+// A ShardFunc is called when a shard of a chunk has been uploaded and recorded
+// in the MetaDB.
+type ShardFunc func(chunkID uint64, shardIndex int, shardID uint64)
+
+type shardNotification struct {
+	chunkID    uint64
+	shardIndex int
+	shardID    uint64
+}
+
+type shardNotifierKey struct{}
+
+// WithShardFunc returns a Context that causes ChunkUploaders to call fn each
+// time they record a shard with SetChunkShard. Shards may complete in any
+// order, but calls to fn are serialized. fn is called from a separate
+// goroutine, so a slow fn does not stall the upload unless it falls far behind.
+//
+// The returned stop function must be called once all uploads using the Context
+// have returned; it waits for any pending calls to fn to complete.
+func WithShardFunc(ctx context.Context, fn ShardFunc) (_ context.Context, stop func()) {
+	ch := make(chan shardNotification, shardNotifyBuffer)
+	done := make(chan struct{})
+	go func() {
+		for n := range ch {
+			fn(n.chunkID, n.shardIndex, n.shardID)
+		}
+		close(done)
+	}()
+	return context.WithValue(ctx, shardNotifierKey{}, ch), func() {
+		close(ch)
+		<-done
+	}
+}
+
+// notifyShard queues a notification for the Context's ShardFunc, if any.
+func notifyShard(ctx context.Context, chunkID uint64, shardIndex int, shardID uint64) {
+	if ch, ok := ctx.Value(shardNotifierKey{}).(chan shardNotification); ok {
+		ch <- shardNotification{chunkID, shardIndex, shardID}
+	}
+}
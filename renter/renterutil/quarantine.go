@@ -0,0 +1,81 @@
+package renterutil
+
+import (
+	"sync"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+)
+
+type quarantineState struct {
+	failures int
+	until    time.Time
+}
+
+// A HostQuarantine tracks consecutive failures per host, temporarily
+// quarantining hosts that fail too often. Once a host's quarantine expires, it
+// is re-admitted on probation: a single success clears its record, while a
+// single failure quarantines it again. It is safe for concurrent use.
+type HostQuarantine struct {
+	threshold int
+	backoff   time.Duration
+	hosts     map[hostdb.HostPublicKey]*quarantineState
+	mu        sync.Mutex
+}
+
+// RecordSuccess records a successful interaction with a host, clearing any
+// previous failures.
+func (q *HostQuarantine) RecordSuccess(host hostdb.HostPublicKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.hosts, host)
+}
+
+// RecordFailure records a failed interaction with a host. If the host has
+// failed too many times in a row, it is quarantined.
+func (q *HostQuarantine) RecordFailure(host hostdb.HostPublicKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qs, ok := q.hosts[host]
+	if !ok {
+		qs = new(quarantineState)
+		q.hosts[host] = qs
+	}
+	qs.failures++
+	if qs.failures >= q.threshold {
+		qs.until = time.Now().Add(q.backoff)
+	}
+}
+
+// Quarantined reports whether host is currently quarantined.
+func (q *HostQuarantine) Quarantined(host hostdb.HostPublicKey) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qs, ok := q.hosts[host]
+	return ok && time.Now().Before(qs.until)
+}
+
+// Quarantine returns the hosts that are currently quarantined, along with the
+// time at which each will be re-admitted.
+func (q *HostQuarantine) Quarantine() map[hostdb.HostPublicKey]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := make(map[hostdb.HostPublicKey]time.Time)
+	now := time.Now()
+	for host, qs := range q.hosts {
+		if now.Before(qs.until) {
+			m[host] = qs.until
+		}
+	}
+	return m
+}
+
+// NewHostQuarantine returns a HostQuarantine that quarantines hosts for backoff
+// after threshold consecutive failures.
+func NewHostQuarantine(threshold int, backoff time.Duration) *HostQuarantine {
+	return &HostQuarantine{
+		threshold: threshold,
+		backoff:   backoff,
+		hosts:     make(map[hostdb.HostPublicKey]*quarantineState),
+	}
+}
@@ -0,0 +1,145 @@
+package renterutil
+
+import (
+	"context"
+	"sync"
+
+	"lukechampine.com/us/hostdb"
+)
+
+// ChunkRedundancy reports the number of shards requested and actually stored
+// for a chunk.
+type ChunkRedundancy struct {
+	ID        uint64
+	MinShards int
+	Requested int
+	Achieved  int
+}
+
+// Degraded returns true if fewer shards were stored than requested.
+func (cr ChunkRedundancy) Degraded() bool {
+	return cr.Achieved < cr.Requested
+}
+
+// BlobRedundancy returns the redundancy of each chunk of b, as recorded in db.
+func BlobRedundancy(db MetaDB, b DBBlob) ([]ChunkRedundancy, error) {
+	crs := make([]ChunkRedundancy, len(b.Chunks))
+	for i, cid := range b.Chunks {
+		c, err := db.Chunk(cid)
+		if err != nil {
+			return nil, err
+		}
+		crs[i] = ChunkRedundancy{
+			ID:        c.ID,
+			MinShards: int(c.MinShards),
+			Requested: len(c.Shards),
+		}
+		for _, sid := range c.Shards {
+			if sid != 0 {
+				crs[i].Achieved++
+			}
+		}
+	}
+	return crs, nil
+}
+
+// liveShards returns the number of shards of c stored on online hosts.
+func liveShards(db MetaDB, c DBChunk, online map[hostdb.HostPublicKey]bool) (int, error) {
+	var n int
+	for _, sid := range c.Shards {
+		if sid == 0 {
+			continue
+		}
+		s, err := db.Shard(sid)
+		if err != nil {
+			return 0, err
+		} else if online[s.HostKey] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// BlobsBelowTarget returns, in sorted order, the keys of all blobs with at
+// least one chunk whose number of shards stored on online hosts has fallen
+// below the blob's RedundancyTarget. Hosts absent from online are considered
+// offline. Up to kv.P blobs are checked concurrently.
+func (kv PseudoKV) BlobsBelowTarget(online map[hostdb.HostPublicKey]bool) ([][]byte, error) {
+	keys, err := blobKeys(kv.DB)
+	if err != nil {
+		return nil, err
+	}
+	isBelow := make([]bool, len(keys))
+	err = forEachKey(context.Background(), keys, kv.P, func(_ context.Context, i int, key []byte) error {
+		b, err := kv.DB.Blob(key)
+		if err != nil {
+			return err
+		}
+		for _, cid := range b.Chunks {
+			c, err := kv.DB.Chunk(cid)
+			if err != nil {
+				return err
+			}
+			n, err := liveShards(kv.DB, c, online)
+			if err != nil {
+				return err
+			} else if n < b.chunkTarget(c) {
+				isBelow[i] = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var below [][]byte
+	for i, key := range keys {
+		if isBelow[i] {
+			below = append(below, key)
+		}
+	}
+	return below, nil
+}
+
+// An UploadResult reports the outcome of an upload, including any shortfall in
+// redundancy and the hosts responsible for it.
+type UploadResult struct {
+	Chunks      []ChunkRedundancy
+	FailedHosts HostErrorSet
+}
+
+// Degraded returns true if any chunk was stored with fewer shards than
+// requested.
+func (ur UploadResult) Degraded() bool {
+	for _, cr := range ur.Chunks {
+		if cr.Degraded() {
+			return true
+		}
+	}
+	return false
+}
+
+// An uploadRecorder collects host failures during an upload. It is passed to
+// ChunkUploaders via the upload's Context, in the manner of net/http/httptrace.
+type uploadRecorder struct {
+	errs HostErrorSet
+	mu   sync.Mutex
+}
+
+type uploadRecorderKey struct{}
+
+func withUploadRecorder(ctx context.Context, ur *uploadRecorder) context.Context {
+	return context.WithValue(ctx, uploadRecorderKey{}, ur)
+}
+
+// recordHostErrors records errs with the Context's uploadRecorder, if any.
+func recordHostErrors(ctx context.Context, errs ...*HostError) {
+	ur, ok := ctx.Value(uploadRecorderKey{}).(*uploadRecorder)
+	if !ok || len(errs) == 0 {
+		return
+	}
+	ur.mu.Lock()
+	ur.errs = append(ur.errs, errs...)
+	ur.mu.Unlock()
+}
@@ -0,0 +1,268 @@
+package renterutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+)
+
+type repairItem struct {
+	key   []byte
+	cid   uint64
+	spare int    // shards available beyond MinShards
+	seq   uint64 // enqueue order, for breaking ties
+}
+
+// RepairStatus reports the state of a RepairQueue.
+type RepairStatus struct {
+	Queued   int // chunks waiting to be repaired
+	Active   int // chunks currently being repaired
+	Repaired int // chunks successfully repaired
+	Failed   int // chunks whose repair failed
+}
+
+// A RepairQueue repairs degraded chunks in the background. Chunks are
+// deduplicated, and the chunk with the fewest spare shards (i.e. the one
+// closest to becoming unrecoverable) is always repaired first. Repairs are
+// performed by a ChunkUpdater (typically a GenericChunkUpdater with InPlace
+// set), with bounded concurrency and a minimum interval between the start of
+// successive repairs. It is safe for concurrent use.
+type RepairQueue struct {
+	db       MetaDB
+	u        ChunkUpdater
+	p        int
+	interval time.Duration
+	online   map[hostdb.HostPublicKey]bool
+	log      Logger
+
+	queued map[uint64]*repairItem
+	active map[uint64]struct{}
+	status RepairStatus
+	seq    uint64
+	wake   chan struct{}
+	mu     sync.Mutex
+}
+
+// SetOnline sets the hosts considered online when prioritizing chunks; only
+// shards stored on online hosts count towards a chunk's spare shards. If
+// online is nil (the default), all stored shards are counted. Chunks that are
+// already queued are not reprioritized.
+func (q *RepairQueue) SetOnline(online map[hostdb.HostPublicKey]bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.online = online
+}
+
+// SetLogger sets the Logger used to report failed repairs.
+func (q *RepairQueue) SetLogger(l Logger) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.log = l
+}
+
+// Enqueue adds chunk cid of the blob stored under key to the queue. If the
+// chunk is already queued, its priority is recomputed; if it is currently being
+// repaired, Enqueue does nothing.
+func (q *RepairQueue) Enqueue(key []byte, cid uint64) error {
+	c, err := q.db.Chunk(cid)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	online := q.online
+	q.mu.Unlock()
+	var live int
+	if online != nil {
+		if live, err = liveShards(q.db, c, online); err != nil {
+			return err
+		}
+	} else {
+		for _, sid := range c.Shards {
+			if sid != 0 {
+				live++
+			}
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.active[cid]; ok {
+		return nil
+	} else if item, ok := q.queued[cid]; ok {
+		item.key = append([]byte(nil), key...)
+		item.spare = live - int(c.MinShards)
+		return nil
+	}
+	q.seq++
+	q.queued[cid] = &repairItem{
+		key:   append([]byte(nil), key...),
+		cid:   cid,
+		spare: live - int(c.MinShards),
+		seq:   q.seq,
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Queued reports whether chunk cid is queued or currently being repaired.
+func (q *RepairQueue) Queued(cid uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, queued := q.queued[cid]
+	_, active := q.active[cid]
+	return queued || active
+}
+
+// Status returns the current status of the queue.
+func (q *RepairQueue) Status() RepairStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.status
+	s.Queued = len(q.queued)
+	s.Active = len(q.active)
+	return s
+}
+
+// next removes the highest-priority item from the queue and marks it active,
+// blocking until an item is available or ctx is canceled.
+func (q *RepairQueue) next(ctx context.Context) (*repairItem, bool) {
+	for {
+		q.mu.Lock()
+		var best *repairItem
+		for _, item := range q.queued {
+			if best == nil || item.spare < best.spare || (item.spare == best.spare && item.seq < best.seq) {
+				best = item
+			}
+		}
+		if best != nil {
+			delete(q.queued, best.cid)
+			q.active[best.cid] = struct{}{}
+			q.mu.Unlock()
+			return best, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// repair repairs a single chunk, updating its blob if the chunk was replaced.
+func (q *RepairQueue) repair(ctx context.Context, item *repairItem) error {
+	b, err := q.db.Blob(item.key)
+	if err != nil {
+		return err
+	}
+	c, err := q.db.Chunk(item.cid)
+	if err != nil {
+		return err
+	}
+	id, err := q.u.UpdateChunk(ctx, q.db, b, c)
+	if err != nil {
+		return err
+	} else if id == c.ID {
+		return nil
+	}
+	// swap the new chunk into the current version of the blob, retrying if
+	// the blob is modified concurrently. If the blob no longer references
+	// the old chunk, the new chunk is released instead.
+	for {
+		b, err = q.db.Blob(item.key)
+		if err == ErrKeyNotFound {
+			return discardChunks(q.db, []uint64{id})
+		} else if err != nil {
+			_ = discardChunks(q.db, []uint64{id})
+			return err
+		}
+		// EphemeralMetaDB does not copy the blob's chunks
+		b.Chunks = append([]uint64(nil), b.Chunks...)
+		var referenced bool
+		for i := range b.Chunks {
+			if b.Chunks[i] == c.ID {
+				b.Chunks[i] = id
+				referenced = true
+			}
+		}
+		if !referenced {
+			return discardChunks(q.db, []uint64{id})
+		}
+		err = q.db.ReplaceBlobIfUnchanged(b, b.ModTime)
+		if errors.Is(err, ErrConflict) {
+			continue
+		} else if err != nil {
+			_ = discardChunks(q.db, []uint64{id})
+			return err
+		}
+		return nil
+	}
+}
+
+// Run processes the queue until ctx is canceled, repairing up to p chunks at
+// once. It always returns ctx.Err().
+func (q *RepairQueue) Run(ctx context.Context) error {
+	sem := make(chan struct{}, q.p)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var last time.Time
+	for {
+		if wait := time.Until(last.Add(q.interval)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		item, ok := q.next(ctx)
+		if !ok {
+			return ctx.Err()
+		}
+		last = time.Now()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.repair(ctx, item)
+			q.mu.Lock()
+			delete(q.active, item.cid)
+			if err != nil {
+				q.status.Failed++
+				logf(q.log, "%q: could not repair chunk %v: %v", item.key, item.cid, err)
+			} else {
+				q.status.Repaired++
+			}
+			q.mu.Unlock()
+			<-sem
+		}()
+	}
+}
+
+// NewRepairQueue returns an empty RepairQueue that repairs chunks in db using
+// u. At most p chunks are repaired at once, and successive repairs are started
+// at least interval apart. The queue does nothing until Run is called.
+func NewRepairQueue(db MetaDB, u ChunkUpdater, p int, interval time.Duration) *RepairQueue {
+	if p < 1 {
+		p = 1
+	}
+	return &RepairQueue{
+		db:       db,
+		u:        u,
+		p:        p,
+		interval: interval,
+		queued:   make(map[uint64]*repairItem),
+		active:   make(map[uint64]struct{}),
+		wake:     make(chan struct{}, 1),
+	}
+}
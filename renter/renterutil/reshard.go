@@ -0,0 +1,92 @@
+package renterutil
+
+import (
+	"context"
+
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+// ReshardBlob re-encodes each chunk of the blob associated with key using the
+// erasure-coding parameters m and n, uploading the new shards to hosts. This
+// can be used to raise or lower the durability (and cost) of existing data.
+//
+// Chunks are processed one at a time. If m is lowered, a chunk may be split
+// into several smaller chunks. A chunk is replaced in the blob only after all
+// of its new shards have been uploaded, and its old shards are released
+// (allowing them to be deleted by GC) when the updated blob is stored. If an
+// upload fails, the shards uploaded for the chunk are released as well. If
+// ReshardBlob is interrupted, calling it again with the same parameters resumes
+// the operation: chunks that already use m and n are skipped, and any
+// partially-uploaded chunk is uploaded from scratch.
+//
+// If the blob's RedundancyTarget exceeds n, it is reset to its default.
+func ReshardBlob(ctx context.Context, db MetaDB, key []byte, m, n int, hosts *HostSet) error {
+	if err := checkChunkParams(m, n); err != nil {
+		return err
+	}
+	b, err := db.Blob(key)
+	if err != nil {
+		return err
+	}
+	if int(b.RedundancyTarget) > n {
+		b.RedundancyTarget = 0
+		if err := db.AddBlob(b); err != nil {
+			return err
+		}
+	}
+	d := ParallelChunkDownloader{Hosts: hosts}
+	u := ParallelChunkUploader{Hosts: hosts}
+	rsc := renter.NewRSCode(m, n)
+	shards := make([][]byte, n)
+	for i := range shards {
+		shards[i] = make([]byte, renterhost.SectorSize)
+	}
+	maxChunkLen := renterhost.SectorSize * m
+	for i := 0; i < len(b.Chunks); i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c, err := db.Chunk(b.Chunks[i])
+		if err != nil {
+			return err
+		} else if int(c.MinShards) == m && len(c.Shards) == n {
+			continue
+		}
+		data, err := DownloadAndReconstruct(d, db, c, b.Seed)
+		if err != nil {
+			return err
+		}
+		// lowering m may require the chunk to be split into several new chunks;
+		// if any of them cannot be uploaded, release the ones created so far
+		var ids []uint64
+		for len(data) > 0 {
+			chunkLen := len(data)
+			if chunkLen > maxChunkLen {
+				chunkLen = maxChunkLen
+			}
+			nc, err := db.AddChunk(m, n, uint64(chunkLen))
+			if err != nil {
+				_ = discardChunks(db, ids)
+				return err
+			}
+			ids = append(ids, nc.ID)
+			rsc.Encode(data[:chunkLen], shards)
+			if err := u.UploadChunk(ctx, db, nc, b.Seed, shards); err != nil {
+				_ = discardChunks(db, ids)
+				return err
+			}
+			data = data[chunkLen:]
+		}
+		// b.Chunks may be shared with the db, so build a new slice
+		chunks := append([]uint64(nil), b.Chunks[:i]...)
+		chunks = append(chunks, ids...)
+		b.Chunks = append(chunks, b.Chunks[i+1:]...)
+		if err := db.ReplaceBlob(b); err != nil {
+			_ = discardChunks(db, ids)
+			return err
+		}
+		i += len(ids) - 1
+	}
+	return nil
+}
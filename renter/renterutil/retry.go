@@ -0,0 +1,50 @@
+package renterutil
+
+import "time"
+
+// A RetryPolicy decides whether a failed operation should be retried. attempt
+// is the number of attempts made so far, starting at 1. If retry is true, the
+// operation is attempted again after waiting for backoff.
+type RetryPolicy interface {
+	ShouldRetry(attempt int, err error) (retry bool, backoff time.Duration)
+}
+
+type noRetry struct{}
+
+func (noRetry) ShouldRetry(int, error) (bool, time.Duration) { return false, 0 }
+
+// NoRetry is a RetryPolicy that never retries.
+var NoRetry RetryPolicy = noRetry{}
+
+// FixedRetry is a RetryPolicy that retries up to n times, without waiting
+// between attempts.
+type FixedRetry int
+
+// ShouldRetry implements RetryPolicy.
+func (n FixedRetry) ShouldRetry(attempt int, _ error) (bool, time.Duration) {
+	return attempt <= int(n), 0
+}
+
+// ExponentialBackoff is a RetryPolicy that retries up to Retries times,
+// doubling the wait between attempts, starting from Base and never exceeding
+// Max (if nonzero).
+type ExponentialBackoff struct {
+	Retries int
+	Base    time.Duration
+	Max     time.Duration
+}
+
+// ShouldRetry implements RetryPolicy.
+func (eb ExponentialBackoff) ShouldRetry(attempt int, _ error) (bool, time.Duration) {
+	if attempt > eb.Retries {
+		return false, 0
+	}
+	backoff := eb.Base
+	for i := 1; i < attempt && (eb.Max == 0 || backoff < eb.Max); i++ {
+		backoff *= 2
+	}
+	if eb.Max != 0 && backoff > eb.Max {
+		backoff = eb.Max
+	}
+	return true, backoff
+}
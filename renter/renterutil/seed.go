@@ -0,0 +1,96 @@
+package renterutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+)
+
+// ErrIncorrectSeed is returned by VerifySeed when a blob's seed does not match
+// the data stored on hosts.
+var ErrIncorrectSeed = errors.New("seed does not match blob data")
+
+// VerifySeed checks that the seed of the blob associated with key can decrypt
+// its data. It downloads a single segment from MinShards+1 shards of the
+// blob's first redundant chunk, decrypts them, and checks that they form a
+// valid erasure code. Data decrypted with the wrong seed is effectively random,
+// and thus fails this check with overwhelming probability.
+//
+// VerifySeed returns an error if the blob has no chunks with parity shards, as
+// such chunks cannot be verified without a checksum.
+func VerifySeed(db MetaDB, key []byte, hosts *HostSet) error {
+	b, err := db.Blob(key)
+	if err != nil {
+		return err
+	}
+	var c DBChunk
+	for _, cid := range b.Chunks {
+		if c, err = db.Chunk(cid); err != nil {
+			return err
+		} else if len(c.Shards) > int(c.MinShards) {
+			break
+		}
+		c = DBChunk{}
+	}
+	if len(c.Shards) == 0 {
+		return errors.New("blob has no redundant chunks")
+	}
+
+	shards := make([][]byte, len(c.Shards))
+	for i := range shards {
+		shards[i] = make([]byte, 0, merkle.SegmentSize)
+	}
+	var have []int
+	var errs HostErrorSet
+	for i, sid := range c.Shards {
+		if len(have) == int(c.MinShards)+1 {
+			break
+		} else if sid == 0 {
+			continue
+		}
+		s, err := db.Shard(sid)
+		if err != nil {
+			return err
+		}
+		sess, err := hosts.acquire(s.HostKey)
+		if err != nil {
+			errs = append(errs, &HostError{s.HostKey, err})
+			continue
+		}
+		buf := bytes.NewBuffer(shards[i])
+		err = (&renter.ShardDownloader{
+			Downloader: sess,
+			Key:        b.Seed,
+			Slices: []renter.SectorSlice{{
+				MerkleRoot:   s.SectorRoot,
+				SegmentIndex: s.Offset,
+				NumSegments:  1,
+				Nonce:        s.Nonce,
+			}},
+		}).CopySection(buf, 0, merkle.SegmentSize)
+		hosts.release(s.HostKey)
+		if err != nil {
+			errs = append(errs, &HostError{s.HostKey, err})
+			continue
+		}
+		shards[i] = buf.Bytes()
+		have = append(have, i)
+	}
+	if len(have) < int(c.MinShards)+1 {
+		return fmt.Errorf("could not download enough shards to verify seed (needed %v, got %v): %w", c.MinShards+1, len(have), errs)
+	}
+
+	// discard one shard, reconstruct it from the others, and compare
+	check := have[len(have)-1]
+	want := append([]byte(nil), shards[check]...)
+	shards[check] = shards[check][:0]
+	if err := renter.NewRSCode(int(c.MinShards), len(c.Shards)).Reconstruct(shards); err != nil {
+		return err
+	} else if !bytes.Equal(shards[check], want) {
+		return ErrIncorrectSeed
+	}
+	return nil
+}
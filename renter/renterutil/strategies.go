@@ -3,9 +3,12 @@ package renterutil
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sort"
 	"sync"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -13,9 +16,132 @@ import (
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
+// A HostGroupFunc assigns a host to a failure domain, such as a subnet or
+// geographic region. Uploaders with a non-nil HostGroupFunc spread the shards of
+// each chunk across as many distinct groups as possible.
+type HostGroupFunc func(hostdb.HostPublicKey) string
+
+// SubnetHostGroup returns a HostGroupFunc that groups hosts by the /24 (IPv4) or
+// /64 (IPv6) subnet of their NetAddress. Hosts whose NetAddress is a hostname
+// rather than an IP are grouped by hostname, and unknown hosts are each placed
+// in their own group.
+func SubnetHostGroup(hosts []hostdb.ScannedHost) HostGroupFunc {
+	groups := make(map[hostdb.HostPublicKey]string, len(hosts))
+	for _, h := range hosts {
+		addr := string(h.NetAddress)
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		if ip := net.ParseIP(addr); ip == nil {
+			groups[h.PublicKey] = addr
+		} else if ip4 := ip.To4(); ip4 != nil {
+			groups[h.PublicKey] = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			groups[h.PublicKey] = ip.Mask(net.CIDRMask(64, 128)).String()
+		}
+	}
+	return func(hostKey hostdb.HostPublicKey) string {
+		if g, ok := groups[hostKey]; ok {
+			return g
+		}
+		return string(hostKey)
+	}
+}
+
+// hostChooser returns a function that removes and returns a host from hosts.
+// If group is non-nil, hosts in groups not yet used (by the hosts in used or by
+// previously-chosen hosts) are preferred. If deterministic is true, the host is
+// chosen by rendezvous hashing on the Merkle root of the encrypted shard being
+// placed, rather than at random; see placementScore.
+func hostChooser(hosts map[hostdb.HostPublicKey]struct{}, group HostGroupFunc, used []hostdb.HostPublicKey, deterministic bool) func(shard []byte) hostdb.HostPublicKey {
+	usedGroups := make(map[string]struct{})
+	if group != nil {
+		for _, h := range used {
+			usedGroups[group(h)] = struct{}{}
+		}
+	}
+	preferred := func(h hostdb.HostPublicKey) bool {
+		if group == nil {
+			return true
+		}
+		_, ok := usedGroups[group(h)]
+		return !ok
+	}
+	return func(shard []byte) (h hostdb.HostPublicKey) {
+		if deterministic {
+			// NOTE: the root of the entire sector is not suitable, since the
+			// remainder of the sector is filled with random padding
+			root, _ := merkle.ReaderRoot(bytes.NewReader(shard))
+			h = rankedHost(hosts, root, preferred)
+		} else {
+			for h = range hosts {
+				if preferred(h) {
+					break
+				}
+			}
+		}
+		if group != nil {
+			usedGroups[group(h)] = struct{}{}
+		}
+		delete(hosts, h)
+		return
+	}
+}
+
+// placementScore returns a stable pseudorandom score for storing the shard
+// with the given root on host. Each shard is placed on the (preferred) host
+// with the highest score, so a shard is always placed on the same host, given
+// the same set of candidates.
+func placementScore(root crypto.Hash, host hostdb.HostPublicKey) crypto.Hash {
+	return crypto.HashBytes(append(root[:], host...))
+}
+
+// rankedHost returns the host in hosts with the highest placementScore for
+// root. Hosts for which preferred returns true take precedence over all others.
+func rankedHost(hosts map[hostdb.HostPublicKey]struct{}, root crypto.Hash, preferred func(hostdb.HostPublicKey) bool) (best hostdb.HostPublicKey) {
+	var bestScore crypto.Hash
+	bestPreferred := false
+	for h := range hosts {
+		score, pref := placementScore(root, h), preferred(h)
+		if best == "" || (pref && !bestPreferred) || (pref == bestPreferred && bytes.Compare(score[:], bestScore[:]) > 0) {
+			best, bestScore, bestPreferred = h, score, pref
+		}
+	}
+	return
+}
+
+// A NonceFunc generates the nonces used to encrypt shards. It must never return
+// the same nonce twice.
+type NonceFunc func() [24]byte
+
+func (nf NonceFunc) nonce() [24]byte {
+	if nf == nil {
+		return renter.RandomNonce()
+	}
+	return nf()
+}
+
+// CounterNonces returns a NonceFunc that generates nonces from a random 16-byte
+// prefix followed by a 64-bit counter. Unlike random nonces, nonces from the
+// same CounterNonces func are guaranteed to be unique.
+func CounterNonces() NonceFunc {
+	var mu sync.Mutex
+	var nonce [24]byte
+	frand.Read(nonce[:16])
+	var ctr uint64
+	return func() [24]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		ctr++
+		binary.LittleEndian.PutUint64(nonce[16:], ctr)
+		return nonce
+	}
+}
+
 // A ChunkUploader uploads shards, associating them with a given chunk.
 type ChunkUploader interface {
 	UploadChunk(ctx context.Context, db MetaDB, c DBChunk, key renter.KeySeed, shards [][]byte) error
@@ -23,7 +149,12 @@ type ChunkUploader interface {
 
 // SerialChunkUploader uploads chunks to hosts one shard at a time.
 type SerialChunkUploader struct {
-	Hosts *HostSet
+	Hosts                  *HostSet
+	HostGroup              HostGroupFunc
+	Nonces                 NonceFunc         // if nil, renter.RandomNonce is used
+	Deriver                renter.KeyDeriver // if nil, renter.XChaCha20Deriver is used
+	DeterministicPlacement bool              // see ParallelChunkUploader
+	Log                    Logger            // if nil, nothing is logged
 }
 
 // UploadChunk implements ChunkUploader.
@@ -35,6 +166,7 @@ func (scu SerialChunkUploader) UploadChunk(db MetaDB, c DBChunk, key renter.KeyS
 	}
 	need := len(shards)
 	skip := make([]bool, len(shards))
+	var used []hostdb.HostPublicKey
 	for i, sid := range c.Shards {
 		if sid != 0 {
 			s, err := db.Shard(sid)
@@ -43,6 +175,7 @@ func (scu SerialChunkUploader) UploadChunk(db MetaDB, c DBChunk, key renter.KeyS
 			}
 			if scu.Hosts.HasHost(s.HostKey) {
 				skip[i] = true
+				used = append(used, s.HostKey)
 				need--
 				delete(newHosts, s.HostKey)
 			}
@@ -51,36 +184,35 @@ func (scu SerialChunkUploader) UploadChunk(db MetaDB, c DBChunk, key renter.KeyS
 	if need > len(newHosts) {
 		return errors.New("fewer hosts than shards")
 	}
-	chooseHost := func() (h hostdb.HostPublicKey) {
-		for h = range newHosts {
-			delete(newHosts, h)
-			break
-		}
-		return
-	}
+	chooseHost := hostChooser(newHosts, scu.HostGroup, used, scu.DeterministicPlacement)
 
 	for i, shard := range shards {
 		if skip[i] {
 			continue
 		}
-		hostKey := chooseHost()
 
-		var sb renter.SectorBuilder // TODO: reuse
+		sb := renter.SectorBuilder{Deriver: scu.Deriver} // TODO: reuse
 		offset := uint32(sb.Len())
-		nonce := renter.RandomNonce()
+		nonce := scu.Nonces.nonce()
 		sb.Append(shard, key, nonce)
 		sector := sb.Finish()
+		hostKey := chooseHost(sector[:len(shard)])
 		h, err := scu.Hosts.acquire(hostKey)
 		if err != nil {
-			return &HostError{hostKey, err}
+			he := &HostError{hostKey, err}
+			logf(scu.Log, "chunk %v: could not upload shard %v: %v", c.ID, i, he)
+			return he
 		}
 		root, err := h.Append(sector)
+		fcid := h.Revision().ID()
 		scu.Hosts.release(hostKey)
 		if err != nil {
-			return &HostError{hostKey, err}
+			he := &HostError{hostKey, err}
+			logf(scu.Log, "chunk %v: could not upload shard %v: %v", c.ID, i, he)
+			return he
 		}
 
-		sid, err := db.AddShard(DBShard{hostKey, root, offset, nonce})
+		sid, err := db.AddShard(DBShard{hostKey, root, offset, nonce, fcid})
 		if err != nil {
 			return err
 		} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
@@ -92,7 +224,27 @@ func (scu SerialChunkUploader) UploadChunk(db MetaDB, c DBChunk, key renter.KeyS
 
 // ParallelChunkUploader uploads the shards of a chunk in parallel.
 type ParallelChunkUploader struct {
-	Hosts *HostSet
+	Hosts     *HostSet
+	HostGroup HostGroupFunc
+	Nonces    NonceFunc         // if nil, renter.RandomNonce is used
+	Deriver   renter.KeyDeriver // if nil, renter.XChaCha20Deriver is used
+	Log       Logger            // if nil, nothing is logged
+
+	// If DeterministicPlacement is true, each shard is placed on the host
+	// chosen by a stable hash of the shard's Merkle root and the host's key,
+	// rather than on a random host. Uploading the same shards to the same set
+	// of hosts thus always yields the same placement. Since shards are
+	// encrypted before they are hashed, reproducing a placement also requires
+	// the same key seed and a deterministic NonceFunc.
+	DeterministicPlacement bool
+
+	// Pinned optionally maps shard indices to the hosts they must be uploaded
+	// to, overriding the placement policy; the remaining shards are placed as
+	// usual, on other hosts. Every pinned host must be in Hosts, and no host
+	// may be pinned twice or pinned alongside an existing shard of the chunk.
+	// Pins for shards that are already stored are ignored. If an upload to a
+	// pinned host fails, the shard is not placed elsewhere.
+	Pinned map[int]hostdb.HostPublicKey
 }
 
 // UploadChunk implements ChunkUploader.
@@ -107,6 +259,7 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 	}
 	rem := len(shards)
 	skip := make([]bool, len(shards))
+	var used []hostdb.HostPublicKey
 	for i, sid := range c.Shards {
 		if sid != 0 {
 			s, err := db.Shard(sid)
@@ -115,23 +268,37 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 			}
 			if pcu.Hosts.HasHost(s.HostKey) {
 				skip[i] = true
+				used = append(used, s.HostKey)
 				rem--
 				delete(newHosts, s.HostKey)
 			}
 		}
 	}
-	if rem > len(newHosts) {
-		rem = len(newHosts)
+	pinned := make(map[hostdb.HostPublicKey]int)
+	for i, h := range pcu.Pinned {
+		if i < 0 || i >= len(shards) {
+			return fmt.Errorf("pinned shard index %v out of range", i)
+		} else if skip[i] {
+			continue
+		} else if j, ok := pinned[h]; ok {
+			return fmt.Errorf("shards %v and %v are both pinned to host %v", j, i, h.ShortKey())
+		} else if !pcu.Hosts.HasHost(h) {
+			return fmt.Errorf("shard %v is pinned to unknown host %v", i, h.ShortKey())
+		} else if _, ok := newHosts[h]; !ok {
+			return fmt.Errorf("shard %v is pinned to host %v, which already stores a shard of the chunk", i, h.ShortKey())
+		}
+		pinned[h] = i
 	}
-
-	chooseHost := func() (h hostdb.HostPublicKey) {
-		for h = range newHosts {
-			delete(newHosts, h)
-			break
-		}
-		return
+	for h := range pinned {
+		delete(newHosts, h)
+		used = append(used, h)
+	}
+	if rem-len(pinned) > len(newHosts) {
+		rem = len(pinned) + len(newHosts)
 	}
 
+	chooseHost := hostChooser(newHosts, pcu.HostGroup, used, pcu.DeterministicPlacement)
+
 	// spawn workers
 	type req struct {
 		shardIndex int
@@ -172,6 +339,7 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 					continue
 				}
 				root, err := sess.Append(req.shard)
+				fcid := sess.Revision().ID()
 				pcu.Hosts.release(req.hostKey)
 				if err != nil {
 					respChan <- resp{req, 0, err}
@@ -179,7 +347,7 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 				}
 
 				// TODO: need to use sb.Len as offset if reusing sb, i.e. when buffering
-				ssid, err := db.AddShard(DBShard{req.hostKey, root, 0, req.nonce})
+				ssid, err := db.AddShard(DBShard{req.hostKey, root, 0, req.nonce, fcid})
 				respChan <- resp{req, ssid, err}
 			}
 		}()
@@ -200,8 +368,8 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 		if skip[i] {
 			continue
 		}
-		nonces[i] = renter.RandomNonce()
-		var sb renter.SectorBuilder
+		nonces[i] = pcu.Nonces.nonce()
+		sb := renter.SectorBuilder{Deriver: pcu.Deriver}
 		sb.Append(shard, key, nonces[i])
 		sectors[i] = sb.Finish()
 	}
@@ -221,12 +389,19 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 			return ctx.Err()
 		}
 
-		if skip[shardIndex] || len(newHosts) == 0 {
+		if skip[shardIndex] {
 			continue
 		}
+		hostKey, ok := pcu.pinnedHost(shardIndex)
+		if !ok {
+			if len(newHosts) == 0 {
+				continue
+			}
+			hostKey = chooseHost(sectors[shardIndex][:len(shards[shardIndex])])
+		}
 		reqChan <- req{
 			shardIndex: shardIndex,
-			hostKey:    chooseHost(),
+			hostKey:    hostKey,
 			shard:      sectors[shardIndex],
 			nonce:      nonces[shardIndex],
 			block:      false,
@@ -258,6 +433,7 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 				}
 				return err
 			}
+			notifyShard(ctx, c.ID, resp.req.shardIndex, resp.sliceID)
 			rem--
 		} else {
 			if resp.err == errHostAcquired {
@@ -267,10 +443,12 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 				reqQueue = append(reqQueue, resp.req)
 			} else {
 				// uploading to this host failed; don't try it again
-				errs = append(errs, &HostError{resp.req.hostKey, resp.err})
+				he := &HostError{resp.req.hostKey, resp.err}
+				logf(pcu.Log, "chunk %v: could not upload shard %v: %v", c.ID, resp.req.shardIndex, he)
+				errs = append(errs, he)
 				// add a different host to the queue, if able
-				if len(newHosts) > 0 {
-					resp.req.hostKey = chooseHost()
+				if _, ok := pcu.pinnedHost(resp.req.shardIndex); !ok && len(newHosts) > 0 {
+					resp.req.hostKey = chooseHost(resp.req.shard[:len(shards[resp.req.shardIndex])])
 					resp.req.block = false
 					reqQueue = append(reqQueue, resp.req)
 				}
@@ -283,20 +461,32 @@ func (pcu ParallelChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c D
 			}
 		}
 	}
+	recordHostErrors(ctx, errs...)
 	if rem > 0 {
 		return fmt.Errorf("could not upload to enough hosts: %w", errs)
 	}
 	return nil
 }
 
+// pinnedHost returns the host that shard i is pinned to, if any.
+func (pcu ParallelChunkUploader) pinnedHost(i int) (hostdb.HostPublicKey, bool) {
+	h, ok := pcu.Pinned[i]
+	return h, ok
+}
+
 // MinimumChunkUploader uploads shards one at a time, stopping as soon as
 // MinShards shards have been uploaded.
 type MinimumChunkUploader struct {
-	Hosts *HostSet
+	Hosts                  *HostSet
+	HostGroup              HostGroupFunc
+	Nonces                 NonceFunc         // if nil, renter.RandomNonce is used
+	Deriver                renter.KeyDeriver // if nil, renter.XChaCha20Deriver is used
+	DeterministicPlacement bool              // see ParallelChunkUploader
+	Log                    Logger            // if nil, nothing is logged
 }
 
 // UploadChunk implements ChunkUploader.
-func (mcu MinimumChunkUploader) UploadChunk(_ context.Context, db MetaDB, c DBChunk, key renter.KeySeed, shards [][]byte) error {
+func (mcu MinimumChunkUploader) UploadChunk(ctx context.Context, db MetaDB, c DBChunk, key renter.KeySeed, shards [][]byte) error {
 	// choose hosts, preserving any that at already present
 	newHosts := make(map[hostdb.HostPublicKey]struct{})
 	for h := range mcu.Hosts.sessions {
@@ -304,6 +494,7 @@ func (mcu MinimumChunkUploader) UploadChunk(_ context.Context, db MetaDB, c DBCh
 	}
 	need := int(c.MinShards)
 	skip := make([]bool, len(shards))
+	var used []hostdb.HostPublicKey
 	for i, sid := range c.Shards {
 		if sid != 0 {
 			s, err := db.Shard(sid)
@@ -312,6 +503,7 @@ func (mcu MinimumChunkUploader) UploadChunk(_ context.Context, db MetaDB, c DBCh
 			}
 			if mcu.Hosts.HasHost(s.HostKey) {
 				skip[i] = true
+				used = append(used, s.HostKey)
 				need--
 				delete(newHosts, s.HostKey)
 			}
@@ -322,39 +514,42 @@ func (mcu MinimumChunkUploader) UploadChunk(_ context.Context, db MetaDB, c DBCh
 	} else if need <= 0 {
 		return nil // already have minimum
 	}
-	chooseHost := func() (h hostdb.HostPublicKey) {
-		for h = range newHosts {
-			delete(newHosts, h)
-			break
-		}
-		return
-	}
+	chooseHost := hostChooser(newHosts, mcu.HostGroup, used, mcu.DeterministicPlacement)
 	for i, shard := range shards {
 		if skip[i] {
 			continue
 		}
-		hostKey := chooseHost()
 
-		nonce := renter.RandomNonce()
-		var sb renter.SectorBuilder // TODO: reuse
+		nonce := mcu.Nonces.nonce()
+		sb := renter.SectorBuilder{Deriver: mcu.Deriver} // TODO: reuse
 		offset := uint32(sb.Len())
 		sb.Append(shard, key, nonce)
 		sector := sb.Finish()
+		hostKey := chooseHost(sector[:len(shard)])
 		h, err := mcu.Hosts.acquire(hostKey)
 		if err != nil {
-			return &HostError{hostKey, err}
+			he := &HostError{hostKey, err}
+			logf(mcu.Log, "chunk %v: could not upload shard %v: %v", c.ID, i, he)
+			recordHostErrors(ctx, he)
+			return he
 		}
 		root, err := h.Append(sector)
+		fcid := h.Revision().ID()
 		mcu.Hosts.release(hostKey)
 		if err != nil {
-			return &HostError{hostKey, err}
+			he := &HostError{hostKey, err}
+			logf(mcu.Log, "chunk %v: could not upload shard %v: %v", c.ID, i, he)
+			recordHostErrors(ctx, he)
+			return he
 		}
 
-		if sid, err := db.AddShard(DBShard{hostKey, root, offset, nonce}); err != nil {
+		sid, err := db.AddShard(DBShard{hostKey, root, offset, nonce, fcid})
+		if err != nil {
 			return err
 		} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
 			return err
 		}
+		notifyShard(ctx, c.ID, i, sid)
 
 		if need--; need == 0 {
 			break
@@ -363,58 +558,91 @@ func (mcu MinimumChunkUploader) UploadChunk(_ context.Context, db MetaDB, c DBCh
 	return nil
 }
 
-// A ChunkDownloader downloads the shards of a chunk.
+// A ChunkDownloader downloads the shards of a chunk. The returned shards are
+// owned by the caller, which may recycle their buffers once the chunk has been
+// recovered; implementations must not retain them.
 type ChunkDownloader interface {
 	DownloadChunk(db MetaDB, c DBChunk, key renter.KeySeed, off, n int64) ([][]byte, error)
 }
 
 // SerialChunkDownloader downloads the shards of a chunk one at a time.
+//
+// If Cache is non-nil, entire sectors are downloaded and cached, and
+// subsequent reads of the same sector are served from the cache.
+//
+// If Height is non-nil, it is consulted before each chunk is downloaded, and
+// hosts whose contracts are too close to expiration to be revised are skipped
+// with ErrContractExpired.
 type SerialChunkDownloader struct {
-	Hosts *HostSet
+	Hosts   *HostSet
+	Cache   *SectorCache
+	Height  HeightSource
+	Deriver renter.KeyDeriver // if nil, renter.XChaCha20Deriver is used
+	Log     Logger            // if nil, nothing is logged
 }
 
 // DownloadChunk implements ChunkDownloader.
 func (scd SerialChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key renter.KeySeed, off, n int64) ([][]byte, error) {
-	minChunkSize := merkle.SegmentSize * int64(c.MinShards)
+	checkExpiry, err := expiryChecker(scd.Height)
+	if err != nil {
+		return nil, err
+	}
+	offset, length := shardSection(c, off, n)
+
 	shards := make([][]byte, len(c.Shards))
 	for i := range shards {
-		shards[i] = make([]byte, 0, renterhost.SectorSize)
+		shards[i] = allocShard(length)
 	}
 	var errs HostErrorSet
 	need := c.MinShards
 	for i, ssid := range c.Shards {
 		shard, err := db.Shard(ssid)
 		if err != nil {
+			releaseShards(shards)
 			return nil, err
 		}
 
-		start := (off / minChunkSize) * merkle.SegmentSize
-		end := ((off + n) / minChunkSize) * merkle.SegmentSize
-		if (off+n)%minChunkSize != 0 {
-			end += merkle.SegmentSize
+		buf := bytes.NewBuffer(shards[i])
+		if scd.Cache != nil && scd.Cache.copyCachedShard(buf, key, scd.Deriver, shard, offset, length) {
+			shards[i] = buf.Bytes()
+			if need--; need == 0 {
+				break
+			}
+			continue
 		}
-		offset, length := start, end-start
-
 		sess, err := scd.Hosts.acquire(shard.HostKey)
+		if err == nil {
+			if err = checkExpiry(sess); err != nil {
+				scd.Hosts.release(shard.HostKey)
+			}
+		}
 		if err != nil {
-			errs = append(errs, &HostError{shard.HostKey, err})
+			he := &HostError{shard.HostKey, err}
+			logf(scd.Log, "chunk %v: could not download shard %v: %v", c.ID, i, he)
+			errs = append(errs, he)
 			continue
 		}
 
-		buf := bytes.NewBuffer(shards[i])
-		err = (&renter.ShardDownloader{
-			Downloader: sess,
-			Key:        key,
-			Slices: []renter.SectorSlice{{
-				MerkleRoot:   shard.SectorRoot,
-				SegmentIndex: shard.Offset,
-				NumSegments:  merkle.SegmentsPerSector - shard.Offset, // inconsequential
-				Nonce:        shard.Nonce,
-			}},
-		}).CopySection(buf, offset, length)
+		if scd.Cache != nil {
+			err = scd.Cache.copyShard(buf, sess, key, scd.Deriver, shard, offset, length)
+		} else {
+			err = (&renter.ShardDownloader{
+				Downloader: sess,
+				Key:        key,
+				Deriver:    scd.Deriver,
+				Slices: []renter.SectorSlice{{
+					MerkleRoot:   shard.SectorRoot,
+					SegmentIndex: shard.Offset,
+					NumSegments:  merkle.SegmentsPerSector - shard.Offset, // inconsequential
+					Nonce:        shard.Nonce,
+				}},
+			}).CopySection(buf, offset, length)
+		}
 		scd.Hosts.release(shard.HostKey)
 		if err != nil {
-			errs = append(errs, &HostError{shard.HostKey, err})
+			he := &HostError{shard.HostKey, err}
+			logf(scd.Log, "chunk %v: could not download shard %v: %v", c.ID, i, he)
+			errs = append(errs, he)
 			continue
 		}
 		shards[i] = buf.Bytes()
@@ -423,31 +651,76 @@ func (scd SerialChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key renter.
 		}
 	}
 	if need != 0 {
+		releaseShards(shards)
 		return nil, errs
 	}
 	return shards, nil
 }
 
 // ParallelChunkDownloader downloads the shards of a chunk in parallel.
+//
+// If Cache is non-nil, entire sectors are downloaded and cached, and
+// subsequent reads of the same sector are served from the cache.
+//
+// If ReadRepair is true, shards that fail Merkle proof verification are
+// replaced in the background: after the chunk is successfully downloaded from
+// other hosts, a separate goroutine reconstructs the corrupt shards and uploads
+// them to new hosts, so the download does not wait for the repair. A chunk is
+// only repaired by one goroutine at a time. Repair is best-effort; failures are
+// logged.
+//
+// If Quarantine is non-nil, the outcome of each download is recorded with it,
+// and quarantined hosts are only contacted if the other hosts cannot supply
+// enough shards.
+//
+// Margin is the number of extra shards to request up front, beyond the
+// minimum required to recover the chunk. If a shard fails to download (e.g.
+// because it is corrupt), a spare shard is then likely to already be in
+// flight, rather than being requested only after the failure is detected.
+// Raising Margin improves latency on unreliable hosts at the cost of extra
+// bandwidth.
+//
+// If Height is non-nil, it is consulted before each chunk is downloaded, and
+// hosts whose contracts are too close to expiration to be revised are skipped
+// with ErrContractExpired.
 type ParallelChunkDownloader struct {
-	Hosts *HostSet
+	Hosts      *HostSet
+	Cache      *SectorCache
+	ReadRepair bool
+	Quarantine *HostQuarantine
+	Margin     int
+	Height     HeightSource
+	Deriver    renter.KeyDeriver // if nil, renter.XChaCha20Deriver is used
+	Log        Logger            // if nil, nothing is logged
+
+	// HostGroup, Nonces, and DeterministicPlacement control how repaired
+	// shards are placed and encrypted; see ParallelChunkUploader.
+	HostGroup              HostGroupFunc
+	Nonces                 NonceFunc
+	DeterministicPlacement bool
 }
 
 // DownloadChunk implements ChunkDownloader.
 func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key renter.KeySeed, off, n int64) ([][]byte, error) {
-	minChunkSize := merkle.SegmentSize * int64(c.MinShards)
-	start := (off / minChunkSize) * merkle.SegmentSize
-	end := ((off + n) / minChunkSize) * merkle.SegmentSize
-	if (off+n)%minChunkSize != 0 {
-		end += merkle.SegmentSize
+	checkExpiry, err := expiryChecker(pcd.Height)
+	if err != nil {
+		return nil, err
+	}
+	offset, length := shardSection(c, off, n)
+	dbShards, err := db.Shards(c.Shards)
+	if err != nil {
+		return nil, err
 	}
-	offset, length := start, end-start
 
 	// download shards in parallel, stopping when we have any c.MinShards of
 	// them
+	inflight := int(c.MinShards) + pcd.Margin
+	if inflight > len(c.Shards) {
+		inflight = len(c.Shards)
+	}
 	shards := make([][]byte, len(c.Shards))
 	for i := range shards {
-		shards[i] = make([]byte, 0, length)
+		shards[i] = allocShard(length)
 	}
 	type req struct {
 		shardIndex int
@@ -457,23 +730,44 @@ func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key rente
 		shardIndex int
 		err        *HostError
 	}
-	reqChan := make(chan req, c.MinShards)
-	respChan := make(chan resp, c.MinShards)
-	reqQueue := make([]req, len(c.Shards))
-	// initialize queue in random order
-	for i, shardIndex := range frand.Perm(len(reqQueue)) {
-		reqQueue[i] = req{shardIndex, false}
+	reqChan := make(chan req, inflight)
+	respChan := make(chan resp, inflight)
+	// initialize queue in random order, but with the data shards first: if we
+	// get all of them, the chunk can be recovered without any decoding
+	reqQueue := make([]req, 0, len(c.Shards))
+	for _, shardIndex := range frand.Perm(int(c.MinShards)) {
+		reqQueue = append(reqQueue, req{shardIndex, false})
+	}
+	for _, shardIndex := range frand.Perm(len(c.Shards) - int(c.MinShards)) {
+		reqQueue = append(reqQueue, req{int(c.MinShards) + shardIndex, false})
+	}
+	if pcd.Quarantine != nil {
+		quarantined := make([]bool, len(c.Shards))
+		for i, sid := range c.Shards {
+			if sid != 0 {
+				quarantined[i] = pcd.Quarantine.Quarantined(dbShards[i].HostKey)
+			}
+		}
+		sort.SliceStable(reqQueue, func(i, j int) bool {
+			return !quarantined[reqQueue[i].shardIndex] && quarantined[reqQueue[j].shardIndex]
+		})
 	}
 	var wg sync.WaitGroup
 	defer wg.Wait()
-	for len(reqQueue) > len(c.Shards)-int(c.MinShards) {
+	for len(reqQueue) > len(c.Shards)-inflight {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for req := range reqChan {
-				shard, err := db.Shard(c.Shards[req.shardIndex])
-				if err != nil {
-					respChan <- resp{req.shardIndex, &HostError{shard.HostKey, err}}
+				shard := dbShards[req.shardIndex]
+				if c.Shards[req.shardIndex] == 0 {
+					respChan <- resp{req.shardIndex, &HostError{shard.HostKey, ErrKeyNotFound}}
+					continue
+				}
+				buf := bytes.NewBuffer(shards[req.shardIndex])
+				if pcd.Cache != nil && pcd.Cache.copyCachedShard(buf, key, pcd.Deriver, shard, offset, length) {
+					shards[req.shardIndex] = buf.Bytes()
+					respChan <- resp{req.shardIndex, nil}
 					continue
 				}
 
@@ -482,21 +776,34 @@ func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key rente
 					sess, err = pcd.Hosts.acquire(shard.HostKey)
 				}
 				if err != nil {
+					if err != errHostAcquired {
+						pcd.recordResult(shard.HostKey, err)
+					}
+					respChan <- resp{req.shardIndex, &HostError{shard.HostKey, err}}
+					continue
+				} else if err := checkExpiry(sess); err != nil {
+					// not the host's fault, so don't record a failure
+					pcd.Hosts.release(shard.HostKey)
 					respChan <- resp{req.shardIndex, &HostError{shard.HostKey, err}}
 					continue
 				}
-				buf := bytes.NewBuffer(shards[req.shardIndex])
-				err = (&renter.ShardDownloader{
-					Downloader: sess,
-					Key:        key,
-					Slices: []renter.SectorSlice{{
-						MerkleRoot:   shard.SectorRoot,
-						SegmentIndex: shard.Offset,
-						NumSegments:  merkle.SegmentsPerSector - shard.Offset, // inconsequential
-						Nonce:        shard.Nonce,
-					}},
-				}).CopySection(buf, offset, length)
+				if pcd.Cache != nil {
+					err = pcd.Cache.copyShard(buf, sess, key, pcd.Deriver, shard, offset, length)
+				} else {
+					err = (&renter.ShardDownloader{
+						Downloader: sess,
+						Key:        key,
+						Deriver:    pcd.Deriver,
+						Slices: []renter.SectorSlice{{
+							MerkleRoot:   shard.SectorRoot,
+							SegmentIndex: shard.Offset,
+							NumSegments:  merkle.SegmentsPerSector - shard.Offset, // inconsequential
+							Nonce:        shard.Nonce,
+						}},
+					}).CopySection(buf, offset, length)
+				}
 				pcd.Hosts.release(shard.HostKey)
+				pcd.recordResult(shard.HostKey, err)
 				if err != nil {
 					respChan <- resp{req.shardIndex, &HostError{shard.HostKey, err}}
 					continue
@@ -511,11 +818,15 @@ func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key rente
 
 	var goodShards int
 	var errs HostErrorSet
+	var corrupt []int
 	for goodShards < int(c.MinShards) && goodShards+len(errs) < len(c.Shards) {
 		resp := <-respChan
 		if resp.err == nil {
 			goodShards++
 		} else {
+			if errors.Is(resp.err.Err, proto.ErrInvalidMerkleProof) {
+				corrupt = append(corrupt, resp.shardIndex)
+			}
 			if resp.err.Err == errHostAcquired {
 				// host could not be acquired without blocking; add it to the back
 				// of the queue, but next time, block
@@ -525,6 +836,7 @@ func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key rente
 				})
 			} else {
 				// downloading from this host failed; don't try it again
+				logf(pcd.Log, "chunk %v: could not download shard %v: %v", c.ID, resp.shardIndex, resp.err)
 				errs = append(errs, resp.err)
 			}
 			// try the next host in the queue
@@ -536,8 +848,169 @@ func (pcd ParallelChunkDownloader) DownloadChunk(db MetaDB, c DBChunk, key rente
 	}
 	close(reqChan)
 	if goodShards < int(c.MinShards) {
+		wg.Wait() // ensure that no worker is still writing to shards
+		releaseShards(shards)
 		return nil, fmt.Errorf("too many hosts did not supply their shard (needed %v, got %v): %w", c.MinShards, goodShards, errs)
 	}
+	if pcd.ReadRepair && len(corrupt) > 0 {
+		pcd.repairInBackground(db, c, key, corrupt)
+	}
+	return shards, nil
+}
+
+// readRepairs tracks the chunks being repaired in the background, so that
+// concurrent downloads of a corrupt chunk do not repair it more than once.
+var readRepairs = struct {
+	m  map[readRepairKey]struct{}
+	mu sync.Mutex
+}{m: make(map[readRepairKey]struct{})}
+
+type readRepairKey struct {
+	db  MetaDB
+	cid uint64
+}
+
+// repairInBackground spawns a goroutine that repairs the corrupt shards of c,
+// unless c is already being repaired.
+func (pcd ParallelChunkDownloader) repairInBackground(db MetaDB, c DBChunk, key renter.KeySeed, corrupt []int) {
+	rk := readRepairKey{db, c.ID}
+	readRepairs.mu.Lock()
+	_, active := readRepairs.m[rk]
+	if !active {
+		readRepairs.m[rk] = struct{}{}
+	}
+	readRepairs.mu.Unlock()
+	if active {
+		return
+	}
+	go func() {
+		defer func() {
+			readRepairs.mu.Lock()
+			delete(readRepairs.m, rk)
+			readRepairs.mu.Unlock()
+		}()
+		if err := pcd.repairShards(db, c, key, corrupt); err != nil {
+			logf(pcd.Log, "chunk %v: could not repair corrupt shards %v: %v", c.ID, corrupt, err)
+		} else {
+			logf(pcd.Log, "chunk %v: repaired corrupt shards %v", c.ID, corrupt)
+		}
+	}()
+}
+
+// recordResult records the outcome of a download with pcd.Quarantine, if set.
+func (pcd ParallelChunkDownloader) recordResult(host hostdb.HostPublicKey, err error) {
+	if pcd.Quarantine == nil {
+		return
+	} else if err != nil {
+		pcd.Quarantine.RecordFailure(host)
+	} else {
+		pcd.Quarantine.RecordSuccess(host)
+	}
+}
+
+// repairShards reconstructs the specified shards of c and uploads them to
+// hosts that do not currently store any of c's shards. Replacement hosts are
+// chosen, and the shards encrypted, in the same way as ParallelChunkUploader.
+func (pcd ParallelChunkDownloader) repairShards(db MetaDB, c DBChunk, key renter.KeySeed, corrupt []int) error {
+	// download the full chunk, excluding the corrupt shards
+	orig := c.Shards
+	c.Shards = append([]uint64(nil), c.Shards...)
+	for _, i := range corrupt {
+		c.Shards[i] = 0
+	}
+	exclude := make(map[hostdb.HostPublicKey]struct{})
+	var used []hostdb.HostPublicKey
+	for _, sid := range c.Shards {
+		if sid == 0 {
+			continue
+		}
+		s, err := db.Shard(sid)
+		if err != nil {
+			return err
+		}
+		exclude[s.HostKey] = struct{}{}
+		used = append(used, s.HostKey)
+	}
+	shards, err := ParallelChunkDownloader{Hosts: pcd.Hosts, Deriver: pcd.Deriver}.downloadFullChunk(db, c, key)
+	if err != nil {
+		return err
+	}
+	for _, i := range corrupt {
+		if s, err := db.Shard(orig[i]); err == nil {
+			exclude[s.HostKey] = struct{}{}
+		}
+	}
+
+	newHosts := make(map[hostdb.HostPublicKey]struct{})
+	for h := range pcd.Hosts.sessions {
+		if _, ok := exclude[h]; !ok {
+			newHosts[h] = struct{}{}
+		}
+	}
+	chooseHost := hostChooser(newHosts, pcd.HostGroup, used, pcd.DeterministicPlacement)
+	for _, i := range corrupt {
+		if len(newHosts) == 0 {
+			return errors.New("no replacement hosts available")
+		}
+		nonce := pcd.Nonces.nonce()
+		sb := renter.SectorBuilder{Deriver: pcd.Deriver}
+		sb.Append(shards[i], key, nonce)
+		sector := sb.Finish()
+		hostKey := chooseHost(sector[:len(shards[i])])
+		sess, err := pcd.Hosts.acquire(hostKey)
+		if err != nil {
+			return &HostError{hostKey, err}
+		}
+		root, err := sess.Append(sector)
+		fcid := sess.Revision().ID()
+		pcd.Hosts.release(hostKey)
+		if err != nil {
+			return &HostError{hostKey, err}
+		}
+		if sid, err := db.AddShard(DBShard{hostKey, root, 0, nonce, fcid}); err != nil {
+			return err
+		} else if err := db.SetChunkShard(c.ID, i, sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadFullChunk downloads enough shards of c to reconstruct all of them.
+// Shards with an ID of 0 are skipped.
+func (pcd ParallelChunkDownloader) downloadFullChunk(db MetaDB, c DBChunk, key renter.KeySeed) ([][]byte, error) {
+	present := c.Shards
+	c.Shards = make([]uint64, 0, len(present))
+	var indices []int
+	for i, sid := range present {
+		if sid != 0 {
+			c.Shards = append(c.Shards, sid)
+			indices = append(indices, i)
+		}
+	}
+	if len(c.Shards) < int(c.MinShards) {
+		return nil, errors.New("not enough shards to reconstruct chunk")
+	}
+	partial, err := pcd.DownloadChunk(db, c, key, 0, int64(c.Len))
+	if err != nil {
+		return nil, err
+	}
+	var shardSize int
+	for _, shard := range partial {
+		if len(shard) > 0 {
+			shardSize = len(shard)
+		}
+	}
+	shards := make([][]byte, len(present))
+	for i := range shards {
+		shards[i] = make([]byte, 0, shardSize)
+	}
+	for j, i := range indices {
+		shards[i] = partial[j]
+	}
+	if err := renter.NewRSCode(int(c.MinShards), len(shards)).Reconstruct(shards); err != nil {
+		return nil, err
+	}
 	return shards, nil
 }
 
@@ -797,9 +1270,70 @@ type BlobDownloader interface {
 	DownloadBlob(db MetaDB, b DBBlob, w io.Writer, off, n int64) error
 }
 
+// chunkReadLen returns the number of bytes of c that can be read starting at
+// off, limited to n. A negative n reads to the end of the chunk.
+func chunkReadLen(c DBChunk, off, n int64) int64 {
+	rem := int64(c.Len) - off
+	if rem < 0 {
+		rem = 0
+	}
+	if n < 0 || n > rem {
+		n = rem
+	}
+	return n
+}
+
+// shardSection returns the offset and length, within each shard of c, of the
+// segments that encode bytes [off, off+n) of c. Each segment of a shard
+// encodes merkle.SegmentSize * c.MinShards bytes of the chunk, so the section
+// is padded out to segment boundaries; the final segment of a partial chunk
+// is likewise zero-padded when uploaded.
+func shardSection(c DBChunk, off, n int64) (offset, length int64) {
+	minChunkSize := merkle.SegmentSize * int64(c.MinShards)
+	start := (off / minChunkSize) * merkle.SegmentSize
+	end := ((off + n) / minChunkSize) * merkle.SegmentSize
+	if (off+n)%minChunkSize != 0 {
+		end += merkle.SegmentSize
+	}
+	return start, end - start
+}
+
+// recoverChunk recovers bytes [off, off+n) of c from shards, which must have
+// been downloaded with the same off and n, and writes them to w. The padding
+// introduced by shardSection is discarded, so exactly n bytes are written.
+func recoverChunk(w io.Writer, c DBChunk, shards [][]byte, off, n int64) error {
+	rsc := renter.NewRSCode(int(c.MinShards), len(c.Shards))
+	skip := int(off % (merkle.SegmentSize * int64(c.MinShards)))
+	return rsc.Recover(w, shards, skip, int(n))
+}
+
+// DownloadAndReconstruct downloads the shards of c using d, reconstructs the
+// chunk, and returns its plaintext, trimmed to c.Len. As with any
+// ChunkDownloader, if too few shards could be downloaded, the returned error
+// wraps a HostErrorSet describing the failures.
+func DownloadAndReconstruct(d ChunkDownloader, db MetaDB, c DBChunk, key renter.KeySeed) ([]byte, error) {
+	shards, err := d.DownloadChunk(db, c, key, 0, int64(c.Len))
+	if err != nil {
+		return nil, err
+	}
+	defer releaseShards(shards)
+	buf := bytes.NewBuffer(make([]byte, 0, c.Len))
+	if err := recoverChunk(buf, c, shards, 0, int64(c.Len)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // SerialBlobDownloader downloads the chunks of a blob one at a time.
+//
+// If Window is non-zero, each chunk is downloaded in pieces of at most Window
+// bytes (rounded up to a whole number of segments per shard), and each piece
+// is decrypted, reconstructed, and written to w before the next is
+// downloaded. This reduces memory usage and latency to first byte, at the cost
+// of more RPCs per chunk.
 type SerialBlobDownloader struct {
-	D ChunkDownloader
+	D      ChunkDownloader
+	Window int64
 }
 
 // DownloadBlob implements BlobDownloader.
@@ -814,18 +1348,8 @@ func (sbd SerialBlobDownloader) DownloadBlob(db MetaDB, b DBBlob, w io.Writer, o
 			continue
 		}
 
-		reqLen := n
-		if reqLen < 0 || reqLen > int64(c.Len) {
-			reqLen = int64(c.Len)
-		}
-		shards, err := sbd.D.DownloadChunk(db, c, b.Seed, off, reqLen)
-		if err != nil {
-			return err
-		}
-
-		rsc := renter.NewRSCode(int(c.MinShards), len(c.Shards))
-		skip := int(off % (merkle.SegmentSize * int64(c.MinShards)))
-		if err := rsc.Recover(w, shards, skip, int(reqLen)); err != nil {
+		reqLen := chunkReadLen(c, off, n)
+		if err := sbd.downloadChunk(db, c, b.Seed, w, off, reqLen); err != nil {
 			return err
 		}
 		off = 0
@@ -837,6 +1361,35 @@ func (sbd SerialBlobDownloader) DownloadBlob(db MetaDB, b DBBlob, w io.Writer, o
 	return nil
 }
 
+// downloadChunk downloads bytes [off, off+n) of c, writing them to w one
+// window at a time.
+func (sbd SerialBlobDownloader) downloadChunk(db MetaDB, c DBChunk, key renter.KeySeed, w io.Writer, off, n int64) error {
+	for n > 0 {
+		wn := n
+		if sbd.Window > 0 {
+			// end each window on a segment boundary, so that no segment is
+			// downloaded twice
+			minChunkSize := merkle.SegmentSize * int64(c.MinShards)
+			window := ((sbd.Window + minChunkSize - 1) / minChunkSize) * minChunkSize
+			if end := window - off%minChunkSize; end < wn {
+				wn = end
+			}
+		}
+		shards, err := sbd.D.DownloadChunk(db, c, key, off, wn)
+		if err != nil {
+			return err
+		}
+		err = recoverChunk(w, c, shards, off, wn)
+		releaseShards(shards)
+		if err != nil {
+			return err
+		}
+		off += wn
+		n -= wn
+	}
+	return nil
+}
+
 // ParallelBlobDownloader downloads the chunks of a blob in parallel.
 type ParallelBlobDownloader struct {
 	D ChunkDownloader
@@ -870,10 +1423,10 @@ func (pbd ParallelBlobDownloader) DownloadBlob(db MetaDB, b DBBlob, w io.Writer,
 					respChan <- resp{req.index, nil, err}
 					continue
 				}
-				rsc := renter.NewRSCode(int(req.c.MinShards), len(req.c.Shards))
-				skip := int(req.off % (merkle.SegmentSize * int64(req.c.MinShards)))
 				var buf bytes.Buffer
-				if err := rsc.Recover(&buf, shards, skip, int(req.n)); err != nil {
+				err = recoverChunk(&buf, req.c, shards, req.off, req.n)
+				releaseShards(shards)
+				if err != nil {
 					respChan <- resp{req.index, nil, err}
 					continue
 				}
@@ -917,8 +1470,10 @@ func (pbd ParallelBlobDownloader) DownloadBlob(db MetaDB, b DBBlob, w io.Writer,
 		}
 	}()
 
-	// request each chunk
-	for chunkIndex, cid := range b.Chunks {
+	// request each chunk; chunks skipped due to off are not counted, since
+	// the circular buffer is flushed starting from index 0
+	var chunkIndex int
+	for _, cid := range b.Chunks {
 		c, err := db.Chunk(cid)
 		if err != nil {
 			return err
@@ -927,11 +1482,9 @@ func (pbd ParallelBlobDownloader) DownloadBlob(db MetaDB, b DBBlob, w io.Writer,
 			off -= int64(c.Len)
 			continue
 		}
-		reqLen := n
-		if reqLen < 0 || reqLen > int64(c.Len) {
-			reqLen = int64(c.Len)
-		}
+		reqLen := chunkReadLen(c, off, n)
 		reqChan <- req{c, off, reqLen, chunkIndex}
+		chunkIndex++
 		inflight++
 
 		// clear offset (as it only applies to the first chunk) and break early
@@ -16,6 +16,10 @@ import (
 // sources into a single sector. The zero value for a SectorBuilder is an
 // empty sector.
 type SectorBuilder struct {
+	// Deriver is used to derive the encryption key of each appended slice. If
+	// nil, XChaCha20Deriver is used.
+	Deriver KeyDeriver
+
 	sector    [renterhost.SectorSize]byte
 	sectorLen int
 	slices    []SectorSlice
@@ -63,7 +67,7 @@ func (sb *SectorBuilder) Append(data []byte, key KeySeed, nonce [24]byte) int {
 
 	// encrypt the data in place
 	segmentIndex := sb.sectorLen / merkle.SegmentSize
-	key.XORKeyStream(sectorSlice, nonce[:], uint64(segmentIndex))
+	key.XORKeyStreamWith(sb.Deriver, sectorSlice, nonce[:], uint64(segmentIndex))
 
 	// record the new slice and update sectorLen
 	sb.slices = append(sb.slices, SectorSlice{
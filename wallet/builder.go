@@ -28,6 +28,21 @@ func SumOutputs(outputs []UnspentOutput) types.Currency {
 	return types.NewCurrency(sum)
 }
 
+// OutputsAtLeast returns the outputs whose value is at least min, sorted by
+// value in descending order. The supplied slice is not modified.
+func OutputsAtLeast(outputs []UnspentOutput, min types.Currency) []UnspentOutput {
+	var large []UnspentOutput
+	for _, o := range outputs {
+		if o.Value.Cmp(min) >= 0 {
+			large = append(large, o)
+		}
+	}
+	sort.SliceStable(large, func(i, j int) bool {
+		return large[i].Value.Cmp(large[j].Value) > 0
+	})
+	return large
+}
+
 // FundAtLeast selects a set of inputs whose total value is at least amount,
 // returning the selected inputs and the resulting change, or false if the sum
 // of all inputs is less than amount.
@@ -17,6 +17,34 @@ func BenchmarkSumOutputs(b *testing.B) {
 	}
 }
 
+func TestOutputsAtLeast(t *testing.T) {
+	outputs := make([]UnspentOutput, 10)
+	for i := range outputs {
+		outputs[i].Value = types.SiacoinPrecision.Mul64(uint64((i * 7) % 10))
+		outputs[i].ID[0] = byte(i)
+	}
+
+	large := OutputsAtLeast(outputs, types.SiacoinPrecision.Mul64(7))
+	if len(large) != 3 {
+		t.Fatal("expected 3 outputs, got", len(large))
+	}
+	for i, exp := range []uint64{9, 8, 7} {
+		if !large[i].Value.Equals(types.SiacoinPrecision.Mul64(exp)) {
+			t.Errorf("output %v: expected %v SC, got %v", i, exp, large[i].Value.HumanString())
+		}
+	}
+	// input should not be reordered
+	if outputs[1].ID[0] != 1 || !outputs[1].Value.Equals(types.SiacoinPrecision.Mul64(7)) {
+		t.Error("input was modified")
+	}
+
+	if len(OutputsAtLeast(outputs, types.ZeroCurrency)) != len(outputs) {
+		t.Error("zero threshold should return all outputs")
+	} else if len(OutputsAtLeast(outputs, types.SiacoinPrecision.Mul64(10))) != 0 {
+		t.Error("expected no outputs above maximum value")
+	}
+}
+
 func TestDistributeFunds(t *testing.T) {
 	outputs := make([]UnspentOutput, 10)
 	for i := range outputs {
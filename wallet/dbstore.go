@@ -23,6 +23,9 @@ var (
 	// keySeedIndex stores the current seed index.
 	keySeedIndex = []byte("keySeedIndex")
 
+	// keyEncryptedSeed stores the encrypted seed, if any.
+	keyEncryptedSeed = []byte("keyEncryptedSeed")
+
 	// bucketMeta contains global values for the db.
 	bucketMeta = []byte("bucketMeta")
 
@@ -325,6 +328,97 @@ func (s *BoltDBStore) Transaction(id types.TransactionID) (txn Transaction, exis
 	return
 }
 
+// PruneTransactions implements TransactionPruner.
+func (s *BoltDBStore) PruneTransactions(keepAfter types.BlockHeight) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pruned := make(map[types.TransactionID]struct{})
+		c := tx.Bucket(bucketTxns).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var txn Transaction
+			if err := encoding.Unmarshal(v, &txn); err != nil {
+				return err
+			}
+			if txn.BlockHeight < keepAfter {
+				var txid types.TransactionID
+				copy(txid[:], k)
+				pruned[txid] = struct{}{}
+			}
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		for txid := range pruned {
+			if err := tx.Bucket(bucketTxns).Delete(txid[:]); err != nil {
+				return err
+			} else if err := tx.Bucket(bucketMemos).Delete(txid[:]); err != nil {
+				return err
+			}
+		}
+
+		// helper function for deleting pruned txids from an index bucket
+		filter := func(b *bolt.Bucket) error {
+			var keys [][]byte
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var txid types.TransactionID
+				copy(txid[:], v)
+				if _, ok := pruned[txid]; ok {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := filter(tx.Bucket(bucketTxnsRecentIndex)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketTxnsAddrIndex).ForEach(func(addr, _ []byte) error {
+			return filter(tx.Bucket(bucketTxnsAddrIndex).Bucket(addr))
+		})
+	})
+}
+
+// RebuildAddressIndex implements AddressIndexRebuilder.
+func (s *BoltDBStore) RebuildAddressIndex(owner AddressOwner) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketTxnsAddrIndex); err != nil {
+			return err
+		}
+		index, err := tx.CreateBucket(bucketTxnsAddrIndex)
+		if err != nil {
+			return err
+		}
+		seqBytes := make([]byte, 8)
+		c := tx.Bucket(bucketTxnsRecentIndex).Cursor()
+		for _, v := c.First(); v != nil; _, v = c.Next() {
+			b := tx.Bucket(bucketTxns).Get(v)
+			if b == nil {
+				continue
+			}
+			var txn Transaction
+			if err := encoding.Unmarshal(b, &txn); err != nil {
+				return err
+			}
+			for addr := range relevantAddresses(owner, txn.Transaction) {
+				addrTxnsBucket, err := index.CreateBucketIfNotExists(addr[:])
+				if err != nil {
+					return err
+				}
+				seq, _ := tx.Bucket(bucketBlockRewards).NextSequence()
+				binary.BigEndian.PutUint64(seqBytes, seq)
+				if err := addrTxnsBucket.Put(seqBytes, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
 // SetMemo implements Store.
 func (s *BoltDBStore) SetMemo(txid types.TransactionID, memo []byte) {
 	s.update(func(tx *bolt.Tx) error {
@@ -382,6 +476,22 @@ func (s *BoltDBStore) SetSeedIndex(index uint64) {
 	})
 }
 
+// EncryptedSeed implements EncryptedSeedStore.
+func (s *BoltDBStore) EncryptedSeed() (blob []byte) {
+	s.view(func(tx *bolt.Tx) error {
+		blob = append([]byte(nil), tx.Bucket(bucketMeta).Get(keyEncryptedSeed)...)
+		return nil
+	})
+	return
+}
+
+// SetEncryptedSeed implements EncryptedSeedStore.
+func (s *BoltDBStore) SetEncryptedSeed(blob []byte) {
+	s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(keyEncryptedSeed, append([]byte(nil), blob...))
+	})
+}
+
 // OwnsAddress implements Store.
 func (s *BoltDBStore) OwnsAddress(addr types.UnlockHash) (owned bool) {
 	_, ok := s.addrs[addr]
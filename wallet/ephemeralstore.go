@@ -20,9 +20,10 @@ type EphemeralStore struct {
 	txnsRecentIndex []types.TransactionID
 	memos           map[types.TransactionID][]byte
 
-	seedIndex uint64
-	height    int
-	ccid      modules.ConsensusChangeID
+	seedIndex     uint64
+	encryptedSeed []byte
+	height        int
+	ccid          modules.ConsensusChangeID
 }
 
 // ApplyConsensusChange implements ChainStore.
@@ -174,6 +175,54 @@ func (s *EphemeralStore) FileContractHistory(id types.FileContractID) []FileCont
 	return history
 }
 
+// PruneTransactions implements TransactionPruner.
+func (s *EphemeralStore) PruneTransactions(keepAfter types.BlockHeight) error {
+	pruned := make(map[types.TransactionID]struct{})
+	for txid, txn := range s.txns {
+		if txn.BlockHeight < keepAfter {
+			pruned[txid] = struct{}{}
+			delete(s.txns, txid)
+			delete(s.memos, txid)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil
+	}
+	filter := func(txids []types.TransactionID) []types.TransactionID {
+		kept := txids[:0]
+		for _, txid := range txids {
+			if _, ok := pruned[txid]; !ok {
+				kept = append(kept, txid)
+			}
+		}
+		return kept
+	}
+	s.txnsRecentIndex = filter(s.txnsRecentIndex)
+	for addr, txids := range s.txnsAddrIndex {
+		if txids = filter(txids); len(txids) == 0 {
+			delete(s.txnsAddrIndex, addr)
+		} else {
+			s.txnsAddrIndex[addr] = txids
+		}
+	}
+	return nil
+}
+
+// RebuildAddressIndex implements AddressIndexRebuilder.
+func (s *EphemeralStore) RebuildAddressIndex(owner AddressOwner) error {
+	s.txnsAddrIndex = make(map[types.UnlockHash][]types.TransactionID)
+	for _, txid := range s.txnsRecentIndex {
+		txn, ok := s.txns[txid]
+		if !ok {
+			continue
+		}
+		for addr := range relevantAddresses(owner, txn.Transaction) {
+			s.txnsAddrIndex[addr] = append(s.txnsAddrIndex[addr], txid)
+		}
+	}
+	return nil
+}
+
 // SetMemo implements Store.
 func (s *EphemeralStore) SetMemo(txid types.TransactionID, memo []byte) {
 	s.memos[txid] = append([]byte(nil), memo...)
@@ -194,6 +243,16 @@ func (s *EphemeralStore) SetSeedIndex(index uint64) {
 	s.seedIndex = index
 }
 
+// EncryptedSeed implements EncryptedSeedStore.
+func (s *EphemeralStore) EncryptedSeed() []byte {
+	return append([]byte(nil), s.encryptedSeed...)
+}
+
+// SetEncryptedSeed implements EncryptedSeedStore.
+func (s *EphemeralStore) SetEncryptedSeed(blob []byte) {
+	s.encryptedSeed = append([]byte(nil), blob...)
+}
+
 // OwnsAddress implements Store.
 func (s *EphemeralStore) OwnsAddress(addr types.UnlockHash) bool {
 	_, ok := s.addrs[addr]
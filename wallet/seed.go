@@ -82,3 +82,14 @@ func SeedFromPhrase(phrase string) (Seed, error) {
 func NewSeed() Seed {
 	return SeedFromEntropy(frand.Entropy128())
 }
+
+// SeedAddresses returns the standard addresses derived from seed for the
+// indices [start, start+count). These are the same addresses that a wallet
+// using seed would generate at those indices.
+func SeedAddresses(seed Seed, start, count uint64) []types.UnlockHash {
+	addrs := make([]types.UnlockHash, count)
+	for i := range addrs {
+		addrs[i] = StandardAddress(seed.PublicKey(start + uint64(i)))
+	}
+	return addrs
+}
@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 
@@ -49,6 +50,20 @@ func TestSeedPublicKey(t *testing.T) {
 	}
 }
 
+func TestSeedAddresses(t *testing.T) {
+	s := NewSeed()
+	addrs := SeedAddresses(s, 5, 10)
+	if len(addrs) != 10 {
+		t.Fatal("wrong number of addresses:", len(addrs))
+	}
+	for i, addr := range addrs {
+		uc := StandardUnlockConditions(s.PublicKey(5 + uint64(i)))
+		if addr != uc.UnlockHash() {
+			t.Fatal("address mismatch at index", 5+i)
+		}
+	}
+}
+
 func BenchmarkSeedPublicKey(b *testing.B) {
 	b.ReportAllocs()
 	s := NewSeed()
@@ -64,3 +79,48 @@ func BenchmarkSeedPhrase(b *testing.B) {
 		_ = s.String()
 	}
 }
+
+func BenchmarkSeedAddresses(b *testing.B) {
+	b.ReportAllocs()
+	s := NewSeed()
+	for i := 0; i < b.N; i++ {
+		_ = SeedAddresses(s, 0, 1000)
+	}
+}
+
+func TestEncryptSeed(t *testing.T) {
+	seed := NewSeed()
+	blob := EncryptSeed(seed, "foo")
+	if s, err := DecryptSeed(blob, "foo"); err != nil {
+		t.Fatal(err)
+	} else if s != seed {
+		t.Fatal("decrypted seed does not match")
+	}
+	if _, err := DecryptSeed(blob, "bar"); err != ErrWrongPassphrase {
+		t.Fatal("expected ErrWrongPassphrase, got", err)
+	}
+	blob[len(blob)-1] ^= 1
+	if _, err := DecryptSeed(blob, "foo"); err != ErrWrongPassphrase {
+		t.Fatal("expected ErrWrongPassphrase for tampered seed, got", err)
+	}
+	if _, err := DecryptSeed(blob[:len(blob)-1], "foo"); err == nil {
+		t.Fatal("expected error for truncated seed")
+	}
+
+	// encryption should be randomized
+	if bytes.Equal(EncryptSeed(seed, "foo"), EncryptSeed(seed, "foo")) {
+		t.Fatal("encrypting the same seed twice produced the same output")
+	}
+
+	// the encrypted seed should round-trip through a store
+	var store EncryptedSeedStore = NewEphemeralStore()
+	if len(store.EncryptedSeed()) != 0 {
+		t.Fatal("new store should not have an encrypted seed")
+	}
+	store.SetEncryptedSeed(EncryptSeed(seed, "foo"))
+	if s, err := DecryptSeed(store.EncryptedSeed(), "foo"); err != nil {
+		t.Fatal(err)
+	} else if s != seed {
+		t.Fatal("decrypted seed does not match")
+	}
+}
@@ -0,0 +1,67 @@
+package wallet
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+// parameters for encrypted seeds
+const (
+	encryptedSeedVersion = 1
+	encryptedSeedSaltLen = 16
+	encryptedSeedLen     = 1 + encryptedSeedSaltLen + chacha20poly1305.NonceSizeX + 16 + 16 // version, salt, nonce, entropy, tag
+
+	// Argon2id parameters, as recommended by RFC 9106 for memory-constrained
+	// environments
+	seedKDFTime    = 3
+	seedKDFMemory  = 64 * 1024 // KiB
+	seedKDFThreads = 4
+)
+
+// ErrWrongPassphrase is returned by DecryptSeed when the passphrase is
+// incorrect (or the encrypted seed has been tampered with).
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted seed")
+
+// An EncryptedSeedStore is a Store that can persist an encrypted seed, as
+// produced by EncryptSeed.
+type EncryptedSeedStore interface {
+	EncryptedSeed() []byte
+	SetEncryptedSeed(blob []byte)
+}
+
+func deriveSeedKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, seedKDFTime, seedKDFMemory, seedKDFThreads, chacha20poly1305.KeySize)
+}
+
+// EncryptSeed encrypts seed with a key derived from passphrase. The key is
+// derived with Argon2id, and the seed is encrypted with XChaCha20-Poly1305.
+// The returned blob is self-contained and safe to store at rest.
+func EncryptSeed(seed Seed, passphrase string) []byte {
+	blob := make([]byte, 1+encryptedSeedSaltLen+chacha20poly1305.NonceSizeX)
+	blob[0] = encryptedSeedVersion
+	frand.Read(blob[1:])
+	salt := blob[1:][:encryptedSeedSaltLen]
+	nonce := blob[1+encryptedSeedSaltLen:]
+	aead, _ := chacha20poly1305.NewX(deriveSeedKey(passphrase, salt)) // no error possible
+	return aead.Seal(blob, nonce, seed.entropy[:], blob[:1])
+}
+
+// DecryptSeed decrypts a seed encrypted with EncryptSeed.
+func DecryptSeed(blob []byte, passphrase string) (Seed, error) {
+	const overhead = 1 + encryptedSeedSaltLen + chacha20poly1305.NonceSizeX
+	if len(blob) != encryptedSeedLen {
+		return Seed{}, errors.New("encrypted seed has wrong length")
+	} else if blob[0] != encryptedSeedVersion {
+		return Seed{}, errors.Errorf("unsupported encrypted seed version %v", blob[0])
+	}
+	salt := blob[1:][:encryptedSeedSaltLen]
+	nonce := blob[1+encryptedSeedSaltLen:][:chacha20poly1305.NonceSizeX]
+	aead, _ := chacha20poly1305.NewX(deriveSeedKey(passphrase, salt)) // no error possible
+	var entropy [16]byte
+	if _, err := aead.Open(entropy[:0], nonce, blob[overhead:], blob[:1]); err != nil {
+		return Seed{}, ErrWrongPassphrase
+	}
+	return SeedFromEntropy(entropy), nil
+}
@@ -237,8 +237,57 @@ func New(store Store) *SeedWallet {
 // a Seed in memory is less secure than storing it on a hardware wallet.
 type HotWallet struct {
 	*SeedWallet
-	seed Seed
-	mu   sync.Mutex
+	seed   Seed
+	change ChangeStrategy
+	mu     sync.Mutex
+}
+
+// A ChangeStrategy chooses the address that receives the change output of a
+// transaction funded by a HotWallet.
+//
+// Sending change to a new address each time (ChangeNewAddress) makes it
+// harder for an observer to tell which output of a transaction is the change,
+// and thus to link the wallet's transactions together; however, each new
+// address must be tracked by the wallet, and the wallet's funds become spread
+// across many addresses. Reusing a single address (ChangeReuseAddress) keeps
+// the address set small, but links every transaction that produces change to
+// the same address, and thus to each other.
+type ChangeStrategy func(w *HotWallet) types.UnlockHash
+
+// ChangeNewAddress is a ChangeStrategy that derives a new address from the
+// wallet's seed for each change output, advancing the wallet's SeedIndex. It is
+// the default strategy.
+func ChangeNewAddress(w *HotWallet) types.UnlockHash {
+	return w.NextAddress()
+}
+
+// ChangeReuseAddress returns a ChangeStrategy that always uses addr. The
+// address should be owned by the wallet; otherwise, change will be sent to an
+// address that the wallet cannot spend from.
+func ChangeReuseAddress(addr types.UnlockHash) ChangeStrategy {
+	return func(*HotWallet) types.UnlockHash {
+		return addr
+	}
+}
+
+// SetChangeStrategy sets the strategy used by ChangeAddress. If s is nil,
+// ChangeNewAddress is used.
+func (w *HotWallet) SetChangeStrategy(s ChangeStrategy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.change = s
+}
+
+// ChangeAddress returns the address that should receive the change output of
+// a transaction, as chosen by the wallet's ChangeStrategy.
+func (w *HotWallet) ChangeAddress() types.UnlockHash {
+	w.mu.Lock()
+	s := w.change
+	w.mu.Unlock()
+	if s == nil {
+		s = ChangeNewAddress
+	}
+	return s(w)
 }
 
 // NextAddress returns a new (unused) address derived from the wallet's seed.
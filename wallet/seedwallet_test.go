@@ -11,6 +11,7 @@ import (
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
+	bolt "go.etcd.io/bbolt"
 	"lukechampine.com/frand"
 )
 
@@ -340,6 +341,184 @@ func TestWallet(t *testing.T) {
 	}
 }
 
+func TestPruneTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltStore, err := NewBoltDBStore(filepath.Join(dir, "wallet.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltStore.Close()
+
+	for _, store := range []Store{NewEphemeralStore(), boltStore} {
+		w := New(store)
+		cs := new(mockCS)
+		cs.ConsensusSetSubscribe(w.ConsensusSetSubscriber(store.(ChainStore)), store.ConsensusChangeID(), nil)
+		seed := NewSeed()
+		addrInfo := SeedAddressInfo{
+			UnlockConditions: StandardUnlockConditions(seed.PublicKey(0)),
+			KeyIndex:         0,
+		}
+		addr := addrInfo.UnlockHash()
+		w.AddAddress(addrInfo)
+
+		// confirm five transactions; due to the genesis block adjustment, the
+		// first two are both confirmed at height 1
+		var txids []types.TransactionID
+		for i := 0; i < 5; i++ {
+			txn := types.Transaction{
+				SiacoinOutputs: []types.SiacoinOutput{{UnlockHash: addr, Value: types.SiacoinPrecision.Mul64(uint64(i + 1))}},
+			}
+			cs.sendTxn(txn)
+			txids = append(txids, txn.ID())
+			w.SetMemo(txn.ID(), []byte("memo"))
+		}
+		balance := w.Balance(false)
+
+		// prune transactions confirmed before height 2
+		if err := PruneTransactions(store, 2); err != nil {
+			t.Fatal(err)
+		}
+		if !w.Balance(false).Equals(balance) {
+			t.Fatal("pruning changed balance")
+		} else if len(w.UnspentOutputs(false)) != 5 {
+			t.Fatal("pruning removed unspent outputs")
+		}
+		if txns := w.Transactions(-1); len(txns) != 3 {
+			t.Fatal("expected 3 transactions, got", len(txns))
+		} else if txns := w.TransactionsByAddress(addr, -1); len(txns) != 3 {
+			t.Fatal("expected 3 transactions for address, got", len(txns))
+		}
+		for i, txid := range txids {
+			_, ok := w.Transaction(txid)
+			if pruned := i < 2; ok == pruned {
+				t.Fatalf("transaction %v: expected pruned=%v", i, pruned)
+			} else if pruned && len(w.Memo(txid)) != 0 {
+				t.Fatalf("transaction %v: memo was not pruned", i)
+			} else if !pruned && string(w.Memo(txid)) != "memo" {
+				t.Fatalf("transaction %v: memo was pruned", i)
+			}
+		}
+	}
+}
+
+func TestRebuildAddressIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltStore, err := NewBoltDBStore(filepath.Join(dir, "wallet.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltStore.Close()
+	ephemeralStore := NewEphemeralStore()
+
+	// each store is paired with a function that corrupts its index
+	tests := []struct {
+		store   Store
+		corrupt func(addr types.UnlockHash)
+	}{
+		{ephemeralStore, func(addr types.UnlockHash) {
+			delete(ephemeralStore.txnsAddrIndex, addr)
+		}},
+		{boltStore, func(addr types.UnlockHash) {
+			boltStore.update(func(tx *bolt.Tx) error {
+				return tx.Bucket(bucketTxnsAddrIndex).DeleteBucket(addr[:])
+			})
+		}},
+	}
+	for _, test := range tests {
+		w := New(test.store)
+		cs := new(mockCS)
+		cs.ConsensusSetSubscribe(w.ConsensusSetSubscriber(test.store.(ChainStore)), test.store.ConsensusChangeID(), nil)
+		seed := NewSeed()
+		var addrs []types.UnlockHash
+		for i := uint64(0); i < 2; i++ {
+			info := SeedAddressInfo{
+				UnlockConditions: StandardUnlockConditions(seed.PublicKey(i)),
+				KeyIndex:         i,
+			}
+			w.AddAddress(info)
+			addrs = append(addrs, info.UnlockHash())
+		}
+		for i := 0; i < 6; i++ {
+			cs.sendTxn(types.Transaction{
+				SiacoinOutputs: []types.SiacoinOutput{{UnlockHash: addrs[i%2], Value: types.SiacoinPrecision.Mul64(uint64(i + 1))}},
+			})
+		}
+		before := [][]types.TransactionID{
+			w.TransactionsByAddress(addrs[0], -1),
+			w.TransactionsByAddress(addrs[1], -1),
+		}
+		if len(before[0]) != 3 || len(before[1]) != 3 {
+			t.Fatal("wrong number of transactions per address")
+		}
+
+		test.corrupt(addrs[0])
+		if len(w.TransactionsByAddress(addrs[0], -1)) != 0 {
+			t.Fatal("index was not corrupted")
+		}
+		if err := RebuildAddressIndex(test.store, test.store); err != nil {
+			t.Fatal(err)
+		}
+		for i, addr := range addrs {
+			after := w.TransactionsByAddress(addr, -1)
+			if len(after) != len(before[i]) {
+				t.Fatalf("address %v: expected %v transactions, got %v", i, len(before[i]), len(after))
+			}
+			for j := range after {
+				if after[j] != before[i][j] {
+					t.Fatalf("address %v: rebuilt index does not match original", i)
+				}
+			}
+		}
+	}
+}
+
+func TestReusedAddresses(t *testing.T) {
+	store := NewEphemeralStore()
+	w := New(store)
+	cs := new(mockCS)
+	cs.ConsensusSetSubscribe(w.ConsensusSetSubscriber(store), store.ConsensusChangeID(), nil)
+	seed := NewSeed()
+	var addrs []types.UnlockHash
+	for i := uint64(0); i < 3; i++ {
+		info := SeedAddressInfo{
+			UnlockConditions: StandardUnlockConditions(seed.PublicKey(i)),
+			KeyIndex:         i,
+		}
+		w.AddAddress(info)
+		addrs = append(addrs, info.UnlockHash())
+	}
+
+	// addrs[0] receives twice, addrs[1] receives once (albeit with two
+	// outputs), and addrs[2] never receives
+	for i := 0; i < 2; i++ {
+		cs.sendTxn(types.Transaction{
+			SiacoinOutputs: []types.SiacoinOutput{{UnlockHash: addrs[0], Value: types.SiacoinPrecision.Mul64(uint64(i + 1))}},
+		})
+	}
+	cs.sendTxn(types.Transaction{
+		SiacoinOutputs: []types.SiacoinOutput{
+			{UnlockHash: addrs[1], Value: types.SiacoinPrecision},
+			{UnlockHash: addrs[1], Value: types.SiacoinPrecision.Mul64(2)},
+		},
+	})
+
+	if reused := ReusedAddresses(store, store); len(reused) != 1 || reused[0] != addrs[0] {
+		t.Fatal("expected only first address to be reused, got", reused)
+	}
+	w.RemoveAddress(addrs[0])
+	if reused := ReusedAddresses(store, store); len(reused) != 0 {
+		t.Fatal("expected no reused addresses, got", reused)
+	}
+}
+
 func TestWalletThreadSafety(t *testing.T) {
 	store := NewEphemeralStore()
 	w := New(store)
@@ -579,6 +758,37 @@ func TestHotWallet(t *testing.T) {
 	}
 }
 
+func TestHotWalletChangeStrategy(t *testing.T) {
+	w := NewHotWallet(New(NewEphemeralStore()), NewSeed())
+
+	// by default, each change address should be new
+	a1, a2 := w.ChangeAddress(), w.ChangeAddress()
+	if a1 == a2 {
+		t.Fatal("expected distinct change addresses")
+	} else if w.SeedIndex() != 2 {
+		t.Fatal("expected seed index to advance, got", w.SeedIndex())
+	} else if !w.OwnsAddress(a1) || !w.OwnsAddress(a2) {
+		t.Fatal("change addresses should be owned by the wallet")
+	}
+
+	// when reusing an address, the seed index should not advance
+	w.SetChangeStrategy(ChangeReuseAddress(a1))
+	for i := 0; i < 3; i++ {
+		if addr := w.ChangeAddress(); addr != a1 {
+			t.Fatal("expected designated change address, got", addr)
+		}
+	}
+	if w.SeedIndex() != 2 {
+		t.Fatal("seed index should not advance, got", w.SeedIndex())
+	}
+
+	// resetting the strategy should restore the default
+	w.SetChangeStrategy(nil)
+	if addr := w.ChangeAddress(); addr == a1 || addr == a2 {
+		t.Fatal("expected a new change address")
+	}
+}
+
 func TestHotWalletThreadSafety(t *testing.T) {
 	store := NewEphemeralStore()
 	w := NewHotWallet(New(store), Seed{})
@@ -3,13 +3,16 @@
 package wallet
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
@@ -52,6 +55,79 @@ type Store interface {
 	UnspentOutputs() []UnspentOutput
 }
 
+// A TransactionPruner is a Store that can discard old transactions.
+type TransactionPruner interface {
+	PruneTransactions(keepAfter types.BlockHeight) error
+}
+
+// PruneTransactions removes all transactions confirmed before the keepAfter
+// height from store, along with their memos and address index entries.
+// Unspent outputs, block rewards, file contracts, and limbo transactions are
+// not affected, so the balance and spendable outputs of the wallet are
+// unchanged. It returns an error if store does not implement
+// TransactionPruner.
+func PruneTransactions(store Store, keepAfter types.BlockHeight) error {
+	tp, ok := store.(TransactionPruner)
+	if !ok {
+		return errors.New("store does not support pruning")
+	}
+	return tp.PruneTransactions(keepAfter)
+}
+
+// An AddressIndexRebuilder is a Store that can rebuild its index of the
+// transactions relevant to each address.
+type AddressIndexRebuilder interface {
+	RebuildAddressIndex(owner AddressOwner) error
+}
+
+// RebuildAddressIndex discards the address index of store and rebuilds it from
+// the transactions in store, using owner to determine which addresses each
+// transaction is relevant to. This repairs an inconsistent index without
+// rescanning the blockchain. It returns an error if store does not implement
+// AddressIndexRebuilder.
+func RebuildAddressIndex(store Store, owner AddressOwner) error {
+	r, ok := store.(AddressIndexRebuilder)
+	if !ok {
+		return errors.New("store does not support rebuilding the address index")
+	}
+	return r.RebuildAddressIndex(owner)
+}
+
+// ReusedAddresses returns, in sorted order, the addresses in store owned by
+// owner that appear as the recipient of an output in more than one
+// transaction. Receiving multiple payments at the same address links them
+// together, so wallets may wish to warn users about such addresses. Only the
+// transactions retained by store are considered.
+func ReusedAddresses(store Store, owner AddressOwner) []types.UnlockHash {
+	var reused []types.UnlockHash
+	for _, addr := range store.Addresses() {
+		if !owner.OwnsAddress(addr) {
+			continue
+		}
+		var receipts int
+		for _, txid := range store.TransactionsByAddress(addr, -1) {
+			txn, ok := store.Transaction(txid)
+			if !ok {
+				continue
+			}
+			for _, o := range txn.SiacoinOutputs {
+				if o.UnlockHash == addr {
+					receipts++
+					break
+				}
+			}
+			if receipts > 1 {
+				reused = append(reused, addr)
+				break
+			}
+		}
+	}
+	sort.Slice(reused, func(i, j int) bool {
+		return bytes.Compare(reused[i][:], reused[j][:]) < 0
+	})
+	return reused
+}
+
 // A ProcessedConsensusChange is a condensation of a modules.ConsensusChange,
 // containing only the data relevant to certain addresses, and intended to be
 // processed by an atomic unit.
@@ -363,45 +439,6 @@ func FilterConsensusChange(cc modules.ConsensusChange, owner AddressOwner, curre
 	// only revert them if they are invalidated.
 
 	// more helper functions
-	relevantTxn := func(txn types.Transaction) map[types.UnlockHash]struct{} {
-		addrs := make(map[types.UnlockHash]struct{})
-		processAddr := func(addr types.UnlockHash) {
-			if _, ok := addrs[addr]; !ok && owner.OwnsAddress(addr) {
-				addrs[addr] = struct{}{}
-			}
-		}
-		for i := range txn.SiacoinInputs {
-			processAddr(CalculateUnlockHash(txn.SiacoinInputs[i].UnlockConditions))
-		}
-		for i := range txn.SiacoinOutputs {
-			processAddr(txn.SiacoinOutputs[i].UnlockHash)
-		}
-		for i := range txn.SiafundInputs {
-			processAddr(CalculateUnlockHash(txn.SiafundInputs[i].UnlockConditions))
-			processAddr(txn.SiafundInputs[i].ClaimUnlockHash)
-		}
-		for i := range txn.SiafundOutputs {
-			processAddr(txn.SiafundOutputs[i].UnlockHash)
-		}
-		for i := range txn.FileContracts {
-			for _, sco := range txn.FileContracts[i].ValidProofOutputs {
-				processAddr(sco.UnlockHash)
-			}
-			for _, sco := range txn.FileContracts[i].MissedProofOutputs {
-				processAddr(sco.UnlockHash)
-			}
-		}
-		for i := range txn.FileContractRevisions {
-			for _, sco := range txn.FileContractRevisions[i].NewValidProofOutputs {
-				processAddr(sco.UnlockHash)
-			}
-			for _, sco := range txn.FileContractRevisions[i].NewMissedProofOutputs {
-				processAddr(sco.UnlockHash)
-			}
-		}
-		return addrs
-	}
-
 	relevantFileContract := func(valid, missed []types.SiacoinOutput) bool {
 		relevant := false
 		for _, sco := range valid {
@@ -416,7 +453,7 @@ func FilterConsensusChange(cc modules.ConsensusChange, owner AddressOwner, curre
 	processTxns := func(b types.Block, height types.BlockHeight, pcc *ProcessedConsensusChange) {
 		bid := b.ID()
 		for _, txn := range b.Transactions {
-			addrs := relevantTxn(txn)
+			addrs := relevantAddresses(owner, txn)
 			if len(addrs) == 0 {
 				continue
 			}
@@ -523,6 +560,111 @@ func FilterConsensusChange(cc modules.ConsensusChange, owner AddressOwner, curre
 	return reverted, applied, cc.ID
 }
 
+// relevantAddresses returns the set of addresses owned by owner that appear in
+// txn.
+func relevantAddresses(owner AddressOwner, txn types.Transaction) map[types.UnlockHash]struct{} {
+	addrs := make(map[types.UnlockHash]struct{})
+	processAddr := func(addr types.UnlockHash) {
+		if _, ok := addrs[addr]; !ok && owner.OwnsAddress(addr) {
+			addrs[addr] = struct{}{}
+		}
+	}
+	for i := range txn.SiacoinInputs {
+		processAddr(CalculateUnlockHash(txn.SiacoinInputs[i].UnlockConditions))
+	}
+	for i := range txn.SiacoinOutputs {
+		processAddr(txn.SiacoinOutputs[i].UnlockHash)
+	}
+	for i := range txn.SiafundInputs {
+		processAddr(CalculateUnlockHash(txn.SiafundInputs[i].UnlockConditions))
+		processAddr(txn.SiafundInputs[i].ClaimUnlockHash)
+	}
+	for i := range txn.SiafundOutputs {
+		processAddr(txn.SiafundOutputs[i].UnlockHash)
+	}
+	for i := range txn.FileContracts {
+		for _, sco := range txn.FileContracts[i].ValidProofOutputs {
+			processAddr(sco.UnlockHash)
+		}
+		for _, sco := range txn.FileContracts[i].MissedProofOutputs {
+			processAddr(sco.UnlockHash)
+		}
+	}
+	for i := range txn.FileContractRevisions {
+		for _, sco := range txn.FileContractRevisions[i].NewValidProofOutputs {
+			processAddr(sco.UnlockHash)
+		}
+		for _, sco := range txn.FileContractRevisions[i].NewMissedProofOutputs {
+			processAddr(sco.UnlockHash)
+		}
+	}
+	return addrs
+}
+
+// A TxKind classifies a transaction from the perspective of a wallet.
+type TxKind int
+
+// TxKind values.
+const (
+	TxKindUnrelated TxKind = iota // txn neither spends nor creates owned siacoin outputs
+	TxKindReceived                // txn increases the owner's balance
+	TxKindSent                    // txn decreases the owner's balance
+	TxKindSelf                    // txn only moves siacoins between owned addresses
+)
+
+// String implements fmt.Stringer.
+func (k TxKind) String() string {
+	switch k {
+	case TxKindUnrelated:
+		return "unrelated"
+	case TxKindReceived:
+		return "received"
+	case TxKindSent:
+		return "sent"
+	case TxKindSelf:
+		return "self"
+	default:
+		return "TxKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// ClassifyTransaction classifies txn relative to the addresses owned by owner,
+// and returns the magnitude of its net effect on the owner's siacoin balance.
+// The sign of the net value is implied by the kind: for TxKindReceived it is
+// the amount gained, and for TxKindSent and TxKindSelf it is the amount lost
+// (for TxKindSelf, this is the miner fee).
+//
+// Since a SiacoinInput does not contain the value of the output it spends,
+// inputValues must supply the value of each owned input; inputs missing from
+// inputValues are treated as having zero value.
+func ClassifyTransaction(txn types.Transaction, owner AddressOwner, inputValues map[types.SiacoinOutputID]types.Currency) (TxKind, types.Currency) {
+	in, out := types.ZeroCurrency, types.ZeroCurrency
+	var ownedInputs, ownedOutputs int
+	for _, sci := range txn.SiacoinInputs {
+		if owner.OwnsAddress(CalculateUnlockHash(sci.UnlockConditions)) {
+			in = in.Add(inputValues[sci.ParentID])
+			ownedInputs++
+		}
+	}
+	for _, sco := range txn.SiacoinOutputs {
+		if owner.OwnsAddress(sco.UnlockHash) {
+			out = out.Add(sco.Value)
+			ownedOutputs++
+		}
+	}
+
+	switch {
+	case ownedInputs == 0 && ownedOutputs == 0:
+		return TxKindUnrelated, types.ZeroCurrency
+	case ownedInputs == len(txn.SiacoinInputs) && ownedOutputs == len(txn.SiacoinOutputs) && len(txn.FileContracts) == 0 && in.Cmp(out) >= 0:
+		return TxKindSelf, in.Sub(out)
+	case in.Cmp(out) < 0:
+		return TxKindReceived, out.Sub(in)
+	default:
+		return TxKindSent, in.Sub(out)
+	}
+}
+
 // RelevantTransaction returns true if txn is relevant to owner.
 func RelevantTransaction(owner AddressOwner, txn types.Transaction) bool {
 	for i := range txn.SiacoinInputs {
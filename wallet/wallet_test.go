@@ -19,6 +19,95 @@ func TestStandardAddress(t *testing.T) {
 	}
 }
 
+type addressSet map[types.UnlockHash]bool
+
+func (s addressSet) OwnsAddress(addr types.UnlockHash) bool { return s[addr] }
+
+func TestClassifyTransaction(t *testing.T) {
+	seed := NewSeed()
+	ours := StandardUnlockConditions(seed.PublicKey(0))
+	theirs := StandardUnlockConditions(NewSeed().PublicKey(0))
+	owner := addressSet{ours.UnlockHash(): true}
+	ourInput := types.SiacoinInput{ParentID: types.SiacoinOutputID{1}, UnlockConditions: ours}
+	theirInput := types.SiacoinInput{ParentID: types.SiacoinOutputID{2}, UnlockConditions: theirs}
+	inputValues := map[types.SiacoinOutputID]types.Currency{
+		ourInput.ParentID: types.NewCurrency64(100),
+	}
+	output := func(uc types.UnlockConditions, v uint64) types.SiacoinOutput {
+		return types.SiacoinOutput{Value: types.NewCurrency64(v), UnlockHash: uc.UnlockHash()}
+	}
+
+	tests := []struct {
+		desc string
+		txn  types.Transaction
+		kind TxKind
+		net  uint64
+	}{
+		{
+			desc: "unrelated",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{theirInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(theirs, 50)},
+			},
+			kind: TxKindUnrelated,
+		},
+		{
+			desc: "received",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{theirInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(ours, 30), output(theirs, 60)},
+			},
+			kind: TxKindReceived,
+			net:  30,
+		},
+		{
+			desc: "sent, with change",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{ourInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(theirs, 70), output(ours, 20)},
+				MinerFees:      []types.Currency{types.NewCurrency64(10)},
+			},
+			kind: TxKindSent,
+			net:  80,
+		},
+		{
+			desc: "self",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{ourInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(ours, 60), output(ours, 35)},
+				MinerFees:      []types.Currency{types.NewCurrency64(5)},
+			},
+			kind: TxKindSelf,
+			net:  5,
+		},
+		{
+			desc: "joint, net gain",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{ourInput, theirInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(ours, 150), output(theirs, 10)},
+			},
+			kind: TxKindReceived,
+			net:  50,
+		},
+		{
+			desc: "contract formation",
+			txn: types.Transaction{
+				SiacoinInputs:  []types.SiacoinInput{ourInput},
+				SiacoinOutputs: []types.SiacoinOutput{output(ours, 40)},
+				FileContracts:  []types.FileContract{{Payout: types.NewCurrency64(60)}},
+			},
+			kind: TxKindSent,
+			net:  60,
+		},
+	}
+	for _, test := range tests {
+		kind, net := ClassifyTransaction(test.txn, owner, inputValues)
+		if kind != test.kind || !net.Equals64(test.net) {
+			t.Errorf("%v: expected %v %v, got %v %v", test.desc, test.kind, test.net, kind, net)
+		}
+	}
+}
+
 func BenchmarkNewSeed(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {